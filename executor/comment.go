@@ -0,0 +1,160 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// commentPrefix starts the placeholder identifiers comment_out leaves in
+// the AST until the file is rendered. They end in __ so that no
+// placeholder is a prefix of another: _1__ isn't found in _10__.
+const commentPrefix = "__stencil_comment_out_"
+
+// executeCommentOut replaces the bound statement with its original source
+// text wrapped in a block comment. The binding may also be the expression
+// of an expression statement, such as a bound call. The statement is
+// swapped for a placeholder so that other actions can keep editing the
+// AST; render substitutes the comment text for it.
+func (e *Executor) executeCommentOut(stmt *grammar.CommentOutStmt, bindings matcher.Bindings) error {
+	target, ok := bindings[stmt.Binding]
+	if !ok {
+		return fmt.Errorf("binding $%s not found", stmt.Binding)
+	}
+	node, ok := target.(ast.Node)
+	if !ok {
+		return fmt.Errorf("$%s is not a statement", stmt.Binding)
+	}
+	if e.src == "" {
+		return fmt.Errorf("comment_out needs the original source")
+	}
+
+	list, i := findStmt(e.file, node)
+	if list == nil {
+		return fmt.Errorf("$%s is not a statement in a block", stmt.Binding)
+	}
+	old := (*list)[i]
+
+	start := e.fset.Position(old.Pos()).Offset
+	end := e.fset.Position(old.End()).Offset
+	lineStart := strings.LastIndex(e.src[:start], "\n") + 1
+	indent := e.src[lineStart:start]
+	if strings.TrimSpace(indent) != "" {
+		indent = ""
+	}
+
+	// Comments inside the statement are part of its text now
+	var kept []*ast.CommentGroup
+	for _, cg := range e.file.Comments {
+		if cg.Pos() < old.Pos() || cg.End() > old.End() {
+			kept = append(kept, cg)
+		}
+	}
+	e.file.Comments = kept
+
+	if e.commented == nil {
+		e.commented = make(map[string]commentedStmt)
+	}
+	placeholder := fmt.Sprintf("%s%d__", commentPrefix, len(e.commented))
+	e.commented[placeholder] = commentedStmt{
+		text:       e.src[start:end],
+		indent:     indent,
+		blankAfter: blankLineAfter(e.src, end),
+	}
+	(*list)[i] = &ast.ExprStmt{X: &ast.Ident{NamePos: old.Pos(), Name: placeholder}}
+	return nil
+}
+
+// commentedStmt is the original source of a commented-out statement.
+type commentedStmt struct {
+	text       string
+	indent     string // leading whitespace of the statement's first line
+	blankAfter bool   // whether a blank line followed it
+}
+
+// blankLineAfter reports whether the line after the one containing
+// offset is blank.
+func blankLineAfter(src string, offset int) bool {
+	nl := strings.Index(src[offset:], "\n")
+	if nl < 0 {
+		return false
+	}
+	next := src[offset+nl+1:]
+	if end := strings.Index(next, "\n"); end >= 0 {
+		return strings.TrimSpace(next[:end]) == ""
+	}
+	return false
+}
+
+// findStmt locates the statement list holding node, or the expression
+// statement whose expression is node, and the index within it.
+func findStmt(file *ast.File, node ast.Node) (*[]ast.Stmt, int) {
+	var list *[]ast.Stmt
+	index := -1
+	ast.Inspect(file, func(n ast.Node) bool {
+		if list != nil {
+			return false
+		}
+		var stmts *[]ast.Stmt
+		switch s := n.(type) {
+		case *ast.BlockStmt:
+			stmts = &s.List
+		case *ast.CaseClause:
+			stmts = &s.Body
+		case *ast.CommClause:
+			stmts = &s.Body
+		default:
+			return true
+		}
+		for i, stmt := range *stmts {
+			if es, ok := stmt.(*ast.ExprStmt); stmt == node || ok && es.X == node {
+				list, index = stmts, i
+				return false
+			}
+		}
+		return true
+	})
+	return list, index
+}
+
+// uncommentPlaceholders replaces each comment_out placeholder in rendered
+// source with its comment. Text that itself contains */ can't go in a
+// block comment, so it becomes line comments at the placeholder's indent.
+//
+// A placeholder is one line long, so the printer separates it from a
+// statement that followed a multi-line original with a blank line; that
+// line is dropped again unless the original had one.
+func (e *Executor) uncommentPlaceholders(src string) string {
+	for placeholder, stmt := range e.commented {
+		at := strings.Index(src, placeholder)
+		if at < 0 {
+			continue
+		}
+
+		comment := "/* " + stmt.text + " */"
+		if strings.Contains(stmt.text, "*/") {
+			indent := src[strings.LastIndex(src[:at], "\n")+1 : at]
+			lines := strings.Split(stmt.text, "\n")
+			for i, line := range lines {
+				if i > 0 {
+					line = indent + "// " + strings.TrimPrefix(line, stmt.indent)
+				} else {
+					line = "// " + line
+				}
+				lines[i] = line
+			}
+			comment = strings.Join(lines, "\n")
+		}
+
+		rest := src[at+len(placeholder):]
+		if nl := strings.Index(rest, "\n"); nl >= 0 && !stmt.blankAfter &&
+			strings.HasPrefix(rest[nl:], "\n\n") {
+			rest = rest[:nl] + rest[nl+1:]
+		}
+		src = src[:at] + comment + rest
+	}
+	return src
+}
@@ -0,0 +1,116 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/ast/astutil"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// executeExtractConstant replaces the bound literal with a reference to a
+// constant named after it, appending const Name = <literal> to the file.
+// The literal may be negated, as in -1. A constant of that name with the
+// same value is reused, so several matches of one magic number share it;
+// a name declared as anything else is an error.
+func (e *Executor) executeExtractConstant(ext *grammar.ExtractConstant, bindings matcher.Bindings) error {
+	target, ok := bindings[ext.Binding]
+	if !ok {
+		return fmt.Errorf("binding $%s not found", ext.Binding)
+	}
+	lit, ok := target.(ast.Expr)
+	if !ok || !isLiteral(lit) {
+		return fmt.Errorf("$%s is not a literal", ext.Binding)
+	}
+
+	name := e.interpolate(ext.Name, bindings)
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("extract_constant: %q is not a valid constant name", name)
+	}
+	value := types.ExprString(lit)
+	existing, declared := e.constValue(name)
+	if declared && existing != value {
+		return fmt.Errorf("extract_constant: %s is already declared as %s, not %s", name, existing, value)
+	}
+	if !declared && ((e.file.Scope != nil && e.file.Scope.Lookup(name) != nil) || e.declaresType(name)) {
+		return fmt.Errorf("extract_constant: %s is already declared", name)
+	}
+
+	var err error
+	replaced := false
+	astutil.Apply(e.file, func(c *astutil.Cursor) bool {
+		if c.Node() != lit {
+			return !replaced
+		}
+		if _, ok := c.Parent().(*ast.ImportSpec); ok || c.Name() == "Tag" {
+			err = fmt.Errorf("extract_constant: $%s is an import path or struct tag, which must stay a literal", ext.Binding)
+		} else {
+			c.Replace(&ast.Ident{NamePos: lit.Pos(), Name: name})
+		}
+		replaced = true
+		return false
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !replaced {
+		return fmt.Errorf("extract_constant: $%s is not in the file", ext.Binding)
+	}
+
+	if !declared {
+		e.file.Decls = append(e.file.Decls, &ast.GenDecl{
+			Tok: token.CONST,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names:  []*ast.Ident{ast.NewIdent(name)},
+				Values: []ast.Expr{copyLiteral(lit)},
+			}},
+		})
+	}
+	return nil
+}
+
+// isLiteral reports whether x is a basic literal, or one with a sign.
+func isLiteral(x ast.Expr) bool {
+	if u, ok := x.(*ast.UnaryExpr); ok && (u.Op == token.SUB || u.Op == token.ADD) {
+		x = u.X
+	}
+	_, ok := x.(*ast.BasicLit)
+	return ok
+}
+
+// copyLiteral returns a copy of a literal from isLiteral without positions,
+// for declaring it elsewhere in the file.
+func copyLiteral(x ast.Expr) ast.Expr {
+	if u, ok := x.(*ast.UnaryExpr); ok {
+		return &ast.UnaryExpr{Op: u.Op, X: copyLiteral(u.X)}
+	}
+	lit := x.(*ast.BasicLit)
+	return &ast.BasicLit{Kind: lit.Kind, Value: lit.Value}
+}
+
+// constValue returns the value of the package-level constant name declared
+// in the file, if it has one.
+func (e *Executor) constValue(name string) (string, bool) {
+	for _, decl := range e.file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs, ok := spec.(*ast.ValueSpec)
+			if !ok {
+				continue
+			}
+			for i, ident := range vs.Names {
+				if ident.Name == name && i < len(vs.Values) {
+					return types.ExprString(vs.Values[i]), true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,162 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"reflect"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// executeDelete removes the node each remove statement names. A node in
+// a list, such as a statement, a spec or a declaration, is taken out of
+// it, as is an element of a composite literal, and the expression of an
+// expression statement, such as a bound call, takes its statement with
+// it. Optional fields such as $Field.tag are cleared; any other node,
+// such as an argument or a field's type, can't be removed. A declaration left with
+// no specs, such as an import block whose last import was removed, goes
+// too. Comments in or trailing the removed node go with it.
+func (e *Executor) executeDelete(del *grammar.DeleteClause, bindings matcher.Bindings) error {
+	for _, stmt := range del.Stmts {
+		path := stmt.Path.Binding
+		if len(stmt.Path.Segments) > 0 {
+			path += "." + strings.Join(stmt.Path.Segments, ".")
+		}
+		val, ok := bindings.Lookup(path)
+		if !ok {
+			return fmt.Errorf("binding $%s not found", path)
+		}
+		node, ok := val.(ast.Node)
+		if !ok || reflect.ValueOf(node).IsNil() {
+			return fmt.Errorf("remove $%s: not a node", path)
+		}
+		if node == e.file {
+			return fmt.Errorf("remove $%s: can't remove the file", path)
+		}
+		if err := e.remove(node); err != nil {
+			return fmt.Errorf("remove $%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// optionalFields are the fields remove may clear rather than take out
+// of a list.
+var optionalFields = map[string]bool{"Tag": true, "Doc": true, "Comment": true}
+
+// remove takes node out of the file.
+func (e *Executor) remove(node ast.Node) error {
+	if list, i := findStmt(e.file, node); list != nil {
+		node = (*list)[i]
+	}
+	start, end := node.Pos(), node.End()
+	if cg, ok := docComment(node); ok && cg != nil {
+		start = cg.Pos()
+	}
+
+	var err error
+	found := false
+	astutil.Apply(e.file, func(c *astutil.Cursor) bool {
+		if found || c.Node() != node {
+			return !found
+		}
+		found = true
+		_, isExpr := node.(ast.Expr)
+		switch {
+		case c.Index() >= 0 && (!isExpr || c.Name() == "Elts"):
+			c.Delete()
+		case optionalFields[c.Name()]:
+			f := reflect.ValueOf(c.Parent()).Elem().FieldByName(c.Name())
+			f.Set(reflect.Zero(f.Type()))
+		default:
+			// Dropping an argument or operand would leave broken code
+			err = fmt.Errorf("%s.%s can't be removed", reflect.TypeOf(c.Parent()).Elem().Name(), c.Name())
+		}
+		return false
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("not in the file")
+	}
+
+	if spec, ok := node.(*ast.ImportSpec); ok {
+		for i, imp := range e.file.Imports {
+			if imp == spec {
+				e.file.Imports = append(e.file.Imports[:i], e.file.Imports[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// A declaration with no specs left is removed with its keyword
+	astutil.Apply(e.file, func(c *astutil.Cursor) bool {
+		var gd *ast.GenDecl
+		switch n := c.Node().(type) {
+		case *ast.GenDecl:
+			gd = n
+		case *ast.DeclStmt:
+			gd, _ = n.Decl.(*ast.GenDecl)
+		}
+		if gd == nil || len(gd.Specs) > 0 || c.Index() < 0 {
+			return true
+		}
+		start = min(start, gd.Pos())
+		if gd.Doc != nil {
+			start = min(start, gd.Doc.Pos())
+		}
+		if gd.Rparen.IsValid() {
+			end = max(end, gd.Rparen+1)
+		}
+		c.Delete()
+		return false
+	}, nil)
+
+	e.dropLines(start, end)
+	return nil
+}
+
+// dropLines removes the comments from start to end, or trailing it on
+// its last line, and folds its lines into one so the printer doesn't
+// leave a gap where they were.
+func (e *Executor) dropLines(start, end token.Pos) {
+	f := e.fset.File(start)
+	if f == nil {
+		return
+	}
+	first, last := e.fset.Position(start).Line, e.fset.Position(end).Line
+
+	var kept []*ast.CommentGroup
+	for _, cg := range e.file.Comments {
+		inside := cg.Pos() >= start && cg.End() <= end
+		trailing := cg.Pos() >= end && e.fset.Position(cg.Pos()).Line == last
+		if !inside && !trailing {
+			kept = append(kept, cg)
+		}
+	}
+	e.file.Comments = kept
+
+	for line := first; line <= last && line < f.LineCount(); line++ {
+		f.MergeLine(first)
+	}
+}
+
+// docComment returns the doc comment of a node that can have one.
+func docComment(n ast.Node) (*ast.CommentGroup, bool) {
+	v := reflect.ValueOf(n)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	f := v.Elem().FieldByName("Doc")
+	if !f.IsValid() {
+		return nil, false
+	}
+	cg, ok := f.Interface().(*ast.CommentGroup)
+	return cg, ok
+}
@@ -15,9 +15,16 @@ import (
 	"go/ast"
 	"go/format"
 	"go/parser"
+	"go/printer"
 	"go/token"
+	"reflect"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/vinodhalaharvi/stencil/grammar"
 	"github.com/vinodhalaharvi/stencil/matcher"
@@ -28,19 +35,51 @@ type Result struct {
 	// ModifiedSource is the transformed Go source code (for patch/insert/delete)
 	ModifiedSource string
 
-	// EmittedFiles maps filename to content (for emit actions)
+	// EmittedFiles maps filename to content (for emit actions); range
+	// over EmittedNames to visit them in a stable order
 	EmittedFiles map[string]string
 
 	// Applied tracks which actions were applied
 	Applied []string
+
+	// MatchActions lists the actions applied to each match, indexed like
+	// the matches passed to Execute
+	MatchActions [][]string
+
+	// Regions holds the output of emit into actions, to be written with
+	// ReplaceRegion
+	Regions []Region
+}
+
+// EmittedNames returns the names of the emitted files, sorted, so that
+// they are written and reported in the same order on every run.
+func (r *Result) EmittedNames() []string {
+	names := make([]string, 0, len(r.EmittedFiles))
+	for name := range r.EmittedFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // Executor applies lift block actions to Go source.
 type Executor struct {
-	fset    *token.FileSet
-	file    *ast.File
-	src     string
-	imports map[string]bool // track imports to add
+	fset      *token.FileSet
+	file      *ast.File
+	src       string
+	imports   map[string]bool // track imports to add
+	module    *Module         // resolves import paths, if set
+	lenient   bool            // leave unresolved ${Var} in emitted files
+	waitGroup bool            // track every wrapped goroutine with a wait group
+
+	// templateDir resolves relative template_file paths, and templates
+	// caches the files read
+	templateDir string
+	templates   map[string]string
+
+	// commented maps placeholder identifiers left by comment_out to the
+	// statements render puts back as comments
+	commented map[string]commentedStmt
 }
 
 // New creates an Executor from Go source code.
@@ -65,62 +104,216 @@ func NewFromMatcher(m *matcher.Matcher) *Executor {
 	return &Executor{
 		fset:    m.FileSet(),
 		file:    m.File(),
+		src:     string(m.Source()),
 		imports: make(map[string]bool),
 	}
 }
 
+// SetModule makes the executor resolve the imports it adds against mod,
+// e.g. turning "./internal/store" into a module-qualified path.
+func (e *Executor) SetModule(mod *Module) {
+	e.module = mod
+}
+
+// SetLenient makes every emit leave unresolved ${Var} references in its
+// output, as if it were marked lenient, instead of failing.
+func (e *Executor) SetLenient(lenient bool) {
+	e.lenient = lenient
+}
+
+// SetWaitGroup makes every wrap_in_goroutine track its goroutine with a
+// sync.WaitGroup, as if it said with_waitgroup.
+func (e *Executor) SetWaitGroup(waitGroup bool) {
+	e.waitGroup = waitGroup
+}
+
+// SetTemplateDir makes relative template_file paths resolve against dir
+// instead of the current directory.
+func (e *Executor) SetTemplateDir(dir string) {
+	e.templateDir = dir
+}
+
+// UnresolvedError reports ${Var} references in an emitted file that name
+// no binding, or a field the bound node doesn't have.
+type UnresolvedError struct {
+	Block string   // lift block name
+	File  string   // emitted file
+	Names []string // unresolved references, in order of appearance
+}
+
+func (e *UnresolvedError) Error() string {
+	refs := make([]string, len(e.Names))
+	for i, name := range e.Names {
+		refs[i] = "${" + name + "}"
+	}
+	return fmt.Sprintf("block %q: emit %q: unresolved %s", e.Block, e.File, strings.Join(refs, ", "))
+}
+
 // Execute applies all actions in a lift block using the provided matches.
 func (e *Executor) Execute(block *grammar.LiftBlock, matches []matcher.Match) (*Result, error) {
 	result := &Result{
 		EmittedFiles: make(map[string]string),
+		MatchActions: make([][]string, len(matches)),
+	}
+
+	applied := func(i int, name string) {
+		result.Applied = append(result.Applied, name)
+		result.MatchActions[i] = append(result.MatchActions[i], name)
 	}
 
 	for _, action := range block.Actions {
-		for _, match := range matches {
+		if action.Emit != nil && action.Emit.Schema != nil && len(matches) > 0 {
+			// One schema document covers every match, so structs can
+			// refer to each other
+			filename := action.Emit.File
+			content, err := e.executeJSONSchema(action.Emit, matches)
+			if err != nil {
+				return nil, fmt.Errorf("emit failed: %w", err)
+			}
+			result.EmittedFiles[filename] = content
+			for i := range matches {
+				applied(i, "emit:"+filename)
+			}
+			continue
+		}
+
+		var region []string
+		for i, match := range matches {
 			if action.Insert != nil {
 				if err := e.executeInsert(action.Insert, match.Bindings); err != nil {
 					return nil, fmt.Errorf("insert failed: %w", err)
 				}
-				result.Applied = append(result.Applied, "insert")
+				applied(i, "insert")
 			}
 
 			if action.Patch != nil {
 				if err := e.executePatch(action.Patch, match.Bindings); err != nil {
 					return nil, fmt.Errorf("patch failed: %w", err)
 				}
-				result.Applied = append(result.Applied, "patch")
+				applied(i, "patch")
 			}
 
 			if action.Delete != nil {
 				if err := e.executeDelete(action.Delete, match.Bindings); err != nil {
 					return nil, fmt.Errorf("delete failed: %w", err)
 				}
-				result.Applied = append(result.Applied, "delete")
+				applied(i, "delete")
 			}
 
 			if action.Emit != nil {
-				content, err := e.executeEmit(action.Emit, match.Bindings)
+				filename := action.Emit.File
+				content, unresolved, err := e.executeEmit(action.Emit, match.Bindings)
 				if err != nil {
 					return nil, fmt.Errorf("emit failed: %w", err)
 				}
-				filename := strings.Trim(action.Emit.File, `"`)
+				if len(unresolved) > 0 && !action.Emit.Lenient && !e.lenient {
+					return nil, &UnresolvedError{Block: block.Name, File: filename, Names: unresolved}
+				}
+				if action.Emit.Into {
+					region = append(region, strings.TrimRight(content, "\n"))
+					applied(i, "emit:"+filename)
+					continue
+				}
+				if prev, ok := result.EmittedFiles[filename]; ok {
+					// Types emitted to one schema file accumulate
+					if merge := SchemaMerger(action.Emit); merge != nil {
+						content = merge([]string{prev, content})
+					}
+				}
 				result.EmittedFiles[filename] = content
-				result.Applied = append(result.Applied, "emit:"+filename)
+				applied(i, "emit:"+filename)
+			}
+		}
+
+		if len(region) > 0 {
+			r := Region{
+				File:    action.Emit.File,
+				Block:   block.Name,
+				Target:  action.Emit.Target,
+				Content: strings.Join(region, "\n\n") + "\n",
+			}
+			if action.Emit.Package != nil {
+				r.Package = *action.Emit.Package
+			}
+			if r.Target == "go" {
+				// A new file joins the source's package unless told otherwise
+				if r.Package == "" {
+					r.Package = e.file.Name.Name
+				}
+				r.Imports = e.regionImports(r.Content)
 			}
+			result.Regions = append(result.Regions, r)
 		}
 	}
 
+	src, err := e.Source()
+	if err != nil {
+		return nil, err
+	}
+	result.ModifiedSource = src
+
+	return result, nil
+}
+
+// Source returns the Go source of the file as modified so far, with the
+// imports actions need added.
+func (e *Executor) Source() (string, error) {
 	// Add any required imports
 	e.addImports()
 
 	// Render modified AST back to source
-	var buf bytes.Buffer
-	if err := format.Node(&buf, e.fset, e.file); err != nil {
-		return nil, fmt.Errorf("format error: %w", err)
+	src, err := e.render()
+	if err != nil {
+		return "", fmt.Errorf("format error: %w", err)
 	}
-	result.ModifiedSource = buf.String()
+	return restoreHeader(e.src, src)
+}
 
-	return result, nil
+// SchemaMerger returns how the output of emit for several matches is
+// combined into one file: MergeGraphQL for emit graphql, MergeSQL for a
+// generated emit sql, MergeProto for a generated emit proto, or nil if
+// later output replaces earlier.
+func SchemaMerger(emit *grammar.EmitClause) func([]string) string {
+	noBody := emit.ASTBody == nil && emit.CodeBody == nil && emit.Template == nil
+	switch {
+	case emit.Target == "graphql":
+		return MergeGraphQL
+	case emit.Target == "sql" && noBody:
+		return MergeSQL
+	case emit.Target == "proto" && noBody && emit.TemplateFile == nil:
+		return MergeProto
+	}
+	return nil
+}
+
+// render prints the file. Declarations added by actions have no source
+// positions, so the printer can't tell they need a blank line before
+// them; they are printed after the rest of the file, one at a time.
+// Added imports stay at the top.
+func (e *Executor) render() (string, error) {
+	file := *e.file
+	file.Decls = nil
+	var added []ast.Decl
+	for _, decl := range e.file.Decls {
+		if gd, ok := decl.(*ast.GenDecl); !decl.Pos().IsValid() && (!ok || gd.Tok != token.IMPORT) {
+			added = append(added, decl)
+		} else {
+			file.Decls = append(file.Decls, decl)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, e.fset, &file); err != nil {
+		return "", err
+	}
+	for _, decl := range added {
+		buf.WriteString("\n")
+		if err := format.Node(&buf, e.fset, decl); err != nil {
+			return "", err
+		}
+		buf.WriteString("\n")
+	}
+	return e.uncommentPlaceholders(buf.String()), nil
 }
 
 // executeInsert handles insert actions (prepend/append code to blocks).
@@ -151,7 +344,7 @@ func (e *Executor) executeInsert(ins *grammar.InsertClause, bindings matcher.Bin
 	}
 
 	// Parse the code to insert
-	codeText := strings.Trim(ins.Code.Text, "`")
+	codeText := ins.Code.Text
 	codeText = e.interpolate(codeText, bindings)
 
 	// Track imports needed
@@ -162,8 +355,15 @@ func (e *Executor) executeInsert(ins *grammar.InsertClause, bindings matcher.Bin
 		e.imports["time"] = true
 	}
 
-	// Parse as statements
-	stmts, err := parseStatements(codeText)
+	// Parse as statements, or as cases when inserting into a switch or
+	// select body
+	parse := parseStatements
+	if kind := clauseKind(blockStmt, codeText); kind != "" {
+		parse = func(code string) ([]ast.Stmt, error) {
+			return parseClauses(kind, code)
+		}
+	}
+	stmts, err := parse(codeText)
 	if err != nil {
 		return fmt.Errorf("parse insert code: %w", err)
 	}
@@ -216,8 +416,7 @@ func (e *Executor) executePatchStmt(stmt *grammar.PatchStmt, bindings matcher.Bi
 			return fmt.Errorf("$%s is not an identifier", stmt.Rename.Binding)
 		}
 
-		newName := strings.Trim(stmt.Rename.NewName, `"`)
-		ident.Name = newName
+		ident.Name = stmt.Rename.NewName
 		return nil
 	}
 
@@ -231,116 +430,351 @@ func (e *Executor) executePatchStmt(stmt *grammar.PatchStmt, bindings matcher.Bi
 		return fmt.Errorf("retype not yet implemented")
 	}
 
+	if stmt.AddMethod != nil {
+		return e.executeAddMethod(stmt.AddMethod, bindings)
+	}
+
+	if stmt.Comment != nil {
+		return e.executeCommentOut(stmt.Comment, bindings)
+	}
+
+	if stmt.Goroutine != nil {
+		return e.executeWrapGoroutine(stmt.Goroutine, bindings)
+	}
+
+	if stmt.Extract != nil {
+		return e.executeExtractInterface(stmt.Extract, bindings)
+	}
+
+	if stmt.InlineVar != nil {
+		return e.executeInlineVar(stmt.InlineVar, bindings)
+	}
+
+	if stmt.Check != nil {
+		return e.executeAddInterfaceCheck(stmt.Check, bindings)
+	}
+
+	if stmt.Const != nil {
+		return e.executeExtractConstant(stmt.Const, bindings)
+	}
+
 	return nil
 }
 
-func (e *Executor) executeSet(set *grammar.SetStmt, bindings matcher.Bindings) error {
-	// Handle special case: $Params.first = "ctx context.Context"
-	target, ok := bindings[set.Path.Binding]
+// executeAddMethod appends a method on the bound type to the file. The
+// receiver is named after the type's first letter, e.g. (u *User), and
+// the signature and body are interpolated. A type that already has a
+// method of that name is left alone, so re-running a rule is harmless.
+func (e *Executor) executeAddMethod(add *grammar.AddMethodStmt, bindings matcher.Bindings) error {
+	target, ok := bindings[add.Binding]
 	if !ok {
-		return fmt.Errorf("binding $%s not found", set.Path.Binding)
+		return fmt.Errorf("binding $%s not found", add.Binding)
 	}
 
-	if len(set.Path.Segments) == 1 && set.Path.Segments[0] == "first" {
-		// Prepend to a FieldList
-		fl, ok := target.(*ast.FieldList)
-		if !ok {
-			return fmt.Errorf("$%s is not a FieldList", set.Path.Binding)
-		}
+	typeName := e.bindingToString(target)
+	if !token.IsIdentifier(typeName) {
+		return fmt.Errorf("$%s is not a type name", add.Binding)
+	}
 
-		if set.Value.String == nil {
-			return fmt.Errorf("set value must be a string")
-		}
+	recvType := typeName
+	if add.Pointer {
+		recvType = "*" + typeName
+	}
 
-		// Parse the field spec
-		fieldSpec := strings.Trim(*set.Value.String, `"`)
-		parts := strings.SplitN(fieldSpec, " ", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid field spec: %s", fieldSpec)
-		}
+	sig := strings.TrimSpace(e.interpolate(add.Signature, bindings))
+	body := e.interpolate(add.Body, bindings)
 
-		// Create new field
-		newField := &ast.Field{
-			Names: []*ast.Ident{{Name: parts[0]}},
-			Type:  parseTypeExpr(parts[1]),
-		}
+	src := fmt.Sprintf("package p\nfunc (%s %s) %s {\n%s\n}", receiverName(typeName), recvType, sig, body)
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return fmt.Errorf("add_method %s: %w", sig, err)
+	}
 
-		// Prepend
-		if fl.List == nil {
-			fl.List = []*ast.Field{newField}
-		} else {
-			fl.List = append([]*ast.Field{newField}, fl.List...)
-		}
+	fd := f.Decls[0].(*ast.FuncDecl)
+	if e.hasMethod(typeName, fd.Name.Name) {
+		return nil
+	}
+
+	clearPositions(fd)
+	e.file.Decls = append(e.file.Decls, fd)
+	return nil
+}
 
-		// Track import
-		if strings.Contains(parts[1], "context.") {
-			e.imports["context"] = true
+// hasMethod reports whether the file declares method on typeName, with
+// either a value or pointer receiver.
+func (e *Executor) hasMethod(typeName, method string) bool {
+	for _, fd := range e.methods(typeName) {
+		if fd.Name.Name == method {
+			return true
 		}
+	}
+	return false
+}
 
-		return nil
+// receiverName returns the conventional receiver name for a type: its
+// first letter, lowercased.
+func receiverName(typeName string) string {
+	r, _ := utf8.DecodeRuneInString(typeName)
+	return string(unicode.ToLower(r))
+}
+
+func (e *Executor) executeSet(set *grammar.SetStmt, bindings matcher.Bindings) error {
+	// Handle field list ends: $Params.first = "ctx context.Context",
+	// $Results.last = "error"
+	target, ok := bindings[set.Path.Binding]
+	if !ok {
+		return fmt.Errorf("binding $%s not found", set.Path.Binding)
+	}
+
+	if len(set.Path.Segments) == 1 {
+		switch end := set.Path.Segments[0]; end {
+		case "first", "last":
+			return e.setFieldListEnd(set, bindings, target, end == "first")
+		}
 	}
 
 	return fmt.Errorf("set path %s.%v not yet supported", set.Path.Binding, set.Path.Segments)
 }
 
-// executeDelete handles delete actions.
-func (e *Executor) executeDelete(del *grammar.DeleteClause, bindings matcher.Bindings) error {
-	// Delete implementation would remove nodes from the AST
-	// For now, just log what would be deleted
-	for _, stmt := range del.Stmts {
-		_ = stmt // TODO: implement deletion
+// setFieldListEnd adds a field to the start or end of a FieldList.
+// The value is a field as a parameter list declares it: "ctx
+// context.Context" for a named field, "a, b int" for several names, or
+// "error" for an unnamed one (typically a result).
+func (e *Executor) setFieldListEnd(set *grammar.SetStmt, bindings matcher.Bindings, target any, first bool) error {
+	fl, ok := target.(*ast.FieldList)
+	if !ok || fl == nil {
+		return fmt.Errorf("$%s is not a FieldList", set.Path.Binding)
+	}
+
+	if set.Value.String == nil {
+		return fmt.Errorf("set value must be a string")
 	}
-	return fmt.Errorf("delete not yet implemented")
+
+	// Parse the field as the only parameter of a func type
+	fieldSpec := strings.TrimSpace(*set.Value.String)
+	expr, err := parser.ParseExpr("func(" + fieldSpec + ")")
+	if err != nil {
+		return fmt.Errorf("invalid field %q: %w", fieldSpec, err)
+	}
+	fields := expr.(*ast.FuncType).Params.List
+	if len(fields) != 1 {
+		return fmt.Errorf("invalid field %q: want a type, or names and a type", fieldSpec)
+	}
+	newField := fields[0]
+
+	// Go doesn't mix named and unnamed parameters or results in one list
+	fl = matcher.PlaceFieldList(bindings, fl)
+	if len(fl.List) > 0 {
+		path := "$" + strings.Join(append([]string{set.Path.Binding}, set.Path.Segments...), ".")
+		switch named := len(fl.List[0].Names) > 0; {
+		case named && len(newField.Names) == 0:
+			return fmt.Errorf("set %s: %q is unnamed but the list's fields are named", path, fieldSpec)
+		case !named && len(newField.Names) > 0:
+			return fmt.Errorf("set %s: %q is named but the list's fields are unnamed", path, fieldSpec)
+		}
+	}
+
+	// Placed at the closing parenthesis, the field prints on its line
+	// without a trailing comma
+	if fl.Closing.IsValid() {
+		movePositions(newField, fl.Closing)
+	} else {
+		clearPositions(newField)
+	}
+	if first {
+		fl.List = append([]*ast.Field{newField}, fl.List...)
+	} else {
+		fl.List = append(fl.List, newField)
+	}
+
+	// Track import
+	ast.Inspect(newField.Type, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "context" {
+				e.imports["context"] = true
+			}
+		}
+		return true
+	})
+
+	return nil
 }
 
-// executeEmit handles emit actions (generate new files).
-func (e *Executor) executeEmit(emit *grammar.EmitClause, bindings matcher.Bindings) (string, error) {
+// executeEmit handles emit actions (generate new files). It also returns
+// the ${Var} references it couldn't resolve.
+func (e *Executor) executeEmit(emit *grammar.EmitClause, bindings matcher.Bindings) (string, []string, error) {
 	var content string
+	var unresolved []string
 
-	if emit.Template != nil {
+	if emit.Dialect != nil && emit.Target != "sql" {
+		return "", nil, fmt.Errorf("dialect only applies to emit sql, not emit %s", emit.Target)
+	}
+	if emit.Input && emit.Target != "graphql" {
+		return "", nil, fmt.Errorf("input only applies to emit graphql, not emit %s", emit.Target)
+	}
+
+	noBody := emit.ASTBody == nil && emit.CodeBody == nil && emit.Template == nil
+	if emit.Target == "sql" && noBody {
+		// SQL with no body - generate the table from $Name and $Fields
+		dialect := "postgres"
+		if emit.Dialect != nil {
+			dialect = *emit.Dialect
+		}
+		content, err := e.executeSQLEmit(dialect, bindings)
+		return content, nil, err
+	} else if emit.Target == "graphql" && noBody {
+		// GraphQL with no body - generate the type from $Name and $Fields
+		content, err := e.executeGraphQLEmit(emit.Input, bindings)
+		return content, nil, err
+	} else if emit.TemplateFile != nil {
+		// Template file mode - load and execute with text/template
+		var err error
+		if content, err = e.executeTemplateFile(emit, bindings); err != nil {
+			return "", nil, err
+		}
+	} else if emit.Target == "proto" && noBody {
+		// Proto with no body - generate the message from $Name and $Fields
+		var err error
+		if content, err = e.executeProtoEmit(emit.Package, bindings); err != nil {
+			return "", nil, err
+		}
+	} else if emit.Template != nil && emit.Template.Engine == "gotpl" {
+		// Go template mode - execute with text/template
+		var err error
+		if content, err = e.executeGoTemplate(emit, bindings); err != nil {
+			return "", nil, err
+		}
+	} else if emit.Template != nil {
 		// Template mode - just interpolate
-		content = strings.Trim(emit.Template.Text, "`")
-		content = e.interpolate(content, bindings)
+		nodes, err := templateNodes(emit.Template.Nodes, emit.Template.Text)
+		if err != nil {
+			return "", nil, err
+		}
+		content, unresolved = e.renderTemplate(nodes, bindings)
 	} else if emit.CodeBody != nil {
 		// Code mode - interpolate Go code
-		content = strings.Trim(emit.CodeBody.Text, "`")
-		content = e.interpolate(content, bindings)
+		nodes, err := templateNodes(emit.CodeBody.Nodes, emit.CodeBody.Text)
+		if err != nil {
+			return "", nil, err
+		}
+		content, unresolved = e.renderTemplate(nodes, bindings)
 
 		// Add package declaration if specified
-		if emit.Package != nil {
+		if emit.Package != nil && !emit.Into {
 			content = fmt.Sprintf("package %s\n\n%s", *emit.Package, content)
 		}
 	} else if emit.ASTBody != nil {
 		// AST mode - build AST and render
-		return "", fmt.Errorf("emit ast mode not yet implemented")
+		return "", nil, fmt.Errorf("emit ast mode not yet implemented")
 	}
 
-	return content, nil
+	if emit.Target == "proto" {
+		content = addProtoImports(content)
+	}
+
+	return content, unresolved, nil
+}
+
+// emitStruct returns the struct whose name and fields are bound to
+// nameVar and fieldsVar, which generated emits such as emit sql without a
+// body work from.
+func (e *Executor) emitStruct(target string, bindings matcher.Bindings, nameVar, fieldsVar string) (string, []*ast.Field, error) {
+	name := e.bindingToString(bindings[nameVar])
+	if name == "" {
+		return "", nil, fmt.Errorf("emit %s needs $%s bound to the struct name", target, nameVar)
+	}
+	switch v := bindings[fieldsVar].(type) {
+	case *ast.FieldList:
+		if v == nil {
+			return name, nil, nil
+		}
+		return name, v.List, nil
+	case []*ast.Field:
+		return name, v, nil
+	}
+	return "", nil, fmt.Errorf("emit %s needs $%s... bound to the struct fields", target, fieldsVar)
 }
 
+// templateNodes returns the parsed form of an emit body, parsing text
+// if the program's templates weren't parsed up front.
+func templateNodes(nodes []*grammar.TemplateNode, text string) ([]*grammar.TemplateNode, error) {
+	if nodes != nil {
+		return nodes, nil
+	}
+	return grammar.ParseTemplate(text)
+}
+
+// renderTemplate expands template nodes, keeping the branch of each
+// ${if} whose predicate holds for bindings. Like expand, it returns the
+// ${Var} references it couldn't resolve.
+func (e *Executor) renderTemplate(nodes []*grammar.TemplateNode, bindings matcher.Bindings) (string, []string) {
+	var b strings.Builder
+	var unresolved []string
+	var render func(nodes []*grammar.TemplateNode)
+	render = func(nodes []*grammar.TemplateNode) {
+		for _, node := range nodes {
+			if node.If == nil {
+				text, missing := e.expand(node.Text, bindings)
+				b.WriteString(text)
+				for _, name := range missing {
+					if !slices.Contains(unresolved, name) {
+						unresolved = append(unresolved, name)
+					}
+				}
+				continue
+			}
+			if matcher.EvalPredicate(node.If.Cond, bindings) {
+				render(node.If.Then)
+			} else {
+				render(node.If.Else)
+			}
+		}
+	}
+	render(nodes)
+	return b.String(), unresolved
+}
+
+// interpolateRe matches ${Name} or ${Name | transform | transform(n) ...}.
+// Names follow Go identifier rules, so Unicode letters are allowed, and
+// may be dotted to reach into the bound node: ${m.Type}.
+var interpolateRe = regexp.MustCompile(`\$\{([\p{L}\p{Nd}_]+(?:\.[\p{L}\p{Nd}_]+)*)((?:\s*\|\s*\w+(?:\(\d+\))?)*)\s*\}`)
+
 // interpolate replaces ${Var} and ${Var | transform} in text.
+// Transforms are applied left to right, so ${Body | dedent | indent(4)}
+// re-indents a multi-line value to sit inside the surrounding template.
 func (e *Executor) interpolate(text string, bindings matcher.Bindings) string {
-	// Match ${Name} or ${Name | transform}
-	re := regexp.MustCompile(`\$\{(\w+)(?:\s*\|\s*(\w+))?\}`)
+	out, _ := e.expand(text, bindings)
+	return out
+}
 
-	return re.ReplaceAllStringFunc(text, func(match string) string {
-		parts := re.FindStringSubmatch(match)
+// expand interpolates like interpolate, additionally returning the names
+// it left unchanged because they don't resolve.
+func (e *Executor) expand(text string, bindings matcher.Bindings) (string, []string) {
+	var unresolved []string
+	out := interpolateRe.ReplaceAllStringFunc(text, func(match string) string {
+		parts := interpolateRe.FindStringSubmatch(match)
 		name := parts[1]
-		transform := parts[2]
 
-		val, ok := bindings[name]
+		val, ok := bindings.Lookup(name)
 		if !ok {
+			if !slices.Contains(unresolved, name) {
+				unresolved = append(unresolved, name)
+			}
 			return match // leave unchanged if not found
 		}
 
-		str := bindingToString(val)
+		str := e.bindingToString(val)
 
-		if transform != "" {
-			str = applyTransform(str, transform)
+		// Only the first transform sees the raw binding; later ones
+		// operate on the string produced so far.
+		for _, transform := range strings.Split(parts[2], "|")[1:] {
+			str = applyTransform(str, strings.TrimSpace(transform), val, e.fset)
+			val = str
 		}
 
 		return str
 	})
+	return out, unresolved
 }
 
 // addImports adds any required imports to the file.
@@ -378,9 +812,15 @@ func (e *Executor) addImports() {
 		}
 	}
 
-	// Add missing imports
+	// Add missing imports, in a stable order
+	var paths []string
 	for imp := range e.imports {
+		paths = append(paths, e.module.ResolveImport(imp))
+	}
+	sort.Strings(paths)
+	for _, imp := range paths {
 		if !existing[imp] {
+			existing[imp] = true
 			importDecl.Specs = append(importDecl.Specs, &ast.ImportSpec{
 				Path: &ast.BasicLit{
 					Kind:  token.STRING,
@@ -397,6 +837,42 @@ func (e *Executor) addImports() {
 	}
 }
 
+// clauseKind reports whether code inserted into block must be parsed as
+// "switch" or "select" cases: the block already holds case clauses, or
+// it is empty and the code starts with case or default.
+func clauseKind(block *ast.BlockStmt, code string) string {
+	if len(block.List) > 0 {
+		switch block.List[0].(type) {
+		case *ast.CaseClause:
+			return "switch"
+		case *ast.CommClause:
+			return "select"
+		}
+		return ""
+	}
+	trimmed := strings.TrimSpace(code)
+	if strings.HasPrefix(trimmed, "case ") || strings.HasPrefix(trimmed, "default:") {
+		return "switch"
+	}
+	return ""
+}
+
+// parseClauses parses the case clauses of a switch or select statement,
+// e.g. `default: panic("unhandled type")`.
+func parseClauses(kind, code string) ([]ast.Stmt, error) {
+	stmts, err := parseStatements(kind + " {\n" + code + "\n}")
+	if err != nil {
+		return nil, err
+	}
+	switch s := stmts[0].(type) {
+	case *ast.SwitchStmt:
+		return s.Body.List, nil
+	case *ast.SelectStmt:
+		return s.Body.List, nil
+	}
+	return nil, fmt.Errorf("no %s cases found", kind)
+}
+
 // parseStatements parses a string as Go statements.
 func parseStatements(code string) ([]ast.Stmt, error) {
 	// Wrap in a function to parse as statements
@@ -410,27 +886,42 @@ func parseStatements(code string) ([]ast.Stmt, error) {
 	// Extract statements from the function body
 	for _, decl := range f.Decls {
 		if fd, ok := decl.(*ast.FuncDecl); ok {
+			// Positions refer to the scratch file; clear them so the
+			// printer lays the statements out fresh in their new home.
+			for _, stmt := range fd.Body.List {
+				clearPositions(stmt)
+			}
 			return fd.Body.List, nil
 		}
 	}
 	return nil, fmt.Errorf("no statements found")
 }
 
-// parseTypeExpr parses a type expression string.
-func parseTypeExpr(typeStr string) ast.Expr {
-	// Handle common cases
-	if strings.Contains(typeStr, ".") {
-		parts := strings.SplitN(typeStr, ".", 2)
-		return &ast.SelectorExpr{
-			X:   &ast.Ident{Name: parts[0]},
-			Sel: &ast.Ident{Name: parts[1]},
+// clearPositions zeroes every token.Pos field in the subtree rooted at n.
+func clearPositions(n ast.Node) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(n, func(n ast.Node) bool {
+		if n == nil {
+			return false
 		}
-	}
-	return &ast.Ident{Name: typeStr}
+		v := reflect.ValueOf(n)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return true
+		}
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.Type() == posType && f.CanSet() {
+				f.SetInt(0)
+			}
+		}
+		return true
+	})
 }
 
 // bindingToString converts a binding value to string.
-func bindingToString(v any) string {
+// AST nodes other than identifiers and literals are rendered as Go source;
+// a BlockStmt renders as its statements without the enclosing braces.
+func (e *Executor) bindingToString(v any) string {
 	switch val := v.(type) {
 	case *ast.Ident:
 		return val.Name
@@ -438,14 +929,45 @@ func bindingToString(v any) string {
 		return val
 	case *ast.BasicLit:
 		return val.Value
+	case *ast.BlockStmt:
+		lines := make([]string, 0, len(val.List))
+		for _, stmt := range val.List {
+			lines = append(lines, e.renderNode(stmt))
+		}
+		return strings.Join(lines, "\n")
+	case ast.Node:
+		return e.renderNode(val)
 	default:
 		return fmt.Sprintf("%v", v)
 	}
 }
 
+// renderNode formats an AST node as Go source.
+func (e *Executor) renderNode(n ast.Node) string {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, e.fset, n); err != nil {
+		return fmt.Sprintf("%v", n)
+	}
+	return buf.String()
+}
+
 // applyTransform applies a named transform to a string.
-func applyTransform(s string, transform string) string {
-	switch transform {
+// Transforms that take an argument are written as name(n), e.g. indent(4).
+// v is the value s was rendered from, for transforms that need the AST.
+func applyTransform(s string, transform string, v any, fset *token.FileSet) string {
+	name, arg := parseTransform(transform)
+
+	switch name {
+	case "signature":
+		if sig := signatureTransform(v, fset); sig != "" {
+			return sig
+		}
+		return s
+	case "type_name":
+		if name := typeNameTransform(v); name != "" {
+			return name
+		}
+		return s
 	case "snake_case":
 		return toSnakeCase(s)
 	case "lower":
@@ -454,29 +976,271 @@ func applyTransform(s string, transform string) string {
 		return strings.ToUpper(s)
 	case "camel_case":
 		return toCamelCase(s)
+	case "indent":
+		return indentLines(s, arg)
+	case "dedent":
+		return dedentLines(s)
+	case "zero_value":
+		return zeroValueTransform(s)
+	case "proto_fields":
+		return protoFieldsTransform(v, fset)
+	case "proto_type":
+		return protoTypeTransform(s)
+	case "proto_message":
+		return protoMessageTransform(s)
+	case "json_schema_type":
+		return jsonSchemaTypeTransform(s)
+	case "json_required":
+		return jsonRequiredTransform(v)
+	case "comment":
+		return commentTransform(s)
+	case "godoc":
+		return godocTransform(s)
 	default:
 		return s
 	}
 }
 
+// parseTransform splits "indent(4)" into its name and integer argument.
+func parseTransform(transform string) (string, int) {
+	open := strings.Index(transform, "(")
+	if open < 0 || !strings.HasSuffix(transform, ")") {
+		return transform, 0
+	}
+	arg, err := strconv.Atoi(transform[open+1 : len(transform)-1])
+	if err != nil {
+		return transform, 0
+	}
+	return transform[:open], arg
+}
+
+// indentLines prepends n spaces to every non-blank line of s.
+func indentLines(s string, n int) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dedentLines strips the leading whitespace common to every non-blank line of s.
+func dedentLines(s string) string {
+	lines := strings.Split(s, "\n")
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix = lead
+			first = false
+			continue
+		}
+		for !strings.HasPrefix(lead, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, prefix)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// zeroValueTransform returns the Go zero value literal for a type expression:
+// 0, "", false, nil for pointer/slice/map/chan/func/interface types, and a
+// composite literal (time.Time{}) for anything else.
+func zeroValueTransform(typeName string) string {
+	typeName = strings.TrimSpace(typeName)
+
+	switch typeName {
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+		"float32", "float64", "complex64", "complex128",
+		"byte", "rune":
+		return "0"
+	case "string":
+		return `""`
+	case "bool":
+		return "false"
+	case "error", "any", "interface{}":
+		return "nil"
+	}
+
+	for _, prefix := range []string{"*", "[]", "map[", "chan ", "chan<-", "<-chan", "func(", "interface{"} {
+		if strings.HasPrefix(typeName, prefix) {
+			return "nil"
+		}
+	}
+
+	return typeName + "{}"
+}
+
+// signatureTransform renders a *ast.FuncDecl as name(params) results, e.g.
+// CreateUser(ctx context.Context, name string) (*User, error). A bare
+// *ast.FuncType renders as func(params) results. Other values yield "".
+func signatureTransform(v any, fset *token.FileSet) string {
+	var name string
+	var ft *ast.FuncType
+	switch val := v.(type) {
+	case *ast.FuncDecl:
+		name, ft = val.Name.Name, val.Type
+	case *ast.FuncType:
+		ft = val
+	default:
+		return ""
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, ft); err != nil {
+		return ""
+	}
+	if name == "" {
+		return buf.String()
+	}
+	return name + strings.TrimPrefix(buf.String(), "func")
+}
+
+// typeNameTransform returns the name of a type expression: T for an
+// identifier, pkg.T for a selector, and *T, []T, [N]T, map[K]V and ...T
+// built from the names of their parts. Other nodes have no name.
+func typeNameTransform(v any) string {
+	switch t := v.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.SelectorExpr:
+		if x := typeNameTransform(t.X); x != "" {
+			return x + "." + t.Sel.Name
+		}
+	case *ast.StarExpr:
+		if x := typeNameTransform(t.X); x != "" {
+			return "*" + x
+		}
+	case *ast.ArrayType:
+		elem := typeNameTransform(t.Elt)
+		if elem == "" {
+			return ""
+		}
+		if t.Len == nil {
+			return "[]" + elem
+		}
+		if lit, ok := t.Len.(*ast.BasicLit); ok {
+			return "[" + lit.Value + "]" + elem
+		}
+		if n := typeNameTransform(t.Len); n != "" {
+			return "[" + n + "]" + elem
+		}
+	case *ast.MapType:
+		key, value := typeNameTransform(t.Key), typeNameTransform(t.Value)
+		if key != "" && value != "" {
+			return "map[" + key + "]" + value
+		}
+	case *ast.Ellipsis:
+		if elem := typeNameTransform(t.Elt); elem != "" {
+			return "..." + elem
+		}
+	case *ast.ParenExpr:
+		return typeNameTransform(t.X)
+	case *ast.Field:
+		return typeNameTransform(t.Type)
+	}
+	return ""
+}
+
 // toSnakeCase converts PascalCase to snake_case.
 func toSnakeCase(s string) string {
-	var result bytes.Buffer
-	for i, r := range s {
-		if i > 0 && r >= 'A' && r <= 'Z' {
-			result.WriteByte('_')
+	return strings.ToLower(strings.Join(splitWords(s), "_"))
+}
+
+// splitWords splits a PascalCase or camelCase name into its words. A word
+// starts at an upper-case letter that follows a lower-case letter or
+// digit, or that ends an acronym: UserID → User ID, HTTPServer → HTTP
+// Server.
+func splitWords(s string) []string {
+	runes := []rune(s)
+	var words []string
+	start := 0
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+		}
+	}
+	if start < len(runes) {
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
+
+// commentTransform turns s into line comments, one per line: // s.
+func commentTransform(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("// "+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// godocTransform writes the doc comment of a type named s, in the
+// "TypeName is a ..." form: UserService → // UserService is a user
+// service. Acronyms keep their case: // HTTPClient is an HTTP client.
+func godocTransform(s string) string {
+	words := splitWords(s)
+	if len(words) == 0 {
+		return s
+	}
+	for i, word := range words {
+		if !isAcronym(word) {
+			words[i] = strings.ToLower(word)
 		}
-		result.WriteRune(r)
 	}
-	return strings.ToLower(result.String())
+	return fmt.Sprintf("// %s is %s %s.", s, article(words[0]), strings.Join(words, " "))
+}
+
+// isAcronym reports whether word is two or more upper-case letters, such
+// as HTTP or ID.
+func isAcronym(word string) bool {
+	return utf8.RuneCountInString(word) > 1 && strings.ToUpper(word) == word && strings.ToLower(word) != word
+}
+
+// article returns "a" or "an" for word, going by its first letter, or for
+// an acronym by how its first letter is spoken: an HTTP client. A u
+// sounded "you", followed by one consonant and a vowel as in user or
+// unit, takes "a"; update and unmarshaler take "an".
+func article(word string) string {
+	if isAcronym(word) {
+		r, _ := utf8.DecodeRuneInString(word)
+		if strings.ContainsRune("AEFHILMNORSX", r) {
+			return "an"
+		}
+		return "a"
+	}
+
+	const vowels = "aeiou"
+	runes := []rune(word)
+	switch {
+	case len(runes) == 0 || !strings.ContainsRune(vowels, runes[0]):
+		return "a"
+	case runes[0] == 'u' && len(runes) > 2 && !strings.ContainsRune(vowels, runes[1]) && strings.ContainsRune(vowels, runes[2]):
+		return "a"
+	}
+	return "an"
 }
 
 // toCamelCase converts snake_case to camelCase.
 func toCamelCase(s string) string {
 	parts := strings.Split(s, "_")
 	for i := 1; i < len(parts); i++ {
-		if len(parts[i]) > 0 {
-			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		if r, size := utf8.DecodeRuneInString(parts[i]); size > 0 {
+			parts[i] = string(unicode.ToUpper(r)) + parts[i][size:]
 		}
 	}
 	return strings.Join(parts, "")
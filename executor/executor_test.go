@@ -1,9 +1,23 @@
 package executor
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/bufbuild/protocompile"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
 	"github.com/vinodhalaharvi/stencil/grammar"
 	"github.com/vinodhalaharvi/stencil/matcher"
 )
@@ -80,11 +94,15 @@ lift "test" {
 	}
 }
 
-func TestPatchRename(t *testing.T) {
+func TestInsertAppendIfBody(t *testing.T) {
 	src := `package main
 
-func OldName() {
-	println("hello")
+func Load() error {
+	err := read()
+	if err != nil {
+		return err
+	}
+	return nil
 }
 `
 
@@ -94,21 +112,37 @@ func OldName() {
 	}
 
 	parser, _ := grammar.NewParser()
-	prog, _ := parser.ParseString("test.lift", `
+	prog, err := parser.ParseString("test.lift", `
 lift "test" {
 	from go {
-		match FuncDecl {
-			name: $Name
+		match IfStmt {
+			cond: BinaryExpr {
+				op: "!="
+				rhs: Ident { name: "nil" }
+			}
+			body: $Body
 		}
 	}
 
-	patch {
-		rename $Name "NewName"
+	where {
+		contains($Body, ReturnStmt { })
+	}
+
+	insert code {
+		append $Body
+		`+"`"+`log.Printf("load failed: %v", err)`+"`"+`
 	}
 }
 `)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
 
 	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
 
 	exec := NewFromMatcher(m)
 
@@ -117,22 +151,27 @@ lift "test" {
 		t.Fatalf("execute error: %v", err)
 	}
 
-	if !strings.Contains(result.ModifiedSource, "func NewName()") {
-		t.Errorf("expected func NewName(), got:\n%s", result.ModifiedSource)
-	}
-
-	if strings.Contains(result.ModifiedSource, "OldName") {
-		t.Error("OldName should have been renamed")
+	want := `	if err != nil {
+		return err
+		log.Printf("load failed: %v", err)
+	}`
+	if !strings.Contains(result.ModifiedSource, want) {
+		t.Errorf("expected log call appended to the if body, got:\n%s", result.ModifiedSource)
 	}
 
-	t.Logf("✓ Patch rename works")
+	t.Logf("✓ Insert into IfStmt body works")
 }
 
-func TestPatchSetParamsFirst(t *testing.T) {
+func TestInsertRangeBoundaryCheck(t *testing.T) {
 	src := `package main
 
-func Fetch(url string) error {
-	return nil
+func Process(users []User, names []string) {
+	for _, u := range users {
+		save(u)
+	}
+	for _, n := range names {
+		println(n)
+	}
 }
 `
 
@@ -142,24 +181,34 @@ func Fetch(url string) error {
 	}
 
 	parser, _ := grammar.NewParser()
-	prog, _ := parser.ParseString("test.lift", `
+	prog, err := parser.ParseString("test.lift", `
 lift "test" {
 	from go {
-		match FuncDecl {
-			name: $Name
-			type: FuncType {
-				params: $Params...
-			}
+		match RangeStmt {
+			x: $Slice
+			body: $Body
 		}
 	}
 
-	patch {
-		set $Params.first = "ctx context.Context"
+	where {
+		$Slice in ["users"]
+	}
+
+	insert code {
+		prepend $Body
+		`+"`"+`if len(${Slice}) == 0 { return }`+"`"+`
 	}
 }
 `)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
 
 	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
 
 	exec := NewFromMatcher(m)
 
@@ -168,29 +217,32 @@ lift "test" {
 		t.Fatalf("execute error: %v", err)
 	}
 
-	if !strings.Contains(result.ModifiedSource, "ctx context.Context") {
-		t.Errorf("expected ctx context.Context param, got:\n%s", result.ModifiedSource)
+	want := `	for _, u := range users {
+		if len(users) == 0 {
+			return
+		}
+		save(u)
+	}`
+	if !strings.Contains(result.ModifiedSource, want) {
+		t.Errorf("expected boundary check in users loop, got:\n%s", result.ModifiedSource)
 	}
-
-	// ctx should come before url
-	ctxIdx := strings.Index(result.ModifiedSource, "ctx context.Context")
-	urlIdx := strings.Index(result.ModifiedSource, "url string")
-	if ctxIdx > urlIdx {
-		t.Error("ctx should come before url")
+	if strings.Contains(result.ModifiedSource, "len(names)") {
+		t.Error("names loop should not be modified")
 	}
 
-	t.Logf("✓ Patch set params.first works")
+	t.Logf("✓ Insert into RangeStmt body works")
 }
 
-func TestConditionalPatch(t *testing.T) {
+func TestInsertForStmtBody(t *testing.T) {
 	src := `package main
 
-func WithCtx(ctx context.Context, url string) error {
-	return nil
-}
-
-func NoCtx(url string) error {
-	return nil
+func Drain(q *Queue) {
+	for ; q.Len() > 0; {
+		q.Pop()
+	}
+	for i := 0; i < 3; i++ {
+		q.Push(i)
+	}
 }
 `
 
@@ -200,38 +252,34 @@ func NoCtx(url string) error {
 	}
 
 	parser, _ := grammar.NewParser()
-	prog, _ := parser.ParseString("test.lift", `
+	prog, err := parser.ParseString("test.lift", `
 lift "test" {
 	from go {
-		match FuncDecl {
-			name: $Name
-			type: FuncType {
-				params: $Params...
-			}
+		match ForStmt {
+			init: $Init
+			cond: $Cond
+			body: $Body
 		}
 	}
 
 	where {
-		not contains($Params, Field {
-			type: SelectorExpr {
-				x: Ident { name: "context" }
-				sel: Ident { name: "Context" }
-			}
-		})
+		$Init.empty
 	}
 
-	patch {
-		set $Params.first = "ctx context.Context"
+	insert code {
+		prepend $Body
+		`+"`"+`log.Printf("draining: %v", ${Cond})`+"`"+`
 	}
 }
 `)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
 
 	matches, _ := m.MatchBlock(prog.Blocks[0])
 	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
-
-	// Should only match NoCtx
 	if len(matches) != 1 {
-		t.Fatalf("expected 1 match (NoCtx), got %d", len(matches))
+		t.Fatalf("expected 1 match, got %d", len(matches))
 	}
 
 	exec := NewFromMatcher(m)
@@ -241,20 +289,37 @@ lift "test" {
 		t.Fatalf("execute error: %v", err)
 	}
 
-	// NoCtx should now have ctx param
-	if !strings.Contains(result.ModifiedSource, "func NoCtx(ctx context.Context") {
-		t.Errorf("NoCtx should have ctx param:\n%s", result.ModifiedSource)
+	// The empty init and post are dropped when the loop is printed.
+	want := `	for q.Len() > 0 {
+		log.Printf("draining: %v", q.Len() > 0)
+		q.Pop()
+	}`
+	if !strings.Contains(result.ModifiedSource, want) {
+		t.Errorf("expected log call in drain loop, got:\n%s", result.ModifiedSource)
+	}
+	if strings.Count(result.ModifiedSource, "log.Printf") != 1 {
+		t.Error("counting loop should not be modified")
 	}
 
-	t.Logf("✓ Conditional patch works (only patches functions without ctx)")
+	t.Logf("✓ Insert into ForStmt body works")
 }
 
-func TestEmitTemplate(t *testing.T) {
+func TestInsertDefaultCase(t *testing.T) {
 	src := `package main
 
-type User struct {
-	ID   int
-	Name string
+func Kind(v any) string {
+	switch x := v.(type) {
+	case int:
+		return "int"
+	case string:
+		return x
+	}
+	switch v.(type) {
+	case nil:
+		return "nil"
+	default:
+		return "other"
+	}
 }
 `
 
@@ -263,55 +328,122 @@ type User struct {
 		t.Fatalf("matcher error: %v", err)
 	}
 
+	lift, err := os.ReadFile("../examples/exhaustive-type-switch.lift")
+	if err != nil {
+		t.Fatalf("read example: %v", err)
+	}
 	parser, _ := grammar.NewParser()
-	prog, _ := parser.ParseString("test.lift", `
-lift "test" {
-	from go {
-		match TypeSpec {
-			name: $Name
-			type: StructType {
-				fields: $Fields...
-			}
-		}
+	prog, err := parser.ParseString("exhaustive-type-switch.lift", string(lift))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
 	}
 
-	emit proto {
-		file "model.proto"
-		template {`+"`"+`syntax = "proto3";
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 type switch without default, got %d", len(matches))
+	}
 
-message ${Name} {
-  // fields go here
-}`+"`"+`}
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := `	switch x := v.(type) {
+	case int:
+		return "int"
+	case string:
+		return x
+	default:
+		panic("unhandled type")
+	}`
+	if !strings.Contains(result.ModifiedSource, want) {
+		t.Errorf("expected default case, got:\n%s", result.ModifiedSource)
+	}
+	if strings.Count(result.ModifiedSource, "default:") != 2 {
+		t.Errorf("switch with a default should be unchanged, got:\n%s", result.ModifiedSource)
+	}
+
+	t.Logf("✓ Insert default case into type switch works")
+}
+
+func TestInsertSelectDefault(t *testing.T) {
+	src := `package main
+
+func Poll(events <-chan string, done chan struct{}) string {
+	select {
+	case e := <-events:
+		return e
+	case <-done:
+	}
+	select {
+	case e := <-events:
+		return e
+	default:
+	}
+	return ""
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "non-blocking-select" {
+	from go {
+		match SelectStmt { body: $SelectBody }
+	}
+	where {
+		not contains($SelectBody, CommClause { comm: nil })
+	}
+	insert code {
+		append $SelectBody
+		`+"`default:\n\treturn \"\"`"+`
 	}
 }
 `)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
 
 	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 select without default, got %d", len(matches))
+	}
 
 	exec := NewFromMatcher(m)
-
 	result, err := exec.Execute(prog.Blocks[0], matches)
 	if err != nil {
 		t.Fatalf("execute error: %v", err)
 	}
 
-	protoContent, ok := result.EmittedFiles["model.proto"]
-	if !ok {
-		t.Fatal("expected model.proto in emitted files")
+	want := `	select {
+	case e := <-events:
+		return e
+	case <-done:
+	default:
+		return ""
+	}`
+	if !strings.Contains(result.ModifiedSource, want) {
+		t.Errorf("expected default case, got:\n%s", result.ModifiedSource)
 	}
-
-	if !strings.Contains(protoContent, "message User") {
-		t.Errorf("expected 'message User', got:\n%s", protoContent)
+	if strings.Count(result.ModifiedSource, "default:") != 2 {
+		t.Errorf("select with a default should be unchanged, got:\n%s", result.ModifiedSource)
 	}
 
-	t.Logf("✓ Emit template works")
+	t.Logf("✓ Insert default case into select works")
 }
 
-func TestEmitCodeWithTransform(t *testing.T) {
+func TestPatchRename(t *testing.T) {
 	src := `package main
 
-type UserAccount struct {
-	ID int
+func OldName() {
+	println("hello")
 }
 `
 
@@ -324,16 +456,13 @@ type UserAccount struct {
 	prog, _ := parser.ParseString("test.lift", `
 lift "test" {
 	from go {
-		match TypeSpec {
+		match FuncDecl {
 			name: $Name
 		}
 	}
 
-	emit sql {
-		file "migration.sql"
-		template {`+"`"+`CREATE TABLE ${Name | snake_case} (
-  id SERIAL PRIMARY KEY
-);`+"`"+`}
+	patch {
+		rename $Name "NewName"
 	}
 }
 `)
@@ -347,27 +476,22 @@ lift "test" {
 		t.Fatalf("execute error: %v", err)
 	}
 
-	sqlContent, ok := result.EmittedFiles["migration.sql"]
-	if !ok {
-		t.Fatal("expected migration.sql in emitted files")
+	if !strings.Contains(result.ModifiedSource, "func NewName()") {
+		t.Errorf("expected func NewName(), got:\n%s", result.ModifiedSource)
 	}
 
-	if !strings.Contains(sqlContent, "user_account") {
-		t.Errorf("expected 'user_account' (snake_case), got:\n%s", sqlContent)
+	if strings.Contains(result.ModifiedSource, "OldName") {
+		t.Error("OldName should have been renamed")
 	}
 
-	t.Logf("✓ Emit with transform works")
+	t.Logf("✓ Patch rename works")
 }
 
-func TestFullEnforceContextTimeout(t *testing.T) {
-	src := `package client
-
-import (
-	"net/http"
-)
+func TestPatchSetParamsFirst(t *testing.T) {
+	src := `package main
 
-func Fetch(url string) (*http.Response, error) {
-	return http.Get(url)
+func Fetch(url string) error {
+	return nil
 }
 `
 
@@ -378,58 +502,23 @@ func Fetch(url string) (*http.Response, error) {
 
 	parser, _ := grammar.NewParser()
 	prog, _ := parser.ParseString("test.lift", `
-lift "enforce-ctx-timeout" {
+lift "test" {
 	from go {
 		match FuncDecl {
-			name: $FuncName
+			name: $Name
 			type: FuncType {
 				params: $Params...
 			}
-			body: $Body
-		}
-
-		match CallExpr in $Body {
-			fun: SelectorExpr {
-				sel: $CallName
-			}
 		}
 	}
 
-	where {
-		$CallName in ["Get", "Post", "Do"]
-		not contains($Body, CallExpr {
-			fun: SelectorExpr {
-				x: Ident { name: "context" }
-				sel: Ident { name: "WithTimeout" }
-			}
-		})
-	}
-
 	patch {
-		if not contains($Params, Field {
-			type: SelectorExpr {
-				x: Ident { name: "context" }
-				sel: Ident { name: "Context" }
-			}
-		}) {
-			set $Params.first = "ctx context.Context"
-		}
-	}
-
-	insert code {
-		prepend $Body
-		`+"`"+`ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()`+"`"+`
+		set $Params.first = "ctx context.Context"
 	}
 }
 `)
 
 	matches, _ := m.MatchBlock(prog.Blocks[0])
-	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
-
-	if len(matches) != 1 {
-		t.Fatalf("expected 1 match, got %d", len(matches))
-	}
 
 	exec := NewFromMatcher(m)
 
@@ -438,32 +527,3817 @@ lift "enforce-ctx-timeout" {
 		t.Fatalf("execute error: %v", err)
 	}
 
-	// Verify all transformations applied
-	out := result.ModifiedSource
+	if !strings.Contains(result.ModifiedSource, "ctx context.Context") {
+		t.Errorf("expected ctx context.Context param, got:\n%s", result.ModifiedSource)
+	}
 
-	// 1. ctx param added
-	if !strings.Contains(out, "ctx context.Context") {
-		t.Error("expected ctx context.Context param")
+	// ctx should come before url
+	ctxIdx := strings.Index(result.ModifiedSource, "ctx context.Context")
+	urlIdx := strings.Index(result.ModifiedSource, "url string")
+	if ctxIdx > urlIdx {
+		t.Error("ctx should come before url")
 	}
 
-	// 2. timeout boilerplate added (may be reformatted across lines)
-	if !strings.Contains(out, "WithTimeout") {
-		t.Error("expected WithTimeout")
+	t.Logf("✓ Patch set params.first works")
+}
+
+func TestPatchSetFieldListEnds(t *testing.T) {
+	src := `package main
+
+func Fetch(url string) int {
+	return 0
+}
+
+func Log(msg string) {
+	println(msg)
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
 	}
 
-	if !strings.Contains(out, "defer cancel()") {
-		t.Error("expected defer cancel()")
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl {
+			name: $Name
+			type: FuncType {
+				params: $Params...
+				results: $Results...
+			}
+		}
+	}
+
+	patch {
+		set $Params.last = "opts Options"
+		set $Results.first = "context.Context"
+		set $Results.last = "error"
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	out := result.ModifiedSource
+
+	if !strings.Contains(out, "func Fetch(url string, opts Options) (context.Context, int, error) {") {
+		t.Errorf("expected Fetch with added param and results, got:\n%s", out)
+	}
+
+	// Log had no results; the list is created on demand
+	if !strings.Contains(out, "func Log(msg string, opts Options) (context.Context, error) {") {
+		t.Errorf("expected Log with added param and results, got:\n%s", out)
 	}
 
-	// 3. imports added
 	if !strings.Contains(out, `"context"`) {
 		t.Error("expected context import")
 	}
 
-	if !strings.Contains(out, `"time"`) {
-		t.Error("expected time import")
+	t.Logf("✓ Patch set first/last on params and results works")
+}
+
+func TestPatchSetResultsLastSingle(t *testing.T) {
+	src := `package main
+
+func Close() {
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
 	}
 
-	t.Logf("✓ Full enforce-ctx-timeout transformation works")
-	t.Logf("Output:\n%s", out)
+	parser, _ := grammar.NewParser()
+	prog, _ := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl {
+			type: FuncType {
+				results: $Results...
+			}
+		}
+	}
+
+	patch {
+		set $Results.last = "error"
+	}
+}
+`)
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	// A single unnamed result is printed without parentheses
+	if !strings.Contains(result.ModifiedSource, "func Close() error {") {
+		t.Errorf("expected func Close() error, got:\n%s", result.ModifiedSource)
+	}
+
+	t.Logf("✓ Patch set results.last on void func works")
+}
+
+func TestPatchSetFieldSpecs(t *testing.T) {
+	src := `package main
+
+func Close() {
+}
+`
+	named := `package main
+
+func C(a, b int) (x int) {
+	return a + b
+}
+`
+	unnamed := `package main
+
+func U(int, string) int {
+	return 0
+}
+`
+	tests := []struct {
+		set  string
+		want string
+		err  string
+		src  string // instead of Close, if set
+	}{
+		{`set $Params.last = "m map[string]int"`, "func Close(m map[string]int) {", "", ""},
+		{`set $Params.last = "a, b int"`, "func Close(a, b int) {", "", ""},
+		{`set $Params.last = "opts Options"`, "func Close(opts Options) {", "", ""},
+		{`set $Params.last = "opts int"`, "func Close(opts int) {", "", ""},
+		{`set $Params.first = "fn func(int) error"`, "func Close(fn func(int) error) {", "", ""},
+		{`set $Results.last = "func() error"`, "func Close() func() error {", "", ""},
+		{`set $Results.last = "[]*http.Request"`, "func Close() []*http.Request {", "", ""},
+		{`set $Results.last = "int, error"`, "", `invalid field "int, error"`, ""},
+		{`set $Results.last = "int)"`, "", `invalid field "int)"`, ""},
+		{`set $Results.last = "err error"`, "func C(a, b int) (x int, err error) {", "", named},
+		{`set $Results.last = "error"`, "", `set $Results.last: "error" is unnamed but the list's fields are named`, named},
+		{`set $Params.first = "ctx context.Context"`, "func C(ctx context.Context, a, b int) (x int) {", "", named},
+		{`set $Params.first = "context.Context"`, "", `set $Params.first: "context.Context" is unnamed but the list's fields are named`, named},
+		{`set $Results.last = "error"`, "func U(int, string) (int, error) {", "", unnamed},
+		{`set $Params.last = "n int"`, "", `set $Params.last: "n int" is named but the list's fields are unnamed`, unnamed},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		if tt.src == "" {
+			tt.src = src
+		}
+		m, err := matcher.New(tt.src)
+		if err != nil {
+			t.Fatalf("matcher error: %v", err)
+		}
+		prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl {
+			type: FuncType { params: $Params... results: $Results... }
+		}
+	}
+	patch { `+tt.set+` }
+}
+`)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+
+		matches, _ := m.MatchBlock(prog.Blocks[0])
+		result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", tt.set, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.set, err)
+		}
+		if !strings.Contains(result.ModifiedSource, tt.want) {
+			t.Errorf("%s: expected %q, got:\n%s", tt.set, tt.want, result.ModifiedSource)
+		}
+	}
+
+	t.Logf("✓ Patch set parses fields as Go")
+}
+
+func TestMatchLeavesAbsentFieldLists(t *testing.T) {
+	src := `package main
+
+func Close() {
+}
+`
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl { type: FuncType { results: $Results... } }
+		match FuncDecl { type: FuncType { results: $Other... } }
+	}
+	patch {
+		set $Results.last = "error"
+		set $Other.first = "int"
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Matching leaves the file alone
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	fd := m.File().Decls[0].(*ast.FuncDecl)
+	if fd.Type.Results != nil {
+		t.Fatalf("expected matching to leave the results nil, got %v", fd.Type.Results)
+	}
+
+	// Patches to two lists bound for the same missing one both land
+	result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if !strings.Contains(result.ModifiedSource, "func Close() (int, error) {") {
+		t.Errorf("expected both results added, got:\n%s", result.ModifiedSource)
+	}
+
+	t.Logf("✓ Absent field lists are placed only when patched")
+}
+
+func TestConditionalPatch(t *testing.T) {
+	src := `package main
+
+func WithCtx(ctx context.Context, url string) error {
+	return nil
+}
+
+func NoCtx(url string) error {
+	return nil
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, _ := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl {
+			name: $Name
+			type: FuncType {
+				params: $Params...
+			}
+		}
+	}
+
+	where {
+		not contains($Params, Field {
+			type: SelectorExpr {
+				x: Ident { name: "context" }
+				sel: Ident { name: "Context" }
+			}
+		})
+	}
+
+	patch {
+		set $Params.first = "ctx context.Context"
+	}
+}
+`)
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+
+	// Should only match NoCtx
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match (NoCtx), got %d", len(matches))
+	}
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	// NoCtx should now have ctx param
+	if !strings.Contains(result.ModifiedSource, "func NoCtx(ctx context.Context") {
+		t.Errorf("NoCtx should have ctx param:\n%s", result.ModifiedSource)
+	}
+
+	t.Logf("✓ Conditional patch works (only patches functions without ctx)")
+}
+
+func TestEmitTemplate(t *testing.T) {
+	src := `package main
+
+type User struct {
+	ID   int
+	Name string
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, _ := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType {
+				fields: $Fields...
+			}
+		}
+	}
+
+	emit proto {
+		file "model.proto"
+		template {`+"`"+`syntax = "proto3";
+
+message ${Name} {
+  // fields go here
+}`+"`"+`}
+	}
+}
+`)
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	protoContent, ok := result.EmittedFiles["model.proto"]
+	if !ok {
+		t.Fatal("expected model.proto in emitted files")
+	}
+
+	if !strings.Contains(protoContent, "message User") {
+		t.Errorf("expected 'message User', got:\n%s", protoContent)
+	}
+
+	t.Logf("✓ Emit template works")
+}
+
+func TestEmitStrictInterpolation(t *testing.T) {
+	src := `package main
+
+type User struct {
+	ID int
+}
+`
+
+	tests := []struct {
+		name       string
+		lenient    string // keyword after the emit target
+		setLenient bool
+		template   string
+		want       string
+		unresolved []string
+	}{
+		{"resolved", "", false, "message ${Name} {}", "message User {}", nil},
+		{"dotted", "", false, "message ${_match.Name} {}", "message User {}", nil},
+		{"typo", "", false, "message ${Nmae} { ${Nmae} ${_match.Nope} }", "", []string{"Nmae", "_match.Nope"}},
+		{"lenient keyword", "lenient", false, "message ${Nmae} {}", "message ${Nmae} {}", nil},
+		{"lenient flag", "", true, "message ${Nmae} {}", "message ${Nmae} {}", nil},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := matcher.New(src)
+			if err != nil {
+				t.Fatalf("matcher error: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "proto" {
+	from go {
+		match TypeSpec { name: $Name }
+	}
+
+	emit proto `+tt.lenient+` {
+		file "user.proto"
+		template {`+"`"+tt.template+"`"+`}
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			if len(matches) != 1 {
+				t.Fatalf("expected 1 match, got %d", len(matches))
+			}
+
+			exec := NewFromMatcher(m)
+			exec.SetLenient(tt.setLenient)
+
+			result, err := exec.Execute(prog.Blocks[0], matches)
+			if tt.unresolved != nil {
+				var unresolved *UnresolvedError
+				if !errors.As(err, &unresolved) {
+					t.Fatalf("expected UnresolvedError, got %v", err)
+				}
+				if unresolved.Block != "proto" || unresolved.File != "user.proto" || !slices.Equal(unresolved.Names, tt.unresolved) {
+					t.Errorf("unexpected error: %+v", unresolved)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if got := result.EmittedFiles["user.proto"]; got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Logf("✓ Strict interpolation reports unresolved bindings")
+}
+
+// TestExecuteDeterministic runs the same block twice and expects the
+// same output, emitted files and applied actions, in the same order.
+func TestExecuteDeterministic(t *testing.T) {
+	src := `package main
+
+type User struct {
+	ID   int
+	Name string
+}
+
+type Order struct {
+	ID    int
+	Total float64
+}
+
+type Item struct {
+	SKU string
+}
+`
+	lift := `
+lift "test" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit proto {
+		file "zz.proto"
+		template {` + "`message ${Name} {}`" + `}
+	}
+
+	emit graphql {
+		file "schema.graphql"
+		template {` + "`type ${Name}`" + `}
+	}
+
+	emit sql {
+		file "a.sql"
+		template {` + "`CREATE TABLE ${Name | snake_case} ();`" + `}
+	}
+}
+`
+
+	run := func() *Result {
+		m, err := matcher.New(src)
+		if err != nil {
+			t.Fatalf("matcher error: %v", err)
+		}
+		parser, _ := grammar.NewParser()
+		prog, err := parser.ParseString("test.lift", lift)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		matches, err := m.MatchBlock(prog.Blocks[0])
+		if err != nil {
+			t.Fatalf("match error: %v", err)
+		}
+		result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+		if err != nil {
+			t.Fatalf("execute error: %v", err)
+		}
+		return result
+	}
+
+	first := run()
+	if got, want := strings.Join(first.EmittedNames(), " "), "a.sql schema.graphql zz.proto"; got != want {
+		t.Errorf("expected emitted files %q, got %q", want, got)
+	}
+	for i := 0; i < 5; i++ {
+		next := run()
+		if next.ModifiedSource != first.ModifiedSource {
+			t.Errorf("run %d: modified source differs", i+2)
+		}
+		if strings.Join(next.Applied, ",") != strings.Join(first.Applied, ",") {
+			t.Errorf("run %d: expected applied %v, got %v", i+2, first.Applied, next.Applied)
+		}
+		for _, name := range first.EmittedNames() {
+			if next.EmittedFiles[name] != first.EmittedFiles[name] {
+				t.Errorf("run %d: %s differs:\n%s\nvs\n%s", i+2, name, next.EmittedFiles[name], first.EmittedFiles[name])
+			}
+		}
+	}
+
+	t.Logf("✓ Repeated runs give identical output")
+}
+
+func TestEmitTemplateConditionals(t *testing.T) {
+	src := `package main
+
+import "time"
+
+type Event struct {
+	At time.Time
+}
+
+type Tag struct {
+	Name string
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit proto {
+		file "model.proto"
+		template {`+"`"+`${if contains($Fields, SelectorExpr { x: "time" sel: "Time" })}
+import "google/protobuf/timestamp.proto";
+${else}
+// no imports
+${end}
+message ${Name} {}
+`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if err := prog.ParseTemplates(); err != nil {
+		t.Fatalf("template error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+
+	want := []string{
+		"import \"google/protobuf/timestamp.proto\";\nmessage Event {}\n",
+		"// no imports\nmessage Tag {}\n",
+	}
+	for i, match := range matches {
+		exec := NewFromMatcher(m)
+		result, err := exec.Execute(prog.Blocks[0], []matcher.Match{match})
+		if err != nil {
+			t.Fatalf("execute error: %v", err)
+		}
+		if got := result.EmittedFiles["model.proto"]; got != want[i] {
+			t.Errorf("match %d: got %q, want %q", i, got, want[i])
+		}
+	}
+
+	t.Logf("✓ Template conditionals choose a branch per match")
+}
+
+func TestEmitCodeWithTransform(t *testing.T) {
+	src := `package main
+
+type UserAccount struct {
+	ID int
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, _ := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match TypeSpec {
+			name: $Name
+		}
+	}
+
+	emit sql {
+		file "migration.sql"
+		template {`+"`"+`CREATE TABLE ${Name | snake_case} (
+  id SERIAL PRIMARY KEY
+);`+"`"+`}
+	}
+}
+`)
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	sqlContent, ok := result.EmittedFiles["migration.sql"]
+	if !ok {
+		t.Fatal("expected migration.sql in emitted files")
+	}
+
+	if !strings.Contains(sqlContent, "user_account") {
+		t.Errorf("expected 'user_account' (snake_case), got:\n%s", sqlContent)
+	}
+
+	t.Logf("✓ Emit with transform works")
+}
+
+func TestFullEnforceContextTimeout(t *testing.T) {
+	src := `package client
+
+import (
+	"net/http"
+)
+
+func Fetch(url string) (*http.Response, error) {
+	return http.Get(url)
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, _ := parser.ParseString("test.lift", `
+lift "enforce-ctx-timeout" {
+	from go {
+		match FuncDecl {
+			name: $FuncName
+			type: FuncType {
+				params: $Params...
+			}
+			body: $Body
+		}
+
+		match CallExpr in $Body {
+			fun: SelectorExpr {
+				sel: $CallName
+			}
+		}
+	}
+
+	where {
+		$CallName in ["Get", "Post", "Do"]
+		not contains($Body, CallExpr {
+			fun: SelectorExpr {
+				x: Ident { name: "context" }
+				sel: Ident { name: "WithTimeout" }
+			}
+		})
+	}
+
+	patch {
+		if not contains($Params, Field {
+			type: SelectorExpr {
+				x: Ident { name: "context" }
+				sel: Ident { name: "Context" }
+			}
+		}) {
+			set $Params.first = "ctx context.Context"
+		}
+	}
+
+	insert code {
+		prepend $Body
+		`+"`"+`ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()`+"`"+`
+	}
+}
+`)
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	// Verify all transformations applied
+	out := result.ModifiedSource
+
+	// 1. ctx param added
+	if !strings.Contains(out, "ctx context.Context") {
+		t.Error("expected ctx context.Context param")
+	}
+
+	// 2. timeout boilerplate added (may be reformatted across lines)
+	if !strings.Contains(out, "WithTimeout") {
+		t.Error("expected WithTimeout")
+	}
+
+	if !strings.Contains(out, "defer cancel()") {
+		t.Error("expected defer cancel()")
+	}
+
+	// 3. imports added
+	if !strings.Contains(out, `"context"`) {
+		t.Error("expected context import")
+	}
+
+	if !strings.Contains(out, `"time"`) {
+		t.Error("expected time import")
+	}
+
+	// 4. per-match actions recorded
+	if len(result.MatchActions) != 1 || strings.Join(result.MatchActions[0], ",") != "patch,insert" {
+		t.Errorf("expected match actions [patch insert], got %v", result.MatchActions)
+	}
+
+	t.Logf("✓ Full enforce-ctx-timeout transformation works")
+	t.Logf("Output:\n%s", out)
+}
+
+func TestEmitTemplateIndent(t *testing.T) {
+	src := `package main
+
+func Handle() {
+	x := 1
+	if x > 0 {
+		println(x)
+	}
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl {
+			name: $Name
+			body: $Body
+		}
+	}
+
+	emit go {
+		file "wrapped.go"
+		template {`+"`"+`func Wrapped${Name}() {
+${Body | indent(4)}
+}`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := "func WrappedHandle() {\n    x := 1\n    if x > 0 {\n    \tprintln(x)\n    }\n}"
+	if got := result.EmittedFiles["wrapped.go"]; got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+
+	t.Logf("✓ Emit indent works")
+}
+
+func TestIndentDedent(t *testing.T) {
+	in := "\t\tfoo()\n\n\t\tif x {\n\t\t\tbar()\n\t\t}"
+
+	if got, want := applyTransform(in, "dedent", nil, nil), "foo()\n\nif x {\n\tbar()\n}"; got != want {
+		t.Errorf("dedent: got %q, want %q", got, want)
+	}
+
+	if got, want := applyTransform("a\n\nb", "indent(2)", nil, nil), "  a\n\n  b"; got != want {
+		t.Errorf("indent(2): got %q, want %q", got, want)
+	}
+
+	if got, want := applyTransform(applyTransform(in, "dedent", nil, nil), "indent(4)", nil, nil), "    foo()\n\n    if x {\n    \tbar()\n    }"; got != want {
+		t.Errorf("dedent | indent(4): got %q, want %q", got, want)
+	}
+
+	t.Logf("✓ Indent and dedent transforms work")
+}
+
+func TestEmitUnicodeTransforms(t *testing.T) {
+	src := `package main
+
+type ÜberWeisung struct {
+	Betrag int
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match TypeSpec {
+			name: $Typ
+		}
+	}
+
+	where {
+		$Typ.exported
+	}
+
+	emit sql {
+		file "migration.sql"
+		template {`+"`"+`CREATE TABLE ${Typ | snake_case} (); -- ${Typ | lower}`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+	if len(matches) != 1 {
+		t.Fatalf("expected ÜberWeisung to be exported, got %d match(es)", len(matches))
+	}
+
+	exec := NewFromMatcher(m)
+
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := "CREATE TABLE über_weisung (); -- überweisung"
+	if got := result.EmittedFiles["migration.sql"]; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := toCamelCase("straße_ärger"); got != "straßeÄrger" {
+		t.Errorf("camel_case: got %q", got)
+	}
+
+	t.Logf("✓ Unicode names flow through emit transforms")
+}
+
+func TestEmitCommentTransforms(t *testing.T) {
+	src := `package main
+
+type HTTPClient struct{}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match TypeSpec {
+			name: $Name
+		}
+	}
+
+	emit go {
+		file "client_gen.go"
+		template {`+"`"+`package main
+
+${Name | godoc}
+type ${Name}Mock struct{}
+
+${Name | comment}
+var _ = ${Name}Mock{}`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	got := result.EmittedFiles["client_gen.go"]
+	for _, want := range []string{
+		"// HTTPClient is an HTTP client.\ntype HTTPClientMock struct{}",
+		"// HTTPClient\nvar _ = HTTPClientMock{}",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, got)
+		}
+	}
+
+	for in, want := range map[string]string{
+		"User":        "// User is a user.",
+		"UserService": "// UserService is a user service.",
+		"Order":       "// Order is an order.",
+		"UserID":      "// UserID is a user ID.",
+		"URLParser":   "// URLParser is a URL parser.",
+		"Updater":     "// Updater is an updater.",
+	} {
+		if got := godocTransform(in); got != want {
+			t.Errorf("godoc(%s) = %q, want %q", in, got, want)
+		}
+	}
+	if got := commentTransform("first\n\nsecond"); got != "// first\n//\n// second" {
+		t.Errorf("comment: got %q", got)
+	}
+
+	t.Logf("✓ comment and godoc transforms work")
+}
+
+func TestZeroValueTransform(t *testing.T) {
+	tests := map[string]string{
+		"int":            "0",
+		"float64":        "0",
+		"string":         `""`,
+		"bool":           "false",
+		"error":          "nil",
+		"*User":          "nil",
+		"[]string":       "nil",
+		"map[string]int": "nil",
+		"chan int":       "nil",
+		"func() error":   "nil",
+		"interface{}":    "nil",
+		"time.Time":      "time.Time{}",
+		"[4]byte":        "[4]byte{}",
+		"Config":         "Config{}",
+	}
+
+	for typ, want := range tests {
+		if got := applyTransform(typ, "zero_value", nil, nil); got != want {
+			t.Errorf("zero_value(%s): got %s, want %s", typ, got, want)
+		}
+	}
+
+	t.Logf("✓ zero_value transform works")
+}
+
+func TestTypeNameTransform(t *testing.T) {
+	for _, typ := range []string{
+		"User",
+		"time.Time",
+		"*http.Request",
+		"[]string",
+		"[]*models.User",
+		"[4]byte",
+		"map[string][]int",
+	} {
+		expr, err := goparser.ParseExpr(typ)
+		if err != nil {
+			t.Fatalf("parse %s: %v", typ, err)
+		}
+		if got := applyTransform("src", "type_name", expr, nil); got != typ {
+			t.Errorf("type_name(%s): got %s", typ, got)
+		}
+	}
+
+	// Nodes that aren't type expressions keep their source text
+	if got := applyTransform("f()", "type_name", &ast.CallExpr{Fun: ast.NewIdent("f")}, nil); got != "f()" {
+		t.Errorf("type_name(call): got %s, want f()", got)
+	}
+
+	t.Logf("✓ type_name transform works")
+}
+
+func TestEmitZeroValues(t *testing.T) {
+	src := `package main
+
+type Account struct {
+	ID      int
+	Owner   string
+	Active  bool
+	Err     error
+	Parent  *Account
+	Created time.Time
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match Field {
+			names: [$FieldName]
+			type: $FieldType
+		}
+	}
+
+	emit go {
+		file "reset.go"
+		template {`+"`"+`a.${FieldName} = ${FieldType | zero_value}`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 6 {
+		t.Fatalf("expected 6 fields, got %d", len(matches))
+	}
+
+	want := []string{
+		"a.ID = 0",
+		`a.Owner = ""`,
+		"a.Active = false",
+		"a.Err = nil",
+		"a.Parent = nil",
+		"a.Created = time.Time{}",
+	}
+
+	exec := NewFromMatcher(m)
+	for i, match := range matches {
+		result, err := exec.Execute(prog.Blocks[0], []matcher.Match{match})
+		if err != nil {
+			t.Fatalf("execute error: %v", err)
+		}
+		if got := result.EmittedFiles["reset.go"]; got != want[i] {
+			t.Errorf("field %d: got %q, want %q", i, got, want[i])
+		}
+	}
+
+	t.Logf("✓ Emit zero values for mixed-type fields works")
+}
+
+func TestEmitSignature(t *testing.T) {
+	src := `package main
+
+func CreateUser(ctx context.Context, name string) (*User, error) {
+	return nil, nil
+}
+
+func Map[T, U any](xs []T, f func(T) U) []U {
+	return nil
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl { type: $Type }
+	}
+
+	emit go {
+		file "doc.md"
+		template {`+"`"+`${_match | signature} / ${Type | signature}`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 funcs, got %d", len(matches))
+	}
+
+	want := []string{
+		"CreateUser(ctx context.Context, name string) (*User, error) / func(ctx context.Context, name string) (*User, error)",
+		"Map[T, U any](xs []T, f func(T) U) []U / func[T, U any](xs []T, f func(T) U) []U",
+	}
+
+	exec := NewFromMatcher(m)
+	for i, match := range matches {
+		result, err := exec.Execute(prog.Blocks[0], []matcher.Match{match})
+		if err != nil {
+			t.Fatalf("execute error: %v", err)
+		}
+		if got := result.EmittedFiles["doc.md"]; got != want[i] {
+			t.Errorf("func %d: got %q, want %q", i, got, want[i])
+		}
+	}
+
+	if got := applyTransform("Name", "signature", "Name", nil); got != "Name" {
+		t.Errorf("signature on non-func: got %q, want unchanged", got)
+	}
+
+	t.Logf("✓ Signature transform works")
+}
+
+func TestPatchAddMethod(t *testing.T) {
+	src := `package main
+
+// User is a user.
+type User struct {
+	Name string
+}
+
+// Order is an order.
+type Order struct {
+	ID int
+}
+
+func (o Order) String() string {
+	return "order"
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "stringer" {
+	from go {
+		match TypeSpec {
+			name: $TypeName
+			type: StructType { }
+		}
+	}
+
+	patch {
+		add_method $TypeName "String() string" {`+"`"+`return "${TypeName}"`+"`"+`}
+		add_method *$TypeName "Reset()" {`+"`"+`panic("unimplemented")`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 structs, got %d", len(matches))
+	}
+
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	for _, want := range []string{
+		"func (u User) String() string {\n\treturn \"User\"\n}",
+		"func (u *User) Reset() {",
+		"func (o *Order) Reset() {",
+	} {
+		if !strings.Contains(result.ModifiedSource, want) {
+			t.Errorf("expected %q in output:\n%s", want, result.ModifiedSource)
+		}
+	}
+
+	if n := strings.Count(result.ModifiedSource, "func (o Order) String()"); n != 1 {
+		t.Errorf("expected existing Order.String to be kept once, found %d", n)
+	}
+
+	if !strings.Contains(result.ModifiedSource, "}\n\nfunc (u User) String() string {") {
+		t.Errorf("expected a blank line before the added method:\n%s", result.ModifiedSource)
+	}
+
+	t.Logf("✓ Patch add_method works")
+}
+
+func TestPatchExtractInterface(t *testing.T) {
+	src := `package main
+
+type UserService struct{}
+
+func (s *UserService) Create(ctx context.Context, name string) (*User, error) {
+	return nil, nil
+}
+
+func (s *UserService) validate(name string) error { return nil }
+
+func (s UserService) Get(id int) *User { return nil }
+
+type Cache struct{}
+
+type Config struct{}
+
+func (c Config) Load() error { return nil }
+
+type ConfigLoader interface {
+	Load() error
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "interfaces" {
+	from go {
+		match TypeSpec {
+			name: $TypeName
+			type: StructType { }
+		}
+	}
+
+	patch {
+		extract_interface $TypeName "${TypeName}Loader"
+		extract_interface $TypeName "${TypeName}API"
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 3 {
+		t.Fatalf("expected 3 structs, got %d", len(matches))
+	}
+
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := "type UserServiceAPI interface {\n" +
+		"\tCreate(ctx context.Context, name string) (*User, error)\n" +
+		"\tGet(id int) *User\n" +
+		"}"
+	if !strings.Contains(result.ModifiedSource, want) {
+		t.Errorf("expected %q in output:\n%s", want, result.ModifiedSource)
+	}
+
+	for _, unwanted := range []string{"\tvalidate(name string) error", "CacheAPI", "CacheLoader"} {
+		if strings.Contains(result.ModifiedSource, unwanted) {
+			t.Errorf("unexpected %q in output:\n%s", unwanted, result.ModifiedSource)
+		}
+	}
+
+	// ConfigLoader already exists; ConfigAPI is new
+	if n := strings.Count(result.ModifiedSource, "type ConfigLoader interface"); n != 1 {
+		t.Errorf("expected existing ConfigLoader to be kept once, found %d", n)
+	}
+	if !strings.Contains(result.ModifiedSource, "}\n\ntype ConfigAPI interface {\n\tLoad() error\n}") {
+		t.Errorf("expected ConfigAPI after a blank line:\n%s", result.ModifiedSource)
+	}
+
+	t.Logf("✓ Patch extract_interface works")
+}
+
+func TestPatchAddInterfaceCheck(t *testing.T) {
+	src := `package main
+
+import (
+	"fmt"
+	nethttp "net/http"
+)
+
+type Handler struct{}
+
+func (h *Handler) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) { fmt.Fprintln(w) }
+
+func (h *Handler) Read(p []byte) (int, error) { return 0, nil }
+
+type Reader struct{}
+
+var _ fmt.Stringer = (*Handler)(nil)
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "checks" {
+	from go {
+		match TypeSpec {
+			name: $TypeName
+			type: StructType { }
+		}
+	}
+
+	patch {
+		add_interface_check $TypeName "net/http.Handler"
+		add_interface_check $TypeName "io.Reader"
+		add_interface_check $TypeName "fmt.Stringer"
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	for _, want := range []string{
+		"var _ nethttp.Handler = (*Handler)(nil)\n",
+		"var _ io.Reader = (*Handler)(nil)\n",
+		"var _ io.Reader = (*Reader)(nil)\n",
+		"var _ fmt.Stringer = (*Reader)(nil)\n",
+		"\t\"io\"\n",
+	} {
+		if !strings.Contains(result.ModifiedSource, want) {
+			t.Errorf("expected %q in output:\n%s", want, result.ModifiedSource)
+		}
+	}
+	if n := strings.Count(result.ModifiedSource, "var _ fmt.Stringer = (*Handler)(nil)"); n != 1 {
+		t.Errorf("expected the existing fmt.Stringer check once, found %d", n)
+	}
+	if n := strings.Count(result.ModifiedSource, `"net/http"`); n != 1 {
+		t.Errorf("expected net/http imported once, found %d:\n%s", n, result.ModifiedSource)
+	}
+
+	// The package name comes from lastElem, must be an identifier, and
+	// the import is only added for a valid interface
+	tests := []struct {
+		iface string
+		want  string
+		err   string
+	}{
+		{iface: "github.com/acme/store/v2.Store", want: "var _ store.Store = (*Reader)(nil)"},
+		{iface: "gopkg.in/yaml.v3.Marshaler", err: "the package name of gopkg.in/yaml.v3 can't be told from its path"},
+		{iface: "github.com/acme/broken.Not-Valid", err: `"broken.Not-Valid" is not an interface type`},
+	}
+	for _, tt := range tests {
+		m, _ := matcher.New("package main\n\ntype Reader struct{}\n")
+		prog, err := parser.ParseString("test.lift", `lift "c" { from go { match TypeSpec { name: $T } } patch { add_interface_check $T "`+tt.iface+`" } }`)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		matches, _ := m.MatchBlock(prog.Blocks[0])
+		exec := NewFromMatcher(m)
+		result, err := exec.Execute(prog.Blocks[0], matches)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", tt.iface, tt.err, err)
+			}
+			if src, _ := exec.Source(); strings.Contains(src, "import") {
+				t.Errorf("%s: expected no import added, got:\n%s", tt.iface, src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: execute error: %v", tt.iface, err)
+		}
+		if !strings.Contains(result.ModifiedSource, tt.want) || !strings.Contains(result.ModifiedSource, `"github.com/acme/store/v2"`) {
+			t.Errorf("%s: expected %q and its import, got:\n%s", tt.iface, tt.want, result.ModifiedSource)
+		}
+	}
+
+	t.Logf("✓ Patch add_interface_check works")
+}
+
+func TestPatchExtractConstant(t *testing.T) {
+	src := `package main
+
+func retry() {
+	for i := 0; i < 5; i++ {
+	}
+	if attempts > 5 {
+		sleep(-1)
+	}
+}
+`
+
+	tests := []struct {
+		name  string
+		patch string
+		want  []string
+		err   string
+	}{
+		{
+			name:  "shared constant",
+			patch: `extract_constant $Lit "MaxRetries"`,
+			want: []string{
+				"i < MaxRetries",
+				"attempts > MaxRetries",
+				"const MaxRetries = 5\n",
+			},
+		},
+		{
+			name:  "name clash",
+			patch: `extract_constant $Lit "retry"`,
+			err:   "retry is already declared",
+		},
+		{
+			name:  "bad name",
+			patch: `extract_constant $Lit "${Lit}s"`,
+			err:   `"5s" is not a valid constant name`,
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := matcher.New(src)
+			if err != nil {
+				t.Fatalf("matcher error: %v", err)
+			}
+			prog, err := parser.ParseString("test.lift", `
+lift "constants" {
+	from go {
+		match BinaryExpr { y: $Lit }
+	}
+	where {
+		$Lit.matches("^[0-9]+$")
+	}
+	patch {
+		`+tt.patch+`
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+			result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(result.ModifiedSource, want) {
+					t.Errorf("expected %q in output:\n%s", want, result.ModifiedSource)
+				}
+			}
+			if n := strings.Count(result.ModifiedSource, "const MaxRetries"); n != 1 {
+				t.Errorf("expected one MaxRetries constant, found %d", n)
+			}
+		})
+	}
+
+	// A negative literal, and a binding that isn't a literal
+	m, _ := matcher.New(src)
+	prog, _ := parser.ParseString("test.lift", `
+lift "negative" {
+	from go { match CallExpr { fun: Ident { name: "sleep" } args: [$Lit] } }
+	patch { extract_constant $Lit "Forever" }
+}
+lift "call" {
+	from go { match CallExpr { fun: Ident { name: "sleep" } } }
+	patch { extract_constant $_match "Sleep" }
+}
+`)
+	exec := NewFromMatcher(m)
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	for _, want := range []string{"sleep(Forever)", "const Forever = -1\n"} {
+		if !strings.Contains(result.ModifiedSource, want) {
+			t.Errorf("expected %q in output:\n%s", want, result.ModifiedSource)
+		}
+	}
+	matches, _ = m.MatchBlock(prog.Blocks[1])
+	if _, err := exec.Execute(prog.Blocks[1], matches); err == nil || !strings.Contains(err.Error(), "not a literal") {
+		t.Errorf("expected a call to be rejected, got %v", err)
+	}
+
+	t.Logf("✓ Patch extract_constant works")
+}
+
+func TestDeleteImport(t *testing.T) {
+	rule := `
+lift "drop-pkg-errors" {
+	from go { match Import { path: "github.com/pkg/errors" } }
+	delete { remove $_match }
+}
+`
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "import block",
+			src: `package a
+
+import (
+	"fmt"
+	// errors wraps errors
+	"github.com/pkg/errors" // deprecated
+	"os"
+)
+
+var _ = fmt.Sprint(os.Args)
+`,
+			want: `package a
+
+import (
+	"fmt"
+	"os"
+)
+
+var _ = fmt.Sprint(os.Args)
+`,
+		},
+		{
+			name: "last import",
+			src: `package a
+
+import "github.com/pkg/errors"
+
+// F fails.
+func F() {}
+`,
+			want: `package a
+
+// F fails.
+func F() {}
+`,
+		},
+		{
+			name: "last import in a block",
+			src: `package a
+
+import (
+	"github.com/pkg/errors"
+)
+
+func F() {}
+`,
+			want: `package a
+
+func F() {}
+`,
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", rule)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := matcher.New(tt.src)
+			if err != nil {
+				t.Fatalf("matcher error: %v", err)
+			}
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			if len(matches) != 1 {
+				t.Fatalf("expected 1 match, got %d", len(matches))
+			}
+			exec := NewFromMatcher(m)
+			result, err := exec.Execute(prog.Blocks[0], matches)
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if result.ModifiedSource != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", result.ModifiedSource, tt.want)
+			}
+			if len(m.File().Imports) != strings.Count(tt.want, "\"")/2 {
+				t.Errorf("expected the file's imports to be updated, got %d", len(m.File().Imports))
+			}
+		})
+	}
+
+	t.Logf("✓ delete removes imports")
+}
+
+func TestDeleteNodes(t *testing.T) {
+	src := `package a
+
+type User struct {
+	Name string ` + "`json:\"name\"`" + `
+}
+
+func F() {
+	debug("start")
+	run()
+}
+`
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "drop-debug" {
+	from go { match ExprStmt { x: CallExpr { fun: Ident { name: "debug" } } } }
+	delete { remove $_match }
+}
+lift "drop-tags" {
+	from go { match Field { tag: $Tag } }
+	delete { remove $_match.tag }
+}
+lift "missing" {
+	from go { match Field { doc: $Doc } }
+	delete { remove $Doc }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	exec := NewFromMatcher(m)
+	var result *Result
+	for _, block := range prog.Blocks[:2] {
+		matches, _ := m.MatchBlock(block)
+		if result, err = exec.Execute(block, matches); err != nil {
+			t.Fatalf("execute error: %v", err)
+		}
+	}
+	want := `package a
+
+type User struct {
+	Name string
+}
+
+func F() {
+	run()
+}
+`
+	if result.ModifiedSource != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result.ModifiedSource, want)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[2])
+	if _, err := exec.Execute(prog.Blocks[2], matches); err == nil || !strings.Contains(err.Error(), "remove $Doc: not a node") {
+		t.Errorf("expected removing a missing doc comment to fail, got %v", err)
+	}
+
+	t.Logf("✓ delete removes statements and clears fields")
+}
+
+func TestDeleteExprStmt(t *testing.T) {
+	src := `package a
+
+func F() {
+	log("start")
+	run()
+	x := log("end")
+	_ = x
+}
+
+type User struct {
+	Name string
+}
+`
+	parser, _ := grammar.NewParser()
+	tests := []struct {
+		name   string
+		match  string
+		remove string
+		want   string
+		err    string
+	}{
+		{
+			name:   "call statement",
+			match:  `CallExpr { fun: Ident { name: "log" } args: [BasicLit { value: "\"start\"" }] }`,
+			remove: "_match",
+			want:   "func F() {\n\trun()\n\tx := log(\"end\")",
+		},
+		{
+			name:   "call in an assignment",
+			match:  `CallExpr { fun: Ident { name: "log" } args: [BasicLit { value: "\"end\"" }] }`,
+			remove: "_match",
+			err:    "remove $_match: AssignStmt.Rhs can't be removed",
+		},
+		{
+			name:   "field type",
+			match:  `Field { names: ["Name"] type: $T }`,
+			remove: "T",
+			err:    "remove $T: Field.Type can't be removed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := matcher.New(src)
+			if err != nil {
+				t.Fatalf("matcher error: %v", err)
+			}
+			prog, err := parser.ParseString("test.lift", `lift "d" { from go { match `+tt.match+` } delete { remove $`+tt.remove+` } }`)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			if len(matches) != 1 {
+				t.Fatalf("expected 1 match, got %d", len(matches))
+			}
+			result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if !strings.Contains(result.ModifiedSource, tt.want) {
+				t.Errorf("got:\n%s\nwant it to contain:\n%s", result.ModifiedSource, tt.want)
+			}
+		})
+	}
+
+	t.Logf("✓ delete takes a bound call's statement and refuses required fields")
+}
+
+func TestMergeFiles(t *testing.T) {
+	iface := `import "context"
+
+// UserStore stores users.
+type UserStore interface {
+	Get(ctx context.Context, id string) (*User, error)
+}`
+
+	impl := `package store
+
+import (
+	"context"
+	stderrors "errors"
+)
+
+type memStore struct{}
+
+func (memStore) Get(ctx context.Context, id string) (*User, error) {
+	return nil, stderrors.New("not found")
+}`
+
+	got, err := MergeFiles("", []string{iface, impl})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+
+	want := `package store
+
+import (
+	"context"
+	stderrors "errors"
+)
+
+// UserStore stores users.
+type UserStore interface {
+	Get(ctx context.Context, id string) (*User, error)
+}
+
+type memStore struct{}
+
+func (memStore) Get(ctx context.Context, id string) (*User, error) {
+	return nil, stderrors.New("not found")
+}
+`
+	if got != want {
+		t.Errorf("unexpected merge:\n%s\nwant:\n%s", got, want)
+	}
+
+	got, err = MergeFiles("main", []string{impl})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if !strings.HasPrefix(got, "package main\n") {
+		t.Errorf("expected explicit package to win, got:\n%s", got)
+	}
+
+	if _, err := MergeFiles("", []string{iface}); err == nil {
+		t.Error("expected error when no package name is known")
+	}
+
+	t.Logf("✓ MergeFiles combines declarations and dedupes imports")
+}
+
+func TestEmitFencedStructTags(t *testing.T) {
+	src := `package main
+
+type User struct {
+	Name string
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", "lift \"dto\" {\n"+
+		"\tfrom go { match TypeSpec { name: $T type: StructType { } } }\n"+
+		"\temit go {\n"+
+		"\t\tfile \"dto.go\"\n"+
+		"\t\tpackage main\n"+
+		"\t\tcode { ```type ${T}DTO struct {\n\tName string `json:\"name\"`\n}``` }\n"+
+		"\t}\n"+
+		"}\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := "package main\n\ntype UserDTO struct {\n\tName string `json:\"name\"`\n}"
+	if got := result.EmittedFiles["dto.go"]; got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+
+	t.Logf("✓ Fenced code blocks can emit struct tags")
+}
+
+func TestModuleResolveImport(t *testing.T) {
+	gomod := filepath.Join(t.TempDir(), "go.mod")
+	err := os.WriteFile(gomod, []byte(`module github.com/acme/shop // the shop
+
+go 1.22
+
+require github.com/pkg/errors v0.9.1
+
+require (
+	github.com/google/uuid v1.6.0
+	github.com/jackc/pgx/v5 v5.5.0 // indirect
+)
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := ReadModule(gomod)
+	if err != nil {
+		t.Fatalf("read module: %v", err)
+	}
+	if mod.Path != "github.com/acme/shop" {
+		t.Errorf("expected module path github.com/acme/shop, got %s", mod.Path)
+	}
+	if len(mod.Requires) != 3 {
+		t.Errorf("expected 3 requirements, got %v", mod.Requires)
+	}
+
+	tests := map[string]string{
+		"./internal/store": "github.com/acme/shop/internal/store",
+		"../shared":        "github.com/acme/shared",
+		"errors":           "github.com/pkg/errors",
+		"uuid":             "github.com/google/uuid",
+		"pgx":              "github.com/jackc/pgx/v5",
+		"context":          "context",
+		"net/http":         "net/http",
+		"golang.org/x/mod": "golang.org/x/mod",
+	}
+	for imp, want := range tests {
+		if got := mod.ResolveImport(imp); got != want {
+			t.Errorf("ResolveImport(%q) = %q, want %q", imp, got, want)
+		}
+	}
+
+	var none *Module
+	if got := none.ResolveImport("errors"); got != "errors" {
+		t.Errorf("nil module should leave imports alone, got %q", got)
+	}
+
+	if _, err := ReadModule(filepath.Join(t.TempDir(), "go.mod")); err == nil {
+		t.Error("expected error for missing go.mod")
+	}
+
+	t.Logf("✓ Module-aware import resolution works")
+}
+
+func TestPatchCommentOut(t *testing.T) {
+	src := `package main
+
+func Run(items []int) {
+	log.Println("start")
+	for _, v := range items {
+		// report each item
+		log.Println(v)
+	}
+
+	if len(items) == 0 {
+		return /* nothing to do */
+	}
+	process(items)
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "calls" {
+	from go {
+		match CallExpr { fun: "log.Println" }
+	}
+	patch { comment_out $_match }
+}
+
+lift "loops" {
+	from go {
+		match RangeStmt { body: $Body }
+	}
+	patch { comment_out $_match }
+}
+
+lift "guards" {
+	from go {
+		match IfStmt { cond: $Cond }
+	}
+	patch { comment_out $_match }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	exec := NewFromMatcher(m)
+	var result *Result
+	for _, block := range prog.Blocks {
+		matches, _ := m.MatchBlock(block)
+		if len(matches) == 0 {
+			t.Fatalf("block %q: expected matches", block.Name)
+		}
+		if result, err = exec.Execute(block, matches); err != nil {
+			t.Fatalf("block %q: execute error: %v", block.Name, err)
+		}
+	}
+
+	want := `package main
+
+func Run(items []int) {
+	/* log.Println("start") */
+	/* for _, v := range items {
+		// report each item
+		log.Println(v)
+	} */
+
+	// if len(items) == 0 {
+	// 	return /* nothing to do */
+	// }
+	process(items)
+}
+`
+	if result.ModifiedSource != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result.ModifiedSource, want)
+	}
+
+	t.Logf("✓ Patch comment_out works")
+}
+
+func TestPatchCommentOutMany(t *testing.T) {
+	// The eleventh comment_out, __stencil_comment_out_10__, comes first
+	// in the file, ahead of the second.
+	var src, want strings.Builder
+	src.WriteString("package main\n\nfunc Top() {\n\twarn()\n}\n\nfunc Run() {\n")
+	want.WriteString("package main\n\nfunc Top() {\n\t/* warn() */\n}\n\nfunc Run() {\n")
+	for i := range 10 {
+		fmt.Fprintf(&src, "\tlog.Println(%d)\n", i)
+		fmt.Fprintf(&want, "\t/* log.Println(%d) */\n", i)
+	}
+	src.WriteString("}\n")
+	want.WriteString("}\n")
+
+	m, err := matcher.New(src.String())
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "calls" { from go { match CallExpr { fun: "log.Println" } } patch { comment_out $_match } }
+lift "warnings" { from go { match CallExpr { fun: "warn" } } patch { comment_out $_match } }
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	exec := NewFromMatcher(m)
+	var result *Result
+	for _, block := range prog.Blocks {
+		matches, _ := m.MatchBlock(block)
+		if result, err = exec.Execute(block, matches); err != nil {
+			t.Fatalf("block %q: execute error: %v", block.Name, err)
+		}
+	}
+	if result.ModifiedSource != want.String() {
+		t.Errorf("got:\n%s\nwant:\n%s", result.ModifiedSource, want.String())
+	}
+
+	t.Logf("✓ comment_out keeps more than 10 statements apart")
+}
+
+func TestPatchWrapGoroutine(t *testing.T) {
+	src := `package main
+
+func main() {
+	var group sync.WaitGroup
+	notify("a", 1) // tell them
+	x := 1
+
+	logEvent(x)
+	group.Wait()
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "notify" {
+	from go {
+		match CallExpr { fun: "notify" }
+	}
+	patch { wrap_in_goroutine $_match with_waitgroup(group) }
+}
+
+lift "log" {
+	from go {
+		match CallExpr { fun: "logEvent" }
+	}
+	patch { wrap_in_goroutine $_match }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	exec := NewFromMatcher(m)
+	var result *Result
+	for _, block := range prog.Blocks {
+		matches, _ := m.MatchBlock(block)
+		if len(matches) == 0 {
+			t.Fatalf("block %q: expected matches", block.Name)
+		}
+		if result, err = exec.Execute(block, matches); err != nil {
+			t.Fatalf("block %q: execute error: %v", block.Name, err)
+		}
+	}
+
+	want := `package main
+
+func main() {
+	var group sync.WaitGroup
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		notify("a", 1) // tell them
+	}()
+	x := 1
+
+	go func() {
+		logEvent(x)
+	}()
+	group.Wait()
+}
+`
+	if result.ModifiedSource != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result.ModifiedSource, want)
+	}
+
+	t.Logf("✓ Patch wrap_in_goroutine works")
+}
+
+func TestPatchWrapGoroutineSetWaitGroup(t *testing.T) {
+	src := `package main
+
+func main() {
+	notify()
+	logEvent()
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "wrap" {
+	from go {
+		match CallExpr { fun: $Fn }
+	}
+	where { $Fn == "notify" }
+	patch { wrap_in_goroutine $_match }
+}
+
+lift "wrap-named" {
+	from go {
+		match CallExpr { fun: $Fn }
+	}
+	where { $Fn == "logEvent" }
+	patch { wrap_in_goroutine $_match with_waitgroup(group) }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	exec := NewFromMatcher(m)
+	exec.SetWaitGroup(true)
+	var result *Result
+	for _, block := range prog.Blocks {
+		matches, _ := m.MatchBlock(block)
+		matches = matcher.FilterMatches(matches, block.Where)
+		if len(matches) != 1 {
+			t.Fatalf("block %q: expected 1 match, got %d", block.Name, len(matches))
+		}
+		if result, err = exec.Execute(block, matches); err != nil {
+			t.Fatalf("block %q: execute error: %v", block.Name, err)
+		}
+	}
+
+	want := `package main
+
+func main() {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		notify()
+	}()
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		logEvent()
+	}()
+}
+`
+	if result.ModifiedSource != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result.ModifiedSource, want)
+	}
+
+	t.Logf("✓ SetWaitGroup tracks every wrapped goroutine")
+}
+
+func TestPatchInlineVar(t *testing.T) {
+	src := `package main
+
+func total(a, b, c int) int {
+	sum := a + b // partial
+	return sum * c
+}
+
+func name(u *User) string {
+	var n = u.Name
+	return strings.ToUpper(n)
+}
+
+func twice(a int) int {
+	d := a * 2
+	return d + d
+}
+
+func loop(xs []int) {
+	v := compute()
+	for range xs {
+		use(v)
+	}
+}
+
+func field(p Point) Point {
+	x := p.X
+	return Point{x: x}
+}
+
+func reassigned(a int) int {
+	x := a
+	a = 5
+	return x
+}
+
+func branch(ok bool) int {
+	v := expensive()
+	if ok {
+		return v
+	}
+	return 0
+}
+
+func call(a int) int {
+	y := a + 1
+	log()
+	return y
+}
+
+func shortCircuit(ok bool) bool {
+	v := check()
+	return ok && v
+}
+
+func apart(a, b int) int {
+	s := a + b
+	c := 2
+	return s * c
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "inline" {
+	from go {
+		match AssignStmt { lhs: [$Var] tok: ":=" }
+	}
+	patch { inline_var $Var }
+}
+
+lift "inline-var-decl" {
+	from go {
+		match BlockStmt { list: [DeclStmt { }, ReturnStmt { results: [CallExpr { args: [$Var] }] }] }
+	}
+	patch { inline_var $Var }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	exec := NewFromMatcher(m)
+	var result *Result
+	for _, block := range prog.Blocks {
+		matches, _ := m.MatchBlock(block)
+		if len(matches) == 0 {
+			t.Fatalf("block %q: expected matches", block.Name)
+		}
+		if result, err = exec.Execute(block, matches); err != nil {
+			t.Fatalf("block %q: execute error: %v", block.Name, err)
+		}
+	}
+
+	want := `package main
+
+func total(a, b, c int) int {
+	return (a + b) * c
+}
+
+func name(u *User) string {
+	return strings.ToUpper(u.Name)
+}
+
+func twice(a int) int {
+	d := a * 2
+	return d + d
+}
+
+func loop(xs []int) {
+	v := compute()
+	for range xs {
+		use(v)
+	}
+}
+
+func field(p Point) Point {
+	x := p.X
+	return Point{x: x}
+}
+
+func reassigned(a int) int {
+	x := a
+	a = 5
+	return x
+}
+
+func branch(ok bool) int {
+	v := expensive()
+	if ok {
+		return v
+	}
+	return 0
+}
+
+func call(a int) int {
+	y := a + 1
+	log()
+	return y
+}
+
+func shortCircuit(ok bool) bool {
+	v := check()
+	return ok && v
+}
+
+func apart(a, b int) int {
+	return (a + b) * 2
+}
+`
+	if result.ModifiedSource != want {
+		t.Errorf("got:\n%s\nwant:\n%s", result.ModifiedSource, want)
+	}
+
+	t.Logf("✓ Patch inline_var inlines single-use variables only")
+}
+
+func TestEmitGoTemplate(t *testing.T) {
+	src := `package main
+
+type UserAccount struct {
+	ID          int    ` + "`json:\"id\"`" + `
+	First, Last string
+	Audit
+}
+`
+
+	tests := []struct {
+		name     string
+		template string
+		lenient  string
+		want     string
+		err      string
+	}{
+		{
+			name: "fields and funcs",
+			template: `message {{.Name}} {
+{{- range $i, $f := .Fields}}
+  {{$f.Type}} {{$f.Name | lower}} = {{$i}};{{if $f.Tag}} // {{$f.Tag}}{{end}}
+{{- end}}
+}
+{{.Name | snake_case | upper}}`,
+			want: `message UserAccount {
+  int id = 0; // json:"id"
+  string first = 1;
+  string last = 2;
+  Audit  = 3;
+}
+USER_ACCOUNT`,
+		},
+		{
+			name:     "missing binding",
+			template: "a\n{{.Nmae}}",
+			err:      `test.lift:11:3: template: user.proto:2:2: executing "user.proto" at <.Nmae>: map has no entry for key "Nmae"`,
+		},
+		{
+			name:     "lenient",
+			template: "{{.Nmae}}",
+			lenient:  "lenient",
+			want:     "<no value>",
+		},
+		{
+			name:     "syntax error",
+			template: "a\nb\n{{if .Name}}",
+			err:      `test.lift:11:3: template: user.proto:3: unexpected EOF`,
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := matcher.New(src)
+			if err != nil {
+				t.Fatalf("matcher error: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "gotpl" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+	emit proto `+tt.lenient+` {
+		file "user.proto"
+		template gotpl {`+"```"+tt.template+"```"+`}
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			exec := NewFromMatcher(m)
+			result, err := exec.Execute(prog.Blocks[0], matches)
+			if tt.err != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+					t.Fatalf("expected error ending %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if got := result.EmittedFiles["user.proto"]; got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Logf("✓ Go template emits work")
+}
+
+func TestEmitInterfaceMocks(t *testing.T) {
+	src := `package main
+
+import (
+	"context"
+	"io"
+)
+
+type Store interface {
+	io.Closer
+	Get(ctx context.Context, id int64) (*User, error)
+	Put(ctx context.Context, u *User) error
+	Delete(context.Context, int64) error
+	List(ctx context.Context) ([]*User, error)
+	Count(ctx context.Context) (n int, err error)
+	Ping()
+}
+
+type Reader interface {
+	Read(p []byte) (int, error)
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	lift, err := os.ReadFile("../examples/interface-mocks.lift")
+	if err != nil {
+		t.Fatalf("read example: %v", err)
+	}
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("interface-mocks.lift", string(lift))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = matcher.FilterMatches(matches, prog.Blocks[0].Where)
+	if len(matches) != 1 {
+		t.Fatalf("expected only Store to have more than 5 methods, got %d matches", len(matches))
+	}
+
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if len(result.Regions) != 1 {
+		t.Fatalf("expected 1 region, got %d", len(result.Regions))
+	}
+	r := result.Regions[0]
+	if r.Package != "main" {
+		t.Errorf("expected the source's package for a new file, got %q", r.Package)
+	}
+	if len(r.Imports) != 1 || r.Imports[0].Path.Value != `"context"` {
+		t.Errorf("expected the stubs to need only context, got %v", r.Imports)
+	}
+
+	want := `// MockStore is a mock Store.
+type MockStore struct{}
+
+func (m *MockStore) Get(ctx context.Context, id int64) (*User, error) {
+	panic("MockStore.Get not implemented")
+}
+
+func (m *MockStore) Put(ctx context.Context, u *User) error {
+	panic("MockStore.Put not implemented")
+}
+
+func (m *MockStore) Delete(context.Context, int64) error {
+	panic("MockStore.Delete not implemented")
+}
+
+func (m *MockStore) List(ctx context.Context) ([]*User, error) {
+	panic("MockStore.List not implemented")
+}
+
+func (m *MockStore) Count(ctx context.Context) (n int, err error) {
+	panic("MockStore.Count not implemented")
+}
+
+func (m *MockStore) Ping() {
+	panic("MockStore.Ping not implemented")
+}
+`
+	if got := result.Regions[0].Content; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	t.Logf("✓ Interface methods generate mock skeletons")
+}
+
+func TestEmitTemplateFile(t *testing.T) {
+	src := `package models
+
+type User struct {
+	ID   int
+	Name string
+}
+`
+
+	dir := t.TempDir()
+	tmpl := `type {{.Name}}Repository struct{}
+{{range .Fields}}
+func (r *{{$Name}}Repository) By{{.Name}}(v {{.Type}}) (*{{$Name}}, error)
+{{- end}}
+`
+	if err := os.WriteFile(filepath.Join(dir, "repo.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "repo" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit go { file "repo_gen.go" template_file "repo.tmpl" }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+
+	exec := NewFromMatcher(m)
+	if _, err := exec.Execute(prog.Blocks[0], matches); err == nil || !strings.Contains(err.Error(), "template_file") {
+		t.Errorf("expected a template_file error without the template dir, got %v", err)
+	}
+
+	exec.SetTemplateDir(dir)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := `type UserRepository struct{}
+
+func (r *UserRepository) ByID(v int) (*User, error)
+func (r *UserRepository) ByName(v string) (*User, error)
+`
+	if got := result.EmittedFiles["repo_gen.go"]; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	t.Logf("✓ Template files loaded from the template dir")
+}
+
+func TestEmitProtoFields(t *testing.T) {
+	src := `package main
+
+import "time"
+
+type Order struct {
+	ID        string
+	UserID    int
+	Paid      bool
+	Total     float64
+	Tags      []string
+	Note      *string
+	Raw       []byte
+	Lines     map[string]int32
+	CreatedAt time.Time
+	Events    chan int
+	Audit
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "proto" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit proto {
+		file "order.proto"
+		template {`+"`"+`syntax = "proto3";
+
+package shop;
+
+message ${Name} {
+${Fields | proto_fields | indent(2)}
+}
+`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	exec := NewFromMatcher(m)
+	result, err := exec.Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := `syntax = "proto3";
+
+package shop;
+
+import "google/protobuf/timestamp.proto";
+
+message Order {
+  string id = 1;
+  int64 user_id = 2;
+  bool paid = 3;
+  double total = 4;
+  repeated string tags = 5;
+  optional string note = 6;
+  bytes raw = 7;
+  map<string, int32> lines = 8;
+  google.protobuf.Timestamp created_at = 9;
+  // TODO: events = 10: no proto type for chan int
+  // TODO: audit = 11: no proto type for Audit
+}
+`
+	if got := result.EmittedFiles["order.proto"]; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	t.Logf("✓ Proto fields emitted")
+}
+
+func TestEmitSQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string // file under ../testdata, or inline Go source
+		dialect string
+		want    string
+	}{
+		{
+			name:   "postgres",
+			source: "user.go",
+			want: `CREATE TABLE "user" (
+    "id" BIGINT PRIMARY KEY,
+    "email_address" TEXT NOT NULL,
+    "name" TEXT NOT NULL,
+    "nickname" TEXT,
+    "admin" BOOLEAN NOT NULL,
+    "avatar" BYTEA NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL,
+    "deleted_at" TIMESTAMPTZ
+);
+`,
+		},
+		{
+			name:    "mysql",
+			source:  "user.go",
+			dialect: "dialect mysql",
+			want: "CREATE TABLE `user` (\n" +
+				"    `id` BIGINT PRIMARY KEY,\n" +
+				"    `email_address` VARCHAR(255) NOT NULL,\n" +
+				"    `name` VARCHAR(255) NOT NULL,\n" +
+				"    `nickname` VARCHAR(255),\n" +
+				"    `admin` BOOLEAN NOT NULL,\n" +
+				"    `avatar` BLOB NOT NULL,\n" +
+				"    `created_at` DATETIME(6) NOT NULL,\n" +
+				"    `deleted_at` DATETIME(6)\n" +
+				");\n",
+		},
+		{
+			name: "sqlite with tagged keys",
+			source: `package main
+
+type OrderLine struct {
+	ID      int
+	OrderID int64 ` + "`db:\",pk\"`" + `
+	LineNo  int   ` + "`db:\"line,pk\"`" + `
+	Meta    map[string]string
+}
+`,
+			dialect: "dialect sqlite",
+			want: `CREATE TABLE "order_line" (
+    "id" INTEGER NOT NULL,
+    "order_id" INTEGER NOT NULL,
+    "line" INTEGER NOT NULL,
+    -- TODO: meta: no SQL type for map[string]string
+    PRIMARY KEY ("order_id", "line")
+);
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m *matcher.Matcher
+			var err error
+			if strings.HasPrefix(tt.source, "package") {
+				m, err = matcher.New(tt.source)
+			} else {
+				m, err = matcher.NewFromFile(filepath.Join("..", "testdata", tt.source))
+			}
+			if err != nil {
+				t.Fatalf("matcher error: %v", err)
+			}
+
+			parser, _ := grammar.NewParser()
+			prog, err := parser.ParseString("test.lift", `
+lift "table" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit sql `+tt.dialect+` { file "schema.sql" }
+}
+`)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			if len(matches) != 1 {
+				t.Fatalf("expected 1 match, got %d", len(matches))
+			}
+			result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+			if got := result.EmittedFiles["schema.sql"]; got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Logf("✓ SQL tables emitted")
+}
+
+func TestMergeSQLTables(t *testing.T) {
+	m, err := matcher.New(`package store
+
+type User struct {
+	ID   int64
+	Name string
+}
+
+type Order struct {
+	ID     int64
+	UserID int64
+}
+`)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "tables" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit sql { file "schema.sql" }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := `CREATE TABLE "user" (
+    "id" BIGINT PRIMARY KEY,
+    "name" TEXT NOT NULL
+);
+
+CREATE TABLE "order" (
+    "id" BIGINT PRIMARY KEY,
+    "user_id" BIGINT NOT NULL
+);
+`
+	if got := result.EmittedFiles["schema.sql"]; got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	t.Logf("✓ tables emitted to one file accumulate")
+}
+
+func TestEmitGraphQL(t *testing.T) {
+	src := `package main
+
+import "time"
+
+type Address struct {
+	Street    string
+	City      string ` + "`json:\"city_name\"`" + `
+	UpdatedAt time.Time
+}
+
+type Customer struct {
+	ID        int64
+	Nickname  *string
+	Tags      []string
+	Addresses []*Address
+	Home      *Address
+	CreatedAt time.Time
+	Scores    *[]float64
+	Meta      map[string]string
+	Secret    string ` + "`json:\"-\"`" + `
+	internal  bool
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "types" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit graphql { file "schema.graphql" }
+}
+
+lift "inputs" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	where { $Name.hasPrefix("Cust") }
+
+	emit graphql input { file "schema.graphql" }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Each block's types accumulate, and the blocks merge into one schema
+	exec := NewFromMatcher(m)
+	var parts []string
+	for _, block := range prog.Blocks {
+		matches, _ := m.MatchBlock(block)
+		matches = matcher.FilterMatches(matches, block.Where)
+		result, err := exec.Execute(block, matches)
+		if err != nil {
+			t.Fatalf("block %q: execute error: %v", block.Name, err)
+		}
+		parts = append(parts, result.EmittedFiles["schema.graphql"])
+	}
+
+	want := `scalar DateTime
+
+type Address {
+  street: String!
+  city_name: String!
+  updatedAt: DateTime!
+}
+
+type Customer {
+  id: Int!
+  nickname: String
+  tags: [String!]!
+  addresses: [Address]!
+  home: Address
+  createdAt: DateTime!
+  scores: [Float!]
+  # TODO: meta: no GraphQL type for map[string]string
+}
+
+input CustomerInput {
+  id: Int!
+  nickname: String
+  tags: [String!]!
+  addresses: [AddressInput]!
+  home: AddressInput
+  createdAt: DateTime!
+  scores: [Float!]
+  # TODO: meta: no GraphQL type for map[string]string
+}
+`
+	if got := MergeGraphQL(parts); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	t.Logf("✓ GraphQL schema emitted")
+}
+
+func TestEmitJSONSchema(t *testing.T) {
+	src := `package api
+
+import "time"
+
+type Base struct {
+	ID int64 ` + "`json:\"id\"`" + `
+}
+
+type User struct {
+	Base
+	Name      string            ` + "`json:\"name\"`" + `
+	Email     string            ` + "`json:\"email,omitempty\"`" + `
+	Nickname  *string           ` + "`json:\"nickname\"`" + `
+	Home      *Address          ` + "`json:\"home,omitempty\"`" + `
+	Addresses []Address         ` + "`json:\"addresses\"`" + `
+	Labels    map[string]string ` + "`json:\"labels,omitempty\"`" + `
+	CreatedAt time.Time         ` + "`json:\"created_at\"`" + `
+	Age       uint8
+	Password  string ` + "`json:\"-\"`" + `
+	secret    string
+}
+
+type Address struct {
+	Street string ` + "`json:\"street\"`" + `
+	Zip    string ` + "`json:\"zip\"`" + `
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "schema" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit json { file "user.schema.json" schema $Name $Fields }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	emitSchema := func() string {
+		matches, _ := m.MatchBlock(prog.Blocks[0])
+		result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+		if err != nil {
+			t.Fatalf("execute error: %v", err)
+		}
+		return result.EmittedFiles["user.schema.json"]
+	}
+
+	got := emitSchema()
+	for i := 0; i < 5; i++ {
+		if again := emitSchema(); again != got {
+			t.Fatalf("schema output is not deterministic:\n%s\nthen:\n%s", got, again)
+		}
+	}
+	for _, want := range []string{
+		`"$schema": "https://json-schema.org/draft/2020-12/schema"`,
+		`"$ref": "#/$defs/User"`,
+		`"required": [
+        "name",
+        "nickname",
+        "addresses",
+        "created_at",
+        "Age"
+      ]`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("schema missing %s:\n%s", want, got)
+		}
+	}
+
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("user.schema.json", strings.NewReader(got)); err != nil {
+		t.Fatalf("add schema: %v", err)
+	}
+	schema, err := compiler.Compile("user.schema.json")
+	if err != nil {
+		t.Fatalf("emitted schema does not compile: %v\n%s", err, got)
+	}
+
+	docs := []struct {
+		name  string
+		doc   string
+		valid bool
+	}{
+		{"valid", `{"id": 7, "name": "Ada", "nickname": null, "Age": 36,
+			"addresses": [{"street": "1 Loop", "zip": "02139"}],
+			"home": {"street": "1 Loop", "zip": "02139"},
+			"labels": {"team": "core"}, "created_at": "2024-05-01T12:00:00Z"}`, true},
+		{"missing required", `{"id": 7, "nickname": "ada", "Age": 36, "addresses": [],
+			"created_at": "2024-05-01T12:00:00Z"}`, false},
+		{"wrong nested type", `{"id": 7, "name": "Ada", "nickname": null, "Age": 36,
+			"addresses": [{"street": 1, "zip": "02139"}], "created_at": "2024-05-01T12:00:00Z"}`, false},
+		{"embedded field type", `{"id": "7", "name": "Ada", "nickname": null, "Age": 36,
+			"addresses": [], "created_at": "2024-05-01T12:00:00Z"}`, false},
+	}
+	for _, tt := range docs {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			if err := json.Unmarshal([]byte(tt.doc), &v); err != nil {
+				t.Fatalf("bad test document: %v", err)
+			}
+			err := schema.Validate(v)
+			if tt.valid && err != nil {
+				t.Errorf("expected valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+
+	t.Logf("✓ JSON Schema emitted and validated")
+}
+
+func TestEmitJSONSchemaDraft07(t *testing.T) {
+	src := `package api
+
+type User struct {
+	ID       int64    ` + "`json:\"id\"`" + `
+	Name     string   ` + "`json:\"name\" validate:\"required\"`" + `
+	Email    string   ` + "`json:\"email,omitempty\" validate:\"required,email\"`" + `
+	Age      int      ` + "`json:\"age,omitempty\"`" + `
+	Score    float64  ` + "`json:\"score,omitempty\"`" + `
+	Active   bool     ` + "`json:\"active\"`" + `
+	Tags     []string ` + "`json:\"tags,omitempty\"`" + `
+	Manager  *User    ` + "`json:\"manager,omitempty\"`" + `
+}
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "schema" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit json { file "user.schema.json" schema $Name $Fields draft "07" }
+}
+
+lift "bad-draft" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit json { file "user.schema.json" schema $Name $Fields draft "04" }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	got := result.EmittedFiles["user.schema.json"]
+
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(got), &doc); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, got)
+	}
+	if doc["$schema"] != "http://json-schema.org/draft-07/schema#" || doc["title"] != "User" || doc["type"] != "object" {
+		t.Errorf("unexpected root:\n%s", got)
+	}
+	if _, ok := doc["properties"].(map[string]any)["email"]; !ok {
+		t.Errorf("expected properties at the root:\n%s", got)
+	}
+	if !strings.Contains(got, `"$ref": "#/definitions/User"`) {
+		t.Errorf("expected the self-reference under definitions:\n%s", got)
+	}
+	required := fmt.Sprint(doc["required"])
+	if required != "[id name email active]" {
+		t.Errorf("expected validate:\"required\" fields to be required, got %s", required)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("user.schema.json", strings.NewReader(got)); err != nil {
+		t.Fatalf("add schema: %v", err)
+	}
+	schema, err := compiler.Compile("user.schema.json")
+	if err != nil {
+		t.Fatalf("emitted schema does not compile: %v\n%s", err, got)
+	}
+	for doc, valid := range map[string]bool{
+		`{"id": 1, "name": "Ada", "email": "ada@example.com", "active": true, "manager": {"id": 2, "name": "Bob", "email": "bob@example.com", "active": false}}`: true,
+		`{"id": 1, "name": "Ada", "active": true}`:                            false,
+		`{"id": 1, "name": "Ada", "email": "a", "active": true, "age": "36"}`: false,
+	} {
+		var v any
+		json.Unmarshal([]byte(doc), &v)
+		if err := schema.Validate(v); (err == nil) != valid {
+			t.Errorf("%s: expected valid=%v, got %v", doc, valid, err)
+		}
+	}
+
+	matches, _ = m.MatchBlock(prog.Blocks[1])
+	if _, err := NewFromMatcher(m).Execute(prog.Blocks[1], matches); err == nil || !strings.Contains(err.Error(), `unknown JSON Schema draft "04"`) {
+		t.Errorf("expected an unknown draft error, got %v", err)
+	}
+
+	t.Logf("✓ Draft-07 JSON Schema emitted and validated")
+}
+
+func TestJSONSchemaTransforms(t *testing.T) {
+	for in, want := range map[string]string{
+		"string":         `{"type":"string"}`,
+		"*int":           `{"type":["integer","null"]}`,
+		"[]time.Time":    `{"items":{"format":"date-time","type":"string"},"type":"array"}`,
+		"map[string]int": `{"additionalProperties":{"type":"integer"},"type":"object"}`,
+		"io.Reader":      `{}`,
+	} {
+		if got := applyTransform(in, "json_schema_type", nil, nil); got != want {
+			t.Errorf("json_schema_type(%s) = %s, want %s", in, got, want)
+		}
+	}
+
+	file, err := goparser.ParseFile(token.NewFileSet(), "x.go", `package p
+type T struct {
+	A    string `+"`json:\"a\" validate:\"required\"`"+`
+	B    string `+"`json:\"b\"`"+`
+	C, D int    `+"`validate:\"min=1,required\"`"+`
+	e    int    `+"`validate:\"required\"`"+`
+}`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := file.Decls[0].(*ast.GenDecl).Specs[0].(*ast.TypeSpec).Type.(*ast.StructType).Fields
+	if got, want := applyTransform("", "json_required", fields, nil), `["a","C","D"]`; got != want {
+		t.Errorf("json_required = %s, want %s", got, want)
+	}
+	if got := applyTransform("", "json_required", []*ast.Field{}, nil); got != "[]" {
+		t.Errorf("json_required of no fields = %s, want []", got)
+	}
+}
+
+func TestEmitIntoRegion(t *testing.T) {
+	src := `package models
+
+type User struct{ Name string }
+
+type Order struct{ Total int }
+`
+
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "stringers" {
+	from go {
+		match TypeSpec { name: $Name }
+	}
+
+	emit go {
+		into "stringers_gen.go"
+		package models
+		code {`+"`"+`func (x ${Name}) String() string { return "${Name}" }`+"`"+`}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+	if len(result.EmittedFiles) != 0 || len(result.Regions) != 1 {
+		t.Fatalf("expected one region and no files, got %d region(s) and files %v",
+			len(result.Regions), result.EmittedFiles)
+	}
+
+	got, err := ReplaceRegion("", result.Regions[0])
+	if err != nil {
+		t.Fatalf("replace error: %v", err)
+	}
+	want := `package models
+
+// stencil:begin stringers
+func (x User) String() string { return "User" }
+
+func (x Order) String() string { return "Order" }
+// stencil:end stringers
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	t.Logf("✓ Emit into collects a region")
+}
+
+func TestReplaceRegion(t *testing.T) {
+	region := Region{File: "gen.go", Block: "b", Target: "go", Content: "func New() {}\n"}
+
+	tests := []struct {
+		name string
+		src  string
+		want string
+		err  string
+	}{
+		{
+			name: "appends markers",
+			src:  "package p\n\n// kept\nvar x = 1\n",
+			want: "package p\n\n// kept\nvar x = 1\n\n// stencil:begin b\nfunc New() {}\n// stencil:end b\n",
+		},
+		{
+			name: "replaces only the region",
+			src:  "package p\n\n// stencil:begin a\nvar a = 1\n// stencil:end a\n\n\t// stencil:begin b\nfunc Old() {}\n\t// stencil:end b\nvar y = 2\n",
+			want: "package p\n\n// stencil:begin a\nvar a = 1\n// stencil:end a\n\n\t// stencil:begin b\nfunc New() {}\n\t// stencil:end b\nvar y = 2\n",
+		},
+		{
+			name: "unchanged region",
+			src:  "package p\n// stencil:begin b\nfunc New() {}\n// stencil:end b\n",
+			want: "package p\n// stencil:begin b\nfunc New() {}\n// stencil:end b\n",
+		},
+		{
+			name: "nested",
+			src:  "// stencil:begin a\n// stencil:begin b\n// stencil:end b\n// stencil:end a\n",
+			err:  "gen.go:2: stencil:begin b inside region a opened on line 1",
+		},
+		{
+			name: "mismatched end",
+			src:  "package p\n// stencil:begin b\n// stencil:end a\n",
+			err:  "gen.go:3: stencil:end a closes region b opened on line 2",
+		},
+		{
+			name: "end without begin",
+			src:  "// stencil:end b\n",
+			err:  "gen.go:1: stencil:end b without stencil:begin",
+		},
+		{
+			name: "unclosed",
+			src:  "package p\n\n// stencil:begin b\n",
+			err:  "gen.go:3: region b is never closed by stencil:end",
+		},
+		{
+			name: "two regions",
+			src:  "// stencil:begin b\n// stencil:end b\n// stencil:begin b\n// stencil:end b\n",
+			err:  "gen.go:3: second region for b (the first begins on line 1)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReplaceRegion(tt.src, region)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tt.want)
+			}
+			if again, _ := ReplaceRegion(got, region); again != got {
+				t.Errorf("second replace changed the file:\n%q", again)
+			}
+		})
+	}
+
+	sql := Region{File: "schema.sql", Block: "tables", Target: "sql", Content: "CREATE TABLE t ();\n"}
+	if got, _ := ReplaceRegion("", sql); got != "-- stencil:begin tables\nCREATE TABLE t ();\n-- stencil:end tables\n" {
+		t.Errorf("sql region: got %q", got)
+	}
+	if _, err := ReplaceRegion("", Region{File: "x.json", Block: "b", Target: "json"}); err == nil {
+		t.Error("expected an error for a json region")
+	}
+
+	t.Logf("✓ Regions replaced in place")
+}
+
+func TestAddImports(t *testing.T) {
+	f, err := goparser.ParseFile(token.NewFileSet(), "", `package p
+
+import (
+	"context"
+	yaml "gopkg.in/yaml.v3"
+)
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports := f.Imports
+
+	tests := []struct {
+		name, src, want string
+	}{
+		{
+			name: "into a parenthesized declaration",
+			src:  "package p\n\nimport (\n\t\"context\"\n)\n\n// stencil:begin b\nvar _ context.Context\n// stencil:end b\n",
+			want: "package p\n\nimport (\n\t\"context\"\n\tyaml \"gopkg.in/yaml.v3\"\n)\n\n// stencil:begin b\nvar _ context.Context\n// stencil:end b\n",
+		},
+		{
+			name: "after a single import",
+			src:  "package p\n\nimport \"fmt\"\n\nvar _ = fmt.Sprint\n",
+			want: "package p\n\nimport \"fmt\"\nimport \"context\"\nimport yaml \"gopkg.in/yaml.v3\"\n\nvar _ = fmt.Sprint\n",
+		},
+		{
+			name: "after the package clause",
+			src:  "package p\n\n// stencil:begin b\n// stencil:end b\n",
+			want: "package p\n\nimport (\n\t\"context\"\n\tyaml \"gopkg.in/yaml.v3\"\n)\n\n// stencil:begin b\n// stencil:end b\n",
+		},
+	}
+	for _, tt := range tests {
+		got, err := AddImports(tt.src, imports)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+
+		// A file with every import is left exactly as it is
+		if again, err := AddImports(got, imports); err != nil || again != got {
+			t.Errorf("%s: expected no change, got %q, %v", tt.name, again, err)
+		}
+	}
+
+	t.Logf("✓ Imports added outside regions")
+}
+
+func TestProtoTypeAndImports(t *testing.T) {
+	types := map[string]string{
+		"int":             "int64",
+		"[]*time.Time":    "repeated google.protobuf.Timestamp",
+		"*time.Duration":  "optional google.protobuf.Duration",
+		"map[int64]bool":  "map<int64, bool>",
+		"map[float64]int": "map[float64]int",
+		"[][]string":      "[][]string",
+		"Address":         "Address",
+	}
+	for in, want := range types {
+		if got := protoTypeTransform(in); got != want {
+			t.Errorf("proto_type(%s) = %q, want %q", in, got, want)
+		}
+	}
+
+	imports := []struct {
+		name, src, want string
+	}{
+		{
+			"after existing import",
+			"syntax = \"proto3\";\nimport \"a.proto\";\nmessage M { google.protobuf.Duration d = 1; }\n",
+			"syntax = \"proto3\";\nimport \"a.proto\";\nimport \"google/protobuf/duration.proto\";\nmessage M { google.protobuf.Duration d = 1; }\n",
+		},
+		{
+			"after syntax",
+			"syntax = \"proto3\";\n\nmessage M { google.protobuf.Timestamp t = 1; }\n",
+			"syntax = \"proto3\";\n\nimport \"google/protobuf/timestamp.proto\";\n\nmessage M { google.protobuf.Timestamp t = 1; }\n",
+		},
+		{
+			"already imported",
+			"import \"google/protobuf/timestamp.proto\";\nmessage M { google.protobuf.Timestamp t = 1; }\n",
+			"import \"google/protobuf/timestamp.proto\";\nmessage M { google.protobuf.Timestamp t = 1; }\n",
+		},
+	}
+	for _, tt := range imports {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addProtoImports(tt.src); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	for in, want := range map[string]string{"ID": "id", "UserID": "user_id", "HTTPServer": "http_server", "Base64Data": "base64_data"} {
+		if got := toSnakeCase(in); got != want {
+			t.Errorf("snake_case(%s) = %q, want %q", in, got, want)
+		}
+	}
+
+	t.Logf("✓ Proto types, imports and names mapped")
+}
+
+func TestPreserveFileHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string // file under ../testdata
+		header string
+	}{
+		{
+			name:   "license and both constraint syntaxes",
+			source: "build_tags.go",
+			header: "// Copyright 2024 The Stencil Authors.\n" +
+				"// Use of this source code is governed by the MIT license.\n\n" +
+				"//go:build linux && amd64\n" +
+				"// +build linux,amd64\n\n" +
+				"// Package client talks to the service.\n",
+		},
+		{
+			// The printer would add //go:build linux and drop the BOM
+			name:   "BOM and legacy constraint only",
+			source: "bom_plus_build.go",
+			header: "\uFEFF// +build linux\n\n",
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "rename" {
+	from go { match FuncDecl { name: $Name } }
+	patch { rename $Name "Get" }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := matcher.NewFromFile(filepath.Join("..", "testdata", tt.source))
+			if err != nil {
+				t.Fatalf("matcher error: %v", err)
+			}
+			if !strings.HasPrefix(string(m.Source()), tt.header) {
+				t.Fatalf("fixture %s doesn't start with the expected header", tt.source)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+			if err != nil {
+				t.Fatalf("execute error: %v", err)
+			}
+
+			want := tt.header + "package client\n\nfunc Get() {}\n"
+			if result.ModifiedSource != want {
+				t.Errorf("expected:\n%q\ngot:\n%q", want, result.ModifiedSource)
+			}
+		})
+	}
+
+	// A header whose constraint went missing can't be repaired
+	orig := "//go:build linux\n\npackage client\n"
+	if _, err := restoreHeader(orig, "package client\n"); err == nil || !strings.Contains(err.Error(), "build constraints") {
+		t.Errorf("expected an error for a lost constraint, got %v", err)
+	}
+
+	t.Logf("✓ File headers and build constraints preserved")
+}
+
+func TestEmitProtoMessage(t *testing.T) {
+	m, err := matcher.NewFromFile(filepath.Join("..", "testdata", "user.go"))
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "messages" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit proto { file "user.proto" package users }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	got := result.EmittedFiles["user.proto"]
+	want := `syntax = "proto3";
+
+package users;
+
+import "google/protobuf/timestamp.proto";
+
+message User {
+  int64 id = 1;
+  string email = 2;
+  string name = 3;
+  optional string nickname = 4;
+  bool admin = 5;
+  bytes avatar = 6;
+  google.protobuf.Timestamp created_at = 7;
+  optional google.protobuf.Timestamp deleted_at = 8;
+  string session = 9;
+}
+`
+	if got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	// Compile the file and check every Go field came through
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{"user.proto": got}),
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), "user.proto")
+	if err != nil {
+		t.Fatalf("emitted proto does not compile: %v", err)
+	}
+	msg := files[0].Messages().ByName("User")
+	if msg == nil {
+		t.Fatalf("no User message in %s", got)
+	}
+
+	fields := []struct {
+		name     protoreflect.Name
+		kind     protoreflect.Kind
+		optional bool
+	}{
+		{"id", protoreflect.Int64Kind, false},
+		{"email", protoreflect.StringKind, false},
+		{"name", protoreflect.StringKind, false},
+		{"nickname", protoreflect.StringKind, true},
+		{"admin", protoreflect.BoolKind, false},
+		{"avatar", protoreflect.BytesKind, false},
+		{"created_at", protoreflect.MessageKind, false},
+		{"deleted_at", protoreflect.MessageKind, true},
+		{"session", protoreflect.StringKind, false},
+	}
+	if n := msg.Fields().Len(); n != len(fields) {
+		t.Fatalf("expected %d fields, got %d", len(fields), n)
+	}
+	for i, want := range fields {
+		f := msg.Fields().Get(i)
+		if f.Name() != want.name || f.Number() != protoreflect.FieldNumber(i+1) ||
+			f.Kind() != want.kind || f.HasOptionalKeyword() != want.optional {
+			t.Errorf("field %d: expected %s %v optional=%v, got %s = %d %v optional=%v",
+				i+1, want.name, want.kind, want.optional, f.Name(), f.Number(), f.Kind(), f.HasOptionalKeyword())
+		}
+	}
+
+	t.Logf("✓ emit proto generates a compilable message")
+}
+
+func TestMergeProtoMessages(t *testing.T) {
+	src := `package api
+
+import "time"
+
+type HTTPRequest struct {
+	URL     string
+	Timeout time.Duration
+}
+
+type userID struct {
+	Value int64
+}
+`
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "messages" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+
+	emit proto { file "api.proto" }
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	result, err := NewFromMatcher(m).Execute(prog.Blocks[0], matches)
+	if err != nil {
+		t.Fatalf("execute error: %v", err)
+	}
+
+	want := `syntax = "proto3";
+
+import "google/protobuf/duration.proto";
+
+message HttpRequest {
+  string url = 1;
+  google.protobuf.Duration timeout = 2;
+}
+
+message UserId {
+  int64 value = 1;
+}
+`
+	if got := result.EmittedFiles["api.proto"]; got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	for in, want := range map[string]string{
+		"User":        "User",
+		"HTTPRequest": "HttpRequest",
+		"userID":      "UserId",
+		"OAuth2Token": "OAuth2Token",
+	} {
+		if got := protoMessageTransform(in); got != want {
+			t.Errorf("proto_message(%s) = %q, want %q", in, got, want)
+		}
+	}
+
+	t.Logf("✓ Generated proto messages merge into one file")
+}
+
+func TestRewriteImports(t *testing.T) {
+	src := `package main
+
+import (
+	"fmt"
+
+	"github.com/old/pkg"
+	"github.com/old/pkg/store"
+	"github.com/old/pkgx"
+	util "github.com/old/util"
+)
+
+func main() { fmt.Println(pkg.X, store.Y, pkgx.Z, util.W) }
+`
+	m, err := matcher.New(src)
+	if err != nil {
+		t.Fatalf("matcher error: %v", err)
+	}
+	n := RewriteImports(m.File(), map[string]string{
+		"github.com/old/pkg":  "github.com/new/pkg",
+		"github.com/old/util": "github.com/new/helpers/v2",
+	})
+	if n != 3 {
+		t.Errorf("expected 3 imports rewritten, got %d", n)
+	}
+
+	got, err := NewFromMatcher(m).Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"github.com/new/pkg"`,
+		`"github.com/new/pkg/store"`,
+		`"github.com/old/pkgx"`,
+		`util "github.com/new/helpers/v2"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %s in:\n%s", want, got)
+		}
+	}
+
+	// A new last element keeps the old name
+	m, _ = matcher.New("package main\n\nimport \"github.com/old/pkg\"\n\nvar _ = pkg.X\n")
+	RewriteImports(m.File(), map[string]string{"github.com/old/pkg": "github.com/new/lib/v3"})
+	if got, _ := NewFromMatcher(m).Source(); !strings.Contains(got, `pkg "github.com/new/lib/v3"`) {
+		t.Errorf("expected the import named pkg, got:\n%s", got)
+	}
+
+	// A name that can't be told from the old path is left alone
+	for _, paths := range [][2]string{
+		{"gopkg.in/yaml.v2", "gopkg.in/yaml.v3"},
+		{"github.com/x/go-bar", "github.com/y/bar"},
+	} {
+		m, _ = matcher.New("package main\n\nimport \"" + paths[0] + "\"\n\nvar _ = x.X\n")
+		RewriteImports(m.File(), map[string]string{paths[0]: paths[1]})
+		got, err := NewFromMatcher(m).Source()
+		if err != nil {
+			t.Fatalf("%s: %v", paths[0], err)
+		}
+		if want := "import \"" + paths[1] + "\"\n"; !strings.Contains(got, want) {
+			t.Errorf("expected %q, got:\n%s", want, got)
+		}
+	}
+
+	t.Logf("✓ Import paths rewritten")
 }
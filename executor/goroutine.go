@@ -0,0 +1,97 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// executeWrapGoroutine replaces the statement holding the bound call with
+// go func() { <stmt> }(). With a wait group, from with_waitgroup or
+// SetWaitGroup, it becomes
+//
+//	wg.Add(1)
+//	go func() {
+//		defer wg.Done()
+//		<stmt>
+//	}()
+func (e *Executor) executeWrapGoroutine(wrap *grammar.WrapGoroutine, bindings matcher.Bindings) error {
+	target, ok := bindings[wrap.Binding]
+	if !ok {
+		return fmt.Errorf("binding $%s not found", wrap.Binding)
+	}
+	node, ok := target.(ast.Node)
+	if !ok {
+		return fmt.Errorf("$%s is not a call", wrap.Binding)
+	}
+
+	list, i := findStmt(e.file, node)
+	if list == nil {
+		return fmt.Errorf("$%s is not a statement in a block", wrap.Binding)
+	}
+	old := (*list)[i]
+
+	body := &ast.BlockStmt{
+		Lbrace: old.Pos(),
+		List:   []ast.Stmt{old},
+		Rbrace: e.nextLine(old.End()),
+	}
+	var before []ast.Stmt
+	if wrap.WaitGroup || e.waitGroup {
+		wg := "wg"
+		if wrap.WGName != nil {
+			wg = *wrap.WGName
+		}
+		pos := old.Pos()
+		add := wgCall(pos, wg, "Add", &ast.BasicLit{ValuePos: pos, Kind: token.INT, Value: "1"})
+		done := &ast.DeferStmt{Defer: pos, Call: wgCall(pos, wg, "Done")}
+		before = append(before, &ast.ExprStmt{X: add})
+		body.List = append([]ast.Stmt{done}, body.List...)
+	}
+
+	goStmt := &ast.GoStmt{
+		Go: old.Pos(),
+		Call: &ast.CallExpr{
+			Fun: &ast.FuncLit{
+				Type: &ast.FuncType{Func: old.Pos(), Params: &ast.FieldList{}},
+				Body: body,
+			},
+		},
+	}
+
+	stmts := append(before, goStmt)
+	*list = append((*list)[:i], append(stmts, (*list)[i+1:]...)...)
+	return nil
+}
+
+// wgCall builds the call wg.<method>(args...) at pos. Generated code
+// placed at the wrapped statement's position keeps comments after it.
+func wgCall(pos token.Pos, wg, method string, args ...ast.Expr) *ast.CallExpr {
+	return &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   &ast.Ident{NamePos: pos, Name: wg},
+			Sel: &ast.Ident{NamePos: pos, Name: method},
+		},
+		Lparen: pos,
+		Args:   args,
+		Rparen: pos,
+	}
+}
+
+// nextLine returns the start of the line after pos. A block whose braces
+// sit on different lines is never printed as a one-liner, so giving a
+// generated block this closing position keeps it multi-line.
+func (e *Executor) nextLine(pos token.Pos) token.Pos {
+	f := e.fset.File(pos)
+	if f == nil {
+		return token.NoPos
+	}
+	line := f.Line(pos)
+	if line >= f.LineCount() {
+		return pos
+	}
+	return f.LineStart(line + 1)
+}
@@ -0,0 +1,198 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// TemplateField is how a field of a bound field list, such as the
+// $Fields... of a struct, appears to a Go template. Name is empty for
+// embedded and unnamed fields; Tag is the unquoted struct tag. For an
+// interface method, Params is its parameter list without parentheses and
+// Results its results as written after them: "error", "(int, error)" or
+// nothing.
+type TemplateField struct {
+	Name    string
+	Type    string
+	Tag     string
+	Params  string
+	Results string
+}
+
+// templateFuncs exposes the ${} transforms to Go templates, e.g.
+// {{.Name | snake_case}} or {{.Body | indent 4}}.
+var templateFuncs = template.FuncMap{
+	"snake_case":       toSnakeCase,
+	"camel_case":       toCamelCase,
+	"lower":            strings.ToLower,
+	"upper":            strings.ToUpper,
+	"indent":           func(n int, s string) string { return indentLines(s, n) },
+	"dedent":           dedentLines,
+	"zero_value":       zeroValueTransform,
+	"proto_type":       protoTypeTransform,
+	"json_schema_type": jsonSchemaTypeTransform,
+	"comment":          commentTransform,
+	"godoc":            godocTransform,
+}
+
+// executeGoTemplate runs a template gotpl body with text/template against
+// the match's bindings. Referring to a binding that doesn't exist is an
+// error unless the emit is lenient. Errors carry the template's position
+// in the .lift file and the line within the template.
+func (e *Executor) executeGoTemplate(emit *grammar.EmitClause, bindings matcher.Bindings) (string, error) {
+	out, err := e.runGoTemplate(emit.File, emit.Template.Text, emit.Lenient, bindings)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", emit.Template.Pos, err)
+	}
+	return out, nil
+}
+
+// executeTemplateFile runs an emit's template_file like a template gotpl
+// body. A relative path is resolved against the template directory.
+func (e *Executor) executeTemplateFile(emit *grammar.EmitClause, bindings matcher.Bindings) (string, error) {
+	path := *emit.TemplateFile
+	if e.templateDir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(e.templateDir, path)
+	}
+
+	text, ok := e.templates[path]
+	if !ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: template_file: %w", emit.Pos, err)
+		}
+		if e.templates == nil {
+			e.templates = make(map[string]string)
+		}
+		text = string(data)
+		e.templates[path] = text
+	}
+
+	return e.runGoTemplate(path, text, emit.Lenient, bindings)
+}
+
+// runGoTemplate executes text with text/template. Each binding is both a
+// key of dot, as in {{.Name}}, and a variable, as in {{$Name}}, which
+// stays reachable inside range and with.
+func (e *Executor) runGoTemplate(name, text string, lenient bool, bindings matcher.Bindings) (string, error) {
+	tpl := template.New(name).Funcs(templateFuncs)
+	if !lenient && !e.lenient {
+		tpl = tpl.Option("missingkey=error")
+	}
+
+	names := make([]string, 0, len(bindings))
+	for binding := range bindings {
+		names = append(names, binding)
+	}
+	sort.Strings(names)
+	var vars strings.Builder
+	for _, binding := range names {
+		fmt.Fprintf(&vars, "{{$%s := .%s}}", binding, binding)
+	}
+
+	tpl, err := tpl.Parse(vars.String() + text)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := tpl.Execute(&out, e.templateData(bindings)); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// templateData converts bindings into plain values for a Go template:
+// identifiers become their names, field lists become []TemplateField,
+// other nodes and lists of nodes become their Go source.
+func (e *Executor) templateData(bindings matcher.Bindings) map[string]any {
+	data := make(map[string]any, len(bindings))
+	for name, v := range bindings {
+		data[name] = e.templateValue(v)
+	}
+	return data
+}
+
+func (e *Executor) templateValue(v any) any {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case *ast.FieldList:
+		if val == nil {
+			return []TemplateField(nil)
+		}
+		return e.templateFields(val.List)
+	case []*ast.Field:
+		return e.templateFields(val)
+	case ast.Node:
+		return e.bindingToString(val)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice {
+		strs := make([]string, rv.Len())
+		for i := range strs {
+			strs[i] = e.bindingToString(rv.Index(i).Interface())
+		}
+		return strs
+	}
+	return v
+}
+
+// templateFields flattens fields so that each name gets its own entry:
+// "A, B int" yields two fields of type int.
+func (e *Executor) templateFields(fields []*ast.Field) []TemplateField {
+	var out []TemplateField
+	for _, f := range fields {
+		typ := e.renderNode(f.Type)
+		var tag string
+		if f.Tag != nil {
+			tag, _ = strconv.Unquote(f.Tag.Value)
+		}
+		var params, results string
+		if ft, ok := f.Type.(*ast.FuncType); ok {
+			params = e.paramList(ft.Params)
+			results = e.paramList(ft.Results)
+			if n := ft.Results.NumFields(); n > 1 || n == 1 && len(ft.Results.List[0].Names) > 0 {
+				results = "(" + results + ")"
+			}
+		}
+		if len(f.Names) == 0 {
+			out = append(out, TemplateField{Type: typ, Tag: tag})
+		}
+		for _, name := range f.Names {
+			out = append(out, TemplateField{Name: name.Name, Type: typ, Tag: tag, Params: params, Results: results})
+		}
+	}
+	return out
+}
+
+// paramList renders a parameter or result list without its parentheses,
+// as in "ctx context.Context, id int64".
+func (e *Executor) paramList(fl *ast.FieldList) string {
+	if fl == nil {
+		return ""
+	}
+	parts := make([]string, len(fl.List))
+	for i, f := range fl.List {
+		parts[i] = e.renderNode(f.Type)
+		if len(f.Names) > 0 {
+			names := make([]string, len(f.Names))
+			for j, name := range f.Names {
+				names[j] = name.Name
+			}
+			parts[i] = strings.Join(names, ", ") + " " + parts[i]
+		}
+	}
+	return strings.Join(parts, ", ")
+}
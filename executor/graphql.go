@@ -0,0 +1,190 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// graphqlScalars maps Go types to GraphQL types. Custom scalars, which the
+// schema must declare, are listed in graphqlCustomScalars.
+var graphqlScalars = map[string]string{
+	"string":    "String",
+	"bool":      "Boolean",
+	"int":       "Int",
+	"int8":      "Int",
+	"int16":     "Int",
+	"int32":     "Int",
+	"int64":     "Int",
+	"uint":      "Int",
+	"uint8":     "Int",
+	"uint16":    "Int",
+	"uint32":    "Int",
+	"byte":      "Int",
+	"rune":      "Int",
+	"float32":   "Float",
+	"float64":   "Float",
+	"time.Time": "DateTime",
+}
+
+var graphqlCustomScalars = map[string]bool{
+	"DateTime": true,
+}
+
+// executeGraphQLEmit generates a GraphQL type, or an input type named
+// <Name>Input, for the struct bound to $Name and $Fields..., for emit
+// graphql without a body. Like encoding/json, it skips unexported fields
+// and names fields by their json tag, else in camelCase.
+func (e *Executor) executeGraphQLEmit(input bool, bindings matcher.Bindings) (string, error) {
+	name, fields, err := e.emitStruct("graphql", bindings, "Name", "Fields")
+	if err != nil {
+		return "", err
+	}
+
+	kind := "type"
+	if input {
+		kind, name = "input", name+"Input"
+	}
+
+	var lines []string
+	scalars := make(map[string]bool)
+	for _, f := range fields {
+		var tag string
+		if f.Tag != nil {
+			s, _ := strconv.Unquote(f.Tag.Value)
+			tag, _, _ = strings.Cut(reflect.StructTag(s).Get("json"), ",")
+		}
+		if tag == "-" {
+			continue
+		}
+
+		typ, ok := graphqlFieldType(f.Type, input)
+		names := f.Names
+		if len(names) == 0 {
+			// Embedded fields have no name to give the GraphQL field
+			names, ok = []*ast.Ident{{Name: exprString(e.fset, f.Type)}}, false
+		}
+		for _, n := range names {
+			if len(f.Names) > 0 && !n.IsExported() {
+				continue
+			}
+			field := tag
+			if field == "" || len(names) > 1 {
+				field = toCamelCase(toSnakeCase(n.Name))
+			}
+			if !ok {
+				lines = append(lines, fmt.Sprintf("# TODO: %s: no GraphQL type for %s",
+					field, exprString(e.fset, f.Type)))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s", field, typ))
+			if base := strings.Trim(typ, "[]!"); graphqlCustomScalars[base] {
+				scalars[base] = true
+			}
+		}
+	}
+
+	var b strings.Builder
+	for _, s := range sortedKeys(scalars) {
+		fmt.Fprintf(&b, "scalar %s\n\n", s)
+	}
+	fmt.Fprintf(&b, "%s %s {\n", kind, name)
+	for _, line := range lines {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// graphqlFieldType maps a Go field type to a GraphQL type. Values are
+// non-null unless they are pointers, and slices are lists of non-null
+// elements unless the elements are pointers. Other exported struct types
+// are referred to by name, with an Input suffix in input types.
+func graphqlFieldType(expr ast.Expr, input bool) (string, bool) {
+	nonNull := "!"
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr, nonNull = star.X, ""
+	}
+
+	if arr, ok := expr.(*ast.ArrayType); ok && arr.Len == nil && goTypeName(arr) != "[]byte" {
+		elem, elemNonNull := arr.Elt, "!"
+		if star, ok := elem.(*ast.StarExpr); ok {
+			elem, elemNonNull = star.X, ""
+		}
+		typ, ok := graphqlNamedType(elem, input)
+		if !ok {
+			return "", false
+		}
+		return "[" + typ + elemNonNull + "]" + nonNull, true
+	}
+
+	typ, ok := graphqlNamedType(expr, input)
+	if !ok {
+		return "", false
+	}
+	return typ + nonNull, true
+}
+
+// graphqlNamedType maps an unlabelled Go type to a GraphQL scalar or
+// object type name.
+func graphqlNamedType(expr ast.Expr, input bool) (string, bool) {
+	if typ, ok := graphqlScalars[goTypeName(expr)]; ok {
+		return typ, true
+	}
+	if ident, ok := expr.(*ast.Ident); ok && token.IsExported(ident.Name) {
+		if input {
+			return ident.Name + "Input", true
+		}
+		return ident.Name, true
+	}
+	return "", false
+}
+
+// MergeGraphQL combines schema documents emitted to the same file into
+// one, declaring each scalar once at the top.
+func MergeGraphQL(contents []string) string {
+	scalars := make(map[string]bool)
+	var defs []string
+	for _, content := range contents {
+		var kept []string
+		for _, line := range strings.Split(content, "\n") {
+			if name, ok := strings.CutPrefix(strings.TrimSpace(line), "scalar "); ok {
+				scalars[strings.TrimSpace(name)] = true
+				continue
+			}
+			kept = append(kept, line)
+		}
+		if def := strings.TrimSpace(strings.Join(kept, "\n")); def != "" {
+			defs = append(defs, def)
+		}
+	}
+
+	var b strings.Builder
+	for _, s := range sortedKeys(scalars) {
+		fmt.Fprintf(&b, "scalar %s\n", s)
+	}
+	if len(scalars) > 0 && len(defs) > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString(strings.Join(defs, "\n\n"))
+	if len(defs) > 0 {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// sortedKeys returns the keys of set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,74 @@
+package executor
+
+import (
+	"fmt"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"slices"
+	"strings"
+)
+
+// byteOrderMark is the UTF-8 BOM some editors put at the start of a file.
+// The Go scanner skips it and the printer never writes it.
+const byteOrderMark = "\uFEFF"
+
+// fileHeader returns src up to its package clause: a BOM, license
+// comments, build constraints and the package doc, with their spacing.
+func fileHeader(src string) (string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	return src[:fset.Position(f.Package).Offset], nil
+}
+
+// RestoreHeader gives src, the file as rewritten after the executor
+// printed it, such as by goimports, the original file's header byte for
+// byte, as Source does.
+func (e *Executor) RestoreHeader(src string) (string, error) {
+	return restoreHeader(e.src, src)
+}
+
+// restoreHeader gives out, the printed form of orig, orig's header byte
+// for byte. The printer drops a BOM, adds a //go:build line above a lone
+// // +build and may respace comments; those are undone. If the header's
+// comments changed in any other way — a build constraint lost or moved
+// into the body — out can't be trusted to build the same way, and that is
+// an error.
+func restoreHeader(orig, out string) (string, error) {
+	want, err := fileHeader(orig)
+	if err != nil {
+		return "", err
+	}
+	got, err := fileHeader(out)
+	if err != nil {
+		return "", err
+	}
+	if got == want {
+		return out, nil
+	}
+
+	wantLines, gotLines := headerComments(want), headerComments(got)
+	if !slices.ContainsFunc(wantLines, constraint.IsGoBuild) {
+		// The printer derives //go:build from // +build lines
+		gotLines = slices.DeleteFunc(gotLines, constraint.IsGoBuild)
+	}
+	if !slices.Equal(gotLines, wantLines) {
+		return "", fmt.Errorf("rewriting changed the file header, so its build constraints may no longer apply:\n%s\nbecame:\n%s",
+			strings.TrimSpace(want), strings.TrimSpace(got))
+	}
+	return want + out[len(got):], nil
+}
+
+// headerComments returns the non-blank lines of a header, trimmed.
+func headerComments(header string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimPrefix(header, byteOrderMark), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,227 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"slices"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// executeExtractInterface declares an interface with the signature of
+// every exported method on the bound type, value or pointer receiver, in
+// the order they appear in the file. It is shorthand for matching the
+// type's methods and emitting an InterfaceType from them. Nothing is added
+// if the type has no exported methods or the name is already declared, so
+// re-running a rule is harmless.
+func (e *Executor) executeExtractInterface(ext *grammar.ExtractInterface, bindings matcher.Bindings) error {
+	target, ok := bindings[ext.Binding]
+	if !ok {
+		return fmt.Errorf("binding $%s not found", ext.Binding)
+	}
+
+	typeName := e.bindingToString(target)
+	if !token.IsIdentifier(typeName) {
+		return fmt.Errorf("$%s is not a type name", ext.Binding)
+	}
+
+	name := e.interpolate(ext.Name, bindings)
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("extract_interface: %q is not a valid interface name", name)
+	}
+	if (e.file.Scope != nil && e.file.Scope.Lookup(name) != nil) || e.declaresType(name) {
+		return nil
+	}
+
+	var methods []string
+	for _, fd := range e.methods(typeName) {
+		if fd.Name.IsExported() {
+			methods = append(methods, signatureTransform(fd, e.fset))
+		}
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+
+	src := fmt.Sprintf("package p\ntype %s interface {\n%s\n}", name, strings.Join(methods, "\n"))
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return fmt.Errorf("extract_interface %s: %w", name, err)
+	}
+
+	decl := f.Decls[0]
+	clearPositions(decl)
+	e.file.Decls = append(e.file.Decls, decl)
+	return nil
+}
+
+// methods returns the file's methods on typeName, with either a value or
+// pointer receiver.
+func (e *Executor) methods(typeName string) []*ast.FuncDecl {
+	var methods []*ast.FuncDecl
+	for _, decl := range e.file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Recv == nil || len(fd.Recv.List) == 0 {
+			continue
+		}
+		recv := fd.Recv.List[0].Type
+		if star, ok := recv.(*ast.StarExpr); ok {
+			recv = star.X
+		}
+		if ident, ok := recv.(*ast.Ident); ok && ident.Name == typeName {
+			methods = append(methods, fd)
+		}
+	}
+	return methods
+}
+
+// declaresType reports whether the file declares a type named name,
+// including one added by an earlier action.
+func (e *Executor) declaresType(name string) bool {
+	for _, decl := range e.file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			if ts, ok := spec.(*ast.TypeSpec); ok && ts.Name.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// executeAddInterfaceCheck appends var _ Iface = (*TypeName)(nil) to the
+// file. An interface given as "path/to/pkg.Name" is written pkg.Name,
+// or under the name the file already imports the package by, and the
+// import is added if the file doesn't have it. The check isn't added
+// twice, so re-running a rule is harmless.
+func (e *Executor) executeAddInterfaceCheck(check *grammar.AddInterfaceCheck, bindings matcher.Bindings) error {
+	target, ok := bindings[check.Binding]
+	if !ok {
+		return fmt.Errorf("binding $%s not found", check.Binding)
+	}
+	typeName := e.bindingToString(target)
+	if !token.IsIdentifier(typeName) {
+		return fmt.Errorf("$%s is not a type name", check.Binding)
+	}
+
+	var iface, importPath string
+	if check.IfaceBinding != nil {
+		v, ok := bindings[*check.IfaceBinding]
+		if !ok {
+			return fmt.Errorf("binding $%s not found", *check.IfaceBinding)
+		}
+		iface = e.bindingToString(v)
+	} else {
+		iface = e.interpolate(*check.Iface, bindings)
+		if i := strings.LastIndex(iface, "."); i > 0 {
+			path, name := iface[:i], iface[i+1:]
+			qual, imported := e.importName(path)
+			if qual == "" {
+				return fmt.Errorf("add_interface_check: the package name of %s can't be told from its path; import it in the file first", path)
+			}
+			if !imported {
+				importPath = path
+			}
+			iface = qual + "." + name
+		}
+	}
+
+	ifaceType, err := parser.ParseExpr(iface)
+	if err != nil || !isTypeName(ifaceType) {
+		return fmt.Errorf("add_interface_check: %q is not an interface type", iface)
+	}
+	if importPath != "" {
+		e.imports[importPath] = true
+	}
+	if e.hasInterfaceCheck(types.ExprString(ifaceType), typeName) {
+		return nil
+	}
+
+	e.file.Decls = append(e.file.Decls, &ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{&ast.ValueSpec{
+			Names: []*ast.Ident{ast.NewIdent("_")},
+			Type:  ifaceType,
+			Values: []ast.Expr{&ast.CallExpr{
+				Fun:  &ast.ParenExpr{X: &ast.StarExpr{X: ast.NewIdent(typeName)}},
+				Args: []ast.Expr{ast.NewIdent("nil")},
+			}},
+		}},
+	})
+	return nil
+}
+
+// isTypeName reports whether x names a type: T or pkg.T, or an
+// instance of a generic one such as T[int].
+func isTypeName(x ast.Expr) bool {
+	switch t := x.(type) {
+	case *ast.Ident:
+		return true
+	case *ast.SelectorExpr:
+		_, ok := t.X.(*ast.Ident)
+		return ok
+	case *ast.IndexExpr:
+		return isTypeName(t.X)
+	case *ast.IndexListExpr:
+		return isTypeName(t.X)
+	}
+	return false
+}
+
+// importName returns the name the file refers to the package at path
+// by: the name of an existing import of it, or else its packageName. A
+// path that is already the name of an import, such as http for
+// net/http, is returned as it is. The name is empty if it can't be told
+// from the path. imported reports whether the file imports the package.
+func (e *Executor) importName(path string) (name string, imported bool) {
+	for _, imp := range e.file.Imports {
+		impPath := strings.Trim(imp.Path.Value, `"`)
+		impName, _ := packageName(impPath)
+		if imp.Name != nil {
+			if imp.Name.Name == "_" || imp.Name.Name == "." {
+				continue
+			}
+			impName = imp.Name.Name
+		}
+		if impPath == path || impName == path {
+			if !token.IsIdentifier(impName) {
+				return "", true
+			}
+			return impName, true
+		}
+	}
+	if name, ok := packageName(path); ok {
+		return name, false
+	}
+	return "", false
+}
+
+// hasInterfaceCheck reports whether the file declares var _ iface with a
+// value of typeName: (*T)(nil), &T{} or T{}.
+func (e *Executor) hasInterfaceCheck(iface, typeName string) bool {
+	values := []string{"(*" + typeName + ")(nil)", "&" + typeName + "{}", typeName + "{}"}
+	for _, decl := range e.file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs, ok := spec.(*ast.ValueSpec)
+			if !ok || vs.Type == nil || len(vs.Names) != 1 || vs.Names[0].Name != "_" || len(vs.Values) != 1 {
+				continue
+			}
+			if types.ExprString(vs.Type) == iface && slices.Contains(values, types.ExprString(vs.Values[0])) {
+				return true
+			}
+		}
+	}
+	return false
+}
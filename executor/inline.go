@@ -0,0 +1,363 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"reflect"
+
+	"golang.org/x/tools/go/ast/astutil"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// executeInlineVar inlines a variable declared in a block and used once
+// after it: the use is replaced by the expression the variable was
+// declared with, and the declaration is removed. The block is the match,
+// if it is a BlockStmt, or else the innermost block around $Var, so a
+// rule can also match the declaration itself.
+//
+// Only x := expr and var x = expr declare a variable that can be
+// inlined. One that is assigned again, has its address taken, is
+// shadowed, or is used more than once or never is left alone, and so is
+// one used where it might run another number of times than once: in a
+// branch or body of an if, switch, select or loop, in a function literal
+// or on the right of && or ||. Unless the use is in the next statement,
+// the statements in between mustn't make calls or write what expr reads,
+// since inlining would change the value expr has when it runs.
+func (e *Executor) executeInlineVar(stmt *grammar.InlineVarStmt, bindings matcher.Bindings) error {
+	target, ok := bindings[stmt.Binding]
+	if !ok {
+		return fmt.Errorf("binding $%s not found", stmt.Binding)
+	}
+	name := e.bindingToString(target)
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("$%s is not a variable", stmt.Binding)
+	}
+
+	block, _ := bindings[matcher.BindMatch].(*ast.BlockStmt)
+	if node, ok := target.(ast.Node); ok && block == nil {
+		path, _ := astutil.PathEnclosingInterval(e.file, node.Pos(), node.End())
+		for _, n := range path {
+			if b, ok := n.(*ast.BlockStmt); ok {
+				block = b
+				break
+			}
+		}
+	}
+	if block == nil {
+		return fmt.Errorf("inline_var $%s: not in a block", stmt.Binding)
+	}
+
+	decl := -1
+	var value ast.Expr
+	for i, s := range block.List {
+		if v, ok := declaredValue(s, name); ok {
+			if decl >= 0 {
+				return nil
+			}
+			decl, value = i, v
+		}
+	}
+	if decl < 0 {
+		return nil
+	}
+
+	rest := block.List[decl+1:]
+	use, ok := singleUse(rest, name)
+	if !ok {
+		return nil
+	}
+	for i, s := range rest {
+		if use.Pos() >= s.Pos() && use.End() <= s.End() {
+			if !unaffected(value, rest[:i]) {
+				return nil
+			}
+			break
+		}
+	}
+
+	// The declaration's extent, before its value moves
+	start, end := block.List[decl].Pos(), block.List[decl].End()
+	first, last := e.fset.Position(start).Line, e.fset.Position(end).Line
+
+	movePositions(value, use.Pos())
+	astutil.Apply(block, nil, func(c *astutil.Cursor) bool {
+		if c.Node() == use {
+			c.Replace(parenthesize(value, c))
+			return false
+		}
+		return true
+	})
+	block.List = append(block.List[:decl], block.List[decl+1:]...)
+
+	// Comments in the declaration, or trailing it, would otherwise be
+	// printed with the next statement
+	var kept []*ast.CommentGroup
+	for _, cg := range e.file.Comments {
+		inside := cg.Pos() >= start && cg.End() <= end
+		trailing := cg.Pos() >= end && e.fset.Position(cg.Pos()).Line == last
+		if !inside && !trailing {
+			kept = append(kept, cg)
+		}
+	}
+	e.file.Comments = kept
+
+	// Folding the declaration's lines into the next one keeps the printer
+	// from leaving a blank line where it was
+	if f := e.fset.File(start); f != nil {
+		for line := first; line <= last && line < f.LineCount(); line++ {
+			f.MergeLine(first)
+		}
+	}
+	return nil
+}
+
+// movePositions places every position set in the subtree rooted at n at
+// pos, so that an expression moved elsewhere prints as if written there.
+func movePositions(n ast.Node, pos token.Pos) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(n, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		v := reflect.ValueOf(n)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return true
+		}
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.Type() == posType && f.CanSet() && f.Int() != 0 {
+				f.SetInt(int64(pos))
+			}
+		}
+		return true
+	})
+}
+
+// declaredValue returns the expression s declares name with, if s is
+// name := expr or var name = expr.
+func declaredValue(s ast.Stmt, name string) (ast.Expr, bool) {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		if s.Tok != token.DEFINE || len(s.Lhs) != 1 || len(s.Rhs) != 1 {
+			return nil, false
+		}
+		if id, ok := s.Lhs[0].(*ast.Ident); ok && id.Name == name {
+			return s.Rhs[0], true
+		}
+	case *ast.DeclStmt:
+		gen, ok := s.Decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR || len(gen.Specs) != 1 {
+			return nil, false
+		}
+		spec := gen.Specs[0].(*ast.ValueSpec)
+		if spec.Type == nil && len(spec.Names) == 1 && len(spec.Values) == 1 && spec.Names[0].Name == name {
+			return spec.Values[0], true
+		}
+	}
+	return nil, false
+}
+
+// singleUse returns the one identifier in stmts that reads name. It
+// reports false if there isn't exactly one, or if name is written,
+// redeclared or has its address taken, or if its use might not run
+// exactly once: in a loop, function literal or branch, or on the right
+// of && or ||.
+func singleUse(stmts []ast.Stmt, name string) (*ast.Ident, bool) {
+	isName := func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		return ok && id.Name == name
+	}
+
+	var uses []*ast.Ident
+	var guarded []ast.Node      // code that may run other than once
+	skip := map[ast.Node]bool{} // field, method and label names
+	safe := true
+	for _, s := range stmts {
+		ast.Inspect(s, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ForStmt, *ast.FuncLit, *ast.SelectStmt:
+				guarded = append(guarded, n)
+			case *ast.IfStmt:
+				guarded = append(guarded, n.Body)
+				if n.Else != nil {
+					guarded = append(guarded, n.Else)
+				}
+			case *ast.SwitchStmt:
+				guarded = append(guarded, n.Body)
+			case *ast.TypeSwitchStmt:
+				guarded = append(guarded, n.Body)
+			case *ast.BinaryExpr:
+				if n.Op == token.LAND || n.Op == token.LOR {
+					guarded = append(guarded, n.Y)
+				}
+			case *ast.RangeStmt:
+				guarded = append(guarded, n)
+				safe = safe && !isName(n.Key) && !isName(n.Value)
+			case *ast.AssignStmt:
+				for _, lhs := range n.Lhs {
+					safe = safe && !isName(lhs)
+				}
+			case *ast.IncDecStmt:
+				safe = safe && !isName(n.X)
+			case *ast.UnaryExpr:
+				safe = safe && !(n.Op == token.AND && isName(n.X))
+			case *ast.ValueSpec:
+				for _, id := range n.Names {
+					safe = safe && !isName(id)
+				}
+			case *ast.Field:
+				for _, id := range n.Names {
+					safe = safe && !isName(id)
+				}
+			case *ast.KeyValueExpr:
+				// A struct field key isn't a use, but without types it
+				// can't be told from a map key that is
+				safe = safe && !isName(n.Key)
+			case *ast.SelectorExpr:
+				skip[n.Sel] = true
+			case *ast.LabeledStmt:
+				skip[n.Label] = true
+			case *ast.BranchStmt:
+				skip[n.Label] = true
+			case *ast.Ident:
+				if n.Name == name && !skip[n] {
+					uses = append(uses, n)
+				}
+			}
+			return true
+		})
+	}
+
+	if !safe || len(uses) != 1 {
+		return nil, false
+	}
+	for _, g := range guarded {
+		if uses[0].Pos() >= g.Pos() && uses[0].End() <= g.End() {
+			return nil, false
+		}
+	}
+	return uses[0], true
+}
+
+// unaffected reports whether running stmts first leaves the value of x
+// alone: they make no calls or channel receives, and write none of the
+// variables x reads, or no variables at all if x makes a call itself.
+func unaffected(x ast.Expr, stmts []ast.Stmt) bool {
+	operands := map[string]bool{}
+	effects := false
+	ast.Inspect(x, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			ast.Inspect(n.X, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					operands[id.Name] = true
+				}
+				return true
+			})
+			return false
+		case *ast.Ident:
+			operands[n.Name] = true
+		case *ast.CallExpr:
+			effects = true
+		case *ast.UnaryExpr:
+			effects = effects || n.Op == token.ARROW
+		}
+		return true
+	})
+
+	writes := func(lhs ast.Expr) bool {
+		root := rootIdent(lhs)
+		return root == nil || effects || operands[root.Name]
+	}
+	ok := true
+	for _, s := range stmts {
+		ast.Inspect(s, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				ok = false
+			case *ast.UnaryExpr:
+				ok = ok && n.Op != token.ARROW && !(n.Op == token.AND && writes(n.X))
+			case *ast.AssignStmt:
+				for _, lhs := range n.Lhs {
+					ok = ok && (n.Tok == token.DEFINE && !operands[identName(lhs)] || !writes(lhs))
+				}
+			case *ast.IncDecStmt:
+				ok = ok && !writes(n.X)
+			case *ast.SendStmt:
+				ok = false
+			}
+			return ok
+		})
+	}
+	return ok
+}
+
+// rootIdent returns the variable an assignment to x writes: a for a, a.f,
+// a[i] or *a. It returns nil if there is none, as for *f() = v.
+func rootIdent(x ast.Expr) *ast.Ident {
+	for {
+		switch e := x.(type) {
+		case *ast.Ident:
+			return e
+		case *ast.SelectorExpr:
+			x = e.X
+		case *ast.IndexExpr:
+			x = e.X
+		case *ast.StarExpr:
+			x = e.X
+		case *ast.ParenExpr:
+			x = e.X
+		default:
+			return nil
+		}
+	}
+}
+
+// identName returns the name of an identifier, or "" for anything else.
+func identName(x ast.Expr) string {
+	if id, ok := x.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// parenthesize wraps an inlined expression in parentheses where the
+// identifier it replaces binds tighter than the expression would.
+func parenthesize(x ast.Expr, c *astutil.Cursor) ast.Expr {
+	var op token.Token
+	switch x := x.(type) {
+	case *ast.BinaryExpr:
+		op = x.Op
+	case *ast.UnaryExpr, *ast.StarExpr:
+	default:
+		return x
+	}
+
+	switch parent := c.Parent().(type) {
+	case *ast.BinaryExpr:
+		// Unary operators bind tighter than any binary one; a right
+		// operand of equal precedence needs them to keep its grouping
+		if op == token.ILLEGAL || op.Precedence() > parent.Op.Precedence() ||
+			(op.Precedence() == parent.Op.Precedence() && c.Name() == "X") {
+			return x
+		}
+	case *ast.UnaryExpr, *ast.StarExpr:
+		if op == token.ILLEGAL {
+			return x
+		}
+	case *ast.SelectorExpr, *ast.IndexExpr, *ast.IndexListExpr, *ast.SliceExpr, *ast.TypeAssertExpr:
+		if c.Name() != "X" {
+			return x
+		}
+	case *ast.CallExpr:
+		if c.Name() != "Fun" {
+			return x
+		}
+	default:
+		return x
+	}
+	return &ast.ParenExpr{X: x}
+}
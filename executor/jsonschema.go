@@ -0,0 +1,321 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// jsonSchemaDrafts are the drafts emit json can write, with their $schema
+// and the keyword shared definitions go under. 2020-12 is the default.
+var jsonSchemaDrafts = map[string]struct{ uri, defs string }{
+	"2020-12": {"https://json-schema.org/draft/2020-12/schema", "$defs"},
+	"07":      {"http://json-schema.org/draft-07/schema#", "definitions"},
+}
+
+// jsonSchemaTypes maps Go types to the JSON Schema their encoding/json
+// output satisfies.
+var jsonSchemaTypes = map[string]map[string]any{
+	"string":        {"type": "string"},
+	"bool":          {"type": "boolean"},
+	"int":           {"type": "integer"},
+	"int8":          {"type": "integer"},
+	"int16":         {"type": "integer"},
+	"int32":         {"type": "integer"},
+	"int64":         {"type": "integer"},
+	"uint":          {"type": "integer", "minimum": 0},
+	"uint8":         {"type": "integer", "minimum": 0},
+	"uint16":        {"type": "integer", "minimum": 0},
+	"uint32":        {"type": "integer", "minimum": 0},
+	"uint64":        {"type": "integer", "minimum": 0},
+	"byte":          {"type": "integer", "minimum": 0},
+	"rune":          {"type": "integer"},
+	"float32":       {"type": "number"},
+	"float64":       {"type": "number"},
+	"[]byte":        {"type": "string", "contentEncoding": "base64"},
+	"time.Time":     {"type": "string", "format": "date-time"},
+	"time.Duration": {"type": "integer"},
+}
+
+// executeJSONSchema generates one JSON Schema document for the structs
+// bound by emit json { schema $Name $Fields } across all matches. The
+// document's root, titled with its name, is the first struct no other one
+// uses. For 2020-12 every struct is defined under $defs, so struct fields
+// can $ref each other, and the root refers to its definition. Draft 07
+// describes the root in place, with the other structs under definitions.
+func (e *Executor) executeJSONSchema(emit *grammar.EmitClause, matches []matcher.Match) (string, error) {
+	if emit.Target != "json" {
+		return "", fmt.Errorf("schema only applies to emit json, not emit %s", emit.Target)
+	}
+	draft := "2020-12"
+	if emit.Schema.Draft != nil {
+		draft = *emit.Schema.Draft
+	}
+	dialect, ok := jsonSchemaDrafts[draft]
+	if !ok {
+		return "", fmt.Errorf("unknown JSON Schema draft %q (want 2020-12 or 07)", draft)
+	}
+
+	type structDef struct {
+		name   string
+		fields []*ast.Field
+	}
+	var structs []structDef
+	known := make(map[string]bool)
+	for _, match := range matches {
+		name, fields, err := e.emitStruct("json", match.Bindings, emit.Schema.Name, emit.Schema.Fields)
+		if err != nil {
+			return "", err
+		}
+		if !known[name] {
+			known[name] = true
+			structs = append(structs, structDef{name, fields})
+		}
+	}
+	if len(structs) == 0 {
+		return "", fmt.Errorf("emit json schema: no structs matched")
+	}
+
+	defs := make(map[string]any)
+	referenced := make(map[string]bool) // by another struct
+	used := make(map[string]bool)       // by any struct, itself included
+	for _, s := range structs {
+		refs := make(map[string]bool)
+		defs[s.name] = jsonObjectSchema(s.fields, known, refs, dialect.defs)
+		for name := range refs {
+			used[name] = true
+			if name != s.name {
+				referenced[name] = true
+			}
+		}
+	}
+
+	root := structs[0]
+	for _, s := range structs {
+		if !referenced[s.name] {
+			root = s
+			break
+		}
+	}
+
+	var doc map[string]any
+	if draft == "07" {
+		doc = jsonObjectSchema(root.fields, known, make(map[string]bool), dialect.defs)
+		if !used[root.name] {
+			delete(defs, root.name)
+		}
+		if len(defs) > 0 {
+			doc["definitions"] = defs
+		}
+	} else {
+		doc = map[string]any{
+			"$ref":  "#/$defs/" + root.name,
+			"$defs": defs,
+		}
+	}
+	doc["$schema"] = dialect.uri
+	doc["title"] = root.name
+
+	// encoding/json sorts map keys, which keeps the output stable
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// jsonTags is what a struct field's tags say about its JSON encoding.
+type jsonTags struct {
+	name      string // from the json tag, if it names the property
+	skip      bool   // json:"-"
+	omitempty bool
+	validated bool // validate:"required"
+}
+
+func readJSONTags(f *ast.Field) jsonTags {
+	var tag reflect.StructTag
+	if f.Tag != nil {
+		s, _ := strconv.Unquote(f.Tag.Value)
+		tag = reflect.StructTag(s)
+	}
+	encoding := tag.Get("json")
+	name, opts, _ := strings.Cut(encoding, ",")
+	tags := jsonTags{name: name, skip: encoding == "-"}
+	for _, opt := range strings.Split(opts, ",") {
+		tags.omitempty = tags.omitempty || opt == "omitempty"
+	}
+	for _, rule := range strings.Split(tag.Get("validate"), ",") {
+		tags.validated = tags.validated || rule == "required"
+	}
+	return tags
+}
+
+// jsonProperties returns the properties encoding/json gives a field:
+// one per exported name, named by the json tag or else the field name.
+// An embedded field has one only if its tag names it.
+func jsonProperties(f *ast.Field, tags jsonTags) []string {
+	if tags.skip {
+		return nil
+	}
+	if len(f.Names) == 0 {
+		if tags.name == "" {
+			return nil
+		}
+		return []string{tags.name}
+	}
+
+	var properties []string
+	for _, n := range f.Names {
+		if !n.IsExported() {
+			continue
+		}
+		if tags.name != "" && len(f.Names) == 1 {
+			properties = append(properties, tags.name)
+		} else {
+			properties = append(properties, n.Name)
+		}
+	}
+	return properties
+}
+
+// jsonObjectSchema describes a struct the way encoding/json encodes it:
+// properties are named by their json tag or else the field name, fields
+// without omitempty or with validate:"required" are required, and
+// unexported and json:"-" fields are left out. An embedded struct that is
+// also in the schema is folded in with allOf. Types in known become $refs
+// into defs and are added to referenced.
+func jsonObjectSchema(fields []*ast.Field, known, referenced map[string]bool, defs string) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+	var embedded []any
+
+	for _, f := range fields {
+		tags := readJSONTags(f)
+		if len(f.Names) == 0 && tags.name == "" && !tags.skip {
+			// Promoted fields, which only a struct we know can describe
+			typ := f.Type
+			if star, ok := typ.(*ast.StarExpr); ok {
+				typ = star.X
+			}
+			if ident, ok := typ.(*ast.Ident); ok && known[ident.Name] {
+				referenced[ident.Name] = true
+				embedded = append(embedded, map[string]any{"$ref": "#/" + defs + "/" + ident.Name})
+			}
+			continue
+		}
+
+		for _, property := range jsonProperties(f, tags) {
+			properties[property] = jsonTypeSchema(f.Type, known, referenced, defs)
+			if !tags.omitempty || tags.validated {
+				required = append(required, property)
+			}
+		}
+	}
+
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if len(embedded) > 0 {
+		schema["allOf"] = embedded
+	}
+	return schema
+}
+
+// jsonTypeSchema maps a Go type to a JSON Schema. Pointers may also be
+// null. Types it can't describe, such as interfaces, accept any value.
+func jsonTypeSchema(expr ast.Expr, known, referenced map[string]bool, defs string) map[string]any {
+	if s, ok := jsonSchemaTypes[goTypeName(expr)]; ok {
+		// Copy, so one document never shares a map between properties
+		schema := make(map[string]any, len(s))
+		for k, v := range s {
+			schema[k] = v
+		}
+		return schema
+	}
+
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		schema := jsonTypeSchema(t.X, known, referenced, defs)
+		if typ, ok := schema["type"].(string); ok {
+			schema["type"] = []string{typ, "null"}
+			return schema
+		}
+		return map[string]any{"anyOf": []any{schema, map[string]any{"type": "null"}}}
+	case *ast.ArrayType:
+		schema := map[string]any{
+			"type":  "array",
+			"items": jsonTypeSchema(t.Elt, known, referenced, defs),
+		}
+		if lit, ok := t.Len.(*ast.BasicLit); ok {
+			if n, err := strconv.Atoi(lit.Value); err == nil {
+				schema["minItems"], schema["maxItems"] = n, n
+			}
+		}
+		return schema
+	case *ast.MapType:
+		if goTypeName(t.Key) == "string" {
+			return map[string]any{
+				"type":                 "object",
+				"additionalProperties": jsonTypeSchema(t.Value, known, referenced, defs),
+			}
+		}
+	case *ast.Ident:
+		if known[t.Name] {
+			referenced[t.Name] = true
+			return map[string]any{"$ref": "#/" + defs + "/" + t.Name}
+		}
+	}
+	return map[string]any{}
+}
+
+// jsonSchemaTypeTransform maps a Go type to its JSON Schema, as compact
+// JSON: ${Type | json_schema_type} gives {"type":"string"} for a string.
+func jsonSchemaTypeTransform(s string) string {
+	expr, err := parser.ParseExpr(s)
+	if err != nil {
+		return s
+	}
+	out, err := json.Marshal(jsonTypeSchema(expr, nil, make(map[string]bool), "$defs"))
+	if err != nil {
+		return s
+	}
+	return string(out)
+}
+
+// jsonRequiredTransform lists the properties of the fields in v tagged
+// validate:"required" as a JSON array, for the required keyword.
+func jsonRequiredTransform(v any) string {
+	var fields []*ast.Field
+	switch val := v.(type) {
+	case *ast.FieldList:
+		if val != nil {
+			fields = val.List
+		}
+	case []*ast.Field:
+		fields = val
+	}
+
+	required := []string{}
+	for _, f := range fields {
+		if tags := readJSONTags(f); tags.validated {
+			required = append(required, jsonProperties(f, tags)...)
+		}
+	}
+	out, _ := json.Marshal(required)
+	return string(out)
+}
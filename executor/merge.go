@@ -0,0 +1,100 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// MergeFiles combines emitted Go files into one. Contents without a
+// package clause are treated as bare declarations. Imports are
+// deduplicated and every other declaration is kept in order, comments
+// included. pkg names the merged package; if empty, the first package
+// clause found is used.
+func MergeFiles(pkg string, contents []string) (string, error) {
+	type importKey struct{ name, path string }
+	seen := make(map[importKey]bool)
+	var imports []importKey
+	var decls []string
+
+	for i, content := range contents {
+		fset := token.NewFileSet()
+		if clause, err := parser.ParseFile(fset, "", content, parser.PackageClauseOnly); err != nil {
+			// Bare declarations: give them a package clause to parse.
+			content = "package p\n\n" + content
+		} else if pkg == "" {
+			pkg = clause.Name.Name
+		}
+
+		file, err := parser.ParseFile(fset, "", content, parser.ParseComments)
+		if err != nil {
+			return "", fmt.Errorf("merge: file %d: %w", i+1, err)
+		}
+
+		for _, spec := range file.Imports {
+			key := importKey{path: spec.Path.Value}
+			if spec.Name != nil {
+				key.name = spec.Name.Name
+			}
+			if !seen[key] {
+				seen[key] = true
+				imports = append(imports, key)
+			}
+		}
+
+		tf := fset.File(file.Pos())
+		for _, decl := range file.Decls {
+			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+				continue
+			}
+			start := decl.Pos()
+			if doc := declDoc(decl); doc != nil {
+				start = doc.Pos()
+			}
+			decls = append(decls, content[tf.Offset(start):tf.Offset(decl.End())])
+		}
+	}
+
+	if pkg == "" {
+		return "", fmt.Errorf("merge: no package name (add package to the merge action)")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "package %s\n", pkg)
+	if len(imports) > 0 {
+		b.WriteString("\nimport (\n")
+		for _, imp := range imports {
+			if imp.name != "" {
+				fmt.Fprintf(&b, "\t%s %s\n", imp.name, imp.path)
+			} else {
+				fmt.Fprintf(&b, "\t%s\n", imp.path)
+			}
+		}
+		b.WriteString(")\n")
+	}
+	for _, decl := range decls {
+		b.WriteString("\n")
+		b.WriteString(decl)
+		b.WriteString("\n")
+	}
+
+	out, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return "", fmt.Errorf("merge: %w", err)
+	}
+	return string(out), nil
+}
+
+// declDoc returns the doc comment of a top-level declaration, if any.
+func declDoc(decl ast.Decl) *ast.CommentGroup {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		return d.Doc
+	case *ast.GenDecl:
+		return d.Doc
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"go/token"
+	"os"
+	"path"
+	"strings"
+)
+
+// Module describes the Go module being rewritten, so generated imports
+// can be resolved against it. See ReadModule.
+type Module struct {
+	Path     string   // module path from the module directive
+	Requires []string // paths of required modules
+}
+
+// ReadModule reads the module path and requirements from a go.mod file.
+func ReadModule(gomod string) (*Module, error) {
+	f, err := os.Open(gomod)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mod := &Module{}
+	inRequire := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case inRequire:
+			if fields[0] == ")" {
+				inRequire = false
+			} else {
+				mod.Requires = append(mod.Requires, unquoteModPath(fields[0]))
+			}
+		case fields[0] == "module" && len(fields) > 1:
+			mod.Path = unquoteModPath(fields[1])
+		case fields[0] == "require" && len(fields) > 1:
+			if fields[1] == "(" {
+				inRequire = true
+			} else {
+				mod.Requires = append(mod.Requires, unquoteModPath(fields[1]))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if mod.Path == "" {
+		return nil, fmt.Errorf("%s: no module directive", gomod)
+	}
+	return mod, nil
+}
+
+func unquoteModPath(s string) string {
+	return strings.Trim(s, "\"`")
+}
+
+// ResolveImport normalizes an import path against the module:
+//
+//   - "./x" and "../x" are taken relative to the module root
+//   - a bare name such as "errors" becomes a required module whose last
+//     element matches it (github.com/pkg/errors), ignoring /vN suffixes
+//
+// Anything else is returned unchanged.
+func (m *Module) ResolveImport(imp string) string {
+	if m == nil {
+		return imp
+	}
+
+	if strings.HasPrefix(imp, "./") || strings.HasPrefix(imp, "../") {
+		return path.Join(m.Path, imp)
+	}
+
+	if strings.ContainsAny(imp, "./") {
+		return imp
+	}
+	for _, req := range m.Requires {
+		if lastElem(req) == imp {
+			return req
+		}
+	}
+	return imp
+}
+
+// packageName returns the name a package is taken to have from its
+// import path, its last element as lastElem finds it. It reports false
+// when that isn't an identifier, as for gopkg.in/yaml.v3 or
+// github.com/x/go-bar, whose names can't be told from the path.
+func packageName(importPath string) (string, bool) {
+	name := lastElem(importPath)
+	return name, token.IsIdentifier(name)
+}
+
+// lastElem returns the last element of a module path, skipping a major
+// version suffix: github.com/foo/bar/v2 → bar.
+func lastElem(modPath string) string {
+	elem := path.Base(modPath)
+	if len(elem) > 1 && elem[0] == 'v' && strings.Trim(elem[1:], "0123456789") == "" {
+		elem = path.Base(path.Dir(modPath))
+	}
+	return elem
+}
@@ -0,0 +1,278 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// protoScalars maps Go types to proto3 types.
+var protoScalars = map[string]string{
+	"string":        "string",
+	"bool":          "bool",
+	"int":           "int64",
+	"int64":         "int64",
+	"int32":         "int32",
+	"int16":         "int32",
+	"int8":          "int32",
+	"uint":          "uint64",
+	"uint64":        "uint64",
+	"uint32":        "uint32",
+	"uint16":        "uint32",
+	"uint8":         "uint32",
+	"byte":          "uint32",
+	"rune":          "int32",
+	"float64":       "double",
+	"float32":       "float",
+	"[]byte":        "bytes",
+	"time.Time":     "google.protobuf.Timestamp",
+	"time.Duration": "google.protobuf.Duration",
+}
+
+// protoImports maps well-known proto types to the file that defines them.
+var protoImports = map[string]string{
+	"google.protobuf.Timestamp": "google/protobuf/timestamp.proto",
+	"google.protobuf.Duration":  "google/protobuf/duration.proto",
+}
+
+// protoFieldsTransform renders a field list as proto3 message fields, one
+// per line: types are mapped, names snake_cased and fields numbered from
+// 1. A field whose type has no proto equivalent becomes a TODO comment
+// that still takes its number, so supporting it later renumbers nothing.
+func protoFieldsTransform(v any, fset *token.FileSet) string {
+	var fields []*ast.Field
+	switch val := v.(type) {
+	case *ast.FieldList:
+		if val != nil {
+			fields = val.List
+		}
+	case []*ast.Field:
+		fields = val
+	default:
+		return ""
+	}
+
+	var lines []string
+	n := 0
+	for _, f := range fields {
+		typ, ok := protoFieldType(f.Type)
+		names := f.Names
+		if len(names) == 0 {
+			// Embedded fields have no name to give the proto field
+			names, ok = []*ast.Ident{{Name: exprString(fset, f.Type)}}, false
+		}
+		for _, name := range names {
+			n++
+			if !ok {
+				lines = append(lines, fmt.Sprintf("// TODO: %s = %d: no proto type for %s",
+					toSnakeCase(name.Name), n, exprString(fset, f.Type)))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s %s = %d;", typ, toSnakeCase(name.Name), n))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// protoMessageTransform converts a Go type name to a proto3 message name:
+// PascalCase, with acronyms capitalized as words as the style guide asks,
+// e.g. HTTPRequest to HttpRequest and userID to UserId.
+func protoMessageTransform(s string) string {
+	words := strings.Split(toSnakeCase(s), "_")
+	for i, w := range words {
+		if r, size := utf8.DecodeRuneInString(w); size > 0 {
+			words[i] = string(unicode.ToUpper(r)) + w[size:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// executeProtoEmit generates a proto3 file with a message for the struct
+// bound to $Name and $Fields..., for emit proto without a body. Fields are
+// mapped and numbered as by proto_fields. Imports for well-known types are
+// added afterwards, as for every proto emit.
+func (e *Executor) executeProtoEmit(pkg *string, bindings matcher.Bindings) (string, error) {
+	name, fields, err := e.emitStruct("proto", bindings, "Name", "Fields")
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("syntax = \"proto3\";\n\n")
+	if pkg != nil {
+		fmt.Fprintf(&b, "package %s;\n\n", *pkg)
+	}
+	fmt.Fprintf(&b, "message %s {\n", protoMessageTransform(name))
+	if body := protoFieldsTransform(fields, e.fset); body != "" {
+		b.WriteString(indentLines(body, 2))
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// MergeProto combines proto files emitted to the same file into one,
+// keeping the first syntax and package statements, each import once, and
+// every message in order.
+func MergeProto(contents []string) string {
+	var syntax, pkg string
+	imports := make(map[string]bool)
+	var defs []string
+	for _, content := range contents {
+		var kept []string
+		for _, line := range strings.Split(content, "\n") {
+			trimmed := strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(trimmed, "syntax "):
+				if syntax == "" {
+					syntax = trimmed
+				}
+			case strings.HasPrefix(trimmed, "package "):
+				if pkg == "" {
+					pkg = trimmed
+				}
+			case strings.HasPrefix(trimmed, "import "):
+				imports[trimmed] = true
+			default:
+				kept = append(kept, line)
+			}
+		}
+		if def := strings.TrimSpace(strings.Join(kept, "\n")); def != "" {
+			defs = append(defs, def)
+		}
+	}
+
+	var sections []string
+	for _, stmt := range []string{syntax, pkg} {
+		if stmt != "" {
+			sections = append(sections, stmt)
+		}
+	}
+	if len(imports) > 0 {
+		sections = append(sections, strings.Join(sortedKeys(imports), "\n"))
+	}
+	sections = append(sections, defs...)
+	return strings.Join(sections, "\n\n") + "\n"
+}
+
+// protoTypeTransform maps a single Go type, given as source, to its proto3
+// field type, e.g. "[]string" to "repeated string". Unmappable types are
+// returned unchanged.
+func protoTypeTransform(s string) string {
+	expr, err := parser.ParseExpr(s)
+	if err != nil {
+		return s
+	}
+	if typ, ok := protoFieldType(expr); ok {
+		return typ
+	}
+	return s
+}
+
+// protoFieldType maps a Go field type to a proto3 field type, including
+// the repeated or optional label.
+func protoFieldType(expr ast.Expr) (string, bool) {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		if typ, ok := protoValueType(t.X); ok {
+			return "optional " + typ, true
+		}
+	case *ast.ArrayType:
+		if t.Len != nil {
+			break
+		}
+		if typ, ok := protoValueType(t); ok {
+			return typ, true // []byte
+		}
+		elem := t.Elt
+		if star, ok := elem.(*ast.StarExpr); ok {
+			elem = star.X
+		}
+		if typ, ok := protoValueType(elem); ok {
+			return "repeated " + typ, true
+		}
+	case *ast.MapType:
+		key, ok := protoValueType(t.Key)
+		if !ok || key == "bytes" || key == "double" || key == "float" || strings.Contains(key, ".") {
+			break
+		}
+		if value, ok := protoValueType(t.Value); ok {
+			return fmt.Sprintf("map<%s, %s>", key, value), true
+		}
+	default:
+		return protoValueType(expr)
+	}
+	return "", false
+}
+
+// protoValueType maps an unlabelled Go type to a proto3 type.
+func protoValueType(expr ast.Expr) (string, bool) {
+	typ, ok := protoScalars[goTypeName(expr)]
+	return typ, ok
+}
+
+// exprString renders an expression as Go source.
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	var b strings.Builder
+	if err := printer.Fprint(&b, fset, expr); err != nil {
+		return fmt.Sprintf("%T", expr)
+	}
+	return b.String()
+}
+
+// addProtoImports adds an import for each well-known type the proto
+// source uses but doesn't import. Imports go after the last existing
+// import, else after the package or syntax statement.
+func addProtoImports(src string) string {
+	var missing []string
+	for typ, file := range protoImports {
+		if strings.Contains(src, typ) && !strings.Contains(src, `"`+file+`"`) {
+			missing = append(missing, file)
+		}
+	}
+	if len(missing) == 0 {
+		return src
+	}
+	sort.Strings(missing)
+
+	var imports strings.Builder
+	for _, file := range missing {
+		fmt.Fprintf(&imports, "import %q;\n", file)
+	}
+
+	lines := strings.SplitAfter(src, "\n")
+	anchor, afterImport := -1, false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "import "):
+			anchor, afterImport = i, true
+		case !afterImport && (strings.HasPrefix(trimmed, "package ") || strings.HasPrefix(trimmed, "syntax ")):
+			anchor = i
+		}
+	}
+
+	if anchor < 0 {
+		return imports.String() + "\n" + src
+	}
+	head := strings.Join(lines[:anchor+1], "")
+	if !strings.HasSuffix(head, "\n") {
+		head += "\n"
+	}
+	if !afterImport {
+		head += "\n"
+	}
+	rest := strings.Join(lines[anchor+1:], "")
+	if !afterImport && !strings.HasPrefix(rest, "\n") {
+		rest = "\n" + rest
+	}
+	return head + imports.String() + rest
+}
@@ -0,0 +1,246 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// Region is the output of an emit into action: the concatenated output
+// for every match, to go between a block's markers in File.
+type Region struct {
+	File    string
+	Block   string
+	Target  string
+	Package string // package clause for a new Go file, if any
+	Content string
+
+	// Imports are the source's imports that Go content refers to, which
+	// AddImports adds to File outside the markers
+	Imports []*ast.ImportSpec
+}
+
+// regionComments maps emit targets to their line comment prefix, which
+// the region markers are written with. JSON has no comments.
+var regionComments = map[string]string{
+	"go":      "//",
+	"proto":   "//",
+	"sql":     "--",
+	"graphql": "#",
+	"yaml":    "#",
+	"toml":    "#",
+}
+
+// CommentPrefix returns the line comment prefix of files an emit target
+// writes, such as "--" for sql. It reports false for json, which has no
+// comments.
+func CommentPrefix(target string) (string, bool) {
+	prefix, ok := regionComments[target]
+	return prefix, ok
+}
+
+// regionMarker is one stencil:begin or stencil:end line.
+type regionMarker struct {
+	line  int // 0-based
+	begin bool
+	block string
+}
+
+// ReplaceRegion returns src with the content between the markers
+//
+//	// stencil:begin <block>
+//	// stencil:end <block>
+//
+// replaced by r.Content, leaving everything outside them untouched. If
+// the markers are absent they are appended, after a package clause when
+// src is empty and r.Package is set. Replacing a region with the content
+// it already has returns src unchanged. Nested, unclosed or unmatched
+// markers are errors naming r.File and the line.
+func ReplaceRegion(src string, r Region) (string, error) {
+	comment, ok := regionComments[r.Target]
+	if !ok {
+		return "", fmt.Errorf("emit %s cannot use into: it has no comments to mark the region", r.Target)
+	}
+
+	lines := strings.SplitAfter(src, "\n")
+	markers, err := regionMarkers(lines, comment, r.File)
+	if err != nil {
+		return "", err
+	}
+
+	body := strings.TrimRight(r.Content, "\n")
+	if body != "" {
+		body += "\n"
+	}
+
+	for i := 0; i+1 < len(markers); i += 2 {
+		begin, end := markers[i], markers[i+1]
+		if begin.block != r.Block {
+			continue
+		}
+		return strings.Join(lines[:begin.line+1], "") + body + strings.Join(lines[end.line:], ""), nil
+	}
+
+	// No region yet: add one at the end
+	var b strings.Builder
+	b.WriteString(src)
+	switch {
+	case src == "" && r.Package != "" && r.Target == "go":
+		fmt.Fprintf(&b, "package %s\n\n", r.Package)
+	case src != "" && !strings.HasSuffix(src, "\n"):
+		b.WriteString("\n\n")
+	case src != "":
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%s stencil:begin %s\n%s%s stencil:end %s\n", comment, r.Block, body, comment, r.Block)
+	return b.String(), nil
+}
+
+// regionMarkers finds the markers in lines, checking that every region is
+// closed, none nest, and no block has two regions. Markers come back in
+// begin/end pairs.
+func regionMarkers(lines []string, comment, file string) ([]regionMarker, error) {
+	var markers []regionMarker
+	var open *regionMarker
+	seen := make(map[string]int)
+
+	for i, line := range lines {
+		text, ok := strings.CutPrefix(strings.TrimSpace(line), comment)
+		if !ok {
+			continue
+		}
+		text = strings.TrimSpace(text)
+		var m regionMarker
+		if block, ok := strings.CutPrefix(text, "stencil:begin "); ok {
+			m = regionMarker{line: i, begin: true, block: strings.TrimSpace(block)}
+		} else if block, ok := strings.CutPrefix(text, "stencil:end "); ok {
+			m = regionMarker{line: i, block: strings.TrimSpace(block)}
+		} else {
+			continue
+		}
+
+		switch {
+		case m.begin && open != nil:
+			return nil, fmt.Errorf("%s:%d: stencil:begin %s inside region %s opened on line %d",
+				file, i+1, m.block, open.block, open.line+1)
+		case m.begin && seen[m.block] > 0:
+			return nil, fmt.Errorf("%s:%d: second region for %s (the first begins on line %d)",
+				file, i+1, m.block, seen[m.block])
+		case m.begin:
+			seen[m.block] = i + 1
+			open = &m
+		case open == nil:
+			return nil, fmt.Errorf("%s:%d: stencil:end %s without stencil:begin", file, i+1, m.block)
+		case open.block != m.block:
+			return nil, fmt.Errorf("%s:%d: stencil:end %s closes region %s opened on line %d",
+				file, i+1, m.block, open.block, open.line+1)
+		default:
+			markers = append(markers, *open, m)
+			open = nil
+		}
+	}
+
+	if open != nil {
+		return nil, fmt.Errorf("%s:%d: region %s is never closed by stencil:end", file, open.line+1, open.block)
+	}
+	return markers, nil
+}
+
+// regionImports returns the imports of the file that content, the output
+// of an emit go into action, refers to by package name. Names the content
+// declares itself, such as a receiver, don't count. Content that doesn't
+// parse as declarations needs none.
+func (e *Executor) regionImports(content string) []*ast.ImportSpec {
+	byName := make(map[string]*ast.ImportSpec)
+	for _, spec := range e.file.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		name, ok := packageName(importPath)
+		if spec.Name != nil {
+			name, ok = spec.Name.Name, spec.Name.Name != "_" && spec.Name.Name != "."
+		}
+		if ok {
+			byName[name] = spec
+		}
+	}
+
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p\n\n"+content, 0)
+	if err != nil {
+		return nil
+	}
+	var imports []*ast.ImportSpec
+	seen := make(map[*ast.ImportSpec]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil {
+				if spec := byName[x.Name]; spec != nil && !seen[spec] {
+					seen[spec] = true
+					imports = append(imports, spec)
+				}
+			}
+		}
+		return true
+	})
+	return imports
+}
+
+// AddImports returns src, a Go file, with those of imports it doesn't
+// have yet added, as a Region's Imports are once it is written. They go
+// at the end of its last import declaration, or in a new one after the
+// package clause; nothing else in src changes.
+func AddImports(src string, imports []*ast.ImportSpec) (string, error) {
+	if len(imports) == 0 {
+		return src, nil
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ImportsOnly)
+	if err != nil {
+		return "", err
+	}
+	have := make(map[string]bool)
+	for _, spec := range f.Imports {
+		have[importSpecText(spec)] = true
+	}
+	var missing []string
+	for _, spec := range imports {
+		if text := importSpecText(spec); !have[text] {
+			have[text] = true
+			missing = append(missing, text)
+		}
+	}
+	if len(missing) == 0 {
+		return src, nil
+	}
+
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+	var last *ast.GenDecl
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			last = gd
+		}
+	}
+	switch {
+	case last != nil && last.Rparen.IsValid():
+		at := offset(last.Rparen)
+		return src[:at] + "\t" + strings.Join(missing, "\n\t") + "\n" + src[at:], nil
+	case last != nil:
+		at := offset(last.End())
+		return src[:at] + "\nimport " + strings.Join(missing, "\nimport ") + src[at:], nil
+	}
+	at := offset(f.Name.End())
+	return src[:at] + "\n\nimport (\n\t" + strings.Join(missing, "\n\t") + "\n)" + src[at:], nil
+}
+
+// importSpecText returns an import spec as written: "context" or
+// yaml "gopkg.in/yaml.v3".
+func importSpecText(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name + " " + spec.Path.Value
+	}
+	return spec.Path.Value
+}
@@ -0,0 +1,51 @@
+package executor
+
+import (
+	"go/ast"
+	"strconv"
+	"strings"
+)
+
+// RewriteImports replaces the import paths of file that rewrites maps
+// from old to new, for moving code to a renamed module. A key also
+// matches the packages beneath it, so github.com/old/pkg=github.com/new/pkg
+// moves github.com/old/pkg/sub too. An import whose package name changes
+// gets the old one as its name, so the file's references still resolve;
+// one whose old name can't be told from its path, such as
+// gopkg.in/yaml.v2, keeps its name as it is. It returns how many imports
+// were rewritten.
+func RewriteImports(file *ast.File, rewrites map[string]string) int {
+	n := 0
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		rewritten, ok := rewriteImport(path, rewrites)
+		if !ok {
+			continue
+		}
+		oldName, ok := packageName(path)
+		if newName, _ := packageName(rewritten); imp.Name == nil && ok && oldName != newName {
+			imp.Name = ast.NewIdent(oldName)
+		}
+		imp.Path.Value = strconv.Quote(rewritten)
+		n++
+	}
+	return n
+}
+
+// rewriteImport returns the path rewrites moves path to, using the
+// longest old path that is path or a parent of it.
+func rewriteImport(path string, rewrites map[string]string) (string, bool) {
+	best := ""
+	for old := range rewrites {
+		if (path == old || strings.HasPrefix(path, old+"/")) && len(old) > len(best) {
+			best = old
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return rewrites[best] + strings.TrimPrefix(path, best), true
+}
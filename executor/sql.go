@@ -0,0 +1,259 @@
+package executor
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// sqlDialect holds what differs between SQL databases: the column type
+// for each Go type and how identifiers are quoted.
+type sqlDialect struct {
+	types map[string]string
+	quote string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {
+		quote: `"`,
+		types: map[string]string{
+			"string":        "TEXT",
+			"bool":          "BOOLEAN",
+			"int":           "INTEGER",
+			"int8":          "SMALLINT",
+			"int16":         "SMALLINT",
+			"int32":         "INTEGER",
+			"int64":         "BIGINT",
+			"uint":          "BIGINT",
+			"uint8":         "SMALLINT",
+			"uint16":        "INTEGER",
+			"uint32":        "BIGINT",
+			"uint64":        "NUMERIC(20)",
+			"byte":          "SMALLINT",
+			"rune":          "INTEGER",
+			"float32":       "REAL",
+			"float64":       "DOUBLE PRECISION",
+			"[]byte":        "BYTEA",
+			"time.Time":     "TIMESTAMPTZ",
+			"time.Duration": "BIGINT",
+		},
+	},
+	"mysql": {
+		quote: "`",
+		types: map[string]string{
+			"string":        "VARCHAR(255)",
+			"bool":          "BOOLEAN",
+			"int":           "INT",
+			"int8":          "TINYINT",
+			"int16":         "SMALLINT",
+			"int32":         "INT",
+			"int64":         "BIGINT",
+			"uint":          "BIGINT UNSIGNED",
+			"uint8":         "TINYINT UNSIGNED",
+			"uint16":        "SMALLINT UNSIGNED",
+			"uint32":        "INT UNSIGNED",
+			"uint64":        "BIGINT UNSIGNED",
+			"byte":          "TINYINT UNSIGNED",
+			"rune":          "INT",
+			"float32":       "FLOAT",
+			"float64":       "DOUBLE",
+			"[]byte":        "BLOB",
+			"time.Time":     "DATETIME(6)",
+			"time.Duration": "BIGINT",
+		},
+	},
+	"sqlite": {
+		quote: `"`,
+		types: map[string]string{
+			"string":        "TEXT",
+			"bool":          "BOOLEAN",
+			"int":           "INTEGER",
+			"int8":          "INTEGER",
+			"int16":         "INTEGER",
+			"int32":         "INTEGER",
+			"int64":         "INTEGER",
+			"uint":          "INTEGER",
+			"uint8":         "INTEGER",
+			"uint16":        "INTEGER",
+			"uint32":        "INTEGER",
+			"uint64":        "INTEGER",
+			"byte":          "INTEGER",
+			"rune":          "INTEGER",
+			"float32":       "REAL",
+			"float64":       "REAL",
+			"[]byte":        "BLOB",
+			"time.Time":     "TIMESTAMP",
+			"time.Duration": "INTEGER",
+		},
+	},
+}
+
+// sqlColumn is one column of a generated table.
+type sqlColumn struct {
+	name     string
+	typ      string
+	nullable bool
+	pk       bool
+	todo     string // why the field has no column, if it doesn't
+}
+
+// executeSQLEmit generates CREATE TABLE for the struct bound to $Name
+// and $Fields..., for emit sql without a body.
+func (e *Executor) executeSQLEmit(dialect string, bindings matcher.Bindings) (string, error) {
+	d, ok := sqlDialects[dialect]
+	if !ok {
+		return "", fmt.Errorf("unknown SQL dialect %q", dialect)
+	}
+
+	name, fields, err := e.emitStruct("sql", bindings, "Name", "Fields")
+	if err != nil {
+		return "", err
+	}
+
+	return createTable(d, toSnakeCase(name), sqlColumns(d, fields, e.fset)), nil
+}
+
+// MergeSQL combines CREATE TABLE statements emitted to the same file into
+// one migration, in order, separated by blank lines.
+func MergeSQL(contents []string) string {
+	var stmts []string
+	for _, content := range contents {
+		if stmt := strings.TrimSpace(content); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	if len(stmts) == 0 {
+		return ""
+	}
+	return strings.Join(stmts, "\n\n") + "\n"
+}
+
+// sqlColumns maps struct fields to columns. Names are snake_cased unless
+// a db tag names the column, and db:"-" skips the field. Pointers are
+// nullable. The primary key is the fields tagged db:"...,pk", or else
+// the field named ID.
+func sqlColumns(d sqlDialect, fields []*ast.Field, fset *token.FileSet) []sqlColumn {
+	var cols []sqlColumn
+	tagged, id := false, -1
+	for _, f := range fields {
+		var tag string
+		if f.Tag != nil {
+			s, _ := strconv.Unquote(f.Tag.Value)
+			tag = reflect.StructTag(s).Get("db")
+		}
+		if tag == "-" {
+			continue
+		}
+		column, opts, _ := strings.Cut(tag, ",")
+		pk := false
+		for _, opt := range strings.Split(opts, ",") {
+			pk = pk || opt == "pk"
+		}
+		tagged = tagged || pk
+
+		typ, nullable := f.Type, false
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ, nullable = star.X, true
+		}
+		sqlType, ok := d.types[goTypeName(typ)]
+
+		names := f.Names
+		if len(names) == 0 {
+			// Embedded fields have no column of their own
+			names, ok = []*ast.Ident{{Name: exprString(fset, f.Type)}}, false
+		}
+		for _, n := range names {
+			col := sqlColumn{name: column, typ: sqlType, nullable: nullable, pk: pk}
+			if col.name == "" || len(names) > 1 {
+				col.name = toSnakeCase(n.Name)
+			}
+			if !ok {
+				col.todo = "no SQL type for " + exprString(fset, f.Type)
+			}
+			if n.Name == "ID" {
+				id = len(cols)
+			}
+			cols = append(cols, col)
+		}
+	}
+
+	// An explicit pk tag replaces the ID default
+	if !tagged && id >= 0 {
+		cols[id].pk = true
+	}
+	return cols
+}
+
+// createTable renders the CREATE TABLE statement. A single key column is
+// marked PRIMARY KEY inline; several get a table constraint. Columns
+// without a SQL type become TODO comments.
+func createTable(d sqlDialect, table string, cols []sqlColumn) string {
+	quote := func(s string) string { return d.quote + s + d.quote }
+
+	var keys []string
+	for _, c := range cols {
+		if c.pk && c.todo == "" {
+			keys = append(keys, quote(c.name))
+		}
+	}
+
+	var defs []string
+	for _, c := range cols {
+		if c.todo != "" {
+			defs = append(defs, fmt.Sprintf("-- TODO: %s: %s", c.name, c.todo))
+			continue
+		}
+		def := quote(c.name) + " " + c.typ
+		switch {
+		case c.pk && len(keys) == 1:
+			def += " PRIMARY KEY"
+		case !c.nullable:
+			def += " NOT NULL"
+		}
+		defs = append(defs, def)
+	}
+	if len(keys) > 1 {
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(keys, ", ")))
+	}
+
+	// Every definition but the last takes a comma; comments never do
+	last := -1
+	for i, def := range defs {
+		if !strings.HasPrefix(def, "--") {
+			last = i
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE %s (\n", quote(table))
+	for i, def := range defs {
+		if i < last && !strings.HasPrefix(def, "--") {
+			def += ","
+		}
+		fmt.Fprintf(&b, "    %s\n", def)
+	}
+	b.WriteString(");\n")
+	return b.String()
+}
+
+// goTypeName returns the name a type is looked up by in the proto and
+// SQL type maps: "string", "time.Time" or "[]byte".
+func goTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.SelectorExpr:
+		if pkg, ok := t.X.(*ast.Ident); ok {
+			return pkg.Name + "." + t.Sel.Name
+		}
+	case *ast.ArrayType:
+		if elt, ok := t.Elt.(*ast.Ident); ok && t.Len == nil {
+			return "[]" + elt.Name
+		}
+	}
+	return ""
+}
@@ -2,4 +2,17 @@ module github.com/vinodhalaharvi/stencil
 
 go 1.22.2
 
-require github.com/alecthomas/participle/v2 v2.1.4
+require (
+	github.com/alecthomas/participle/v2 v2.1.4
+	github.com/bufbuild/protocompile v0.14.1
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/tools v0.26.0
+	google.golang.org/protobuf v1.34.2
+)
+
+require (
+	golang.org/x/mod v0.21.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+)
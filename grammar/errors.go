@@ -0,0 +1,119 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// ParseError is a syntax error in a .lift file, rendered with the
+// offending source line, a caret under the column and, at known trouble
+// spots, a hint. Unwrap returns the underlying participle error.
+type ParseError struct {
+	Pos     lexer.Position
+	Message string
+	Excerpt string
+	Hint    string
+	err     error
+}
+
+func (e *ParseError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s", e.Pos, e.Message)
+	if e.Excerpt != "" {
+		b.WriteString("\n")
+		b.WriteString(e.Excerpt)
+	}
+	if e.Hint != "" {
+		fmt.Fprintf(&b, "\nhint: %s", e.Hint)
+	}
+	return b.String()
+}
+
+func (e *ParseError) Unwrap() error { return e.err }
+
+// WrapError turns a participle error from parsing source into a
+// *ParseError. Other errors are returned unchanged.
+func WrapError(err error, source string) error {
+	var perr participle.Error
+	if !errors.As(err, &perr) {
+		return err
+	}
+
+	pos := perr.Position()
+	if pos.Offset < 0 || pos.Offset > len(source) {
+		pos.Offset = len(source)
+	}
+
+	return &ParseError{
+		Pos:     pos,
+		Message: perr.Message(),
+		Excerpt: excerpt(source, pos.Offset, pos.Line),
+		Hint:    hint(source[:pos.Offset], source[pos.Offset:]),
+		err:     err,
+	}
+}
+
+// excerpt renders the line containing offset and the line before it,
+// with a caret under offset.
+func excerpt(source string, offset, line int) string {
+	start := strings.LastIndex(source[:offset], "\n") + 1
+	end := strings.IndexByte(source[offset:], '\n')
+	if end < 0 {
+		end = len(source)
+	} else {
+		end += offset
+	}
+
+	width := len(fmt.Sprint(line))
+	var b strings.Builder
+	if start > 0 {
+		prevStart := strings.LastIndex(source[:start-1], "\n") + 1
+		fmt.Fprintf(&b, "%*d | %s\n", width, line-1, source[prevStart:start-1])
+	}
+	fmt.Fprintf(&b, "%*d | %s\n", width, line, source[start:end])
+
+	// Keep tabs so the caret lines up with the text above it
+	var pad strings.Builder
+	for _, r := range source[start:offset] {
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	fmt.Fprintf(&b, "%*s | %s^", width, "", pad.String())
+	return b.String()
+}
+
+var emitTargets = []string{"go", "proto", "sql", "graphql", "json", "yaml", "toml"}
+
+var (
+	liftNameRe   = regexp.MustCompile(`\blift\s*$`)
+	emitTargetRe = regexp.MustCompile(`^emit\s+([\p{L}_][\p{L}\p{Nd}_]*)`)
+	codeBeforeRe = regexp.MustCompile("(?:\\b(?:code|template)\\s*\\{|\\binsert\\s+code\\s*\\{\\s*\\w+(?:\\s*\\$\\w+)?)\\s*$")
+	codeAfterRe  = regexp.MustCompile("^(?:emit\\b[^`{}]*\\{[^`{}]*\\b(?:code|template)|insert\\s+code)\\s*\\{(?:\\s*\\w+(?:\\s*\\$\\w+)?)?\\s*[^\\s`}]")
+)
+
+// hint returns advice for errors at known trouble spots, given the source
+// before and after the error position.
+func hint(before, after string) string {
+	switch {
+	case strings.HasPrefix(after, "`"):
+		return "unterminated raw string: close the code block with a backtick"
+	case liftNameRe.MatchString(before):
+		return `block names are quoted: lift "name" { ... }`
+	case codeBeforeRe.MatchString(before), codeAfterRe.MatchString(after):
+		return "code must be a raw string: wrap it in backticks, e.g. code { `...` }"
+	}
+
+	if m := emitTargetRe.FindStringSubmatch(after); m != nil && !slices.Contains(emitTargets, m[1]) {
+		return fmt.Sprintf("unknown emit target %q (expected one of %s)", m[1], strings.Join(emitTargets, ", "))
+	}
+	return ""
+}
@@ -12,12 +12,18 @@ func TestParseExampleFiles(t *testing.T) {
 		t.Fatalf("failed to build parser: %v", err)
 	}
 
-	examples, err := filepath.Glob("../examples/*.lift")
-	if err != nil {
-		t.Fatalf("failed to glob: %v", err)
-	}
-	if len(examples) == 0 {
-		t.Fatal("no example .lift files found")
+	// The built-in rules are embedded into the binary, so they are checked
+	// alongside the examples
+	var examples []string
+	for _, pattern := range []string{"../examples/*.lift", "../internal/rules/*.lift"} {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatalf("failed to glob: %v", err)
+		}
+		if len(paths) == 0 {
+			t.Fatalf("no .lift files match %s", pattern)
+		}
+		examples = append(examples, paths...)
 	}
 
 	for _, path := range examples {
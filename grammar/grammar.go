@@ -9,23 +9,33 @@
 package grammar
 
 import (
+	"strings"
+	"sync"
+
 	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
 )
 
 // ---------------------------------------------------------------------------
 // Custom lexer — handles "...", multi-char operators, raw strings, comments
+//
+// Quoted strings take Go escape sequences (\", \\, \n, \t, \u1234) and are
+// unquoted once, here, so every String field holds the plain value.
+//
+// Raw strings are `...` or, when the payload itself contains backticks
+// (struct tags, raw string literals), fenced as ```...```. Either way the
+// delimiters are stripped before parsing; see unquoteRaw.
 // ---------------------------------------------------------------------------
 
 var liftLexer = lexer.MustSimple([]lexer.SimpleRule{
 	{Name: "Comment", Pattern: `//[^\n]*`},
-	{Name: "RawString", Pattern: "`[^`]*`"},
-	{Name: "String", Pattern: `"[^"]*"`},
+	{Name: "RawString", Pattern: "```(?s:.*?)```|`[^`]*`"},
+	{Name: "String", Pattern: `"(?:\\.|[^"\\\n])*"`},
 	{Name: "Spread", Pattern: `\.\.\.`},
 	{Name: "Int", Pattern: `[0-9]+`},
 	{Name: "OpMulti", Pattern: `>=|<=|!=|==`},
-	{Name: "Punct", Pattern: `[{}\[\]():=.,<>|*$@!]`},
-	{Name: "Ident", Pattern: `[a-zA-Z_][a-zA-Z0-9_]*`},
+	{Name: "Punct", Pattern: `[{}\[\]():=.,<>|*$@!/]`},
+	{Name: "Ident", Pattern: `[\p{L}_][\p{L}\p{Nd}_]*`},
 	{Name: "Whitespace", Pattern: `[\s]+`},
 })
 
@@ -33,19 +43,39 @@ var liftLexer = lexer.MustSimple([]lexer.SimpleRule{
 // Top-level
 // ---------------------------------------------------------------------------
 
-// Program is the root of a .lift file.
+// Program is the root of a .lift file: an optional version directive,
+// then pattern definitions and lift blocks, in any order.
+//
+// version: "1.0" names the stencil release the file is written for; see
+// Program.CheckVersion.
 type Program struct {
-	Pos    lexer.Position
-	Blocks []*LiftBlock `@@*`
+	Pos      lexer.Position
+	Version  string        `( "version" ":" @String )?`
+	Patterns []*PatternDef `( @@`
+	Blocks   []*LiftBlock  `| @@ )*`
+}
+
+// PatternDef: pattern CtxParam = Field { type: SelectorExpr { ... } }
+// Defines a reusable sub-pattern referenced by name wherever an
+// ASTPattern is accepted. See Program.ResolvePatterns.
+type PatternDef struct {
+	Pos     lexer.Position
+	Name    string      `"pattern" @Ident "="`
+	Pattern *ASTPattern `@@`
 }
 
 // LiftBlock is a named transformation unit.
+// Severity and Message are optional and used when reporting matches as
+// lint violations.
 type LiftBlock struct {
-	Pos     lexer.Position
-	Name    string         `"lift" @String "{"`
-	From    *FromClause    `@@`
-	Where   []*WhereClause `@@*`
-	Actions []*Action      `@@* "}"`
+	Pos      lexer.Position
+	Name     string         `"lift" @String "{"`
+	Severity string         `( "severity" ":" @( "error" | "warning" | "info" ) )?`
+	Message  *string        `( "message" ":" @String )?`
+	Scope    *MatchScope    `( "scope" @@ )?`
+	From     *FromClause    `@@`
+	Where    []*WhereClause `@@*`
+	Actions  []*Action      `@@* "}"`
 }
 
 // ---------------------------------------------------------------------------
@@ -58,12 +88,46 @@ type FromClause struct {
 	Matchers []*MatchStmt `"from" "go" "{" @@* "}"`
 }
 
-// MatchStmt: match TypeSpec { ... } or match CallExpr in $Body { ... }
+// MatchStmt: match TypeSpec { ... }, match CallExpr in $Body { ... }
+// or match CallExpr in func "main" { ... }
+//
+// match FuncDecl / Body / CallExpr { ... } is a path: the fields match the
+// CallExpr, found anywhere in a FuncDecl's Body. See FromClause.Expand.
+//
+// A MatchStmt may instead be an or_match, in which case only Or is set.
 type MatchStmt struct {
 	Pos      lexer.Position
-	NodeType string        `"match" @Ident`
+	Or       *OrMatchStmt  `( @@`
+	NodeType string        `| "match" @Ident`
+	Path     []*PathStep   `@@*`
 	In       *string       `( "in" "$" @Ident )?`
-	Fields   []*FieldMatch `"{" @@* "}"`
+	Scope    *MatchScope   `( "in" @@ )?`
+	Fields   []*FieldMatch `"{" @@* "}" )`
+}
+
+// OrMatchStmt: or_match { match CallExpr { ... } match CallExpr { ... } }
+// matches wherever any of its alternatives does; a node two alternatives
+// both match is reported once. Alternatives can't be paths or or_matches
+// themselves.
+type OrMatchStmt struct {
+	Pos          lexer.Position
+	Alternatives []*MatchStmt `"or_match" "{" @@+ "}"`
+}
+
+// PathStep: / Body / CallExpr — a field of the previous node type and
+// the node type to find anywhere inside it.
+type PathStep struct {
+	Pos      lexer.Position
+	Field    string `"/" @Ident`
+	NodeType string `"/" @Ident`
+}
+
+// MatchScope: func "main" or type "Config" — restricts matching to the
+// named declaration. Used after "in" on a matcher or "scope" on a block.
+type MatchScope struct {
+	Pos  lexer.Position
+	Kind string `@( "func" | "type" )`
+	Name string `@String`
 }
 
 // FieldMatch: name: $Name
@@ -76,20 +140,53 @@ type FieldMatch struct {
 // MatchValue — the recursive heart. This is where arbitrary nesting lives.
 //
 // MatchValue → ASTPattern → FieldMatch → MatchValue → ...
+//
+// nil matches a field that is absent, such as the comm of a select's
+// default case; [] also matches an empty list.
 type MatchValue struct {
 	Pos     lexer.Position
 	Spread  *SpreadBinding `  @@`
 	Binding *SimpleBinding `| @@`
+	Wild    bool           `| @"_":Ident`
+	Nil     bool           `| @"nil":Ident`
 	Pattern *ASTPattern    `| @@`
-	List    []*MatchValue  `| "[" ( @@ ( "," @@ )* )? "]"`
+	Empty   bool           `| @( "[" "]" )`
+	List    []*MatchValue  `| "[" @@ ( "," @@ )* "]"`
+	Tag     *TagPattern    `| @@`
 	Exact   *string        `| @String`
-	Wild    bool           `| @"_"`
 }
 
-// SpreadBinding: $Fields...
-type SpreadBinding struct {
+// TagPattern: tag: { json: "-" db: $Column } matches the keys of a struct
+// tag, read as reflect.StructTag does. Each key's value is a string, a
+// binding, _ for any value, or nil for a key the tag doesn't have.
+type TagPattern struct {
 	Pos  lexer.Position
-	Name string `"$" @Ident Spread`
+	Keys []*TagKey `"{" @@* "}"`
+}
+
+// TagKey: json: "-", or "some.key": $V for a key that isn't an identifier.
+type TagKey struct {
+	Pos   lexer.Position
+	Key   string      `( @Ident | @String ) ":"`
+	Value *MatchValue `@@`
+}
+
+// SpreadBinding: $Fields... or $PublicFields...(exported)
+// The optional filter names a property, as in PropertyPred; only the
+// elements that have it are captured. Bounds such as $Args...(min=1,max=3)
+// limit how many elements, after filtering, the spread accepts.
+type SpreadBinding struct {
+	Pos    lexer.Position
+	Name   string        `"$" @Ident Spread`
+	Filter *string       `( "(" @Ident ")" )?`
+	Bounds *SpreadBounds `@@?`
+}
+
+// SpreadBounds: (min=1,max=3), (min=6) or (max=0)
+type SpreadBounds struct {
+	Pos lexer.Position
+	Min *int `"(" ( "min" "=" @Int ( ","`
+	Max *int `    "max" "=" @Int )? | "max" "=" @Int ) ")"`
 }
 
 // SimpleBinding: $Name (no spread)
@@ -98,12 +195,16 @@ type SimpleBinding struct {
 	Name string `"$" @Ident`
 }
 
-// ASTPattern: StructType { fields: $Fields... }
+// ASTPattern: StructType { fields: $Fields... } or a pattern name (CtxParam)
 // Recurses via FieldMatch → MatchValue → ASTPattern
 type ASTPattern struct {
 	Pos      lexer.Position
-	NodeType string        `@Ident "{"`
-	Fields   []*FieldMatch `@@* "}"`
+	NodeType string        `( @Ident "{"`
+	Fields   []*FieldMatch `  @@* "}"`
+	Ref      string        `| @Ident )`
+
+	// Def is the definition Ref names, linked by Program.ResolvePatterns.
+	Def *ASTPattern `parser:"" json:"-"`
 }
 
 // ---------------------------------------------------------------------------
@@ -116,15 +217,34 @@ type WhereClause struct {
 	Predicates []*Predicate `"where" "{" @@* "}"`
 }
 
-// Predicate — supports negation, contains, len, membership, property check.
-// Ordered carefully for Participle's PEG-style parsing.
+// Predicate — supports negation, and/or groups, contains,
+// not_contains_any, not_preceded_by, count, len, deps, membership,
+// string and property checks. Ordered carefully for Participle's
+// PEG-style parsing.
 type Predicate struct {
-	Pos         lexer.Position
-	Not         *Predicate    `  "not" @@`
-	Contains    *ContainsPred `| "contains" @@`
-	LenCheck    *LenPred      `| "len" @@`
-	MemberCheck *MemberPred   `| @@`
-	PropCheck   *PropertyPred `| @@`
+	Pos            lexer.Position
+	Not            *Predicate          `  "not" @@`
+	Group          *PredGroup          `| @@`
+	Contains       *ContainsPred       `| "contains" @@`
+	NotContainsAny *NotContainsAnyPred `| "not_contains_any" @@`
+	NotPrecededBy  *PrecededByPred     `| "not_preceded_by" @@`
+	CountCheck     *CountPred          `| @@`
+	LenCheck       *LenPred            `| "len" @@`
+	DepsCheck      *DepsPred           `| "deps" @@`
+	EqualCheck     *EqualPred          `| @@`
+	MemberCheck    *MemberPred         `| @@`
+	FieldsNamed    *FieldsNamedPred    `| @@`
+	TagCheck       *TagPred            `| @@`
+	StringCheck    *StringPred         `| @@`
+	PropCheck      *PropertyPred       `| @@`
+}
+
+// PredGroup: or { ... } / and { ... } — nestable boolean composition.
+// Predicates listed directly in a where clause are implicitly ANDed.
+type PredGroup struct {
+	Pos        lexer.Position
+	Op         string       `@( "and" | "or" ) "{"`
+	Predicates []*Predicate `@@* "}"`
 }
 
 // ContainsPred: contains($Body, CallExpr { ... })
@@ -134,6 +254,32 @@ type ContainsPred struct {
 	Pattern *ASTPattern `@@ ")"`
 }
 
+// NotContainsAnyPred: not_contains_any($Body, [CallExpr { ... }, ...])
+// Passes only when none of the patterns occur in the binding.
+type NotContainsAnyPred struct {
+	Pos      lexer.Position
+	Binding  string        `"(" "$" @Ident ","`
+	Patterns []*ASTPattern `"[" @@ ( "," @@ )* "]" ")"`
+}
+
+// PrecededByPred: not_preceded_by(IfStmt { cond: BinaryExpr { x: $Res } })
+// The pattern is looked for in the statements before the match in its
+// block; bindings it shares with the match must refer to the same thing.
+type PrecededByPred struct {
+	Pos     lexer.Position
+	Pattern *ASTPattern `"(" @@ ")"`
+}
+
+// CountPred: count($Body, IfStmt { ... }) >= 3, or written as an
+// attribute of the scope, $Body.count(IfStmt { ... }) >= 3.
+type CountPred struct {
+	Pos     lexer.Position
+	Binding string      `( "count" "(" "$" @Ident "," | "$" @Ident "." "count" "(" )`
+	Pattern *ASTPattern `@@ ")"`
+	Op      string      `@( ">=" | "<=" | "!=" | "==" | ">" | "<" )`
+	Value   int         `@Int`
+}
+
 // LenPred: len($Methods) > 0
 type LenPred struct {
 	Pos     lexer.Position
@@ -142,31 +288,91 @@ type LenPred struct {
 	Value   int    `@Int`
 }
 
-// MemberPred: $CallName in ["Get", "Post"]
+// DepsPred: deps($Body) contains "database/sql" — the node bound to $Body
+// uses something from the package with that import path. Needs type
+// information; see matcher.WithTypeCheck.
+type DepsPred struct {
+	Pos     lexer.Position
+	Binding string `"(" "$" @Ident ")"`
+	Path    string `"contains" @String`
+}
+
+// MemberPred: $CallName in ["Get", "Post"], or $FieldType in $TypeNames
+// to test against the names in another binding, such as the fields of a
+// FieldList or the specs of a type declaration.
 type MemberPred struct {
 	Pos     lexer.Position
-	Binding string   `"$" @Ident "in"`
-	Values  []string `"[" @String ( "," @String )* "]"`
+	Binding string      `"$" @Ident "in"`
+	Values  []string    `( "[" @String ( "," @String )* "]"`
+	Set     *BindingRef `| @@ )`
 }
 
-// PropertyPred: $Name.exported
+// FieldsNamedPred: $Fields.fields_named "ID|UUID" — some field of the
+// struct, field list or spread bound to $Fields has a name matching the
+// regex.
+type FieldsNamedPred struct {
+	Pos     lexer.Position
+	Binding string `"$" @Ident "." "fields_named"`
+	Pattern string `@String`
+}
+
+// TagPred: $Field.hasTag("db"), or $Field.tag("json") == "-" to compare
+// the value of a struct tag key. $Field is a field or its tag.
+type TagPred struct {
+	Pos     lexer.Position
+	Binding string  `"$" @Ident "."`
+	Func    string  `@( "hasTag" | "tag" )`
+	Key     string  `"(" @String ")"`
+	Op      *string `( @( "==" | "!=" )`
+	Value   *string `  @String )?`
+}
+
+// EqualPred: $Alias == "." compares the string form of a binding, and
+// $Doc == nil or $Doc != nil tests whether it holds a missing node, such
+// as the doc comment of an undocumented declaration.
+type EqualPred struct {
+	Pos     lexer.Position
+	Binding string  `"$" @Ident`
+	Op      string  `@( "==" | "!=" )`
+	Nil     bool    `( @"nil"`
+	Value   *string `| @String )`
+}
+
+// StringPred: $FuncName.hasPrefix("Test") or $Name.matches("^New[A-Z]").
+// With .text, as in $Doc.text.matches("(?i)deprecated"), the string is
+// the text of a comment, or of a declaration's doc comment.
+type StringPred struct {
+	Pos      lexer.Position
+	Binding  string `"$" @Ident "."`
+	Text     bool   `@( "text" "." )?`
+	Func     string `@( "hasPrefix" | "hasSuffix" | "matches" )`
+	Argument string `"(" @String ")"`
+}
+
+// PropertyPred: $Name.exported, or $Name.implements "io.Reader" for a
+// property that takes an argument.
+//
+// Any identifier parses as a property; the matcher validates the name so
+// new properties don't require a grammar change.
 type PropertyPred struct {
 	Pos      lexer.Position
-	Binding  string `"$" @Ident`
-	Property string `"." @( "exported" | "pointer" | "slice" | "map" | "builtin" | "error" )`
+	Binding  string  `"$" @Ident`
+	Property string  `"." @Ident`
+	Arg      *string `@String?`
 }
 
 // ---------------------------------------------------------------------------
 // ACTIONS
 // ---------------------------------------------------------------------------
 
-// Action is a sum type: exactly one of patch/delete/insert/emit.
+// Action is a sum type: exactly one of patch/delete/insert/emit/merge.
 type Action struct {
 	Pos    lexer.Position
 	Patch  *PatchClause  `  @@`
 	Delete *DeleteClause `| @@`
 	Insert *InsertClause `| @@`
 	Emit   *EmitClause   `| @@`
+	Merge  *MergeClause  `| @@`
 }
 
 // --- PATCH ---
@@ -177,13 +383,75 @@ type PatchClause struct {
 	Stmts []*PatchStmt `"patch" "{" @@* "}"`
 }
 
-// PatchStmt: one of if/set/rename/retype.
+// PatchStmt: one of if/set/rename/retype/add_method/comment_out/
+// wrap_in_goroutine/extract_interface/inline_var/add_interface_check.
 type PatchStmt struct {
-	Pos    lexer.Position
-	If     *ConditionalPatch `  @@`
-	Set    *SetStmt          `| @@`
-	Rename *RenameStmt       `| @@`
-	Retype *RetypeStmt       `| @@`
+	Pos       lexer.Position
+	If        *ConditionalPatch  `  @@`
+	Set       *SetStmt           `| @@`
+	Rename    *RenameStmt        `| @@`
+	Retype    *RetypeStmt        `| @@`
+	AddMethod *AddMethodStmt     `| @@`
+	Comment   *CommentOutStmt    `| @@`
+	Goroutine *WrapGoroutine     `| @@`
+	Extract   *ExtractInterface  `| @@`
+	InlineVar *InlineVarStmt     `| @@`
+	Check     *AddInterfaceCheck `| @@`
+	Const     *ExtractConstant   `| @@`
+}
+
+// CommentOutStmt: comment_out $OldCall — replaces the statement with its
+// original source wrapped in a block comment.
+type CommentOutStmt struct {
+	Pos     lexer.Position
+	Binding string `"comment_out" "$" @Ident`
+}
+
+// WrapGoroutine: wrap_in_goroutine $Call, optionally with_waitgroup or
+// with_waitgroup(name) to track the goroutine with a sync.WaitGroup
+// (named wg unless given).
+type WrapGoroutine struct {
+	Pos       lexer.Position
+	Binding   string  `"wrap_in_goroutine" "$" @Ident`
+	WaitGroup bool    `( @"with_waitgroup"`
+	WGName    *string `  ( "(" @Ident ")" )? )?`
+}
+
+// InlineVarStmt: inline_var $Var — replaces the one use of a variable
+// with the expression it was declared with, and drops the declaration.
+type InlineVarStmt struct {
+	Pos     lexer.Position
+	Binding string `"inline_var" "$" @Ident`
+}
+
+// ExtractInterface: extract_interface $TypeName "UserStore" — declares an
+// interface of the exported methods on the bound type. The name is
+// interpolated, so "${TypeName}Store" works.
+type ExtractInterface struct {
+	Pos     lexer.Position
+	Binding string `"extract_interface" "$" @Ident`
+	Name    string `@String`
+}
+
+// AddInterfaceCheck: add_interface_check $TypeName "io.Reader" — declares
+// var _ io.Reader = (*TypeName)(nil), so the build fails if the type stops
+// satisfying the interface. The interface is a binding, or a string that
+// is interpolated and may qualify it with an import path, as in
+// "net/http.Handler".
+type AddInterfaceCheck struct {
+	Pos          lexer.Position
+	Binding      string  `"add_interface_check" "$" @Ident`
+	IfaceBinding *string `( "$" @Ident`
+	Iface        *string `| @String )`
+}
+
+// ExtractConstant: extract_constant $MagicNumber "MaxRetries" — declares
+// const MaxRetries = <literal> and refers to it where the bound literal
+// was. The name is interpolated.
+type ExtractConstant struct {
+	Pos     lexer.Position
+	Binding string `"extract_constant" "$" @Ident`
+	Name    string `@String`
 }
 
 // ConditionalPatch: if not contains(...) { set ... }
@@ -214,6 +482,16 @@ type RetypeStmt struct {
 	NewType string `@String`
 }
 
+// AddMethodStmt: add_method *$TypeName "String() string" { `return "..."` }
+// The leading * gives the method a pointer receiver.
+type AddMethodStmt struct {
+	Pos       lexer.Position
+	Pointer   bool   `"add_method" @"*"?`
+	Binding   string `"$" @Ident`
+	Signature string `@String`
+	Body      string `"{" @RawString "}"`
+}
+
 // FieldPath: $Field.type.name
 type FieldPath struct {
 	Pos      lexer.Position
@@ -256,14 +534,45 @@ type InsertPos struct {
 // --- EMIT ---
 
 // EmitClause: emit go { file "x.go" ast { ... } }
+//
+// Interpolation in emitted files is strict: an unresolved ${Var} is an
+// error. emit proto lenient { ... } leaves it in the output instead.
+//
+// emit sql with no body generates CREATE TABLE from $Name and $Fields...;
+// emit sql dialect mysql { ... } picks the database (postgres by default).
+// emit graphql with no body generates a type, or with input an input type.
+// emit json { file "x.json" schema $Name $Fields } generates a JSON Schema.
+//
+// emit go { into "x.go" ... } writes the output for every match between
+// // stencil:begin <block> and // stencil:end <block> markers in x.go,
+// leaving the rest of the file alone.
 type EmitClause struct {
 	Pos      lexer.Position
 	Target   string         `"emit" @( "go" | "proto" | "sql" | "graphql" | "json" | "yaml" | "toml" )`
-	File     string         `"{" "file" @String`
+	Dialect  *string        `( "dialect" @( "postgres" | "mysql" | "sqlite" ) )?`
+	Input    bool           `@"input"?`
+	Lenient  bool           `@"lenient"?`
+	Into     bool           `"{" ( "file" | @"into" )`
+	File     string         `@String`
 	Package  *string        `( "package" @Ident )?`
 	ASTBody  *ASTEmitBlock  `( @@`
 	CodeBody *CodeEmitBlock `| @@`
-	Template *TplEmitBlock  `| @@ )? "}"`
+	Template *TplEmitBlock  `| @@`
+	Schema   *SchemaBlock   `| @@`
+
+	// TemplateFile is a text/template file run like template gotpl,
+	// relative to --template-dir if set
+	TemplateFile *string `| "template_file" @String )? "}"`
+}
+
+// MergeClause: merge go { file "combined.go" package main }
+// Every file of that name emitted by any block is combined into one, with
+// imports deduplicated.
+type MergeClause struct {
+	Pos     lexer.Position
+	Target  string  `"merge" @"go"`
+	File    string  `"{" "file" @String`
+	Package *string `( "package" @Ident )? "}"`
 }
 
 // ASTEmitBlock: ast { GenDecl { ... } }
@@ -276,15 +585,33 @@ type ASTEmitBlock struct {
 type CodeEmitBlock struct {
 	Pos  lexer.Position
 	Text string `"code" "{" @RawString "}"`
+
+	// Nodes is Text split into ${if} sections by Program.ParseTemplates.
+	Nodes []*TemplateNode `parser:"" json:"-"`
+}
+
+// SchemaBlock: schema $Name $Fields — emit json generates a JSON Schema
+// for the struct with that name and fields. draft "07" targets draft-07
+// instead of 2020-12.
+type SchemaBlock struct {
+	Pos    lexer.Position
+	Name   string  `"schema" "$" @Ident`
+	Fields string  `"$" @Ident`
+	Draft  *string `( "draft" @String )?`
 }
 
-// TplEmitBlock: template { `...` }
+// TplEmitBlock: template { `...` } or template gotpl { `...` }, the
+// latter executed with Go's text/template instead of ${} interpolation.
 type TplEmitBlock struct {
-	Pos  lexer.Position
-	Text string `"template" "{" @RawString "}"`
+	Pos    lexer.Position
+	Engine string `"template" @"gotpl"?`
+	Text   string `"{" @RawString "}"`
+
+	// Nodes is Text split into ${if} sections by Program.ParseTemplates.
+	Nodes []*TemplateNode `parser:"" json:"-"`
 }
 
-// CodeBlock for insert code — just raw string
+// CodeBlock for insert code — just raw string, delimiters stripped
 type CodeBlock struct {
 	Pos  lexer.Position
 	Text string `@RawString`
@@ -331,9 +658,16 @@ type ForASTLoop struct {
 // BindingRef: $Name or $m.MethodType or $f.Type | proto_type
 type BindingRef struct {
 	Pos        lexer.Position
-	Name       string   `"$" @Ident`
-	Field      *string  `( "." @Ident )?`
-	Transforms []string `( "|" @Ident )*`
+	Name       string       `"$" @Ident`
+	Field      *string      `( "." @Ident )?`
+	Transforms []*Transform `( "|" @@ )*`
+}
+
+// Transform: snake_case or indent(4)
+type Transform struct {
+	Pos  lexer.Position
+	Name string `@Ident`
+	Arg  *int   `( "(" @Int ")" )?`
 }
 
 // ---------------------------------------------------------------------------
@@ -352,11 +686,41 @@ type Expr struct {
 // Parser constructor
 // ---------------------------------------------------------------------------
 
-// NewParser builds a Participle parser for .lift files.
+// NewParser returns the Participle parser for .lift files. It is built on
+// the first call and shared after that; parsers are safe for concurrent
+// use.
 func NewParser() (*participle.Parser[Program], error) {
-	return participle.Build[Program](
+	return defaultParser()
+}
+
+var defaultParser = sync.OnceValues(func() (*participle.Parser[Program], error) {
+	return participle.Build[Program](parserOptions()...)
+})
+
+// NewParserWithOptions builds a new parser for .lift files with opts
+// applied after the defaults, e.g. participle.UseLookahead(10).
+func NewParserWithOptions(opts ...participle.Option) (*participle.Parser[Program], error) {
+	return participle.Build[Program](append(parserOptions(), opts...)...)
+}
+
+// parserOptions configures every parser built from the .lift grammar.
+func parserOptions() []participle.Option {
+	return []participle.Option{
 		participle.Lexer(liftLexer),
 		participle.UseLookahead(5),
 		participle.Elide("Comment", "Whitespace"),
-	)
+		participle.Unquote("String"),
+		participle.Map(unquoteRaw, "RawString"),
+	}
+}
+
+// unquoteRaw strips the delimiters from a raw string token, so code and
+// template payloads arrive unquoted whichever form was used.
+func unquoteRaw(t lexer.Token) (lexer.Token, error) {
+	delim := "`"
+	if len(t.Value) >= 6 && strings.HasPrefix(t.Value, "```") {
+		delim = "```"
+	}
+	t.Value = strings.TrimSuffix(strings.TrimPrefix(t.Value, delim), delim)
+	return t, nil
 }
@@ -2,8 +2,12 @@ package grammar
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/alecthomas/participle/v2"
 )
 
 func TestBasicStructMatch(t *testing.T) {
@@ -505,3 +509,1308 @@ lift "transform" {
 
 	t.Log("✓ Rename and retype parsed")
 }
+
+func TestTransformWithArgument(t *testing.T) {
+	input := `
+lift "transform-args" {
+	from go {
+		match FuncDecl {
+			name: $Name
+			body: $Body
+		}
+	}
+
+	emit go {
+		file "out.go"
+		ast {
+			FuncDecl {
+				name: $Name | snake_case
+				body: $Body | dedent | indent(4)
+			}
+		}
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("transform.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	fields := prog.Blocks[0].Actions[0].Emit.ASTBody.Body.Fields
+	name := fields[0].Value.Binding
+	if len(name.Transforms) != 1 || name.Transforms[0].Name != "snake_case" || name.Transforms[0].Arg != nil {
+		t.Errorf("expected bare snake_case transform, got %+v", name.Transforms)
+	}
+
+	body := fields[1].Value.Binding
+	if len(body.Transforms) != 2 {
+		t.Fatalf("expected 2 transforms, got %d", len(body.Transforms))
+	}
+	if body.Transforms[0].Name != "dedent" {
+		t.Errorf("expected dedent, got %s", body.Transforms[0].Name)
+	}
+	indent := body.Transforms[1]
+	if indent.Name != "indent" || indent.Arg == nil || *indent.Arg != 4 {
+		t.Errorf("expected indent(4), got %+v", indent)
+	}
+
+	t.Log("✓ Transform with argument parsed")
+}
+
+func TestBlockSeverityAndMessage(t *testing.T) {
+	input := `
+lift "no-panic" {
+	severity: error
+	message: "do not panic in library code"
+
+	from go {
+		match CallExpr {
+			fun: Ident { name: "panic" }
+		}
+	}
+}
+
+lift "no-severity" {
+	from go {
+		match FuncDecl { name: $Name }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("severity.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if prog.Blocks[0].Severity != "error" {
+		t.Errorf("expected severity error, got %q", prog.Blocks[0].Severity)
+	}
+	if msg := prog.Blocks[0].Message; msg == nil || *msg != "do not panic in library code" {
+		t.Errorf("expected message, got %v", msg)
+	}
+	if prog.Blocks[1].Severity != "" {
+		t.Errorf("expected empty severity, got %q", prog.Blocks[1].Severity)
+	}
+	if prog.Blocks[1].Message != nil {
+		t.Errorf("expected no message, got %q", *prog.Blocks[1].Message)
+	}
+
+	if _, err := parser.ParseString("bad.lift", `lift "x" { severity: fatal from go { } }`); err == nil {
+		t.Error("expected unknown severity to fail parsing")
+	}
+
+	t.Log("✓ Block severity and message parsed")
+}
+
+func TestStringPredicates(t *testing.T) {
+	input := `
+lift "naming" {
+	from go {
+		match FuncDecl { name: $FuncName }
+	}
+
+	where {
+		$FuncName.hasPrefix("Test")
+		not $FuncName.hasSuffix("Handler")
+		$FuncName.matches("^New[A-Z]")
+		$FuncName.exported
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("strings.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	preds := prog.Blocks[0].Where[0].Predicates
+	if len(preds) != 4 {
+		t.Fatalf("expected 4 predicates, got %d", len(preds))
+	}
+	if preds[0].StringCheck == nil || preds[0].StringCheck.Func != "hasPrefix" || preds[0].StringCheck.Argument != "Test" {
+		t.Errorf("expected hasPrefix(\"Test\"), got %+v", preds[0].StringCheck)
+	}
+	if preds[1].Not == nil || preds[1].Not.StringCheck == nil || preds[1].Not.StringCheck.Func != "hasSuffix" {
+		t.Error("expected not hasSuffix()")
+	}
+	if preds[2].StringCheck == nil || preds[2].StringCheck.Func != "matches" {
+		t.Error("expected matches()")
+	}
+	if preds[3].PropCheck == nil || preds[3].PropCheck.Property != "exported" {
+		t.Error("expected property check to still parse after string predicates")
+	}
+
+	t.Log("✓ String predicates parsed")
+}
+
+func TestCountPredicate(t *testing.T) {
+	input := `
+lift "too-many-err-checks" {
+	from go {
+		match FuncDecl { body: $Body }
+	}
+
+	where {
+		count($Body, IfStmt {
+			cond: BinaryExpr { op: "!=" rhs: Ident { name: "nil" } }
+		}) >= 3
+		$Body.count(CallExpr { fun: SelectorExpr { sel: Ident { name: "Error" } } }) > 3
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("count.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	count := prog.Blocks[0].Where[0].Predicates[0].CountCheck
+	if count == nil {
+		t.Fatal("expected count predicate")
+	}
+	if count.Binding != "Body" || count.Pattern.NodeType != "IfStmt" || count.Op != ">=" || count.Value != 3 {
+		t.Errorf("unexpected count predicate: %+v", count)
+	}
+
+	// The attribute form parses to the same predicate
+	count = prog.Blocks[0].Where[0].Predicates[1].CountCheck
+	if count == nil {
+		t.Fatal("expected $Body.count to be a count predicate")
+	}
+	if count.Binding != "Body" || count.Pattern.NodeType != "CallExpr" || count.Op != ">" || count.Value != 3 {
+		t.Errorf("unexpected count predicate: %+v", count)
+	}
+
+	t.Log("✓ Count predicate parsed")
+}
+
+func TestPredicateGroups(t *testing.T) {
+	input := `
+lift "composed" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+	}
+
+	where {
+		or {
+			and {
+				$Name.exported
+				not contains($Body, Ident { name: "ctx" })
+			}
+			not and {
+				$Name.exported
+				$Name.hasPrefix("Dial")
+			}
+		}
+		len($Body) >= 0
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("groups.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	preds := prog.Blocks[0].Where[0].Predicates
+	if len(preds) != 2 {
+		t.Fatalf("expected 2 top-level predicates, got %d", len(preds))
+	}
+
+	or := preds[0].Group
+	if or == nil || or.Op != "or" || len(or.Predicates) != 2 {
+		t.Fatalf("expected or group with 2 predicates, got %+v", or)
+	}
+	if and := or.Predicates[0].Group; and == nil || and.Op != "and" || len(and.Predicates) != 2 {
+		t.Errorf("expected nested and group, got %+v", and)
+	}
+	if neg := or.Predicates[1].Not; neg == nil || neg.Group == nil || neg.Group.Op != "and" {
+		t.Error("expected not and { ... }")
+	}
+	if preds[1].LenCheck == nil {
+		t.Error("expected flat len predicate after group")
+	}
+
+	t.Log("✓ Predicate groups parsed")
+}
+
+func TestVersionDirective(t *testing.T) {
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	tests := []struct {
+		version string
+		newer   bool
+		err     string
+	}{
+		{"", false, ""},
+		{"0.3", false, ""},
+		{"0.3.0", false, ""},
+		{"0.2.9", false, ""},
+		{"v0.3.1", true, ""},
+		{"1.0", true, ""},
+		{"1", true, ""},
+		{"1.x", false, `invalid version "1.x"`},
+		{"1.2.3.4", false, "invalid version"},
+		{"01.0", false, "invalid version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			input := `lift "x" { from go { match Ident { } } }`
+			if tt.version != "" {
+				input = fmt.Sprintf("version: %q\n\n%s", tt.version, input)
+			}
+			prog, err := parser.ParseString("version.lift", input)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if prog.Version != tt.version || len(prog.Blocks) != 1 {
+				t.Fatalf("expected version %q and 1 block, got %q and %d", tt.version, prog.Version, len(prog.Blocks))
+			}
+
+			newer, err := prog.CheckVersion("0.3.0")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if newer != tt.newer {
+				t.Errorf("expected newer = %v, got %v", tt.newer, newer)
+			}
+		})
+	}
+
+	t.Log("✓ Version directive parsed and checked")
+}
+
+func TestParseDeps(t *testing.T) {
+	input := `
+lift "mixed-concerns" {
+	from go {
+		match FuncDecl { body: $Body }
+	}
+
+	where {
+		deps($Body) contains "database/sql"
+		deps($Body) contains "net/http"
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("deps.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	preds := prog.Blocks[0].Where[0].Predicates
+	if len(preds) != 2 {
+		t.Fatalf("expected 2 predicates, got %d", len(preds))
+	}
+	for i, want := range []string{"database/sql", "net/http"} {
+		if d := preds[i].DepsCheck; d == nil || d.Binding != "Body" || d.Path != want {
+			t.Errorf("expected deps($Body) contains %q, got %+v", want, d)
+		}
+	}
+
+	t.Log("✓ deps predicate parsed")
+}
+
+func TestParseFieldsNamed(t *testing.T) {
+	input := `
+lift "entities" {
+	from go {
+		match TypeSpec { name: $Name type: StructType { fields: $Fields } }
+	}
+
+	where {
+		$Fields.fields_named "^(ID|UUID)$"
+		$Name.exported
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("fields.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	preds := prog.Blocks[0].Where[0].Predicates
+	if f := preds[0].FieldsNamed; f == nil || f.Binding != "Fields" || f.Pattern != "^(ID|UUID)$" {
+		t.Errorf("expected $Fields.fields_named, got %+v", preds[0])
+	}
+	if preds[1].PropCheck == nil || preds[1].PropCheck.Property != "exported" {
+		t.Errorf("expected $Name.exported to stay a property, got %+v", preds[1])
+	}
+
+	t.Log("✓ fields_named predicate parsed")
+}
+
+func TestParseNotContainsAny(t *testing.T) {
+	input := `
+lift "no-abort" {
+	from go {
+		match FuncDecl { body: $Body }
+	}
+
+	where {
+		not_contains_any($Body, [CallExpr { fun: Ident { name: "panic" } }, CallExpr { fun: Ident { name: "log.Fatal" } }])
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("not_contains_any.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	pred := prog.Blocks[0].Where[0].Predicates[0].NotContainsAny
+	if pred == nil {
+		t.Fatal("expected not_contains_any predicate")
+	}
+	if pred.Binding != "Body" {
+		t.Errorf("expected binding Body, got %s", pred.Binding)
+	}
+	if len(pred.Patterns) != 2 {
+		t.Fatalf("expected 2 patterns, got %d", len(pred.Patterns))
+	}
+
+	t.Log("✓ not_contains_any parsed")
+}
+
+func TestParseMatchScope(t *testing.T) {
+	input := `
+lift "scoped" {
+	scope func "TestMain"
+	from go {
+		match CallExpr in func "main" { fun: $Fn }
+		match Field in type "Config" { names: [$Name] }
+		match CallExpr in $Fn { }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("scope.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	block := prog.Blocks[0]
+	if block.Scope == nil || block.Scope.Kind != "func" || block.Scope.Name != "TestMain" {
+		t.Errorf("expected block scope func \"TestMain\", got %+v", block.Scope)
+	}
+
+	matchers := block.From.Matchers
+	if s := matchers[0].Scope; s == nil || s.Kind != "func" || s.Name != "main" {
+		t.Errorf("expected in func \"main\", got %+v", s)
+	}
+	if s := matchers[1].Scope; s == nil || s.Kind != "type" || s.Name != "Config" {
+		t.Errorf("expected in type \"Config\", got %+v", s)
+	}
+	if matchers[2].Scope != nil || matchers[2].In == nil || *matchers[2].In != "Fn" {
+		t.Error("expected in $Fn binding scope")
+	}
+
+	t.Log("✓ Match scopes parsed")
+}
+
+func TestParseMatchPath(t *testing.T) {
+	input := `
+lift "paths" {
+	from go {
+		match TypeSpec { name: $Name }
+		match FuncDecl / Body / IfStmt / Body / CallExpr in func "main" { fun: $Fn }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("path.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	from := prog.Blocks[0].From
+	path := from.Matchers[1].Path
+	if len(path) != 2 || path[0].Field != "Body" || path[0].NodeType != "IfStmt" || path[1].NodeType != "CallExpr" {
+		t.Fatalf("unexpected path: %+v", path)
+	}
+
+	stmts := from.Expand()
+	var got []string
+	for _, stmt := range stmts {
+		desc := stmt.NodeType
+		if stmt.In != nil {
+			desc += " in $" + *stmt.In
+		}
+		if stmt.Scope != nil {
+			desc += " in " + stmt.Scope.Kind
+		}
+		for _, f := range stmt.Fields {
+			if f.Value.Binding != nil {
+				desc += fmt.Sprintf(" %s:$%s", f.Name, f.Value.Binding.Name)
+			}
+		}
+		got = append(got, desc)
+	}
+	want := []string{
+		"TypeSpec name:$Name",
+		"FuncDecl in func Body:$_path2_1",
+		"IfStmt in $_path2_1 Body:$_path2_2",
+		"CallExpr in $_path2_2 fun:$Fn",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expanded to:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	t.Log("✓ Match paths parsed and expanded")
+}
+
+func TestResolvePatterns(t *testing.T) {
+	input := `
+pattern CtxType = SelectorExpr { x: Ident { name: "context" } sel: Ident { name: "Context" } }
+
+lift "needs-ctx" {
+	from go {
+		match FuncDecl { type: FuncType { params: FieldList { list: [CtxParam] } } body: $Body }
+	}
+
+	where {
+		not contains($Body, CtxType)
+	}
+}
+
+pattern CtxParam = Field { type: CtxType }
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("patterns.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if len(prog.Patterns) != 2 || len(prog.Blocks) != 1 {
+		t.Fatalf("expected 2 patterns and 1 block, got %d and %d", len(prog.Patterns), len(prog.Blocks))
+	}
+
+	if err := prog.ResolvePatterns(); err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+
+	ctxType, ctxParam := prog.Patterns[0].Pattern, prog.Patterns[1].Pattern
+	if ref := ctxParam.Fields[0].Value.Pattern; ref.Ref != "CtxType" || ref.Def != ctxType {
+		t.Errorf("expected CtxParam to reference CtxType, got %+v", ref)
+	}
+
+	contains := prog.Blocks[0].Where[0].Predicates[0].Not.Contains
+	if contains.Pattern.Def != ctxType {
+		t.Error("expected contains() reference to be linked")
+	}
+
+	t.Log("✓ Pattern definitions resolved")
+}
+
+func TestResolvePatternsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "unknown in block",
+			input: `lift "x" { from go { match CallExpr { fun: Missing } } }`,
+			want:  "unknown pattern Missing",
+		},
+		{
+			name:  "unknown in definition",
+			input: `pattern A = CallExpr { fun: Missing }`,
+			want:  "unknown pattern Missing",
+		},
+		{
+			name:  "self cycle",
+			input: `pattern A = ParenExpr { x: A }`,
+			want:  "pattern cycle: A -> A",
+		},
+		{
+			name: "indirect cycle",
+			input: `pattern A = ParenExpr { x: B }
+pattern B = StarExpr { x: A }`,
+			want: "pattern cycle: A -> B -> A",
+		},
+		{
+			name: "duplicate",
+			input: `pattern A = Ident { }
+pattern A = Ident { }`,
+			want: "pattern A already defined",
+		},
+	}
+
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("patterns.lift", tt.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			err = prog.ResolvePatterns()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	t.Log("✓ Pattern resolution errors reported")
+}
+
+func TestParseAddMethod(t *testing.T) {
+	input := "lift \"stringer\" {\n" +
+		"\tfrom go { match TypeSpec { name: $T } }\n" +
+		"\tpatch {\n" +
+		"\t\tadd_method $T \"String() string\" { `return \"x\"` }\n" +
+		"\t\tadd_method *$T \"Reset()\" { `` }\n" +
+		"\t}\n" +
+		"}\n"
+
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("add_method.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	stmts := prog.Blocks[0].Actions[0].Patch.Stmts
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 patch statements, got %d", len(stmts))
+	}
+
+	value, pointer := stmts[0].AddMethod, stmts[1].AddMethod
+	if value == nil || value.Pointer || value.Binding != "T" || value.Signature != "String() string" {
+		t.Errorf("unexpected value-receiver add_method: %+v", value)
+	}
+	if pointer == nil || !pointer.Pointer || pointer.Signature != "Reset()" {
+		t.Errorf("unexpected pointer-receiver add_method: %+v", pointer)
+	}
+
+	t.Log("✓ add_method parsed")
+}
+
+func TestParseExtractInterface(t *testing.T) {
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("extract.lift", `
+lift "stores" {
+	from go { match TypeSpec { name: $T } }
+	patch {
+		extract_interface $T "${T}Store"
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	ext := prog.Blocks[0].Actions[0].Patch.Stmts[0].Extract
+	if ext == nil || ext.Binding != "T" || ext.Name != "${T}Store" {
+		t.Errorf("unexpected extract_interface: %+v", ext)
+	}
+
+	t.Log("✓ extract_interface parsed")
+}
+
+func TestParseAddInterfaceCheck(t *testing.T) {
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("check.lift", `
+lift "checks" {
+	from go { match TypeSpec { name: $T } }
+	patch {
+		add_interface_check $T "net/http.Handler"
+		add_interface_check $T $Iface
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	stmts := prog.Blocks[0].Actions[0].Patch.Stmts
+	if c := stmts[0].Check; c == nil || c.Binding != "T" || c.Iface == nil || *c.Iface != "net/http.Handler" {
+		t.Errorf("unexpected add_interface_check with a string: %+v", c)
+	}
+	if c := stmts[1].Check; c == nil || c.IfaceBinding == nil || *c.IfaceBinding != "Iface" {
+		t.Errorf("unexpected add_interface_check with a binding: %+v", c)
+	}
+
+	t.Log("✓ add_interface_check parsed")
+}
+
+func TestParseMergeAction(t *testing.T) {
+	input := `
+lift "impl" {
+	from go { match TypeSpec { name: $T } }
+	merge go { file "combined.go" package main }
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("merge.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	merge := prog.Blocks[0].Actions[0].Merge
+	if merge == nil {
+		t.Fatal("expected merge action")
+	}
+	if merge.File != "combined.go" || merge.Package == nil || *merge.Package != "main" {
+		t.Errorf("unexpected merge action: %+v", merge)
+	}
+
+	t.Log("✓ merge action parsed")
+}
+
+func TestParseErrorHints(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		excerpt string
+		hint    string
+	}{
+		{
+			name:    "unquoted block name",
+			input:   "lift foo {\n}\n",
+			excerpt: "1 | lift foo {\n  |      ^",
+			hint:    "block names are quoted",
+		},
+		{
+			name:    "unknown emit target",
+			input:   "lift \"x\" {\n\tfrom go { match A { } }\n\temit rust { file \"a\" }\n}\n",
+			excerpt: "2 | \tfrom go { match A { } }\n3 | \temit rust { file \"a\" }\n  | \t^",
+			hint:    `unknown emit target "rust"`,
+		},
+		{
+			name:  "emit code without backticks",
+			input: "lift \"x\" {\n\tfrom go { match A { } }\n\temit go { file \"a\" code { func x() {} } }\n}\n",
+			hint:  "wrap it in backticks",
+		},
+		{
+			name:  "insert code without backticks",
+			input: "lift \"x\" {\n\tfrom go { match A { } }\n\tinsert code { append $B func x() {} }\n}\n",
+			hint:  "wrap it in backticks",
+		},
+		{
+			name:  "unterminated raw string",
+			input: "lift \"x\" {\n\tfrom go { match A { } }\n\temit go { file \"a\" template { `abc }\n}\n",
+			hint:  "unterminated raw string",
+		},
+		{
+			name:  "no hint",
+			input: "lift \"x\" {\n\tfrom go { match A { name: 1 } }\n}\n",
+		},
+	}
+
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, raw := parser.ParseString("bad.lift", tt.input)
+			if raw == nil {
+				t.Fatal("expected a parse error")
+			}
+
+			err := WrapError(raw, tt.input)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected *ParseError, got %T", err)
+			}
+			if errors.Unwrap(err) != raw {
+				t.Error("expected Unwrap to return the participle error")
+			}
+			if !strings.Contains(perr.Excerpt, tt.excerpt) {
+				t.Errorf("expected excerpt containing %q, got:\n%s", tt.excerpt, perr.Excerpt)
+			}
+			if tt.hint == "" && perr.Hint != "" {
+				t.Errorf("expected no hint, got %q", perr.Hint)
+			}
+			if !strings.Contains(perr.Hint, tt.hint) {
+				t.Errorf("expected hint containing %q, got %q", tt.hint, perr.Hint)
+			}
+			if !strings.HasPrefix(err.Error(), "bad.lift:") {
+				t.Errorf("expected error to start with the position, got %q", err.Error())
+			}
+		})
+	}
+
+	if err := WrapError(fmt.Errorf("other"), ""); err.Error() != "other" {
+		t.Errorf("expected non-parse errors unchanged, got %v", err)
+	}
+
+	t.Log("✓ Parse errors carry excerpts and hints")
+}
+
+func TestParseFilteredSpread(t *testing.T) {
+	input := `
+lift "public" {
+	from go {
+		match TypeSpec { type: StructType { fields: $PublicFields...(exported) } }
+		match FuncDecl { type: FuncType { params: $Params... } }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("spread.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	matchers := prog.Blocks[0].From.Matchers
+	filtered := matchers[0].Fields[0].Value.Pattern.Fields[0].Value.Spread
+	if filtered == nil || filtered.Name != "PublicFields" || filtered.Filter == nil || *filtered.Filter != "exported" {
+		t.Errorf("expected $PublicFields...(exported), got %+v", filtered)
+	}
+
+	plain := matchers[1].Fields[0].Value.Pattern.Fields[0].Value.Spread
+	if plain == nil || plain.Filter != nil {
+		t.Errorf("expected unfiltered $Params..., got %+v", plain)
+	}
+
+	t.Log("✓ Filtered spread parsed")
+}
+
+func TestParseSpreadBounds(t *testing.T) {
+	input := `
+lift "bounded" {
+	from go {
+		match CallExpr { args: $Args...(min=1,max=3) }
+		match CallExpr { args: $Args...(max=0) }
+		match TypeSpec { type: StructType { fields: $Fields...(exported)(min=2) } }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("bounds.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	matchers := prog.Blocks[0].From.Matchers
+	both := matchers[0].Fields[0].Value.Spread
+	if both == nil || both.Bounds == nil || both.Bounds.Min == nil || *both.Bounds.Min != 1 || both.Bounds.Max == nil || *both.Bounds.Max != 3 {
+		t.Errorf("expected $Args...(min=1,max=3), got %+v", both)
+	}
+
+	max := matchers[1].Fields[0].Value.Spread
+	if max == nil || max.Bounds == nil || max.Bounds.Min != nil || max.Bounds.Max == nil || *max.Bounds.Max != 0 {
+		t.Errorf("expected $Args...(max=0), got %+v", max)
+	}
+
+	filtered := matchers[2].Fields[0].Value.Pattern.Fields[0].Value.Spread
+	if filtered == nil || filtered.Filter == nil || *filtered.Filter != "exported" || filtered.Bounds == nil || *filtered.Bounds.Min != 2 {
+		t.Errorf("expected $Fields...(exported)(min=2), got %+v", filtered)
+	}
+
+	t.Log("✓ Spread bounds parsed")
+}
+
+func TestParseFencedRawStrings(t *testing.T) {
+	input := "lift \"tags\" {\n" +
+		"\tfrom go { match TypeSpec { name: $T } }\n" +
+		"\temit go {\n" +
+		"\t\tfile \"a.go\"\n" +
+		"\t\ttemplate { ```type ${T}DTO struct {\n\tName string `json:\"name\"`\n}``` }\n" +
+		"\t}\n" +
+		"\temit go {\n" +
+		"\t\tfile \"b.go\"\n" +
+		"\t\tcode { `var x = 1` }\n" +
+		"\t}\n" +
+		"}\n"
+
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("fenced.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	actions := prog.Blocks[0].Actions
+	if got, want := actions[0].Emit.Template.Text, "type ${T}DTO struct {\n\tName string `json:\"name\"`\n}"; got != want {
+		t.Errorf("fenced template: got %q, want %q", got, want)
+	}
+	if got, want := actions[1].Emit.CodeBody.Text, "var x = 1"; got != want {
+		t.Errorf("backtick code: got %q, want %q", got, want)
+	}
+
+	t.Log("✓ Fenced and backtick raw strings arrive unquoted")
+}
+
+func TestParseStringEscapes(t *testing.T) {
+	input := `
+lift "escapes" {
+	severity: error
+	message: "use \"errors.New\"\n\tnot fmt"
+	from go {
+		match BasicLit { value: "\"say \\\"hi\\\"\"" }
+		match Ident { name: "_" }
+		match Ident { name: _ }
+	}
+	patch { rename $Name "café" }
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+
+	prog, err := parser.ParseString("escapes.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	block := prog.Blocks[0]
+	if got, want := *block.Message, "use \"errors.New\"\n\tnot fmt"; got != want {
+		t.Errorf("message: got %q, want %q", got, want)
+	}
+
+	matchers := block.From.Matchers
+	if got, want := *matchers[0].Fields[0].Value.Exact, `"say \"hi\""`; got != want {
+		t.Errorf("exact: got %q, want %q", got, want)
+	}
+	if v := matchers[1].Fields[0].Value; v.Wild || v.Exact == nil || *v.Exact != "_" {
+		t.Errorf(`expected "_" to be an exact string, got %+v`, v)
+	}
+	if !matchers[2].Fields[0].Value.Wild {
+		t.Error("expected bare _ to be a wildcard")
+	}
+
+	if got, want := block.Actions[0].Patch.Stmts[0].Rename.NewName, "café"; got != want {
+		t.Errorf("rename: got %q, want %q", got, want)
+	}
+
+	t.Log("✓ Escape sequences in quoted strings are unquoted")
+}
+
+func TestParseTemplate(t *testing.T) {
+	text := "syntax = \"proto3\";\n" +
+		"${if contains($Fields, SelectorExpr { x: \"time\" })}\n" +
+		"import \"google/protobuf/timestamp.proto\";\n" +
+		"${end}\n" +
+		"message ${Name} {${if $Name.exported} // public${else} // private${end}}\n"
+
+	nodes, err := ParseTemplate(text)
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+
+	if len(nodes) != 5 {
+		t.Fatalf("expected 5 nodes, got %d", len(nodes))
+	}
+	if nodes[0].Text != "syntax = \"proto3\";\n" {
+		t.Errorf("directive line not removed: %q", nodes[0].Text)
+	}
+	imp := nodes[1].If
+	if imp == nil || imp.Line != 2 || imp.Cond.Contains == nil || imp.Cond.Contains.Pattern.NodeType != "SelectorExpr" {
+		t.Fatalf("expected ${if contains(...)} on line 2, got %+v", nodes[1])
+	}
+	if len(imp.Then) != 1 || imp.Then[0].Text != "import \"google/protobuf/timestamp.proto\";\n" || imp.Else != nil {
+		t.Errorf("unexpected import section: %+v", imp.Then)
+	}
+	if nodes[2].Text != "message ${Name} {" {
+		t.Errorf("inline directive should keep its line: %q", nodes[2].Text)
+	}
+	exported := nodes[3].If
+	if exported == nil || exported.Cond.PropCheck == nil || exported.Then[0].Text != " // public" || exported.Else[0].Text != " // private" {
+		t.Errorf("unexpected inline if/else: %+v", nodes[3])
+	}
+	if nodes[4].Text != "}\n" {
+		t.Errorf("unexpected trailing text: %q", nodes[4].Text)
+	}
+
+	errorTests := []struct {
+		name, text, want string
+	}{
+		{"unclosed if", "a\n${if $X.exported}\nb\n", "template line 2: ${if} is never closed by ${end}"},
+		{"dangling end", "a\nb\n${end}\n", "template line 3: ${end} without ${if}"},
+		{"dangling else", "${else}", "template line 1: ${else} without ${if}"},
+		{"second else", "${if $X.exported}a${else}b\n${else}c${end}", "template line 2: second ${else} for the ${if} on line 1"},
+		{"bad predicate", "\n${if $X ===}x${end}", "template line 2: ${if}: "},
+		{"unterminated if", "${if contains($X, Ident {", "template line 1: unterminated ${if"},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTemplate(tt.text)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("expected error starting %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	t.Log("✓ Template sections parsed")
+}
+
+func TestParseTemplatesPosition(t *testing.T) {
+	input := `
+lift "dto" {
+	from go { match TypeSpec { name: $Name } }
+	emit go {
+		file "dto.go"
+		template { ` + "`" + `type ${Name}DTO struct {
+${if $Name.exported}
+}` + "`" + ` }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+	prog, err := parser.ParseString("dto.lift", input)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	err = prog.ParseTemplates()
+	want := "dto.lift:6:3: template line 2: ${if} is never closed by ${end}"
+	if err == nil || err.Error() != want {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+
+	t.Log("✓ Template errors point into the .lift file")
+}
+
+func TestNewParserShared(t *testing.T) {
+	first, err := NewParser()
+	if err != nil {
+		t.Fatalf("failed to build parser: %v", err)
+	}
+	second, _ := NewParser()
+	if first != second {
+		t.Errorf("expected NewParser to return the same parser")
+	}
+
+	custom, err := NewParserWithOptions(participle.UseLookahead(10))
+	if err != nil {
+		t.Fatalf("failed to build parser with options: %v", err)
+	}
+	if custom == first {
+		t.Errorf("expected NewParserWithOptions to build a new parser")
+	}
+	if _, err := custom.ParseString("test.lift", `lift "x" { from go { match Ident { } } }`); err != nil {
+		t.Errorf("custom parser failed: %v", err)
+	}
+
+	t.Log("✓ Default parser built once")
+}
+
+func BenchmarkNewParser(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := NewParser(); err != nil {
+			b.Fatalf("failed to build parser: %v", err)
+		}
+	}
+}
+
+func TestParseOrMatch(t *testing.T) {
+	input := `
+lift "http-get" {
+	from go {
+		or_match {
+			match CallExpr { fun: SelectorExpr { x: Ident { name: "http" } sel: Ident { name: "Get" } } }
+			match CallExpr { fun: SelectorExpr { x: Ident { name: "client" } sel: Ident { name: "Get" } } }
+		}
+		match FuncDecl { name: $Name }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := parser.ParseString("test.lift", input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	matchers := prog.Blocks[0].From.Matchers
+	if len(matchers) != 2 {
+		t.Fatalf("expected 2 matchers, got %d", len(matchers))
+	}
+	or := matchers[0].Or
+	if or == nil || matchers[0].NodeType != "" {
+		t.Fatalf("expected an or_match, got %+v", matchers[0])
+	}
+	if len(or.Alternatives) != 2 || or.Alternatives[1].NodeType != "CallExpr" {
+		t.Errorf("expected 2 CallExpr alternatives, got %+v", or.Alternatives)
+	}
+	if matchers[1].Or != nil || matchers[1].NodeType != "FuncDecl" {
+		t.Errorf("expected match FuncDecl after the or_match, got %+v", matchers[1])
+	}
+
+	if _, err := parser.ParseString("test.lift", `lift "t" { from go { or_match { } } }`); err == nil {
+		t.Error("expected an error for an empty or_match")
+	}
+
+	t.Logf("✓ or_match parsed")
+}
+
+func TestLint(t *testing.T) {
+	input := `lift "all" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+		match CallExpr { fun: SelectorExpr { sel: Ident { name: "\"Get\"" } } args: [BasicLit { value: "\"url\"" }] }
+		match TypeSpec { name: $Type }
+	}
+	where {
+		$Name.exported
+		$Name in ["A"]
+		contains($Body, Ident { name: $Type })
+	}
+	insert code {
+		prepend $Body
+	}
+	emit go {
+		file "x.go"
+	}
+	emit sql {
+		file "x.sql"
+	}
+}
+
+lift "clean" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+		match CallExpr in $Body { fun: $Fun }
+	}
+	where {
+		$Fun in ["Get"]
+	}
+	patch {
+		rename $Name "${Name}V2"
+	}
+}
+
+lift "report-only" {
+	from go {
+		match FuncDecl { name: $Name }
+	}
+}
+`
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := parser.ParseString("test.lift", input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var got []string
+	for _, w := range prog.Lint() {
+		got = append(got, fmt.Sprintf("%d: %s", w.Pos.Line, w.Message))
+	}
+	want := []string{
+		`4: exact match "\"Get\"" keeps its quotes, which only a BasicLit value has; write "Get"`,
+		`10: predicate relates $Body and $Type from matchers that share no binding, so every combination of their matches is checked`,
+		`12: insert code { prepend } has nothing to insert`,
+		`15: emit go "x.go" has no body, so it emits an empty file`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got warnings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	prog, err = parser.ParseString("test.lift", `lift "x" {
+	from go { match CallExpr { fun: $Fun args: $Args... } }
+	patch { rename $Fun "g" }
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := prog.Lint(); len(w) != 1 || !strings.Contains(w[0].Message, "$Args is captured") {
+		t.Errorf("expected an unused $Args warning, got %v", w)
+	}
+
+	t.Logf("✓ Lint warns about rules that parse but misbehave")
+}
+
+func TestParseMemberOfBinding(t *testing.T) {
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := parser.ParseString("test.lift", `lift "t" {
+	from go { match Field { type: $FieldType } }
+	where {
+		$FieldType in $Decl.specs
+		$FieldType in ["string"]
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	preds := prog.Blocks[0].Where[0].Predicates
+	set := preds[0].MemberCheck.Set
+	if set == nil || set.Name != "Decl" || set.Field == nil || *set.Field != "specs" {
+		t.Errorf("expected the set $Decl.specs, got %+v", set)
+	}
+	if member := preds[1].MemberCheck; member.Set != nil || len(member.Values) != 1 {
+		t.Errorf("expected a literal list, got %+v", member)
+	}
+
+	t.Logf("✓ in predicates parse against a binding")
+}
+
+func TestParseStructTags(t *testing.T) {
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := parser.ParseString("test.lift", `lift "t" {
+	from go { match Field { names: [$Name] tag: { json: "-" db: nil "x.y": $V } } }
+	where {
+		$_match.hasTag("db")
+		$_match.tag("json") != "-"
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	tag := prog.Blocks[0].From.Matchers[0].Fields[1].Value.Tag
+	if tag == nil || len(tag.Keys) != 3 {
+		t.Fatalf("expected a tag pattern with 3 keys, got %+v", tag)
+	}
+	if k := tag.Keys[0]; k.Key != "json" || k.Value.Exact == nil || *k.Value.Exact != "-" {
+		t.Errorf("expected json: \"-\", got %+v", k)
+	}
+	if k := tag.Keys[1]; k.Key != "db" || !k.Value.Nil {
+		t.Errorf("expected db: nil, got %+v", k)
+	}
+	if k := tag.Keys[2]; k.Key != "x.y" || k.Value.Binding == nil {
+		t.Errorf("expected \"x.y\": $V, got %+v", k)
+	}
+
+	preds := prog.Blocks[0].Where[0].Predicates
+	if has := preds[0].TagCheck; has == nil || has.Func != "hasTag" || has.Key != "db" || has.Op != nil {
+		t.Errorf("expected hasTag(\"db\"), got %+v", has)
+	}
+	if cmp := preds[1].TagCheck; cmp == nil || cmp.Func != "tag" || *cmp.Op != "!=" || *cmp.Value != "-" {
+		t.Errorf("expected tag(\"json\") != \"-\", got %+v", cmp)
+	}
+
+	t.Logf("✓ struct tag patterns and predicates parse")
+}
+
+func TestParseCommentPredicates(t *testing.T) {
+	parser, err := NewParser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := parser.ParseString("test.lift", `lift "t" {
+	from go { match FuncDecl { doc: $Doc } }
+	where {
+		$Doc.text.matches("(?i)deprecated")
+		$Doc.matches("x")
+		$Doc != nil
+		$_match.has_doc
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	preds := prog.Blocks[0].Where[0].Predicates
+	if s := preds[0].StringCheck; s == nil || !s.Text || s.Func != "matches" {
+		t.Errorf("expected $Doc.text.matches, got %+v", s)
+	}
+	if s := preds[1].StringCheck; s == nil || s.Text {
+		t.Errorf("expected $Doc.matches without .text, got %+v", s)
+	}
+	if n := preds[2].EqualCheck; n == nil || n.Binding != "Doc" || n.Op != "!=" || !n.Nil {
+		t.Errorf("expected $Doc != nil, got %+v", n)
+	}
+	if p := preds[3].PropCheck; p == nil || p.Property != "has_doc" {
+		t.Errorf("expected $_match.has_doc, got %+v", p)
+	}
+
+	t.Logf("✓ comment predicates parse")
+}
@@ -0,0 +1,324 @@
+package grammar
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Warning is a problem Program.Lint found in a rule that parses but
+// likely doesn't do what it says.
+type Warning struct {
+	Pos     lexer.Position
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Pos, w.Message)
+}
+
+// Lint checks each lift block for mistakes the grammar accepts:
+//
+//   - bindings captured by a matcher and used nowhere else, in blocks
+//     with actions
+//   - where predicates relating bindings of matchers that no "in $Binding"
+//     or shared binding joins, which compare every combination of their
+//     matches
+//   - exact-match strings that kept their quotes, which only a BasicLit
+//     value has
+//   - emit go, json, yaml and toml with no body
+//   - insert with no code or ast to insert
+//
+// Warnings are returned in source order.
+func (p *Program) Lint() []Warning {
+	var warnings []Warning
+	for _, def := range p.Patterns {
+		walkMatchValues("", &MatchValue{Pattern: def.Pattern}, func(field string, v *MatchValue) {
+			warnings = append(warnings, lintExact(field, v)...)
+		})
+	}
+	for _, block := range p.Blocks {
+		warnings = append(warnings, lintBlock(block)...)
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		a, b := warnings[i].Pos, warnings[j].Pos
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return warnings
+}
+
+// capture is a binding a from clause matcher captures.
+type capture struct {
+	name string
+	pos  lexer.Position
+	stmt int // index of the matcher in FromClause.Expand
+}
+
+func lintBlock(block *LiftBlock) []Warning {
+	var warnings []Warning
+	var captures []capture
+	var stmts []*MatchStmt
+	if block.From != nil {
+		stmts = block.From.Expand()
+	}
+
+	// Matchers are joined by an in $Binding naming a binding of an
+	// earlier one, or by a binding both capture; the rest are cross joined
+	joins := make([]int, len(stmts))
+	var join func(i int) int
+	join = func(i int) int {
+		if joins[i] != i {
+			joins[i] = join(joins[i])
+		}
+		return joins[i]
+	}
+	for i, stmt := range stmts {
+		joins[i] = i
+		alts := []*MatchStmt{stmt}
+		if stmt.Or != nil {
+			alts = stmt.Or.Alternatives
+		}
+		for _, alt := range alts {
+			if alt.In != nil {
+				for _, c := range captures {
+					if c.name == *alt.In {
+						joins[join(i)] = join(c.stmt)
+					}
+				}
+			}
+			for _, field := range alt.Fields {
+				walkMatchValues(field.Name, field.Value, func(field string, v *MatchValue) {
+					warnings = append(warnings, lintExact(field, v)...)
+					for _, c := range valueCaptures(v) {
+						c.stmt = i
+						for _, prev := range captures {
+							if prev.name == c.name {
+								joins[join(i)] = join(prev.stmt)
+							}
+						}
+						captures = append(captures, c)
+					}
+				})
+			}
+		}
+	}
+
+	// A binding is used if another matcher, a where predicate or an
+	// action names it, or if it is captured more than once. Without
+	// actions a block only reports its matches, bindings included.
+	used := make(map[string]bool)
+	for _, stmt := range stmts {
+		for _, name := range inBindings(stmt) {
+			used[name] = true
+		}
+	}
+	for _, where := range block.Where {
+		for _, word := range words(where) {
+			used[word] = true
+		}
+	}
+	for _, action := range block.Actions {
+		for _, word := range words(action) {
+			used[word] = true
+		}
+		// emit sql, graphql and proto without a body read $Name and $Fields
+		if emit := action.Emit; emit != nil && emitsStruct(emit) && !hasBody(emit) {
+			used["Name"], used["Fields"] = true, true
+		}
+	}
+	count := make(map[string]int)
+	for _, c := range captures {
+		count[c.name]++
+	}
+	for _, c := range captures {
+		if len(block.Actions) > 0 && !used[c.name] && count[c.name] == 1 && !strings.HasPrefix(c.name, "_") {
+			warnings = append(warnings, Warning{c.pos, fmt.Sprintf("$%s is captured but no where clause or action uses it; match it with _ instead", c.name)})
+		}
+	}
+
+	// Which matcher each binding comes from, first capture winning
+	owner := make(map[string]int)
+	for i := len(captures) - 1; i >= 0; i-- {
+		owner[captures[i].name] = join(captures[i].stmt)
+	}
+	for _, where := range block.Where {
+		for _, pred := range where.Predicates {
+			var names []string
+			seen := make(map[int]bool)
+			for _, word := range bindingNames(pred) {
+				if stmt, ok := owner[word]; ok && !seen[stmt] {
+					seen[stmt] = true
+					names = append(names, "$"+word)
+				}
+			}
+			if len(names) > 1 {
+				warnings = append(warnings, Warning{pred.Pos, fmt.Sprintf(
+					"predicate relates %s from matchers that share no binding, so every combination of their matches is checked",
+					strings.Join(names, " and "))})
+			}
+		}
+	}
+
+	for _, action := range block.Actions {
+		switch {
+		case action.Emit != nil && !hasBody(action.Emit) && !emitsStruct(action.Emit):
+			warnings = append(warnings, Warning{action.Emit.Pos, fmt.Sprintf("emit %s %q has no body, so it emits an empty file", action.Emit.Target, action.Emit.File)})
+		case action.Insert != nil && action.Insert.ASTNode == nil && action.Insert.Code == nil:
+			warnings = append(warnings, Warning{action.Insert.Pos, fmt.Sprintf("insert %s { %s } has nothing to insert", action.Insert.Mode, action.Insert.Position.Kind)})
+		}
+	}
+	return warnings
+}
+
+// walkMatchValues calls fn for v and every match value nested inside it,
+// with the name of the field each one matches. The definitions pattern
+// references point to are not followed.
+func walkMatchValues(field string, v *MatchValue, fn func(field string, v *MatchValue)) {
+	if v == nil {
+		return
+	}
+	fn(field, v)
+	for _, item := range v.List {
+		walkMatchValues(field, item, fn)
+	}
+	if v.Pattern != nil {
+		for _, f := range v.Pattern.Fields {
+			walkMatchValues(f.Name, f.Value, fn)
+		}
+	}
+	if v.Tag != nil {
+		for _, key := range v.Tag.Keys {
+			walkMatchValues(key.Key, key.Value, fn)
+		}
+	}
+}
+
+// valueCaptures returns the bindings v captures itself, including those
+// of a selector path such as "$Recv.client.Get".
+func valueCaptures(v *MatchValue) []capture {
+	switch {
+	case v.Binding != nil:
+		return []capture{{name: v.Binding.Name, pos: v.Binding.Pos}}
+	case v.Spread != nil:
+		return []capture{{name: v.Spread.Name, pos: v.Spread.Pos}}
+	case v.Exact != nil && strings.Contains(*v.Exact, "."):
+		var captures []capture
+		for _, segment := range strings.Split(*v.Exact, ".") {
+			if name, ok := strings.CutPrefix(segment, "$"); ok {
+				captures = append(captures, capture{name: name, pos: v.Pos})
+			}
+		}
+		return captures
+	}
+	return nil
+}
+
+// lintExact warns about an exact match that kept its quotes, as in
+// name: "\"Get\"", unless it matches a BasicLit value, which has them.
+func lintExact(field string, v *MatchValue) []Warning {
+	if v.Exact == nil || strings.EqualFold(field, "value") {
+		return nil
+	}
+	s := *v.Exact
+	if len(s) < 2 || s[0] != s[len(s)-1] || (s[0] != '"' && s[0] != '`') {
+		return nil
+	}
+	return []Warning{{v.Pos, fmt.Sprintf("exact match %q keeps its quotes, which only a BasicLit value has; write %q", s, s[1:len(s)-1])}}
+}
+
+// inBindings returns the bindings a matcher, or the alternatives of an
+// or_match, match in.
+func inBindings(stmt *MatchStmt) []string {
+	var names []string
+	if stmt.In != nil {
+		names = append(names, *stmt.In)
+	}
+	if stmt.Or != nil {
+		for _, alt := range stmt.Or.Alternatives {
+			names = append(names, inBindings(alt)...)
+		}
+	}
+	return names
+}
+
+// emitsStruct reports whether emit generates its output from $Name and
+// $Fields when it has no body.
+func emitsStruct(emit *EmitClause) bool {
+	return emit.Target == "sql" || emit.Target == "graphql" || emit.Target == "proto"
+}
+
+func hasBody(emit *EmitClause) bool {
+	return emit.ASTBody != nil || emit.CodeBody != nil || emit.Template != nil ||
+		emit.Schema != nil || emit.TemplateFile != nil
+}
+
+var word = regexp.MustCompile(`[\p{L}_][\p{L}\p{Nd}_]*`)
+
+// words returns every identifier in the strings of x, a grammar node:
+// binding names, and the names ${Var} and {{.Var}} refer to in code and
+// templates.
+func words(x any) []string {
+	var words []string
+	for _, s := range collectStrings(x, func(reflect.Type, string) bool { return true }) {
+		words = append(words, word.FindAllString(s, -1)...)
+	}
+	return words
+}
+
+// bindingNames returns the names of the bindings x, a grammar node, refers
+// to, leaving out strings that only look like them.
+func bindingNames(x any) []string {
+	return collectStrings(x, func(typ reflect.Type, field string) bool {
+		switch typ {
+		case reflect.TypeOf(SimpleBinding{}), reflect.TypeOf(SpreadBinding{}), reflect.TypeOf(BindingRef{}):
+			return field == "Name"
+		}
+		return field == "Binding"
+	})
+}
+
+// collectStrings returns the string fields of x and the structs it
+// points to for which keep, given the struct type and field name, is true.
+func collectStrings(x any, keep func(typ reflect.Type, field string) bool) []string {
+	var strs []string
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface:
+			if !v.IsNil() {
+				walk(v.Elem())
+			}
+		case reflect.Struct:
+			if v.Type() == reflect.TypeOf(lexer.Position{}) {
+				return
+			}
+			for i := 0; i < v.NumField(); i++ {
+				field := v.Type().Field(i)
+				f := v.Field(i)
+				for f.Kind() == reflect.Pointer && !f.IsNil() && f.Elem().Kind() == reflect.String {
+					f = f.Elem()
+				}
+				if f.Kind() == reflect.String {
+					if keep(v.Type(), field.Name) {
+						strs = append(strs, f.String())
+					}
+					continue
+				}
+				walk(f)
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i))
+			}
+		}
+	}
+	walk(reflect.ValueOf(x))
+	return strs
+}
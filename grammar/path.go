@@ -0,0 +1,43 @@
+package grammar
+
+import "fmt"
+
+// Expand returns the from clause's matchers with every path desugared
+// into a chain of "in" matchers, so that
+//
+//	match FuncDecl / Body / CallExpr { fun: $F }
+//
+// becomes
+//
+//	match FuncDecl { Body: $_path1_1 }
+//	match CallExpr in $_path1_1 { fun: $F }
+//
+// The first matcher keeps the path's own in clause or scope, and the last
+// gets its fields. Matchers without a path are returned as they are.
+func (f *FromClause) Expand() []*MatchStmt {
+	var stmts []*MatchStmt
+	for i, stmt := range f.Matchers {
+		if len(stmt.Path) == 0 {
+			stmts = append(stmts, stmt)
+			continue
+		}
+
+		current := &MatchStmt{Pos: stmt.Pos, NodeType: stmt.NodeType, In: stmt.In, Scope: stmt.Scope}
+		for j, step := range stmt.Path {
+			binding := fmt.Sprintf("_path%d_%d", i+1, j+1)
+			current.Fields = []*FieldMatch{{
+				Pos:  step.Pos,
+				Name: step.Field,
+				Value: &MatchValue{
+					Pos:     step.Pos,
+					Binding: &SimpleBinding{Pos: step.Pos, Name: binding},
+				},
+			}}
+			stmts = append(stmts, current)
+			current = &MatchStmt{Pos: step.Pos, NodeType: step.NodeType, In: &binding}
+		}
+		current.Fields = stmt.Fields
+		stmts = append(stmts, current)
+	}
+	return stmts
+}
@@ -0,0 +1,190 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResolvePatterns links every pattern reference in the program to its
+// definition. It reports duplicate definitions, references to unknown
+// patterns, and definitions that refer to themselves directly or
+// indirectly. Call it after parsing and before matching.
+func (p *Program) ResolvePatterns() error {
+	r := &patternResolver{
+		defs:  make(map[string]*PatternDef),
+		state: make(map[string]int),
+	}
+
+	for _, def := range p.Patterns {
+		if prev, ok := r.defs[def.Name]; ok {
+			return fmt.Errorf("%s: pattern %s already defined at %s", def.Pos, def.Name, prev.Pos)
+		}
+		r.defs[def.Name] = def
+	}
+
+	for _, def := range p.Patterns {
+		if err := r.resolveDef(def); err != nil {
+			return err
+		}
+	}
+
+	for _, block := range p.Blocks {
+		if block.From != nil {
+			for _, stmt := range block.From.Matchers {
+				if err := walkFields(stmt.Fields, r.link); err != nil {
+					return err
+				}
+				if stmt.Or != nil {
+					for _, alt := range stmt.Or.Alternatives {
+						if err := walkFields(alt.Fields, r.link); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		for _, where := range block.Where {
+			for _, pred := range where.Predicates {
+				if err := walkPredicate(pred, r.link); err != nil {
+					return err
+				}
+			}
+		}
+		for _, action := range block.Actions {
+			if emit := action.Emit; emit != nil && emit.Template != nil {
+				if err := walkTemplate(emit.Template.Nodes, r.link); err != nil {
+					return err
+				}
+			} else if emit != nil && emit.CodeBody != nil {
+				if err := walkTemplate(emit.CodeBody.Nodes, r.link); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+const (
+	resolving = iota + 1
+	resolved
+)
+
+type patternResolver struct {
+	defs  map[string]*PatternDef
+	state map[string]int
+	stack []string // definitions being resolved, for cycle messages
+}
+
+// resolveDef links the references inside a definition, resolving the
+// definitions it refers to first.
+func (r *patternResolver) resolveDef(def *PatternDef) error {
+	switch r.state[def.Name] {
+	case resolved:
+		return nil
+	case resolving:
+		cycle := append(r.stack, def.Name)
+		return fmt.Errorf("%s: pattern cycle: %s", def.Pos, strings.Join(cycle, " -> "))
+	}
+
+	r.state[def.Name] = resolving
+	r.stack = append(r.stack, def.Name)
+
+	err := walkPattern(def.Pattern, func(pat *ASTPattern) error {
+		if pat.Ref == "" {
+			return nil
+		}
+		ref, ok := r.defs[pat.Ref]
+		if !ok {
+			return fmt.Errorf("%s: unknown pattern %s", pat.Pos, pat.Ref)
+		}
+		if err := r.resolveDef(ref); err != nil {
+			return err
+		}
+		pat.Def = ref.Pattern
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.stack = r.stack[:len(r.stack)-1]
+	r.state[def.Name] = resolved
+	return nil
+}
+
+// link points a reference at its (already resolved) definition.
+func (r *patternResolver) link(pat *ASTPattern) error {
+	if pat.Ref == "" {
+		return nil
+	}
+	def, ok := r.defs[pat.Ref]
+	if !ok {
+		return fmt.Errorf("%s: unknown pattern %s", pat.Pos, pat.Ref)
+	}
+	pat.Def = def.Pattern
+	return nil
+}
+
+// walkPattern calls fn for pat and every pattern nested inside it. The
+// definitions references point to are not followed.
+func walkPattern(pat *ASTPattern, fn func(*ASTPattern) error) error {
+	if pat == nil {
+		return nil
+	}
+	if err := fn(pat); err != nil {
+		return err
+	}
+	return walkFields(pat.Fields, fn)
+}
+
+func walkFields(fields []*FieldMatch, fn func(*ASTPattern) error) error {
+	for _, field := range fields {
+		if err := walkValue(field.Value, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkValue(v *MatchValue, fn func(*ASTPattern) error) error {
+	if v == nil {
+		return nil
+	}
+	if err := walkPattern(v.Pattern, fn); err != nil {
+		return err
+	}
+	for _, item := range v.List {
+		if err := walkValue(item, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkPredicate(pred *Predicate, fn func(*ASTPattern) error) error {
+	switch {
+	case pred.Not != nil:
+		return walkPredicate(pred.Not, fn)
+	case pred.Group != nil:
+		for _, p := range pred.Group.Predicates {
+			if err := walkPredicate(p, fn); err != nil {
+				return err
+			}
+		}
+	case pred.Contains != nil:
+		return walkPattern(pred.Contains.Pattern, fn)
+	case pred.NotContainsAny != nil:
+		for _, p := range pred.NotContainsAny.Patterns {
+			if err := walkPattern(p, fn); err != nil {
+				return err
+			}
+		}
+	case pred.NotPrecededBy != nil:
+		return walkPattern(pred.NotPrecededBy.Pattern, fn)
+	case pred.CountCheck != nil:
+		return walkPattern(pred.CountCheck.Pattern, fn)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/participle/v2"
+)
+
+// TemplateNode is one piece of a parsed emit body: literal text, which
+// may still hold ${Var} interpolations, or an ${if} section.
+type TemplateNode struct {
+	Text string
+	If   *TemplateIf
+}
+
+// TemplateIf is ${if <predicate>} ... ${else} ... ${end}. The predicate
+// uses where-clause syntax and is evaluated against each match.
+type TemplateIf struct {
+	Line int // template line of the ${if}, counting from 1
+	Cond *Predicate
+	Then []*TemplateNode
+	Else []*TemplateNode
+}
+
+// ParseTemplates splits the body of every emit in the program into
+// ${if} sections. Errors are reported at the emit body, with the line
+// inside the template text. Call it before ResolvePatterns, which links
+// the patterns used by template predicates.
+func (p *Program) ParseTemplates() error {
+	for _, block := range p.Blocks {
+		for _, action := range block.Actions {
+			if action.Emit == nil {
+				continue
+			}
+			var err error
+			switch emit := action.Emit; {
+			case emit.Template != nil && emit.Template.Engine == "gotpl":
+				// Go templates have their own conditionals
+			case emit.Template != nil:
+				emit.Template.Nodes, err = ParseTemplate(emit.Template.Text)
+				if err != nil {
+					return fmt.Errorf("%s: %w", emit.Template.Pos, err)
+				}
+			case emit.CodeBody != nil:
+				emit.CodeBody.Nodes, err = ParseTemplate(emit.CodeBody.Text)
+				if err != nil {
+					return fmt.Errorf("%s: %w", emit.CodeBody.Pos, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ParseTemplate splits template text into literal text and ${if}
+// sections. A directive alone on its line takes the whole line with it,
+// so sections can be laid out one directive per line.
+func ParseTemplate(text string) ([]*TemplateNode, error) {
+	type frame struct {
+		node   *TemplateIf
+		parent *[]*TemplateNode
+		inElse bool
+	}
+
+	var root []*TemplateNode
+	out := &root
+	var open []*frame
+
+	addText := func(s string) {
+		if s != "" {
+			*out = append(*out, &TemplateNode{Text: s})
+		}
+	}
+
+	pos := 0
+	for {
+		d, err := nextDirective(text, pos)
+		if err != nil {
+			return nil, err
+		}
+		if d == nil {
+			addText(text[pos:])
+			break
+		}
+		addText(text[pos:d.start])
+		pos = d.end
+
+		switch d.kind {
+		case "if":
+			cond, err := parseCondition(d.arg)
+			if err != nil {
+				return nil, fmt.Errorf("template line %d: ${if}: %w", d.line, err)
+			}
+			node := &TemplateIf{Line: d.line, Cond: cond}
+			*out = append(*out, &TemplateNode{If: node})
+			open = append(open, &frame{node: node, parent: out})
+			out = &node.Then
+
+		case "else":
+			if len(open) == 0 {
+				return nil, fmt.Errorf("template line %d: ${else} without ${if}", d.line)
+			}
+			top := open[len(open)-1]
+			if top.inElse {
+				return nil, fmt.Errorf("template line %d: second ${else} for the ${if} on line %d", d.line, top.node.Line)
+			}
+			top.inElse = true
+			out = &top.node.Else
+
+		case "end":
+			if len(open) == 0 {
+				return nil, fmt.Errorf("template line %d: ${end} without ${if}", d.line)
+			}
+			out = open[len(open)-1].parent
+			open = open[:len(open)-1]
+		}
+	}
+
+	if len(open) > 0 {
+		line := open[len(open)-1].node.Line
+		return nil, fmt.Errorf("template line %d: ${if} is never closed by ${end}", line)
+	}
+	return root, nil
+}
+
+// directive is an ${if ...}, ${else} or ${end} found in template text.
+type directive struct {
+	kind       string
+	arg        string // the predicate of an ${if}
+	start, end int    // byte range, widened to the line if it stands alone
+	line       int
+}
+
+// nextDirective finds the first directive at or after from. Other ${...}
+// are interpolations and are skipped.
+func nextDirective(text string, from int) (*directive, error) {
+	for i := from; ; {
+		off := strings.Index(text[i:], "${")
+		if off < 0 {
+			return nil, nil
+		}
+		start := i + off
+		i = start + 2
+
+		body := strings.TrimLeft(text[i:], " \t")
+		var d *directive
+		switch {
+		case strings.HasPrefix(body, "if ") || strings.HasPrefix(body, "if\t"):
+			argStart := len(text) - len(body) + 2
+			closeAt := closingBrace(text, argStart)
+			if closeAt < 0 {
+				line := 1 + strings.Count(text[:start], "\n")
+				return nil, fmt.Errorf("template line %d: unterminated ${if", line)
+			}
+			d = &directive{kind: "if", arg: strings.TrimSpace(text[argStart:closeAt]), end: closeAt + 1}
+		default:
+			for _, kind := range []string{"else", "end"} {
+				if rest, ok := strings.CutPrefix(body, kind); ok {
+					if trimmed := strings.TrimLeft(rest, " \t"); strings.HasPrefix(trimmed, "}") {
+						d = &directive{kind: kind, end: len(text) - len(trimmed) + 1}
+					}
+				}
+			}
+		}
+		if d == nil {
+			continue
+		}
+
+		d.start = start
+		d.line = 1 + strings.Count(text[:start], "\n")
+
+		// A directive alone on its line removes the line.
+		lineStart := strings.LastIndex(text[:start], "\n") + 1
+		lineEnd := len(text)
+		if nl := strings.Index(text[d.end:], "\n"); nl >= 0 {
+			lineEnd = d.end + nl + 1
+		}
+		if lineStart >= from && strings.TrimSpace(text[lineStart:start]) == "" &&
+			strings.TrimSpace(text[d.end:lineEnd]) == "" {
+			d.start, d.end = lineStart, lineEnd
+		}
+		return d, nil
+	}
+}
+
+// closingBrace returns the index of the } closing a directive whose
+// argument starts at from, skipping nested braces and quoted strings.
+// It returns -1 if there is none.
+func closingBrace(text string, from int) int {
+	depth := 0
+	for i := from; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '"', '`':
+			for i++; i < len(text) && text[i] != c; i++ {
+				if c == '"' && text[i] == '\\' {
+					i++
+				}
+			}
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+var predicateParser = sync.OnceValues(func() (*participle.Parser[Predicate], error) {
+	return participle.Build[Predicate](parserOptions()...)
+})
+
+// parseCondition parses the predicate of an ${if}.
+func parseCondition(src string) (*Predicate, error) {
+	parser, err := predicateParser()
+	if err != nil {
+		return nil, err
+	}
+	pred, err := parser.ParseString("", src)
+	if err != nil {
+		var perr participle.Error
+		if errors.As(err, &perr) {
+			return nil, errors.New(perr.Message())
+		}
+		return nil, err
+	}
+	return pred, nil
+}
+
+// walkTemplate calls fn for every pattern used by a predicate in nodes.
+func walkTemplate(nodes []*TemplateNode, fn func(*ASTPattern) error) error {
+	for _, node := range nodes {
+		if node.If == nil {
+			continue
+		}
+		if err := walkPredicate(node.If.Cond, fn); err != nil {
+			return err
+		}
+		if err := walkTemplate(node.If.Then, fn); err != nil {
+			return err
+		}
+		if err := walkTemplate(node.If.Else, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package grammar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CheckVersion reports whether the program's version directive asks for
+// a newer stencil than current, e.g. "1.0" when current is "0.3.0". A
+// missing directive never does. A directive that isn't major[.minor[.patch]]
+// is an error.
+//
+// Everything in a program that parses is supported by this grammar, so a
+// newer version only matters for behaviour: the file may rely on matching
+// or output that this release doesn't have.
+func (p *Program) CheckVersion(current string) (bool, error) {
+	if p.Version == "" {
+		return false, nil
+	}
+	want, err := parseVersion(p.Version)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid version %q: %v", p.Pos, p.Version, err)
+	}
+	have, err := parseVersion(current)
+	if err != nil {
+		return false, err
+	}
+	for i := range want {
+		if want[i] != have[i] {
+			return want[i] > have[i], nil
+		}
+	}
+	return false, nil
+}
+
+// parseVersion parses "1", "1.2" or "1.2.3", with an optional leading v.
+// Missing parts are zero.
+func parseVersion(s string) ([3]int, error) {
+	var v [3]int
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > len(v) {
+		return v, fmt.Errorf("want major.minor.patch")
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part != strconv.Itoa(n) {
+			return v, fmt.Errorf("want major.minor.patch")
+		}
+		v[i] = n
+	}
+	return v, nil
+}
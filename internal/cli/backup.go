@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// backupSuffix is appended to a source path to name its backup.
+const backupSuffix = ".orig"
+
+// backupFile copies path to path+backupSuffix, replacing any earlier backup.
+func backupFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	backup := path + backupSuffix
+	if err := os.WriteFile(backup, data, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("writing backup: %w", err)
+	}
+	return backup, nil
+}
+
+// restoreFile copies path+backupSuffix back over path and removes the backup.
+func restoreFile(path string) error {
+	backup := path + backupSuffix
+	info, err := os.Stat(backup)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no backup found for %s", path)
+		}
+		return err
+	}
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Remove(backup)
+}
+
+// writeFileAtomic replaces path with data by writing a temporary file in
+// the same directory and renaming it over the original, so a crash never
+// leaves path half-written. The original's permissions are kept; a new
+// file gets 0644.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".stencil-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// matchLineEndings converts src, which the Go printer writes with LF line
+// endings, to CRLF if original used CRLF, so rewriting a Windows-style
+// file doesn't touch every line.
+func matchLineEndings(original, src []byte) []byte {
+	if !bytes.Contains(original, []byte("\r\n")) {
+		return src
+	}
+	src = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(src, []byte("\n"), []byte("\r\n"))
+}
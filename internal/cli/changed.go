@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lineRange is an inclusive range of line numbers added or modified in a diff.
+type lineRange struct {
+	Start, End int
+}
+
+// changedLines maps a file path to the line ranges touched by a diff.
+type changedLines map[string][]lineRange
+
+// Contains reports whether line in path falls inside a changed hunk.
+func (c changedLines) Contains(path string, line int) bool {
+	for _, r := range c[filepath.Clean(path)] {
+		if line >= r.Start && line <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// git runs a git command in the current directory and returns its stdout.
+func git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return stdout.String(), nil
+}
+
+// resolveBase returns the revision to diff against. An explicit base is used
+// as-is; otherwise it is the merge-base of HEAD and origin/main.
+func resolveBase(base string) (string, error) {
+	if _, err := git("rev-parse", "--is-inside-work-tree"); err != nil {
+		return "", fmt.Errorf("--changed requires a git repository")
+	}
+	if base != "" {
+		return base, nil
+	}
+	out, err := git("merge-base", "HEAD", "origin/main")
+	if err != nil {
+		return "", fmt.Errorf("cannot determine base (use --base): %w", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// changedGoFiles returns the .go files that differ from base, relative to the
+// current directory. Deleted files are excluded.
+func changedGoFiles(base string) ([]string, error) {
+	rev, err := resolveBase(base)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := git("diff", "--name-only", "--relative", "--diff-filter=d", rev)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if filepath.Ext(line) == ".go" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// changedGoLines returns the added or modified line ranges of every .go file
+// that differs from base.
+func changedGoLines(base string) (changedLines, error) {
+	rev, err := resolveBase(base)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := git("diff", "-U0", "--no-prefix", "--relative", "--diff-filter=d", rev)
+	if err != nil {
+		return nil, err
+	}
+	return parseHunks(out), nil
+}
+
+// parseHunks extracts new-file line ranges from unified diff output.
+// Only .go files are recorded; pure deletions contribute no lines.
+func parseHunks(diff string) changedLines {
+	result := make(changedLines)
+	var current string
+
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			current = strings.TrimPrefix(line, "+++ ")
+			if current == "/dev/null" || filepath.Ext(current) != ".go" {
+				current = ""
+			} else {
+				current = filepath.Clean(current)
+			}
+		case strings.HasPrefix(line, "@@ ") && current != "":
+			if r, ok := parseHunkHeader(line); ok {
+				result[current] = append(result[current], r)
+			}
+		}
+	}
+	return result
+}
+
+// parseHunkHeader parses "@@ -a,b +c,d @@" into the new-file range c..c+d-1.
+func parseHunkHeader(header string) (lineRange, bool) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+		return lineRange{}, false
+	}
+
+	spec := strings.TrimPrefix(fields[2], "+")
+	count := 1
+	if comma := strings.Index(spec, ","); comma >= 0 {
+		n, err := strconv.Atoi(spec[comma+1:])
+		if err != nil {
+			return lineRange{}, false
+		}
+		count = n
+		spec = spec[:comma]
+	}
+
+	start, err := strconv.Atoi(spec)
+	if err != nil || count == 0 {
+		return lineRange{}, false
+	}
+	return lineRange{Start: start, End: start + count - 1}, true
+}
@@ -0,0 +1,2107 @@
+// Package cli implements the stencil commands. Each command parses its
+// own flags with a flag.FlagSet, so flags may come before or after its
+// arguments, and stencil <command> -h prints its usage.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/vinodhalaharvi/stencil/executor"
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/internal/diff"
+	"github.com/vinodhalaharvi/stencil/internal/filter"
+	"github.com/vinodhalaharvi/stencil/internal/findings"
+	"github.com/vinodhalaharvi/stencil/internal/plan"
+	"github.com/vinodhalaharvi/stencil/internal/report"
+	"github.com/vinodhalaharvi/stencil/internal/rules"
+	"github.com/vinodhalaharvi/stencil/matcher"
+	"golang.org/x/tools/imports"
+)
+
+const version = "0.3.0"
+
+// stdout and stderr are where commands write; Run sets them.
+var stdout, stderr io.Writer = os.Stdout, os.Stderr
+
+// commands runs each command with the arguments after its name. A
+// command that fails returns an error, which Run prints, and the exit
+// code.
+var commands map[string]func(args []string) (int, error)
+
+func init() {
+	commands = map[string]func(args []string) (int, error){
+		"parse":    cmdParse,
+		"inspect":  cmdInspect,
+		"match":    cmdMatch,
+		"apply":    cmdApply,
+		"lint":     cmdLint,
+		"new-rule": cmdNewRule,
+		"restore":  cmdRestore,
+		"rules":    cmdRules,
+		"version":  cmdVersion,
+		"help":     cmdHelp,
+	}
+}
+
+// Run runs the command in args, which leave out the program name, with
+// its output going to stdout and stderr, and returns the exit code: 0 on
+// success, 1 if the command failed, and 2 if its flags were wrong. Run
+// isn't safe for concurrent use; commands share the writers and the
+// source read from stdin.
+func Run(args []string, out, errOut io.Writer) int {
+	stdout, stderr = out, errOut
+	stdinSource = nil
+
+	if len(args) < 1 {
+		printUsage(stderr)
+		return 1
+	}
+	name := args[0]
+	switch name {
+	case "--help", "-h":
+		name = "help"
+	case "--version":
+		name = "version"
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command: %s\n\n", args[0])
+		printUsage(stderr)
+		return 1
+	}
+
+	code, err := cmd(args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "error: %v\n", err)
+	}
+	return code
+}
+
+// errUsage is returned by a command whose flags didn't parse. The flag
+// set has already printed the error and the usage.
+var errUsage = errors.New("usage")
+
+// parseCommand parses a command's args with fs and returns the positional
+// arguments. Bad flags come back as errUsage and -h as flag.ErrHelp.
+func parseCommand(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional, err := parseFlags(fs, args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return nil, errUsage
+	}
+	return positional, err
+}
+
+func cmdVersion(args []string) (int, error) {
+	fs := newFlagSet("version", "  stencil version")
+	if _, err := parseCommand(fs, args); err != nil {
+		return 2, err
+	}
+	fmt.Fprintf(stdout, "stencil v%s\n", version)
+	return 0, nil
+}
+
+// cmdHelp prints the overview of the commands, or a command's usage.
+func cmdHelp(args []string) (int, error) {
+	if len(args) == 0 {
+		printUsage(stdout)
+		return 0, nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || args[0] == "help" {
+		return 1, fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd([]string{"-h"})
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, `stencil — structural code matching and generation for Go
+
+Usage:
+  stencil parse   <file.lift>                     Validate a .lift file
+  stencil inspect <file.lift>                     Parse and display structure
+  stencil inspect <file.lift> --block <name>      Display one block, or --field of it
+  stencil inspect --go <file.go>                  Print Go declarations as lift patterns
+  stencil match   <file.lift> --source <path>     Find matches in Go source
+  stencil apply   <file.lift> --source <path>     Apply transformations
+  stencil apply   --from-plan <plan.json>         Apply the changes recorded by apply --plan
+  stencil lint    --rules <dir> --source <path>   Report matches as lint violations
+  stencil lint    <file.lift|dir>...              Check rules for mistakes that parse
+  stencil new-rule --example <file.go> --node <T> Scaffold a rule from the first T in example code
+  stencil restore <file.go>...                    Restore files saved by apply --backup
+  stencil rules   list                            List the built-in rules
+  stencil rules   show <name>                     Print a built-in rule's .lift source
+  stencil version                                 Show version
+  stencil help [command]                          Show this message, or a command's flags
+
+Flags go before or after a command's arguments, as --flag value or
+--flag=value; stencil <command> -h lists them.
+
+A .lift path can also be builtin:<name>, a rule from stencil rules list;
+lint --rules builtin: runs all of them. A bare name such as ctx-timeout that
+isn't in the current directory is looked up, with or without .lift, in the
+directories of $STENCIL_LIFT_PATH (colon-separated), then ~/.stencil/rules.
+
+Examples:
+  stencil parse examples/entity-service.lift
+  stencil inspect examples/enforce-ctx-timeout.lift
+  stencil inspect --go testdata/bad_http_client.go --func GetUser --depth 4
+  stencil match examples/enforce-ctx-timeout.lift --source testdata/bad_http_client.go
+  stencil apply examples/enforce-ctx-timeout.lift --source testdata/bad_http_client.go
+  stencil apply examples/enforce-ctx-timeout.lift --changed --base main -w
+  stencil apply examples/enforce-ctx-timeout.lift --source . --plan plan.json --dry-run
+  stencil lint --rules examples/ --source testdata/
+  stencil match builtin:ctx-timeout --source ./...
+  stencil new-rule --example testdata/scaffold/http_get.go --node CallExpr -o http_get.lift`)
+}
+
+func cmdParse(args []string) (int, error) {
+	fs := newFlagSet("parse", "  stencil parse <file.lift>...")
+	args, err := parseCommand(fs, args)
+	if err != nil {
+		return 2, err
+	}
+	if len(args) == 0 {
+		return 1, errors.New("parse requires a .lift file path")
+	}
+
+	parser, err := grammar.NewParser()
+	if err != nil {
+		return 1, fmt.Errorf("failed to build parser: %w", err)
+	}
+
+	for _, name := range args {
+		path, err := findLiftFile(name)
+		if err != nil {
+			return 1, err
+		}
+
+		data, err := readLift(path)
+		if err != nil {
+			return 1, err
+		}
+
+		prog, err := parseLift(parser, path, data)
+		if err != nil {
+			printParseError(path, err)
+			return 1, nil
+		}
+
+		fmt.Fprintf(stdout, "✓ %s — %d lift block(s)\n", path, len(prog.Blocks))
+		for _, b := range prog.Blocks {
+			matchers := 0
+			if b.From != nil {
+				matchers = len(b.From.Matchers)
+			}
+			fmt.Fprintf(stdout, "  %s: %d matcher(s), %d where(s), %d action(s)\n",
+				b.Name, matchers, len(b.Where), len(b.Actions))
+		}
+	}
+	return 0, nil
+}
+
+// findLiftFile resolves a .lift path given on the command line. A name
+// that isn't a file in the current directory, with or without its .lift
+// extension, is looked up in the directories of STENCIL_LIFT_PATH, then in
+// ~/.stencil/rules, so "stencil apply ctx-timeout" finds ctx-timeout.lift
+// there. Paths with a directory and builtin: rules are used as given.
+func findLiftFile(name string) (string, error) {
+	if name == stdinArg {
+		return name, nil
+	}
+	candidates := []string{name}
+	if filepath.Ext(name) != ".lift" {
+		candidates = append(candidates, name+".lift")
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	if strings.HasPrefix(name, rules.Prefix) || strings.ContainsRune(name, filepath.Separator) || filepath.IsAbs(name) {
+		return name, nil
+	}
+
+	dirs := filepath.SplitList(os.Getenv("STENCIL_LIFT_PATH"))
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".stencil", "rules"))
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		for _, c := range candidates {
+			path := filepath.Join(dir, c)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s not found here, in STENCIL_LIFT_PATH or in ~/.stencil/rules", name)
+}
+
+// readLift reads a .lift file, or the built-in rule a builtin:<name>
+// path names.
+func readLift(path string) ([]byte, error) {
+	if path == stdinArg {
+		return io.ReadAll(os.Stdin)
+	}
+	if name, ok := strings.CutPrefix(path, rules.Prefix); ok {
+		return rules.Source(name)
+	}
+	return os.ReadFile(path)
+}
+
+// liftFiles returns the .lift files under path for lint --rules. A
+// builtin:<name> path is that built-in rule, and builtin: alone is all of
+// them.
+func liftFiles(path string) ([]string, error) {
+	name, ok := strings.CutPrefix(path, rules.Prefix)
+	if !ok {
+		return collectFiles(path, ".lift")
+	}
+	if name != "" {
+		return []string{path}, nil
+	}
+	var paths []string
+	for _, rule := range rules.List() {
+		paths = append(paths, rules.Prefix+rule.Name)
+	}
+	return paths, nil
+}
+
+// parseLift parses and resolves a .lift file. Syntax errors come back as
+// *grammar.ParseError with a source excerpt.
+func parseLift(parser *participle.Parser[grammar.Program], path string, data []byte) (*grammar.Program, error) {
+	prog, err := parser.ParseString(path, string(data))
+	if err != nil {
+		return nil, grammar.WrapError(err, string(data))
+	}
+	if err := prog.ParseTemplates(); err != nil {
+		return nil, err
+	}
+	if err := prog.ResolvePatterns(); err != nil {
+		return nil, err
+	}
+	newer, err := prog.CheckVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if newer {
+		fmt.Fprintf(stderr, "warning: %s is written for stencil %s, this is %s; it may not work as intended\n",
+			path, prog.Version, version)
+	}
+	return prog, nil
+}
+
+// printParseError reports a .lift error, indenting multi-line errors under
+// the file name.
+func printParseError(path string, err error) {
+	msg := strings.ReplaceAll(err.Error(), "\n", "\n  ")
+	fmt.Fprintf(stderr, "✗ %s\n  %s\n", path, msg)
+}
+
+func cmdInspect(args []string) (int, error) {
+	fs := newFlagSet("inspect", `  stencil inspect <file.lift> [--block <name> [--field from|where|actions]]
+  stencil inspect --go <file.go> [--func <name>] [--line <n>] [--depth <n>]`)
+	goSource := fs.Bool("go", false, "print the declarations of a Go file, or - for stdin, as lift patterns")
+	funcName := fs.String("func", "", "(with --go) print only the function or method with this `name`")
+	line := fs.Int("line", 0, "(with --go) print only the declaration spanning line `n`")
+	depth := fs.Int("depth", 0, "(with --go) print nodes nested deeper than `n` as _ (default: no limit)")
+	blockName := fs.String("block", "", "print only the block with this `name`")
+	field := fs.String("field", "", "(with --block) print only the block's from clause, where clauses or actions")
+	args, err := parseCommand(fs, args)
+	if err != nil {
+		return 2, err
+	}
+	if *goSource {
+		return inspectGo(args, *funcName, *line, *depth)
+	}
+	if len(args) == 0 {
+		return 1, errors.New("inspect requires a .lift file path")
+	}
+	if *field != "" && *blockName == "" {
+		return 1, errors.New("--field requires --block")
+	}
+
+	parser, err := grammar.NewParser()
+	if err != nil {
+		return 1, fmt.Errorf("failed to build parser: %w", err)
+	}
+
+	path, err := findLiftFile(args[0])
+	if err != nil {
+		return 1, err
+	}
+
+	data, err := readLift(path)
+	if err != nil {
+		return 1, err
+	}
+
+	prog, err := parseLift(parser, path, data)
+	if err != nil {
+		printParseError(path, err)
+		return 1, nil
+	}
+
+	var v any = prog
+	if *blockName != "" {
+		if v, err = inspectBlock(prog, *blockName, *field); err != nil {
+			return 1, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	out, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintln(stdout, string(out))
+	return 0, nil
+}
+
+// inspectBlock returns the block of prog with the given name, or with
+// field set, only its from clause, where clauses or actions.
+func inspectBlock(prog *grammar.Program, name, field string) (any, error) {
+	i := slices.IndexFunc(prog.Blocks, func(b *grammar.LiftBlock) bool { return b.Name == name })
+	if i < 0 {
+		names := make([]string, len(prog.Blocks))
+		for i, b := range prog.Blocks {
+			names[i] = fmt.Sprintf("%q", b.Name)
+		}
+		return nil, fmt.Errorf("no block named %q (blocks: %s)", name, strings.Join(names, ", "))
+	}
+
+	block := prog.Blocks[i]
+	switch field {
+	case "":
+		return block, nil
+	case "from":
+		return block.From, nil
+	case "where":
+		return block.Where, nil
+	case "actions":
+		return block.Actions, nil
+	}
+	return nil, fmt.Errorf("unknown --field %q (want from, where or actions)", field)
+}
+
+// inspectGo prints the declarations of a Go file in the pattern syntax
+// the matcher reads, ready to paste into a .lift file.
+func inspectGo(args []string, funcName string, line, depth int) (int, error) {
+	if len(args) == 0 {
+		return 1, errors.New("inspect --go requires a .go file path")
+	}
+	if line < 0 || depth < 0 {
+		return 1, errors.New("--line and --depth want a non-negative number")
+	}
+
+	path := args[0]
+	if path == stdinArg {
+		var err error
+		if path, err = readStdinSource(""); err != nil {
+			return 1, err
+		}
+	}
+	src, err := readSource(path)
+	if err != nil {
+		return 1, err
+	}
+	m, err := matcher.NewFromSource(path, src)
+	if err != nil {
+		return 1, err
+	}
+
+	var decls []ast.Decl
+	for _, decl := range m.File().Decls {
+		if fn, ok := decl.(*ast.FuncDecl); funcName != "" && (!ok || fn.Name.Name != funcName) {
+			continue
+		}
+		if line > 0 && (m.FileSet().Position(decl.Pos()).Line > line || m.FileSet().Position(decl.End()).Line < line) {
+			continue
+		}
+		decls = append(decls, decl)
+	}
+
+	if len(decls) == 0 {
+		return 1, fmt.Errorf("no matching declaration in %s", path)
+	}
+
+	for i, decl := range decls {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintln(stdout, matcher.FormatPattern(decl, depth))
+	}
+	return 0, nil
+}
+
+// cmdNewRule writes a .lift skeleton matching the first node of a type
+// in an example Go file.
+func cmdNewRule(args []string) (int, error) {
+	fs := newFlagSet("new-rule", "  stencil new-rule --example <file.go> --node <type> [-o <file.lift>]")
+	example := fs.String("example", "", "Go `file` with an example of the code to match")
+	nodeType := fs.String("node", "", "match the first node of this `type`, such as CallExpr")
+	var output string
+	fs.StringVar(&output, "output", "", "write the rule to this `file` instead of stdout")
+	fs.StringVar(&output, "o", "", "shorthand for --output")
+	if _, err := parseCommand(fs, args); err != nil {
+		return 2, err
+	}
+
+	if *example == "" || *nodeType == "" {
+		return 1, errors.New("new-rule requires --example <file.go> and --node <type>")
+	}
+
+	m, err := matcher.NewFromFile(*example)
+	if err != nil {
+		return 1, err
+	}
+
+	rule, err := m.Scaffold(*nodeType)
+	if err != nil {
+		return 1, err
+	}
+
+	if output == "" {
+		fmt.Fprint(stdout, rule)
+		return 0, nil
+	}
+	if err := os.WriteFile(output, []byte(rule), 0o644); err != nil {
+		return 1, err
+	}
+	fmt.Fprintf(stdout, "✓ %s → %s\n", *example, output)
+	return 0, nil
+}
+
+// cmdMatch runs pattern matching against Go source files.
+func cmdMatch(args []string) (int, error) {
+	fs := newFlagSet("match", "  stencil match <file.lift> --source <path>... | --changed")
+	var src sourceFlags
+	var run runFlags
+	src.register(fs)
+	run.register(fs)
+	changedLinesOnly := fs.Bool("changed-lines", false, "like --changed, and report only findings on changed lines")
+	watch := fs.Bool("watch", false, "re-run on every change to the .lift file or sources")
+	context := fs.Int("context", -1, "group matches by enclosing declaration and show `n` lines of source\naround each, the match underlined (default: one line per match)")
+	noColor := fs.Bool("no-color", false, "don't color the underline, even on a terminal")
+	maxFindings := fs.Int("max-findings", 0, "stop after `n` findings without reading the remaining files")
+	args, err := parseCommand(fs, args)
+	if err != nil {
+		return 2, err
+	}
+	if len(args) != 1 {
+		return 1, errors.New("match requires <file.lift> --source <path> or --changed")
+	}
+	if *maxFindings < 0 {
+		return 1, fmt.Errorf("--max-findings wants a positive number, got %d", *maxFindings)
+	}
+
+	liftPath, sources, base := args[0], []string(src.sources), src.base
+	changed, changedOnly := src.changed || *changedLinesOnly, *changedLinesOnly
+	optimize, timings, skipped := run.optimize, run.timings, run.skipped
+	run.setDebug()
+
+	if len(sources) == 0 && !changed {
+		return 1, errors.New("--source or --changed flag required")
+	}
+
+	liftPath, err = findLiftFile(liftPath)
+	if err != nil {
+		return 1, err
+	}
+
+	if *watch {
+		if changed {
+			return 1, errors.New("--watch requires --source, not --changed")
+		}
+		if len(sources) != 1 || isGlob(sources[0]) || sources[0] == stdinArg {
+			return 1, errors.New("--watch takes a single --source file or directory")
+		}
+		w := &matchWatcher{liftPath: liftPath, sourcePath: sources[0], optimize: optimize, verbose: skipped.verbose}
+		return 0, w.Watch()
+	}
+
+	if err := checkStdin(liftPath, sources); err != nil {
+		return 1, err
+	}
+	if slices.Contains(sources, stdinArg) {
+		if _, err := readStdinSource(src.sourceName); err != nil {
+			return 1, err
+		}
+	}
+
+	// Parse .lift file
+	parser, err := grammar.NewParser()
+	if err != nil {
+		return 1, fmt.Errorf("failed to build parser: %w", err)
+	}
+
+	liftData, err := readLift(liftPath)
+	if err != nil {
+		return 1, err
+	}
+
+	prog, err := parseLift(parser, liftPath, liftData)
+	if err != nil {
+		printParseError(liftPath, err)
+		return 1, nil
+	}
+
+	if optimize {
+		optimizeWhere(prog.Blocks)
+	}
+
+	skip, err := filter.New(src.exclude, src.includeGenerated)
+	if err != nil {
+		return 1, err
+	}
+	sourcePaths, excluded, err := resolveSources(sources, src.includeTests, changed, base, skip)
+	if err != nil {
+		return 1, err
+	}
+
+	var hunks changedLines
+	if changedOnly {
+		if hunks, err = changedGoLines(base); err != nil {
+			return 1, err
+		}
+	}
+
+	stats := newRunStats(len(sourcePaths), timings)
+	stats.excluded = excluded
+	results, err := matchSources(prog, sourcePaths, hunks, *maxFindings, &skipped, stats)
+	if err != nil {
+		return 1, err
+	}
+
+	var listing *matchListing
+	if *context >= 0 {
+		listing = newMatchListing(*context, *noColor)
+	}
+
+	for i := 0; i < len(results); {
+		block := results[i].block
+		n := 0
+		for i+n < len(results) && results[i+n].block == block {
+			n++
+		}
+
+		fmt.Fprintf(stdout, "Block %q: %d match(es)\n", block.Name, n)
+		if listing != nil {
+			listing.Print(results[i : i+n])
+			i += n
+			continue
+		}
+		for j, r := range results[i : i+n] {
+			pos := r.fset.Position(r.match.Node.Pos())
+			fmt.Fprintf(stdout, "  [%d] %s: %s:%d\n", j+1, blockSeverity(block), pos.Filename, pos.Line)
+			if fd := r.match.EnclosingFunc(); fd != nil && fd != r.match.Node {
+				fmt.Fprintf(stdout, "      in func %s (line %d)\n", fd.Name.Name, r.fset.Position(fd.Pos()).Line)
+			}
+
+			printBindings(r.match.Bindings, "      ")
+		}
+		i += n
+	}
+	totalMatches := len(results)
+
+	if totalMatches == 0 {
+		fmt.Fprintln(stdout, "No matches found.")
+	} else {
+		fmt.Fprintf(stdout, "\nTotal: %d match(es)\n", totalMatches)
+	}
+	stats.Summary(len(skipped.Skipped))
+	if *maxFindings > 0 && totalMatches >= *maxFindings {
+		fmt.Fprintf(stderr, "Stopped at --max-findings %d, the remaining files weren't matched\n", *maxFindings)
+	}
+
+	if skipped.Report() {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// found is a match of one lift block in one source file.
+type found struct {
+	block *grammar.LiftBlock
+	fset  *token.FileSet
+	src   []byte // the source matched, which --source - doesn't leave on disk
+	match matcher.Match
+}
+
+// matchSources runs every block of prog against the source files and
+// returns the matches block by block. Matches outside hunks are dropped
+// when hunks is non-nil. Once limit matches are found, if limit is
+// positive, no more blocks are run and no more files read. Files that
+// don't parse are recorded in skipped, and other errors are printed and
+// the file left out, unless it is the only one, which fails the run.
+// Progress and timings go to stats, if non-nil.
+func matchSources(prog *grammar.Program, sourcePaths []string, hunks changedLines, limit int, skipped *skippedFiles, stats *runStats) ([]found, error) {
+	byBlock := make([][]found, len(prog.Blocks))
+	n := 0
+files:
+	for _, path := range sourcePaths {
+		stats.File(path)
+		m, err := newMatcher(path, prog.Blocks)
+		if skipped.Skip(path, err) {
+			continue
+		}
+		if err != nil {
+			if len(sourcePaths) == 1 {
+				return nil, err
+			}
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			continue
+		}
+
+		for i, block := range prog.Blocks {
+			matches, blockStats, err := m.MatchFiltered(block)
+			if err != nil {
+				fmt.Fprintf(stderr, "error matching block %q: %v\n", block.Name, err)
+				continue
+			}
+			stats.Block(block, blockStats)
+
+			for _, match := range matches {
+				if hunks != nil {
+					pos := m.FileSet().Position(match.Node.Pos())
+					if !hunks.Contains(pos.Filename, pos.Line) {
+						continue
+					}
+				}
+				byBlock[i] = append(byBlock[i], found{block: block, fset: m.FileSet(), src: m.Source(), match: match})
+				n++
+				if n == limit {
+					break files
+				}
+			}
+		}
+	}
+
+	stats.Clear()
+
+	var results []found
+	for _, matches := range byBlock {
+		sortFound(matches)
+		results = append(results, matches...)
+	}
+	return results, nil
+}
+
+// sortFound orders matches by file, then by position in it, keeping
+// matches of the same node in the order they were found.
+func sortFound(matches []found) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		a := matches[i].fset.Position(matches[i].match.Node.Pos())
+		b := matches[j].fset.Position(matches[j].match.Node.Pos())
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+}
+
+// resolveSources returns the Go files to process: the files changed since
+// base when changed is set, otherwise the files the --source values name;
+// see expandSources. With both, only the changed files among those the
+// --source values name are kept. Either way, the files skip leaves out
+// are dropped and counted in excluded.
+func resolveSources(sources []string, includeTests, changed bool, base string, skip *filter.Filter) (files []string, excluded int, err error) {
+	if !changed {
+		return expandSources(sources, includeTests, skip)
+	}
+	if slices.Contains(sources, stdinArg) {
+		return nil, 0, errors.New("--changed can't be used with --source -")
+	}
+	changedFiles, err := changedGoFiles(base)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var named map[string]bool
+	if len(sources) > 0 {
+		// Changed test files are kept like any other changed file
+		under, _, err := expandSources(sources, true, skip)
+		if err != nil {
+			return nil, 0, err
+		}
+		named = make(map[string]bool, len(under))
+		for _, file := range under {
+			if abs, err := filepath.Abs(file); err == nil {
+				named[abs] = true
+			}
+		}
+	}
+
+	for _, file := range changedFiles {
+		if named != nil {
+			if abs, err := filepath.Abs(file); err != nil || !named[abs] {
+				continue
+			}
+		}
+		left, err := skip.Skip(".", file)
+		if err != nil {
+			return nil, 0, err
+		}
+		if left {
+			excluded++
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, excluded, nil
+}
+
+// bindingText renders a match's bindings as the source text they were
+// matched from, leaving out the ones the matcher adds itself. Spreads
+// are joined with ", ".
+func bindingText(m *matcher.Matcher, bindings matcher.Bindings) map[string]string {
+	text := make(map[string]string, len(bindings))
+	for name, v := range bindings {
+		if !strings.HasPrefix(name, "_") {
+			text[name] = sourceText(m, v)
+		}
+	}
+	return text
+}
+
+func sourceText(m *matcher.Matcher, v any) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case ast.Node:
+		if !val.Pos().IsValid() || !val.End().IsValid() {
+			return formatBinding(v)
+		}
+		start := m.FileSet().Position(val.Pos()).Offset
+		end := m.FileSet().Position(val.End()).Offset
+		return string(m.Source()[start:end])
+	}
+
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+		parts := make([]string, rv.Len())
+		for i := range parts {
+			parts[i] = sourceText(m, rv.Index(i).Interface())
+		}
+		return strings.Join(parts, ", ")
+	}
+	return fmt.Sprint(v)
+}
+
+// printBindings prints a match's bindings by name, one per line, leaving
+// out the implicit ones ($_match, ...).
+func printBindings(bindings matcher.Bindings, indent string) {
+	var names []string
+	for name := range bindings {
+		if !strings.HasPrefix(name, "_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if val := formatBinding(bindings[name]); val != "" {
+			fmt.Fprintf(stdout, "%s$%s = %s\n", indent, name, val)
+		}
+	}
+}
+
+// formatBinding formats a binding value for display.
+func formatBinding(v any) string {
+	if v == nil {
+		return "<nil>"
+	}
+
+	switch val := v.(type) {
+	case *ast.Ident:
+		return val.Name
+	case string:
+		return fmt.Sprintf("%q", val)
+	case *ast.FuncType:
+		return "<FuncType>"
+	case *ast.BlockStmt:
+		return "<BlockStmt>"
+	case *ast.FieldList:
+		if val == nil || val.List == nil {
+			return "<FieldList(0)>"
+		}
+		return fmt.Sprintf("<FieldList(%d)>", len(val.List))
+	default:
+		return fmt.Sprintf("<%T>", v)
+	}
+}
+
+// cmdApply applies transformations from a .lift file to Go source.
+func cmdApply(args []string) (int, error) {
+	fs := newFlagSet("apply", `  stencil apply <file.lift> --source <path>... | --changed
+  stencil apply --from-plan <plan.json> [--dry-run] [--backup]`)
+	var src sourceFlags
+	var run runFlags
+	src.register(fs)
+	run.register(fs)
+	var outputPath, reportPath, patchPath, planPath, fromPlan, modulePath, scope string
+	var writeInPlace, backup, showDiff bool
+	fs.BoolVar(&writeInPlace, "write", false, "write modified sources in place")
+	fs.BoolVar(&writeInPlace, "w", false, "shorthand for --write")
+	fs.StringVar(&outputPath, "output", "", "write the modified source to this `file` (single source only)")
+	fs.StringVar(&outputPath, "o", "", "shorthand for --output")
+	fs.BoolVar(&backup, "backup", false, "(with --write) save each original as <file>.orig")
+	fs.StringVar(&reportPath, "report", "", "write a JSON report of every transformation to this `file`")
+	fs.BoolVar(&showDiff, "diff", false, "print modified sources as unified diffs instead of in full")
+	fs.StringVar(&patchPath, "patch-file", "", "write every change, emitted files included, to this `file` as a patch\nfor git apply instead of writing files")
+	fs.StringVar(&planPath, "plan", "", "write the planned edits and emitted files as JSON to this `file`")
+	var rewrites stringsFlag
+	fs.Var(&rewrites, "rewrite-imports", "replace imports of the `old=new` path, and of packages beneath it, before\napplying the rule; repeatable")
+	fs.StringVar(&fromPlan, "from-plan", "", "apply the plan in this `file` verbatim; fails if a file changed since")
+	fs.StringVar(&modulePath, "module", "", "resolve added imports against this `go.mod`")
+	fs.StringVar(&scope, "scope", "file", "where matching starts: file, function (function bodies only) or\npackage (package-level declarations only)")
+	opts := applyOptions{}
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "don't write any files")
+	fs.BoolVar(&opts.lenient, "lenient", false, "leave unresolved ${Var} in emitted files instead of failing")
+	fs.BoolVar(&opts.waitGroup, "with-waitgroup", false, "track every goroutine wrap_in_goroutine starts with a sync.WaitGroup\nnamed wg, as if each said with_waitgroup")
+	fs.StringVar(&opts.templateDir, "template-dir", "", "resolve relative template_file paths against this `directory`")
+	fs.StringVar(&opts.outDir, "out-dir", ".", "write emitted files under this `directory`")
+	fs.BoolVar(&opts.failFast, "fail-fast", false, "stop at the first error instead of reporting it and going on")
+	fs.BoolVar(&opts.force, "force", false, "overwrite existing emitted files that aren't generated code")
+	fs.StringVar(&opts.format, "format", "gofmt", "post-process modified sources with gofmt or goimports")
+	fs.StringVar(&opts.guard, "guard-comment", "Code generated", "leave alone sources whose first comment contains this `text`;\n\"\" applies to every file")
+	args, err := parseCommand(fs, args)
+	if err != nil {
+		return 2, err
+	}
+	if fromPlan != "" {
+		return applyPlan(fromPlan, opts.dryRun, backup)
+	}
+	if len(args) != 1 {
+		return 1, errors.New("apply requires <file.lift> --source <path> or --changed")
+	}
+
+	liftPath, sources, base := args[0], []string(src.sources), src.base
+	changed := src.changed
+	optimize, timings, skipped := run.optimize, run.timings, run.skipped
+	run.setDebug()
+
+	if len(sources) == 0 && !changed {
+		return 1, errors.New("--source or --changed flag required")
+	}
+
+	liftPath, err = findLiftFile(liftPath)
+	if err != nil {
+		return 1, err
+	}
+
+	if err := checkStdin(liftPath, sources); err != nil {
+		return 1, err
+	}
+
+	// Source read from stdin can't be written back; on its own, and with
+	// no other output asked for, its modified form goes to stdout alone
+	toStdout := false
+	if slices.Contains(sources, stdinArg) {
+		if writeInPlace {
+			return 1, errors.New("--write can't write back to stdin; leave it out to print the modified source")
+		}
+		if _, err := readStdinSource(src.sourceName); err != nil {
+			return 1, err
+		}
+		toStdout = len(sources) == 1 && outputPath == "" && patchPath == "" && !showDiff && !opts.dryRun
+		if toStdout {
+			opts.log = stderr
+		}
+	}
+
+	if backup && !writeInPlace {
+		return 1, errors.New("--backup requires --write")
+	}
+
+	if patchPath != "" && (writeInPlace || outputPath != "") {
+		return 1, errors.New("--patch-file can't be combined with --write or --output")
+	}
+
+	if opts.format != "gofmt" && opts.format != "goimports" {
+		return 1, fmt.Errorf("unknown --format %q (want gofmt or goimports)", opts.format)
+	}
+
+	if opts.scope, err = matcher.ParseGranularity(scope); err != nil {
+		return 1, fmt.Errorf("--scope: %w", err)
+	}
+
+	for _, rewrite := range rewrites {
+		from, to, ok := strings.Cut(rewrite, "=")
+		if !ok || from == "" || to == "" {
+			return 1, fmt.Errorf("--rewrite-imports wants old=new, got %q", rewrite)
+		}
+		if opts.rewrites == nil {
+			opts.rewrites = make(map[string]string)
+		}
+		opts.rewrites[from] = to
+	}
+
+	// Parse .lift file
+	parser, err := grammar.NewParser()
+	if err != nil {
+		return 1, fmt.Errorf("failed to build parser: %w", err)
+	}
+
+	liftData, err := readLift(liftPath)
+	if err != nil {
+		return 1, err
+	}
+
+	prog, err := parseLift(parser, liftPath, liftData)
+	if err != nil {
+		printParseError(liftPath, err)
+		return 1, nil
+	}
+
+	if optimize {
+		optimizeWhere(prog.Blocks)
+	}
+
+	skip, err := filter.New(src.exclude, src.includeGenerated)
+	if err != nil {
+		return 1, err
+	}
+	sourcePaths, excluded, err := resolveSources(sources, src.includeTests, changed, base, skip)
+	if err != nil {
+		return 1, err
+	}
+
+	if outputPath != "" && len(sourcePaths) > 1 {
+		return 1, errors.New("--output requires a single source file")
+	}
+
+	if reportPath != "" {
+		opts.report = report.New(reportPath)
+	}
+	if planPath != "" {
+		opts.plan = plan.New(opts.outDir)
+	}
+	if patchPath != "" {
+		opts.patch = &patchSet{emitted: make(map[string]string)}
+	}
+	opts.regions = &regionWriter{}
+	opts.written = make(map[string]bool)
+	var failures int
+	opts.failures = &failures
+
+	if modulePath != "" {
+		opts.module, err = executor.ReadModule(modulePath)
+		if err != nil {
+			return 1, err
+		}
+	}
+
+	opts.stats = newRunStats(len(sourcePaths), timings)
+	opts.stats.excluded = excluded
+	totalMatches := 0
+	var guardedPaths []string
+	for _, path := range sourcePaths {
+		opts.stats.File(path)
+		modified, n, err := applyFile(prog, path, opts)
+		if skipped.Skip(path, err) {
+			continue
+		}
+		if errors.Is(err, errGuarded) {
+			guardedPaths = append(guardedPaths, path)
+			if toStdout {
+				stdout.Write(stdinSource.data)
+			}
+			continue
+		}
+		if err != nil {
+			if len(sourcePaths) == 1 || opts.failFast {
+				return 1, err
+			}
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			continue
+		}
+		totalMatches += n
+
+		if n == 0 && modified == "" {
+			if toStdout {
+				stdout.Write(stdinSource.data)
+			}
+			continue
+		}
+
+		original, err := readSource(path)
+		if err != nil {
+			return 1, err
+		}
+		if modified == "" {
+			if opts.plan != nil {
+				opts.plan.Source(path, original, nil)
+			}
+			if toStdout {
+				stdout.Write(original)
+			}
+			continue
+		}
+
+		// Keep the source's line endings
+		output := matchLineEndings(original, []byte(modified))
+		if opts.plan != nil {
+			opts.plan.Source(path, original, output)
+		}
+
+		// Handle output
+		if opts.patch != nil {
+			if !bytes.Equal(original, output) {
+				opts.patch.sources.WriteString(diff.File(patchName(path), original, output))
+				opts.logf("\n→ added %s to the patch\n", path)
+			}
+		} else if opts.dryRun {
+			fmt.Fprintf(stdout, "\n(dry run) would modify %s\n", path)
+		} else if writeInPlace {
+			if backup {
+				backupPath, err := backupFile(path)
+				if err != nil {
+					return 1, fmt.Errorf("backing up %s: %w", path, err)
+				}
+				fmt.Fprintf(stdout, "\n→ saved %s\n", backupPath)
+			}
+			if err := writeFileAtomic(path, output); err != nil {
+				return 1, fmt.Errorf("writing %s: %w", path, err)
+			}
+			fmt.Fprintf(stdout, "\n→ wrote %s\n", path)
+		} else if outputPath != "" {
+			if err := os.WriteFile(outputPath, output, 0644); err != nil {
+				return 1, fmt.Errorf("writing %s: %w", outputPath, err)
+			}
+			fmt.Fprintf(stdout, "\n→ wrote %s\n", outputPath)
+		} else if toStdout {
+			stdout.Write(output)
+		} else if showDiff {
+			fmt.Fprintln(stdout)
+			fmt.Fprint(stdout, diff.File(patchName(path), original, output))
+		} else {
+			// Print to stdout
+			fmt.Fprintf(stdout, "\n--- Modified source: %s ---\n", path)
+			fmt.Fprintln(stdout, modified)
+		}
+	}
+
+	if err := opts.regions.Write(opts); err != nil {
+		return 1, err
+	}
+
+	if opts.report != nil {
+		if err := opts.report.Close(); err != nil {
+			return 1, fmt.Errorf("writing report %s: %w", reportPath, err)
+		}
+		opts.logf("\n→ wrote report %s\n", reportPath)
+	}
+
+	if opts.patch != nil {
+		patch, err := opts.patch.String(opts)
+		if err != nil {
+			return 1, err
+		}
+		if err := os.WriteFile(patchPath, []byte(patch), 0644); err != nil {
+			return 1, fmt.Errorf("writing patch %s: %w", patchPath, err)
+		}
+		opts.logf("\n→ wrote patch %s\n", patchPath)
+	}
+
+	if opts.plan != nil {
+		if err := opts.plan.Write(planPath); err != nil {
+			return 1, fmt.Errorf("writing plan %s: %w", planPath, err)
+		}
+		opts.logf("\n→ wrote plan %s\n", planPath)
+	}
+
+	if totalMatches == 0 {
+		opts.logf("No matches found.\n")
+	}
+	opts.stats.Summary(len(skipped.Skipped))
+
+	if len(guardedPaths) > 0 {
+		fmt.Fprintf(stderr, "\n%d file(s) left alone, their first comment contains %q (--guard-comment \"\" includes them)\n",
+			len(guardedPaths), opts.guard)
+		if skipped.verbose {
+			for _, path := range guardedPaths {
+				fmt.Fprintf(stderr, "  %s\n", path)
+			}
+		}
+	}
+
+	if skipped.Report() || failures > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// applyPlan applies a plan written by apply --plan: the recorded edits to
+// each source file, in place, and the recorded emitted files. Nothing is
+// written if any of those files changed since the plan was made.
+func applyPlan(planPath string, dryRun, backup bool) (int, error) {
+	p, err := plan.Read(planPath)
+	if err != nil {
+		return 1, err
+	}
+	if err := p.Check(); err != nil {
+		return 1, fmt.Errorf("%s no longer applies:\n%v", planPath, err)
+	}
+
+	// Apply every edit before writing anything, so a bad plan leaves all
+	// files as they were
+	outputs := make(map[string][]byte)
+	for _, f := range p.Files {
+		if len(f.Edits) == 0 {
+			continue
+		}
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			return 1, err
+		}
+		if outputs[f.Path], err = plan.Apply(data, f.Edits); err != nil {
+			return 1, fmt.Errorf("%s: %w", f.Path, err)
+		}
+	}
+	opts := applyOptions{outDir: p.OutDir, dryRun: dryRun}
+	for _, e := range p.Emitted {
+		if _, err := emittedPath(e.Path, opts); err != nil {
+			return 1, err
+		}
+	}
+
+	for _, f := range p.Files {
+		output, ok := outputs[f.Path]
+		if !ok {
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(stdout, "(dry run) would modify %s (%d edit(s))\n", f.Path, len(f.Edits))
+			continue
+		}
+		if backup {
+			backupPath, err := backupFile(f.Path)
+			if err != nil {
+				return 1, fmt.Errorf("backing up %s: %w", f.Path, err)
+			}
+			fmt.Fprintf(stdout, "→ saved %s\n", backupPath)
+		}
+		if err := writeFileAtomic(f.Path, output); err != nil {
+			return 1, fmt.Errorf("writing %s: %w", f.Path, err)
+		}
+		fmt.Fprintf(stdout, "→ wrote %s\n", f.Path)
+	}
+	for _, e := range p.Emitted {
+		if err := writeUnder(filepath.Clean(e.Path), e.Content, opts); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+func cmdRestore(args []string) (int, error) {
+	fs := newFlagSet("restore", "  stencil restore <file.go>...")
+	args, err := parseCommand(fs, args)
+	if err != nil {
+		return 2, err
+	}
+	if len(args) == 0 {
+		return 1, errors.New("restore requires a .go file path")
+	}
+
+	for _, path := range args {
+		if err := restoreFile(path); err != nil {
+			return 1, err
+		}
+		fmt.Fprintf(stdout, "✓ restored %s\n", path)
+	}
+	return 0, nil
+}
+
+// cmdRules lists the built-in rules or prints one.
+func cmdRules(args []string) (int, error) {
+	fs := newFlagSet("rules", `  stencil rules list
+  stencil rules show <name>`)
+	args, err := parseCommand(fs, args)
+	if err != nil {
+		return 2, err
+	}
+	if len(args) == 0 {
+		return 1, errors.New("rules requires list or show <name>")
+	}
+
+	switch args[0] {
+	case "list":
+		for _, rule := range rules.List() {
+			fmt.Fprintf(stdout, "%-22s %s\n", rule.Name, rule.Description)
+		}
+	case "show":
+		if len(args) < 2 {
+			return 1, errors.New("rules show requires a rule name")
+		}
+		data, err := rules.Source(strings.TrimPrefix(args[1], rules.Prefix))
+		if err != nil {
+			return 1, err
+		}
+		fmt.Fprint(stdout, string(data))
+	default:
+		return 1, fmt.Errorf("unknown rules command %q (want list or show)", args[0])
+	}
+	return 0, nil
+}
+
+// optimizeWhere reorders each block's where predicates cheapest first.
+func optimizeWhere(blocks []*grammar.LiftBlock) {
+	for _, block := range blocks {
+		block.Where = matcher.OptimizeWhere(block.Where)
+	}
+}
+
+// newMatcher creates a matcher for a Go source file, type-checking its
+// package if any block's where clause needs type information.
+func newMatcher(path string, blocks []*grammar.LiftBlock) (*matcher.Matcher, error) {
+	src, err := readSource(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := matcher.NewFromSource(path, src)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		if matcher.UsesTypes(block.Where) {
+			if err := m.WithTypeCheck(nil); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return m, nil
+}
+
+// applyOptions controls side effects of applyFile.
+type applyOptions struct {
+	dryRun    bool                // don't write emitted files
+	report    *report.Writer      // record each match acted on, if non-nil
+	module    *executor.Module    // resolve added imports against, if non-nil
+	lenient   bool                // leave unresolved ${Var} in emitted files
+	waitGroup bool                // track every wrap_in_goroutine with a wait group
+	regions   *regionWriter       // collects emit into output across files
+	force     bool                // overwrite emitted files that aren't generated code
+	format    string              // "gofmt" or "goimports"; see formatSource
+	stats     *runStats           // progress and per-block timings, if non-nil
+	plan      *plan.Plan          // record planned changes, if non-nil
+	patch     *patchSet           // collect changes as a diff instead of writing them, if non-nil
+	scope     matcher.Granularity // where matchers without a scope of their own look
+	guard     string              // skip sources whose first comment contains this, unless empty
+	log       io.Writer           // where progress lines go; stdout if nil
+
+	rewrites map[string]string // import paths to replace before matching, old to new
+	failFast bool              // return the first matching or execution error
+
+	templateDir string // resolves relative template_file paths
+	outDir      string // emitted files are written under this directory
+
+	written  map[string]bool // emitted files written so far this run, by path under outDir
+	failures *int            // errors reported and gone past, which fail the run
+}
+
+// fail reports an error that the run goes past, so that it still ends
+// with a non-zero exit code.
+func (opts applyOptions) fail(err error) {
+	fmt.Fprintf(stderr, "error: %v\n", err)
+	if opts.failures != nil {
+		*opts.failures++
+	}
+}
+
+// logf prints a progress line to opts.log.
+func (opts applyOptions) logf(format string, args ...any) {
+	w := opts.log
+	if w == nil {
+		w = stdout
+	}
+	fmt.Fprintf(w, format, args...)
+}
+
+// errGuarded is returned by applyFile for a source it leaves alone
+// because of --guard-comment.
+var errGuarded = errors.New("source is guarded")
+
+// guarded reports whether the first comment in file contains guard, as
+// the "Code generated ... DO NOT EDIT." header of generated code does. An
+// empty guard guards nothing.
+func guarded(file *ast.File, guard string) bool {
+	if guard == "" || len(file.Comments) == 0 {
+		return false
+	}
+	for _, c := range file.Comments[0].List {
+		if strings.Contains(c.Text, guard) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFile runs every lift block in prog against one Go source file,
+// writing any emitted files as it goes. It returns the modified source and
+// the number of matches acted on.
+func applyFile(prog *grammar.Program, sourcePath string, opts applyOptions) (string, int, error) {
+	// Create matcher from Go source
+	m, err := newMatcher(sourcePath, prog.Blocks)
+	if err != nil {
+		return "", 0, err
+	}
+	m.SetGranularity(opts.scope)
+	if guarded(m.File(), opts.guard) {
+		return "", 0, errGuarded
+	}
+
+	rewritten := executor.RewriteImports(m.File(), opts.rewrites)
+	if rewritten > 0 {
+		opts.stats.Clear()
+		opts.logf("%s: rewrote %d import(s)\n", sourcePath, rewritten)
+	}
+
+	// Create executor sharing the same AST
+	exec := executor.NewFromMatcher(m)
+	exec.SetModule(opts.module)
+	exec.SetLenient(opts.lenient)
+	exec.SetWaitGroup(opts.waitGroup)
+	exec.SetTemplateDir(opts.templateDir)
+
+	// Emitted files named by a merge action are collected across blocks
+	// and written once at the end
+	merges := mergeActions(prog)
+	pending := make(map[string][]string)
+
+	// So are GraphQL schemas and generated proto files, which accumulate
+	// into one document
+	schemas := schemaFiles(prog)
+	pendingSchemas := make(map[string][]string)
+	emits := emitClauses(prog)
+
+	// A file that can't be written is reported and the run goes on, or
+	// with --fail-fast stops there
+	emitFailed := func(err error) error {
+		if err == nil {
+			return nil
+		}
+		if opts.failFast {
+			return fmt.Errorf("%s: %w", sourcePath, err)
+		}
+		opts.fail(err)
+		return nil
+	}
+
+	// Process each lift block
+	var lastResult *executor.Result
+	totalMatches := 0
+
+	for _, block := range prog.Blocks {
+		matches, stats, err := m.MatchFiltered(block)
+		if err != nil && opts.failFast {
+			return "", 0, fmt.Errorf("%s: block %q: %w", sourcePath, block.Name, err)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error matching block %q: %v\n", block.Name, err)
+			continue
+		}
+		opts.stats.Block(block, stats)
+
+		if len(matches) == 0 {
+			continue
+		}
+
+		opts.stats.Clear()
+		opts.logf("%s: block %q: applying to %d match(es)\n", sourcePath, block.Name, len(matches))
+		totalMatches += len(matches)
+
+		// Execute actions
+		result, err := exec.Execute(block, matches)
+		if err != nil && opts.failFast {
+			pos := m.FileSet().Position(matches[0].Node.Pos())
+			return "", 0, fmt.Errorf("%s: block %q: %w", pos, block.Name, err)
+		}
+		var unresolved *executor.UnresolvedError
+		if errors.As(err, &unresolved) {
+			fmt.Fprintf(stderr, "error: %v (use --lenient to keep them)\n", err)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error executing block %q: %v\n", block.Name, err)
+			continue
+		}
+		lastResult = result
+
+		// Report applied actions
+		for _, action := range result.Applied {
+			opts.logf("  ✓ %s\n", action)
+		}
+
+		if opts.report != nil {
+			for i, match := range matches {
+				pos := m.FileSet().Position(match.Node.Pos())
+				opts.report.Add(report.Entry{
+					Block:   block.Name,
+					File:    sourcePath,
+					Line:    pos.Line,
+					Actions: result.MatchActions[i],
+				})
+			}
+		}
+
+		if opts.plan != nil {
+			for i, match := range matches {
+				pos := m.FileSet().Position(match.Node.Pos())
+				for _, kind := range result.MatchActions[i] {
+					opts.plan.Action(sourcePath, plan.Action{
+						Block:  block.Name,
+						Kind:   kind,
+						Line:   pos.Line,
+						Column: pos.Column,
+					})
+				}
+			}
+		}
+
+		if opts.regions != nil {
+			for _, region := range result.Regions {
+				opts.regions.Add(region)
+			}
+		}
+
+		// Write emitted files
+		for _, filename := range result.EmittedNames() {
+			content := result.EmittedFiles[filename]
+			if _, ok := merges[filename]; ok {
+				pending[filename] = append(pending[filename], content)
+				continue
+			}
+			if _, ok := schemas[filename]; ok {
+				pendingSchemas[filename] = append(pendingSchemas[filename], content)
+				continue
+			}
+			if err := emitFailed(writeEmitted(filename, content, emits[filename], opts)); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+
+	for _, filename := range sortedFiles(pendingSchemas) {
+		if err := emitFailed(writeEmitted(filename, schemas[filename](pendingSchemas[filename]), emits[filename], opts)); err != nil {
+			return "", 0, err
+		}
+	}
+
+	for _, filename := range sortedFiles(pending) {
+		var pkg string
+		if merge := merges[filename]; merge.Package != nil {
+			pkg = *merge.Package
+		}
+		content, err := executor.MergeFiles(pkg, pending[filename])
+		if err != nil {
+			err = fmt.Errorf("merging %s: %w", filename, err)
+		} else {
+			err = writeEmitted(filename, content, emits[filename], opts)
+		}
+		if err := emitFailed(err); err != nil {
+			return "", 0, err
+		}
+	}
+
+	var src string
+	switch {
+	case lastResult != nil:
+		src = lastResult.ModifiedSource
+	case rewritten > 0:
+		if src, err = exec.Source(); err != nil {
+			return "", totalMatches, err
+		}
+	default:
+		return "", totalMatches, nil
+	}
+	src, err = formatSource(sourcePath, src, opts.format)
+	if err != nil {
+		return "", totalMatches, err
+	}
+	// goimports prints the header as gofmt does, dropping a BOM and adding
+	// //go:build
+	if src, err = exec.RestoreHeader(src); err != nil {
+		return "", totalMatches, err
+	}
+	return src, totalMatches, nil
+}
+
+// formatSource post-processes a modified source. The executor already
+// prints it as gofmt would; goimports also adds imports that inserted code
+// uses and removes ones it no longer does, resolving them from the
+// source's module.
+func formatSource(path, src, format string) (string, error) {
+	if format != "goimports" {
+		return src, nil
+	}
+	out, err := imports.Process(path, []byte(src), nil)
+	if err != nil {
+		return "", fmt.Errorf("goimports %s: %w", path, err)
+	}
+	return string(out), nil
+}
+
+// mergeActions returns the merge actions in prog, keyed by file name.
+func mergeActions(prog *grammar.Program) map[string]*grammar.MergeClause {
+	merges := make(map[string]*grammar.MergeClause)
+	for _, block := range prog.Blocks {
+		for _, action := range block.Actions {
+			if action.Merge != nil {
+				merges[action.Merge.File] = action.Merge
+			}
+		}
+	}
+	return merges
+}
+
+// schemaFiles returns the files in prog whose emitted output accumulates,
+// with the function that combines it.
+func schemaFiles(prog *grammar.Program) map[string]func([]string) string {
+	files := make(map[string]func([]string) string)
+	for _, block := range prog.Blocks {
+		for _, action := range block.Actions {
+			if action.Emit == nil {
+				continue
+			}
+			if merge := executor.SchemaMerger(action.Emit); merge != nil {
+				files[action.Emit.File] = merge
+			}
+		}
+	}
+	return files
+}
+
+// emitClauses returns the emit action writing each file prog emits to,
+// keyed by file name. A file a merge action writes has a go emit.
+func emitClauses(prog *grammar.Program) map[string]*grammar.EmitClause {
+	emits := make(map[string]*grammar.EmitClause)
+	for _, block := range prog.Blocks {
+		for _, action := range block.Actions {
+			switch {
+			case action.Emit != nil:
+				emits[action.Emit.File] = action.Emit
+			case action.Merge != nil:
+				emits[action.Merge.File] = &grammar.EmitClause{Target: "go", File: action.Merge.File}
+			}
+		}
+	}
+	return emits
+}
+
+// sortedFiles returns the file names collected in pending, in order.
+func sortedFiles(pending map[string][]string) []string {
+	filenames := make([]string, 0, len(pending))
+	for filename := range pending {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// regionWriter collects the output of emit into actions across source
+// files, so each region is written once with the matches of every file.
+type regionWriter struct {
+	regions []executor.Region
+}
+
+// Add records a region, appending to an earlier one for the same file
+// and block.
+func (w *regionWriter) Add(r executor.Region) {
+	for i := range w.regions {
+		if prev := &w.regions[i]; prev.File == r.File && prev.Block == r.Block {
+			prev.Content += "\n" + r.Content
+			prev.Imports = append(prev.Imports, r.Imports...)
+			return
+		}
+	}
+	w.regions = append(w.regions, r)
+}
+
+// Write replaces each collected region in its file, creating the file if
+// it doesn't exist. A file is only rewritten if a region changed.
+func (w *regionWriter) Write(opts applyOptions) error {
+	var files []string
+	byFile := make(map[string][]executor.Region)
+	for _, r := range w.regions {
+		if _, ok := byFile[r.File]; !ok {
+			files = append(files, r.File)
+		}
+		byFile[r.File] = append(byFile[r.File], r)
+	}
+
+	for _, file := range files {
+		rel, err := emittedPath(file, opts)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(filepath.Join(opts.outDir, rel))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		content := string(data)
+		for _, r := range byFile[file] {
+			if content, err = executor.ReplaceRegion(content, r); err != nil {
+				return err
+			}
+			if content, err = executor.AddImports(content, r.Imports); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		}
+		if data != nil && content == string(data) {
+			opts.logf("  ✓ %s is up to date\n", rel)
+			continue
+		}
+		// Regions keep everything outside their markers, so hand-written
+		// files are fair game
+		if err := writeUnder(rel, content, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generatedHeader matches the "Code generated ... DO NOT EDIT." line that
+// marks a file as safe to regenerate, behind any of the comment prefixes
+// emitted files use, or as the "$comment" of a JSON Schema.
+var generatedHeader = regexp.MustCompile(`(?m)^((//|--|#) Code generated .* DO NOT EDIT\.\r?$|\s*"\$comment": "Code generated .* DO NOT EDIT\.")`)
+
+// generatedText is the generated code header markGenerated adds.
+const generatedText = "Code generated by stencil. DO NOT EDIT."
+
+// markGenerated returns content with a generated code header, so a later
+// run may replace the file: a comment line at the top for targets that
+// have comments, and a "$comment" for a JSON Schema. Other JSON is left
+// as it is, and content that already has a header is too.
+func markGenerated(content string, emit *grammar.EmitClause) string {
+	if emit == nil || generatedHeader.MatchString(content) {
+		return content
+	}
+	if prefix, ok := executor.CommentPrefix(emit.Target); ok {
+		return prefix + " " + generatedText + "\n\n" + content
+	}
+	if emit.Schema != nil && strings.HasPrefix(content, "{\n") {
+		return "{\n  \"$comment\": \"" + generatedText + "\",\n" + content[2:]
+	}
+	return content
+}
+
+// writeEmitted writes a file produced by an emit or merge action under
+// opts.outDir, marked as generated code. It won't replace an existing
+// file that lacks the generated code header, unless this run wrote it or
+// opts.force is set.
+func writeEmitted(filename, content string, emit *grammar.EmitClause, opts applyOptions) error {
+	rel, err := emittedPath(filename, opts)
+	if err != nil {
+		return err
+	}
+	if !opts.force && !opts.written[rel] {
+		data, err := os.ReadFile(filepath.Join(opts.outDir, rel))
+		if err == nil && !generatedHeader.Match(data) {
+			return fmt.Errorf("%s already exists and is not generated code (use --force to overwrite)", rel)
+		}
+	}
+	if opts.written != nil {
+		opts.written[rel] = true
+	}
+	return writeUnder(rel, markGenerated(content, emit), opts)
+}
+
+// emittedPath returns an emitted file's name cleaned and relative to
+// opts.outDir, rejecting absolute paths and names such as "../x" that
+// would land outside it.
+func emittedPath(filename string, opts applyOptions) (string, error) {
+	if filepath.IsAbs(filename) {
+		return "", fmt.Errorf("emitted file %s: absolute paths are not allowed", filename)
+	}
+	if !filepath.IsLocal(filename) {
+		return "", fmt.Errorf("emitted file %s is outside the output directory %s", filename, opts.outDir)
+	}
+	return filepath.Clean(filename), nil
+}
+
+// writeUnder writes content to rel within opts.outDir, creating any
+// missing directories, and reports the path relative to outDir.
+func writeUnder(rel, content string, opts applyOptions) error {
+	path := filepath.Join(opts.outDir, rel)
+	if opts.plan != nil {
+		e := plan.Emitted{Path: rel, Hash: plan.Hash([]byte(content)), Content: content}
+		if data, err := os.ReadFile(path); err == nil {
+			e.Previous = plan.Hash(data)
+		}
+		opts.plan.Emit(e)
+	}
+	if opts.patch != nil {
+		// Diffed once the run is over, against the file as it is now
+		opts.patch.emitted[rel] = content
+		return nil
+	}
+	if opts.dryRun {
+		opts.logf("  (dry run) would write %s\n", rel)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("writing %s: %w", rel, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("writing %s: %w", rel, err)
+	}
+	opts.logf("  → wrote %s\n", rel)
+	return nil
+}
+
+// patchSet collects the changes apply --patch-file writes: the diffs of
+// modified sources, and the final content of each emitted file.
+type patchSet struct {
+	sources strings.Builder
+	emitted map[string]string // by path under opts.outDir
+}
+
+// String returns the patch: the sources' diffs, then one diff for each
+// emitted file that changes, which is reported as it is added.
+func (p *patchSet) String(opts applyOptions) (string, error) {
+	var b strings.Builder
+	b.WriteString(p.sources.String())
+	rels := make([]string, 0, len(p.emitted))
+	for rel := range p.emitted {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	for _, rel := range rels {
+		path := filepath.Join(opts.outDir, rel)
+		old, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			old = nil
+		} else if err != nil {
+			return "", err
+		} else if old == nil {
+			old = []byte{}
+		}
+		content := []byte(p.emitted[rel])
+		if old != nil && bytes.Equal(old, content) {
+			continue
+		}
+		b.WriteString(diff.File(patchName(path), old, content))
+		opts.logf("  → added %s to the patch\n", rel)
+	}
+	return b.String(), nil
+}
+
+// patchName returns path as a patch names it: slash-separated and, if it
+// is under the current directory, where git apply runs, relative to it.
+func patchName(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, abs); err == nil && filepath.IsLocal(rel) {
+				path = rel
+			}
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+// cmdLint applies every lift block found under a rules directory as a
+// read-only lint rule. Actions are never executed; each match is reported
+// as a violation at the block's severity (default "warning").
+//
+// Exit code is 1 if any violation is at or above --fail-on (default
+// error), or with --strict-parse if a file doesn't parse, and 0 otherwise.
+//
+// Given .lift paths instead, lint checks the rules themselves; see
+// lintRules.
+func cmdLint(args []string) (int, error) {
+	fs := newFlagSet("lint", `  stencil lint --rules <dir> --source <path>... | --changed
+  stencil lint [--strict] <file.lift|dir>...`)
+	var src sourceFlags
+	var run runFlags
+	src.register(fs)
+	run.register(fs)
+	var rulesDir, format, formatTemplate, summaryTemplate, failOn string
+	var maxFindings int
+	fs.StringVar(&rulesDir, "rules", "", "`directory` of .lift rules")
+	fs.StringVar(&format, "format", "", "findings `format`: "+strings.Join(findings.Names(), ", ")+" (default text)")
+	fs.StringVar(&formatTemplate, "format-template", "", "Go `template` each finding is printed with")
+	fs.StringVar(&summaryTemplate, "summary-template", "", "Go `template` the run summary is printed with;\nneeds --format-template")
+	fs.StringVar(&failOn, "fail-on", "error", "exit 1 on findings at or above this `severity`: error, warning or info")
+	fs.IntVar(&maxFindings, "max-findings", 0, "stop after `n` findings")
+	strict := fs.Bool("strict", false, "(with .lift paths) exit 1 if any rule has a warning")
+	args, err := parseCommand(fs, args)
+	if err != nil {
+		return 2, err
+	}
+	if len(args) > 0 {
+		if rulesDir != "" || len(src.sources) > 0 || src.changed {
+			return 1, errors.New("lint takes .lift paths or --rules and --source, not both")
+		}
+		return lintRules(args, *strict)
+	}
+	if maxFindings < 0 {
+		return 1, fmt.Errorf("--max-findings wants a positive number, got %d", maxFindings)
+	}
+	optimize, timings, skipped := run.optimize, run.timings, run.skipped
+	run.setDebug()
+
+	sources := []string(src.sources)
+	if rulesDir == "" || (len(sources) == 0 && !src.changed) {
+		return 1, errors.New("lint requires --rules <dir> --source <path> or --changed")
+	}
+	if severities[failOn] == 0 {
+		return 1, fmt.Errorf("--fail-on wants error, warning or info, got %q", failOn)
+	}
+
+	var formatter findings.Formatter
+	switch {
+	case formatTemplate != "":
+		if format != "" {
+			return 1, errors.New("--format-template can't be combined with --format")
+		}
+		// Template errors surface now, not once per finding
+		formatter, err = findings.NewTemplate(formatTemplate, summaryTemplate)
+	case summaryTemplate != "":
+		err = errors.New("--summary-template requires --format-template")
+	default:
+		if format == "" {
+			format = "text"
+		}
+		formatter, err = findings.Lookup(format)
+	}
+	if err != nil {
+		return 1, err
+	}
+
+	parser, err := grammar.NewParser()
+	if err != nil {
+		return 1, fmt.Errorf("failed to build parser: %w", err)
+	}
+
+	rulePaths, err := liftFiles(rulesDir)
+	if err != nil {
+		return 1, err
+	}
+
+	// Load all rules up front so a broken rule fails before any source is read
+	var blocks []*grammar.LiftBlock
+	for _, path := range rulePaths {
+		data, err := readLift(path)
+		if err != nil {
+			return 1, err
+		}
+
+		prog, err := parseLift(parser, path, data)
+		if err != nil {
+			printParseError(path, err)
+			return 1, nil
+		}
+		blocks = append(blocks, prog.Blocks...)
+	}
+
+	if optimize {
+		optimizeWhere(blocks)
+	}
+
+	if slices.Contains(sources, stdinArg) {
+		if _, err := readStdinSource(src.sourceName); err != nil {
+			return 1, err
+		}
+	}
+	skip, err := filter.New(src.exclude, src.includeGenerated)
+	if err != nil {
+		return 1, err
+	}
+	sourcePaths, excluded, err := resolveSources(sources, src.includeTests, src.changed, src.base, skip)
+	if err != nil {
+		return 1, err
+	}
+
+	stats := newRunStats(len(sourcePaths), timings)
+	stats.excluded = excluded
+	counts := make(map[string]int)
+	var found []findings.Finding
+files:
+	for _, path := range sourcePaths {
+		stats.File(path)
+		m, err := newMatcher(path, blocks)
+		if skipped.Skip(path, err) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			continue
+		}
+
+		for _, block := range blocks {
+			matches, blockStats, err := m.MatchFiltered(block)
+			if err != nil {
+				fmt.Fprintf(stderr, "error matching block %q: %v\n", block.Name, err)
+				continue
+			}
+			stats.Block(block, blockStats)
+
+			severity := blockSeverity(block)
+			for _, match := range matches {
+				pos := m.FileSet().Position(match.Node.Pos())
+				found = append(found, findings.Finding{
+					File:     pos.Filename,
+					Line:     pos.Line,
+					Column:   pos.Column,
+					Block:    block.Name,
+					Severity: severity,
+					Message:  blockMessage(block),
+					Bindings: bindingText(m, match.Bindings),
+				})
+				counts[severity]++
+				if len(found) == maxFindings {
+					break files
+				}
+			}
+		}
+	}
+
+	stats.Clear()
+	findings.Sort(found)
+	if err := formatter.Format(stdout, found); err != nil {
+		return 1, err
+	}
+
+	// Other formats are read by tools, so stdout holds nothing else
+	if format == "text" {
+		total := counts["error"] + counts["warning"] + counts["info"]
+		if total == 0 {
+			fmt.Fprintln(stdout, "No violations found.")
+		} else {
+			fmt.Fprintf(stdout, "\n%d violation(s): %d error(s), %d warning(s), %d info\n",
+				total, counts["error"], counts["warning"], counts["info"])
+		}
+	}
+	stats.Summary(len(skipped.Skipped))
+	if maxFindings > 0 && len(found) >= maxFindings {
+		fmt.Fprintf(stderr, "Stopped at --max-findings %d, the remaining files weren't linted\n", maxFindings)
+	}
+	failSkipped := skipped.Report()
+
+	for severity, n := range counts {
+		if n > 0 && severities[severity] >= severities[failOn] {
+			return 1, nil
+		}
+	}
+	if failSkipped {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// lintRules checks the .lift files at paths, each a file or a directory
+// of them, with grammar.Program.Lint and prints the warnings. Exit code is
+// 1 if a file doesn't parse, or with strict if there are any warnings.
+func lintRules(paths []string, strict bool) (int, error) {
+	parser, err := grammar.NewParser()
+	if err != nil {
+		return 1, fmt.Errorf("failed to build parser: %w", err)
+	}
+
+	var files []string
+	for _, path := range paths {
+		found, err := liftFiles(path)
+		if err != nil {
+			return 1, err
+		}
+		files = append(files, found...)
+	}
+
+	failed, warnings := false, 0
+	for _, path := range files {
+		data, err := readLift(path)
+		if err != nil {
+			return 1, err
+		}
+		prog, err := parseLift(parser, path, data)
+		if err != nil {
+			printParseError(path, err)
+			failed = true
+			continue
+		}
+		for _, w := range prog.Lint() {
+			fmt.Fprintf(stdout, "%s:%d:%d: warning: %s\n", path, w.Pos.Line, w.Pos.Column, w.Message)
+			warnings++
+		}
+	}
+
+	if warnings == 0 {
+		fmt.Fprintf(stdout, "✓ %d rule file(s), no warnings\n", len(files))
+	} else {
+		fmt.Fprintf(stdout, "\n%d warning(s) in %d rule file(s)\n", warnings, len(files))
+	}
+	if failed || (strict && warnings > 0) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// severities ranks the severities a block can declare, least severe
+// first.
+var severities = map[string]int{"info": 1, "warning": 2, "error": 3}
+
+// blockSeverity returns the declared severity of a lift block, defaulting
+// to "warning" when none is given.
+func blockSeverity(block *grammar.LiftBlock) string {
+	if block.Severity == "" {
+		return "warning"
+	}
+	return block.Severity
+}
+
+// blockMessage returns the violation message for a lift block: its declared
+// message if any, otherwise the block name.
+func blockMessage(block *grammar.LiftBlock) string {
+	if block.Message != nil {
+		return *block.Message
+	}
+	return block.Name
+}
+
+// collectFiles returns path itself if it is a file, or every file with the
+// given extension beneath it if it is a directory, in lexical order.
+func collectFiles(path, ext string) ([]string, error) {
+	// dir/... is the same as dir, which is walked recursively anyway
+	if dir, ok := strings.CutSuffix(path, "/..."); ok {
+		path = dir
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(p) == ext {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
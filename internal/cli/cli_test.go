@@ -0,0 +1,1348 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/internal/filter"
+)
+
+// run runs the command line args and returns its exit code and output.
+func run(args ...string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	code = Run(args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// writeFiles writes each file's contents under dir, creating directories
+// as needed.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLintExitCode(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rules/panic.lift": `lift "no-panic" {
+	severity: error
+	from go { match CallExpr { fun: Ident { name: "panic" } } }
+}
+`,
+		"rules/print.lift": `lift "no-println" {
+	severity: warning
+	from go { match CallExpr { fun: Ident { name: "println" } } }
+}
+`,
+		"panics/a.go": "package a\n\nfunc A() { panic(1) }\n",
+		"prints/b.go": "package b\n\nfunc B() { println(1) }\n",
+		"clean/c.go":  "package c\n\nfunc C() {}\n",
+	})
+	rules := filepath.Join(dir, "rules")
+
+	tests := []struct {
+		source string
+		args   []string
+		want   int
+	}{
+		{"panics", nil, 1},
+		{"prints", nil, 0},
+		{"prints", []string{"--fail-on", "warning"}, 1},
+		{"clean", []string{"--fail-on", "info"}, 0},
+	}
+	for _, tt := range tests {
+		args := append([]string{"lint", "--rules", rules, "--source", filepath.Join(dir, tt.source)}, tt.args...)
+		if code, _, errOut := run(args...); code != tt.want {
+			t.Errorf("lint --source %s %v: exit code %d, want %d\n%s", tt.source, tt.args, code, tt.want, errOut)
+		}
+	}
+
+	if code, _, errOut := run("lint", "--rules", rules, "--source", dir, "--fail-on", "fatal"); code != 1 || !strings.Contains(errOut, "--fail-on") {
+		t.Errorf("expected an error for --fail-on fatal, got %d, %q", code, errOut)
+	}
+
+	t.Logf("✓ lint exit codes follow --fail-on")
+}
+
+// TestMaxFindings checks that --max-findings stops reading files: the
+// file that doesn't parse comes after the first finding, so it fails the
+// run under --strict-parse only if it is read.
+func TestMaxFindings(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "no-println" {
+	from go { match CallExpr { fun: Ident { name: "println" } } }
+}
+`,
+		"src/a.go": "package a\n\nfunc A() { println(1); println(2) }\n",
+		"src/b.go": "package a\n\nfunc B( {\n",
+	})
+	rule := filepath.Join(dir, "rule.lift")
+	src := filepath.Join(dir, "src")
+
+	for _, args := range [][]string{
+		{"match", rule, "--source", src, "--strict-parse"},
+		{"lint", "--rules", rule, "--source", src, "--strict-parse", "--fail-on", "error"},
+	} {
+		if code, _, errOut := run(args...); code != 1 {
+			t.Errorf("%s without --max-findings: expected exit code 1 for the broken file, got %d\n%s", args[0], code, errOut)
+		}
+
+		if code, _, errOut := run(append(args, "--max-findings", "1")...); code != 0 {
+			t.Errorf("%s --max-findings 1: expected exit code 0 without reading the broken file, got %d\n%s", args[0], code, errOut)
+		}
+	}
+
+	t.Logf("✓ --max-findings stops the run")
+}
+
+func TestMatchMissingScope(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "in-main" {
+	from go { match CallExpr in func "main" { fun: Ident { name: "println" } } }
+}
+
+lift "in-nope" {
+	scope func "nope"
+	from go { match CallExpr { } }
+}
+`,
+		"src/a.go": "package a\n\nfunc main() { println(1) }\n",
+		"src/b.go": "package a\n\nfunc B() { println(2) }\n",
+		"src/c.go": "package a\n\nfunc C() { println(3) }\n",
+	})
+	rule := filepath.Join(dir, "rule.lift")
+	src := filepath.Join(dir, "src")
+
+	for _, args := range [][]string{
+		{"match", rule, "--source", src},
+		{"apply", rule, "--source", src, "--dry-run"},
+		{"lint", "--rules", rule, "--source", src},
+	} {
+		code, _, errOut := run(args...)
+		if code != 0 {
+			t.Fatalf("%s: expected exit code 0, got %d\n%s", args[0], code, errOut)
+		}
+		if strings.Contains(errOut, "error") {
+			t.Errorf("%s: a file without the declaration is an error:\n%s", args[0], errOut)
+		}
+		if n := strings.Count(errOut, `func "nope" not found`); n != 1 {
+			t.Errorf("%s: expected one warning for func \"nope\", got %d:\n%s", args[0], n, errOut)
+		}
+		if strings.Contains(errOut, `func "main" not found`) {
+			t.Errorf("%s: warned about func \"main\", which a.go has:\n%s", args[0], errOut)
+		}
+	}
+
+	t.Logf("✓ A scope missing from a file matches nothing there, with one warning per run")
+}
+
+func TestFlags(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "no-println" {
+	from go { match CallExpr { fun: Ident { name: "println" } } }
+}
+`,
+		"a.go": "package a\n\nfunc A() { println(1) }\n",
+	})
+	rule := filepath.Join(dir, "rule.lift")
+	src := filepath.Join(dir, "a.go")
+
+	// Flags go before or after the lift file, in either spelling
+	for _, args := range [][]string{
+		{"match", rule, "--source", src},
+		{"match", "--source", src, rule},
+		{"match", "--source=" + src, rule},
+		{"match", "-source", src, "--", rule},
+	} {
+		code, out, errOut := run(args...)
+		if code != 0 || !strings.Contains(out, "no-println") {
+			t.Errorf("%v: exit code %d, output %q\n%s", args, code, out, errOut)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want int
+		in   string // expected in stderr
+	}{
+		{[]string{"match", "-h"}, 0, "--max-findings"},
+		{[]string{"help", "apply"}, 0, "--from-plan"},
+		{[]string{"match", rule, "--source", src, "--bogus"}, 2, "-bogus"},
+		{[]string{"match", rule, "--max-findings", "many"}, 2, "invalid value"},
+		{[]string{"match"}, 1, "match requires"},
+		{[]string{"frobnicate"}, 1, "unknown command"},
+	}
+	for _, tt := range tests {
+		code, _, errOut := run(tt.args...)
+		if code != tt.want || !strings.Contains(errOut, tt.in) {
+			t.Errorf("%v: exit code %d, want %d, with %q in stderr:\n%s", tt.args, code, tt.want, tt.in, errOut)
+		}
+	}
+
+	out := filepath.Join(dir, "http_get.lift")
+	if code, _, errOut := run("new-rule", "-o="+out, "--example", "../../testdata/scaffold/http_get.go", "--node", "CallExpr"); code != 0 {
+		t.Errorf("new-rule -o=path: exit code %d\n%s", code, errOut)
+	} else if _, err := os.Stat(out); err != nil {
+		t.Errorf("new-rule -o=path: %v", err)
+	}
+
+	if code, out, _ := run("--version"); code != 0 || !strings.Contains(out, "stencil") {
+		t.Errorf("--version: exit code %d, output %q", code, out)
+	}
+
+	t.Logf("✓ Flags parsed per command")
+}
+
+func TestLintRules(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rules/clean.lift": `lift "no-println" {
+	from go { match CallExpr { fun: Ident { name: "println" } } }
+}
+`,
+		"rules/empty.lift": `lift "empty-insert" {
+	from go { match FuncDecl { body: $Body } }
+	insert code { prepend $Body }
+}
+`,
+	})
+	rules := filepath.Join(dir, "rules")
+
+	code, out, errOut := run("lint", rules)
+	if code != 0 || !strings.Contains(out, "empty.lift:3:2: warning: insert code { prepend } has nothing to insert") {
+		t.Errorf("lint %s: exit code %d, output:\n%s%s", rules, code, out, errOut)
+	}
+	if code, _, _ := run("lint", "--strict", rules); code != 1 {
+		t.Errorf("lint --strict: expected exit code 1 for the warning, got %d", code)
+	}
+	if code, out, _ := run("lint", "--strict", filepath.Join(rules, "clean.lift")); code != 0 || !strings.Contains(out, "no warnings") {
+		t.Errorf("lint --strict clean.lift: exit code %d, output %q", code, out)
+	}
+	if code, _, _ := run("lint", "--rules", rules, rules); code != 1 {
+		t.Errorf("expected an error for .lift paths with --rules, got %d", code)
+	}
+
+	t.Logf("✓ lint checks .lift files")
+}
+
+func TestApplyRewriteImports(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "none" {
+	from go { match CallExpr { fun: Ident { name: "nothing" } } }
+	patch { }
+}
+`,
+		"a.go": "package a\n\nimport \"github.com/old/pkg\"\n\nvar _ = pkg.X\n",
+	})
+	out := filepath.Join(dir, "out.go")
+
+	// No block matches, but the imports still change
+	code, _, errOut := run("apply", filepath.Join(dir, "rule.lift"), "--source", filepath.Join(dir, "a.go"),
+		"--rewrite-imports", "github.com/old/pkg=github.com/new/pkg", "-o", out)
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, errOut)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `import "github.com/new/pkg"`) {
+		t.Errorf("expected the rewritten import, got:\n%s", data)
+	}
+
+	if code, _, errOut := run("apply", filepath.Join(dir, "rule.lift"), "--source", dir, "--rewrite-imports", "github.com/old/pkg"); code != 1 || !strings.Contains(errOut, "old=new") {
+		t.Errorf("expected an error for a rewrite without =, got %d\n%s", code, errOut)
+	}
+
+	t.Logf("✓ apply --rewrite-imports")
+}
+
+func TestApplyGoimportsHeader(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "rename" {
+	from go { match FuncDecl { name: $Fn } }
+	patch { rename $Fn "Get" }
+}
+`,
+	})
+	out := filepath.Join(dir, "out.go")
+
+	// goimports drops the BOM and adds //go:build; both are put back
+	code, _, errOut := run("apply", filepath.Join(dir, "rule.lift"), "--source", "../../testdata/bom_plus_build.go",
+		"--format", "goimports", "-o", out)
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, errOut)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\uFEFF// +build linux\n\npackage client\n\nfunc Get() {}\n"
+	if string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+
+	t.Logf("✓ apply --format goimports keeps the file header")
+}
+
+func TestApplyFailFast(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "typo" {
+	from go { match TypeSpec { name: $Name } }
+	emit proto {
+		file "out.proto"
+		template {` + "`message ${Nmae} {}`" + `}
+	}
+}
+`,
+		"src/a.go": "package a\n\ntype A struct{}\n",
+		"src/b.go": "package a\n\ntype B struct{}\n",
+	})
+	args := []string{"apply", filepath.Join(dir, "rule.lift"), "--source", filepath.Join(dir, "src"),
+		"--out-dir", dir, "--dry-run"}
+
+	// Without --fail-fast each file's error is reported and the run goes on
+	code, out, errOut := run(args...)
+	if code != 0 || strings.Count(errOut, "Nmae") != 2 || !strings.Contains(out, "b.go") {
+		t.Errorf("expected both files to be tried, got %d\n%s\n%s", code, out, errOut)
+	}
+
+	code, out, errOut = run(append(args, "--fail-fast")...)
+	if code != 1 {
+		t.Fatalf("expected exit code 1, got %d\n%s", code, errOut)
+	}
+	if want := filepath.Join(dir, "src", "a.go") + `:3:6: block "typo"`; !strings.Contains(errOut, want) {
+		t.Errorf("expected the error to name %s, got:\n%s", want, errOut)
+	}
+	if strings.Count(errOut, "Nmae") != 1 || strings.Contains(out, "b.go") {
+		t.Errorf("expected apply to stop at a.go, got:\n%s\n%s", out, errOut)
+	}
+
+	// So does a file that can't be written, which fails the run either way
+	writeFiles(t, dir, map[string]string{
+		"outside.lift": `lift "outside" {
+	from go { match TypeSpec { name: $Name } }
+	emit go { file "../${Name}.go" code {` + "`type ${Name}Copy struct{}`" + `} }
+}
+`,
+	})
+	args[1] = filepath.Join(dir, "outside.lift")
+	code, out, errOut = run(args...)
+	if code != 1 || strings.Count(errOut, "outside the output directory") != 2 {
+		t.Errorf("expected both files reported and exit code 1, got %d\n%s\n%s", code, out, errOut)
+	}
+	code, out, errOut = run(append(args, "--fail-fast")...)
+	if code != 1 || strings.Count(errOut, "outside the output directory") != 1 || strings.Contains(out, "b.go") {
+		t.Errorf("expected apply to stop at a.go, got %d\n%s\n%s", code, out, errOut)
+	}
+	if want := filepath.Join(dir, "src", "a.go") + ": emitted file"; !strings.Contains(errOut, want) {
+		t.Errorf("expected the error to name %s, got:\n%s", want, errOut)
+	}
+
+	t.Logf("✓ apply --fail-fast")
+}
+
+func TestEmittedPath(t *testing.T) {
+	opts := applyOptions{outDir: "out"}
+	tests := []struct {
+		name, want, err string
+	}{
+		{name: "user.go", want: "user.go"},
+		{name: "./gen/user.go", want: filepath.Join("gen", "user.go")},
+		{name: "gen/../user.go", want: "user.go"},
+		{name: "../user.go", err: "outside the output directory out"},
+		{name: "/tmp/user.go", err: "absolute paths are not allowed"},
+	}
+	for _, tt := range tests {
+		got, err := emittedPath(tt.name, opts)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %q, %v", tt.name, tt.err, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	t.Logf("✓ emitted paths stay under the output directory")
+}
+
+func TestMarkGenerated(t *testing.T) {
+	schema := &grammar.SchemaBlock{}
+	tests := []struct {
+		emit    *grammar.EmitClause
+		content string
+		want    string
+	}{
+		{&grammar.EmitClause{Target: "sql"}, "CREATE TABLE a ();\n", "-- Code generated by stencil. DO NOT EDIT.\n\nCREATE TABLE a ();\n"},
+		{&grammar.EmitClause{Target: "graphql"}, "type A {}\n", "# Code generated by stencil. DO NOT EDIT.\n\ntype A {}\n"},
+		{&grammar.EmitClause{Target: "json", Schema: schema}, "{\n  \"title\": \"A\"\n}\n", "{\n  \"$comment\": \"Code generated by stencil. DO NOT EDIT.\",\n  \"title\": \"A\"\n}\n"},
+		{&grammar.EmitClause{Target: "json"}, "[1]\n", "[1]\n"},
+		{&grammar.EmitClause{Target: "go"}, "// Code generated by hand. DO NOT EDIT.\n\npackage a\n", "// Code generated by hand. DO NOT EDIT.\n\npackage a\n"},
+	}
+	for _, tt := range tests {
+		got := markGenerated(tt.content, tt.emit)
+		if got != tt.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tt.emit.Target, got, tt.want)
+		}
+		if tt.emit.Target != "json" || tt.emit.Schema != nil {
+			if !generatedHeader.MatchString(got) {
+				t.Errorf("%s: the header isn't recognized:\n%s", tt.emit.Target, got)
+			}
+		}
+	}
+
+	t.Logf("✓ emitted files are marked as generated")
+}
+
+func TestApplyEmitOutDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "repo" {
+	from go { match TypeSpec { name: $Name } }
+	emit go {
+		file "gen/repo.go"
+		package gen
+		code {` + "`type ${Name}Repo struct{}`" + `}
+	}
+}
+`,
+		"src/a.go": "package a\n\ntype A struct{}\n",
+		"src/b.go": "package a\n\ntype B struct{}\n",
+	})
+	out := filepath.Join(dir, "out")
+	gen := filepath.Join(out, "gen", "repo.go")
+	args := []string{"apply", filepath.Join(dir, "rule.lift"), "--source", filepath.Join(dir, "src"), "--out-dir", out}
+
+	// Both sources write the file; the second replaces the first's output
+	// although it was written this run
+	code, stdout, errOut := run(args...)
+	if code != 0 || strings.Contains(errOut, "error") {
+		t.Fatalf("exit code %d\n%s\n%s", code, stdout, errOut)
+	}
+	data, err := os.ReadFile(gen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "// Code generated by stencil. DO NOT EDIT.\n\npackage gen\n\ntype BRepo struct{}"
+	if string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+	if !strings.Contains(stdout, "wrote "+filepath.Join("gen", "repo.go")) {
+		t.Errorf("expected the file reported relative to --out-dir, got:\n%s", stdout)
+	}
+
+	// A second run replaces its own output
+	if code, _, errOut := run(args...); code != 0 || strings.Contains(errOut, "already exists") {
+		t.Fatalf("expected the rerun to succeed, got %d\n%s", code, errOut)
+	}
+
+	// A hand-written file is refused, failing the run, unless --force
+	if err := os.WriteFile(gen, []byte("package gen\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, _, errOut = run(args...)
+	if code != 1 || !strings.Contains(errOut, "already exists and is not generated code") {
+		t.Errorf("expected the hand-written file refused, got %d\n%s", code, errOut)
+	}
+	if data, _ := os.ReadFile(gen); string(data) != "package gen\n" {
+		t.Errorf("expected the hand-written file kept, got:\n%s", data)
+	}
+	if code, _, errOut := run(append(args, "--force")...); code != 0 {
+		t.Fatalf("expected --force to overwrite, got %d\n%s", code, errOut)
+	}
+	if data, _ := os.ReadFile(gen); string(data) != want {
+		t.Errorf("expected --force to overwrite, got:\n%s", data)
+	}
+
+	t.Logf("✓ apply writes generated files under --out-dir")
+}
+
+func TestApplyPatchFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "repo" {
+	from go { match TypeSpec { name: $Name } }
+	emit go {
+		file "gen/repo.go"
+		package gen
+		code {` + "`type ${Name}Repo struct{}`" + `}
+	}
+}
+`,
+		"src/a.go": "package a\n\ntype A struct{}\n",
+		"src/b.go": "package a\n\ntype B struct{}\n",
+	})
+	patch := filepath.Join(dir, "out.patch")
+	args := []string{"apply", filepath.Join(dir, "rule.lift"), "--source", filepath.Join(dir, "src"), "--out-dir", dir, "--patch-file", patch}
+
+	// Both sources emit the same file: the patch creates it once, with
+	// the last content, and mentions no unchanged source
+	code, stdout, errOut := run(args...)
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s\n%s", code, stdout, errOut)
+	}
+	data, err := os.ReadFile(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "diff --git"); n != 1 {
+		t.Errorf("expected one diff, got %d:\n%s", n, data)
+	}
+	if !strings.Contains(string(data), "new file mode") || !strings.Contains(string(data), "+type BRepo struct{}") {
+		t.Errorf("expected the file created with the last content, got:\n%s", data)
+	}
+	if strings.Contains(string(data), "ARepo") {
+		t.Errorf("expected the first content replaced, got:\n%s", data)
+	}
+	if n := strings.Count(stdout, "added "); n != 1 {
+		t.Errorf("expected one file reported, got:\n%s", stdout)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gen", "repo.go")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written but the patch, got %v", err)
+	}
+
+	// Once the file holds that content, there is nothing to patch
+	writeFiles(t, dir, map[string]string{
+		"gen/repo.go": "// Code generated by stencil. DO NOT EDIT.\n\npackage gen\n\ntype BRepo struct{}",
+	})
+	code, stdout, errOut = run(args...)
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s\n%s", code, stdout, errOut)
+	}
+	if data, _ := os.ReadFile(patch); strings.Contains(string(data), "diff --git") {
+		t.Errorf("expected an empty patch, got:\n%s", data)
+	}
+	if strings.Contains(stdout, "added ") {
+		t.Errorf("expected no file reported, got:\n%s", stdout)
+	}
+
+	t.Logf("✓ --patch-file diffs each emitted path once and skips unchanged files")
+}
+
+func TestExpandSources(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.go":               "package a\n",
+		"a_test.go":          "package a\n",
+		"sub/b.go":           "package sub\n",
+		"sub/deep/c.go":      "package deep\n",
+		"sub/deep/c_test.go": "package deep\n",
+		"vendor/v/v.go":      "package v\n",
+		"sub/deep/notes.txt": "not go\n",
+	})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	skip, err := filter.New(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sources []string
+		want    []string
+	}{
+		{[]string{"*.go"}, []string{"a.go"}},
+		{[]string{"./*.go"}, []string{"a.go"}},
+		{[]string{"./sub/*.go"}, []string{"sub/b.go"}},
+		{[]string{"sub/**/*.go"}, []string{"sub/b.go", "sub/deep/c.go"}},
+		{[]string{"./sub/**/*.go"}, []string{"sub/b.go", "sub/deep/c.go"}},
+		{[]string{"**/c.go"}, []string{"sub/deep/c.go"}},
+		{[]string{filepath.Join(dir, "sub", "*", "*.go")}, []string{filepath.Join(dir, "sub", "deep", "c.go")}},
+		{[]string{"sub/deep/c_test.go"}, []string{"sub/deep/c_test.go"}},
+		{[]string{"sub", "./sub/**/*.go"}, []string{"sub/b.go", "sub/deep/c.go"}},
+	}
+	for _, tt := range tests {
+		files, _, err := expandSources(tt.sources, false, skip)
+		if err != nil {
+			t.Errorf("%v: %v", tt.sources, err)
+			continue
+		}
+		for i := range files {
+			files[i] = filepath.ToSlash(filepath.Clean(files[i]))
+		}
+		want := make([]string, len(tt.want))
+		for i := range want {
+			want[i] = filepath.ToSlash(tt.want[i])
+		}
+		if strings.Join(files, " ") != strings.Join(want, " ") {
+			t.Errorf("%v: got %v, want %v", tt.sources, files, want)
+		}
+	}
+
+	if _, _, err := expandSources([]string{"./missing/*.go"}, false, skip); err == nil || !strings.Contains(err.Error(), "matches no .go files") {
+		t.Errorf("expected an error for a glob matching nothing, got %v", err)
+	}
+
+	t.Logf("✓ --source values expand to .go files")
+}
+
+func TestApplyInterfaceMocks(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"store.go": `package store
+
+import (
+	"context"
+	"io"
+)
+
+type User struct{ ID int64 }
+
+type Store interface {
+	io.Closer
+	Get(ctx context.Context, id int64) (*User, error)
+	Put(ctx context.Context, u *User) error
+	Delete(context.Context, int64) error
+	List(ctx context.Context) ([]*User, error)
+	Count(ctx context.Context) (n int, err error)
+	Ping()
+}
+`,
+		"cache.go": `package store
+
+import "time"
+
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+	Len() int
+	Flush()
+	Expire(key string, at time.Time) error
+}
+`,
+	})
+
+	args := []string{"apply", "../../examples/interface-mocks.lift", "--source", dir, "--out-dir", dir}
+	if code, stdout, errOut := run(args...); code != 0 {
+		t.Fatalf("exit code %d\n%s\n%s", code, stdout, errOut)
+	}
+
+	// The mocks join the package and type-check with it
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range []string{"store.go", "cache.go", "mocks_gen.go"} {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("store", fset, files, nil)
+	if err != nil {
+		data, _ := os.ReadFile(filepath.Join(dir, "mocks_gen.go"))
+		t.Fatalf("mocks_gen.go doesn't type-check: %v\n%s", err, data)
+	}
+	for _, mock := range []string{"MockStore", "MockCache"} {
+		if pkg.Scope().Lookup(mock) == nil {
+			t.Errorf("expected %s in the package", mock)
+		}
+	}
+
+	// A second run finds the file up to date
+	if code, stdout, errOut := run(args...); code != 0 || !strings.Contains(stdout, "mocks_gen.go is up to date") {
+		t.Errorf("expected no change on a second run, got %d\n%s\n%s", code, stdout, errOut)
+	}
+
+	t.Logf("✓ examples/interface-mocks.lift writes mocks that compile")
+}
+
+func TestApplyDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "entities" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $Fields... }
+		}
+	}
+	emit sql { file "schema.sql" }
+	emit graphql { file "schema.graphql" }
+	emit go {
+		file "repo.go"
+		package repo
+		code {` + "`type ${Name}Repo struct{}`" + `}
+	}
+}
+
+lift "getters" {
+	from go { match FuncDecl { name: $Fn recv: $Recv body: $Body } }
+	patch { rename $Fn "Renamed" }
+}
+`,
+		"src/b.go": "package a\n\ntype Order struct {\n\tID    int64\n\tTotal int\n}\n\nfunc (o Order) Sum() int { return o.Total }\n",
+		"src/a.go": "package a\n\ntype User struct {\n\tID   int64\n\tName string\n}\n\ntype Account struct {\n\tID int64\n}\n\nfunc (u User) Label() string { return u.Name }\n",
+		"src/c.go": "package a\n\nfunc (u User) Title() string { return u.Name }\n",
+	})
+	rule, src := filepath.Join(dir, "rule.lift"), filepath.Join(dir, "src")
+
+	outputs := func(out string) (string, map[string]string) {
+		t.Helper()
+		code, stdout, errOut := run("apply", rule, "--source", src, "--out-dir", out)
+		if code != 0 {
+			t.Fatalf("exit code %d\n%s\n%s", code, stdout, errOut)
+		}
+		files := make(map[string]string)
+		for _, name := range []string{"schema.sql", "schema.graphql", "repo.go"} {
+			data, err := os.ReadFile(filepath.Join(out, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[name] = string(data)
+		}
+		return strings.ReplaceAll(stdout, out, "OUT"), files
+	}
+
+	// The same run twice prints and writes the same bytes
+	first, firstFiles := outputs(filepath.Join(dir, "out1"))
+	for i := 0; i < 3; i++ {
+		again, files := outputs(filepath.Join(dir, "out2"))
+		if again != first {
+			t.Fatalf("apply output differs between runs:\n%s\n---\n%s", first, again)
+		}
+		for name, content := range firstFiles {
+			if files[name] != content {
+				t.Errorf("%s differs between runs:\n%s\n---\n%s", name, content, files[name])
+			}
+		}
+	}
+
+	// match lists matches by file and position, bindings by name
+	code, stdout, errOut := run("match", rule, "--source", src)
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, errOut)
+	}
+	for i := 0; i < 3; i++ {
+		if _, again, _ := run("match", rule, "--source", src); again != stdout {
+			t.Fatalf("match output differs between runs:\n%s\n---\n%s", stdout, again)
+		}
+	}
+	a, b := strings.Index(stdout, "a.go:3"), strings.Index(stdout, "a.go:8")
+	c := strings.Index(stdout, "b.go:3")
+	if a < 0 || b < a || c < b {
+		t.Errorf("expected matches in file and line order, got:\n%s", stdout)
+	}
+	if fields, name := strings.Index(stdout, "$Fields"), strings.Index(stdout, "$Name"); fields < 0 || name < fields {
+		t.Errorf("expected bindings in name order, got:\n%s", stdout)
+	}
+
+	t.Logf("✓ apply and match are deterministic")
+}
+
+func TestInspectBlock(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rules.lift": `lift "first" {
+	from go { match FuncDecl { name: $Name } }
+}
+
+lift "second" {
+	from go { match CallExpr { fun: $Fn } }
+	where { $Fn.exported }
+	patch { rename $Fn "Renamed" }
+}
+`,
+	})
+	rules := filepath.Join(dir, "rules.lift")
+
+	code, out, errOut := run("inspect", rules, "--block", "second")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, errOut)
+	}
+	var block struct{ Name string }
+	if err := json.Unmarshal([]byte(out), &block); err != nil || block.Name != "second" {
+		t.Errorf("expected the second block, got %v:\n%s", err, out)
+	}
+
+	code, out, errOut = run("inspect", rules, "--block", "second", "--field", "where")
+	if code != 0 {
+		t.Fatalf("exit code %d\n%s", code, errOut)
+	}
+	var where []struct{ Predicates []json.RawMessage }
+	if err := json.Unmarshal([]byte(out), &where); err != nil || len(where) != 1 || len(where[0].Predicates) != 1 {
+		t.Errorf("expected one where clause, got %v:\n%s", err, out)
+	}
+
+	code, out, _ = run("inspect", rules, "--block", "second", "--field", "actions")
+	if code != 0 || !strings.Contains(out, `"Renamed"`) || strings.Contains(out, "CallExpr") {
+		t.Errorf("expected only the actions, got %d:\n%s", code, out)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--block", "third"}, `no block named "third" (blocks: "first", "second")`},
+		{[]string{"--block", "first", "--field", "match"}, `unknown --field "match"`},
+		{[]string{"--field", "from"}, "--field requires --block"},
+	} {
+		code, _, errOut := run(append([]string{"inspect", rules}, tt.args...)...)
+		if code != 1 || !strings.Contains(errOut, tt.err) {
+			t.Errorf("%v: expected exit 1 with %q, got %d\n%s", tt.args, tt.err, code, errOut)
+		}
+	}
+
+	t.Logf("✓ inspect --block and --field")
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new")); err != nil {
+		t.Fatalf("writeFileAtomic: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("expected new content, got %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 kept, got %v", info.Mode().Perm())
+	}
+
+	created := filepath.Join(dir, "b.go")
+	if err := writeFileAtomic(created, []byte("b")); err != nil {
+		t.Fatalf("writeFileAtomic new file: %v", err)
+	}
+	if info, _ := os.Stat(created); info.Mode().Perm() != 0644 {
+		t.Errorf("expected a new file to get 0644, got %v", info.Mode().Perm())
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "c.go"), []byte("c")); err == nil {
+		t.Error("expected an error writing into a missing directory")
+	}
+
+	// No temporary file is left behind
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, " ") != "a.go b.go" {
+		t.Errorf("expected only a.go and b.go, got %v", names)
+	}
+
+	t.Logf("✓ writeFileAtomic replaces files whole, keeping their mode")
+}
+
+func TestMatchLineEndings(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		src      string
+		want     string
+	}{
+		{"lf", "a\nb\n", "a\nc\n", "a\nc\n"},
+		{"crlf", "a\r\nb\r\n", "a\nc\n", "a\r\nc\r\n"},
+		{"crlf already", "a\r\nb\r\n", "a\r\nc\n", "a\r\nc\r\n"},
+		{"no newline", "a", "a\nb\n", "a\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(matchLineEndings([]byte(tt.original), []byte(tt.src))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// apply -w keeps a CRLF file's line endings and, with --backup, its
+	// original bytes in <file>.orig
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "rename" {
+	from go { match FuncDecl { name: $Fn } }
+	where { $Fn == "Old" }
+	patch { rename $Fn "New" }
+}
+`,
+	})
+	src := filepath.Join(dir, "a.go")
+	original := "package a\r\n\r\nfunc Old() {}\r\n\r\nfunc Keep() {}\r\n"
+	if err := os.WriteFile(src, []byte(original), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, errOut := run("apply", filepath.Join(dir, "rule.lift"), "--source", src, "-w", "--backup"); code != 0 {
+		t.Fatalf("apply -w: exit code %d\n%s", code, errOut)
+	}
+	data, _ := os.ReadFile(src)
+	if want := "package a\r\n\r\nfunc New() {}\r\n\r\nfunc Keep() {}\r\n"; string(data) != want {
+		t.Errorf("expected CRLF endings kept:\n got %q\nwant %q", data, want)
+	}
+	if info, _ := os.Stat(src); info.Mode().Perm() != 0755 {
+		t.Errorf("expected mode 0755 kept, got %v", info.Mode().Perm())
+	}
+	if backup, err := os.ReadFile(src + ".orig"); err != nil || string(backup) != original {
+		t.Errorf("expected the original in a.go.orig, got %q (%v)", backup, err)
+	}
+
+	t.Logf("✓ Rewritten files keep their line endings")
+}
+
+func TestParseHunks(t *testing.T) {
+	headers := []struct {
+		header string
+		want   lineRange
+		ok     bool
+	}{
+		{"@@ -1,2 +3,4 @@", lineRange{3, 6}, true},
+		{"@@ -1,2 +3,4 @@ func main() {", lineRange{3, 6}, true},
+		{"@@ -5 +7 @@", lineRange{7, 7}, true},
+		{"@@ -5,0 +6,2 @@", lineRange{6, 7}, true},
+		{"@@ -5,2 +4,0 @@", lineRange{}, false}, // lines removed only
+		{"@@ -5,2 @@", lineRange{}, false},
+		{"@@ -5 +x,2 @@", lineRange{}, false},
+		{"@@ -5 +3,y @@", lineRange{}, false},
+	}
+	for _, tt := range headers {
+		got, ok := parseHunkHeader(tt.header)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseHunkHeader(%q) = %v, %v; want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	diff := `diff --git a.go a.go
+index 1111111..2222222 100644
+--- a.go
++++ a.go
+@@ -3 +3 @@ package a
+-func A() {}
++func A() { println() }
+@@ -10,0 +11,3 @@ func B() {
++	one()
++	two()
++	three()
+@@ -20,2 +23,0 @@ func C() {
+-	gone()
+-	gone()
+diff --git pkg/b.go pkg/b.go
+deleted file mode 100644
+index 3333333..0000000
+--- pkg/b.go
++++ /dev/null
+@@ -1,3 +0,0 @@
+-package pkg
+-
+-func B() {}
+diff --git README.md README.md
+--- README.md
++++ README.md
+@@ -1 +1 @@
+-old
++new
+diff --git pkg/c.go pkg/c.go
+new file mode 100644
+--- /dev/null
++++ pkg/c.go
+@@ -0,0 +1,2 @@
++package pkg
++
+`
+	got := parseHunks(diff)
+	want := changedLines{
+		"a.go":     {{3, 3}, {11, 13}},
+		"pkg/c.go": {{1, 2}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseHunks:\n got %v\nwant %v", got, want)
+	}
+
+	if !got.Contains("./a.go", 12) || got.Contains("a.go", 14) || got.Contains("pkg/b.go", 1) {
+		t.Error("Contains doesn't follow the parsed ranges")
+	}
+
+	t.Logf("✓ Hunk headers parse to changed line ranges")
+}
+
+func TestResolveSourcesChanged(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"api/a.go":  "package api\n",
+		"api/b.go":  "package api\n",
+		"db/c.go":   "package db\n",
+		"README.md": "readme\n",
+	})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "base"},
+	} {
+		if _, err := git(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(t, dir, map[string]string{
+		"api/a.go":  "package api\n\nfunc A() {}\n",
+		"db/c.go":   "package db\n\nfunc C() {}\n",
+		"README.md": "changed\n",
+	})
+	os.Remove("api/b.go")
+
+	skip, _ := filter.New(nil, false)
+	tests := []struct {
+		sources []string
+		want    []string
+	}{
+		{nil, []string{"api/a.go", "db/c.go"}},
+		{[]string{"./api"}, []string{"api/a.go"}},
+		{[]string{filepath.Join(dir, "db")}, []string{"db/c.go"}},
+		{[]string{"**/*.go"}, []string{"api/a.go", "db/c.go"}},
+	}
+	for _, tt := range tests {
+		files, _, err := resolveSources(tt.sources, false, true, "HEAD", skip)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.sources, err)
+		}
+		if !reflect.DeepEqual(files, tt.want) {
+			t.Errorf("--changed --source %v: got %v, want %v", tt.sources, files, tt.want)
+		}
+	}
+
+	if _, _, err := resolveSources([]string{stdinArg}, false, true, "HEAD", skip); err == nil {
+		t.Error("expected an error for --changed with --source -")
+	}
+
+	t.Logf("✓ --changed keeps the changed files among those --source names")
+}
+
+func TestApplyBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "rename" {
+	from go { match FuncDecl { name: $Fn } }
+	where { $Fn == "Old" }
+	patch { rename $Fn "New" }
+}
+`,
+	})
+	rule := filepath.Join(dir, "rule.lift")
+	src := filepath.Join(dir, "a.go")
+	original := "package a\n\nfunc Old() {}\n"
+	if err := os.WriteFile(src, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, errOut := run("restore", src); code != 1 || !strings.Contains(errOut, "no backup found") {
+		t.Errorf("restore without a backup: expected exit code 1 and no backup found, got %d\n%s", code, errOut)
+	}
+
+	if code, _, errOut := run("apply", rule, "--source", src, "-w", "--backup"); code != 0 {
+		t.Fatalf("apply -w --backup: exit code %d\n%s", code, errOut)
+	}
+	if data, _ := os.ReadFile(src); !strings.Contains(string(data), "func New()") {
+		t.Fatalf("expected a.go rewritten, got:\n%s", data)
+	}
+	if backup, _ := os.ReadFile(src + ".orig"); string(backup) != original {
+		t.Fatalf("expected the original in a.go.orig, got:\n%s", backup)
+	}
+
+	code, out, errOut := run("restore", src)
+	if code != 0 || !strings.Contains(out, "restored "+src) {
+		t.Fatalf("restore: exit code %d\n%s%s", code, out, errOut)
+	}
+	if data, _ := os.ReadFile(src); string(data) != original {
+		t.Errorf("expected the original restored, got:\n%s", data)
+	}
+	if info, _ := os.Stat(src); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 restored, got %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(src + ".orig"); !os.IsNotExist(err) {
+		t.Errorf("expected the backup removed, got %v", err)
+	}
+
+	// Without --backup there is nothing to restore
+	if code, _, errOut := run("apply", rule, "--source", src, "-w"); code != 0 {
+		t.Fatalf("apply -w: exit code %d\n%s", code, errOut)
+	}
+	if _, err := os.Stat(src + ".orig"); !os.IsNotExist(err) {
+		t.Errorf("expected no backup without --backup, got %v", err)
+	}
+
+	t.Logf("✓ apply --backup and restore round-trip")
+}
+
+func TestFindLiftFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"here/local.lift":                   `lift "local" {}`,
+		"lib/shared.lift":                   `lift "shared" {}`,
+		"lib/local.lift":                    `lift "shadowed" {}`,
+		"home/.stencil/rules/personal.lift": `lift "personal" {}`,
+		"home/.stencil/rules/shared.lift":   `lift "shadowed" {}`,
+	})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "here")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("STENCIL_LIFT_PATH", filepath.Join(dir, "lib"))
+	t.Setenv("HOME", filepath.Join(dir, "home"))
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr string
+	}{
+		{name: "local.lift", want: "local.lift"},
+		{name: "local", want: "local.lift"},
+		{name: "shared", want: filepath.Join(dir, "lib", "shared.lift")},
+		{name: "shared.lift", want: filepath.Join(dir, "lib", "shared.lift")},
+		{name: "personal", want: filepath.Join(dir, "home", ".stencil", "rules", "personal.lift")},
+		{name: "builtin:ctx-timeout", want: "builtin:ctx-timeout"},
+		{name: "rules/missing.lift", want: "rules/missing.lift"},
+		{name: stdinArg, want: stdinArg},
+		{name: "missing", wantErr: "missing not found here, in STENCIL_LIFT_PATH or in ~/.stencil/rules"},
+	}
+	for _, tt := range tests {
+		got, err := findLiftFile(tt.name)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("findLiftFile(%q): expected error %q, got %q, %v", tt.name, tt.wantErr, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("findLiftFile(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// A built-in rule found this way can be read
+	if data, err := readLift("builtin:ctx-timeout"); err != nil || len(data) == 0 {
+		t.Errorf("readLift(builtin:ctx-timeout): %v", err)
+	}
+
+	t.Logf("✓ .lift files are found here, in STENCIL_LIFT_PATH and in ~/.stencil/rules")
+}
+
+func TestMatchContext(t *testing.T) {
+	dir := t.TempDir()
+	src := "package a\r\n\r\nfunc A() {\r\n\tpanic(\"a\")\r\n}\r\n"
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "no-panic" {
+	from go { match CallExpr { fun: Ident { name: "panic" } } }
+}
+`,
+		"a.go":  src,
+		"stdin": src,
+	})
+	rule := filepath.Join(dir, "rule.lift")
+	want := "      3 | func A() {\n" +
+		"      4 | \tpanic(\"a\")\n" +
+		"        | \t^^^^^^^^^^\n" +
+		"      5 | }\n"
+
+	code, out, errOut := run("match", rule, "--source", filepath.Join(dir, "a.go"), "--context", "1", "--no-color")
+	if code != 0 {
+		t.Fatalf("match --context: exit code %d\n%s", code, errOut)
+	}
+	if !strings.Contains(out, "a.go: func A — 1 finding(s)") || !strings.Contains(out, want) {
+		t.Errorf("expected the finding under func A with CRs trimmed:\n%q", out)
+	}
+
+	// Source read from stdin is listed from memory
+	stdin, err := os.Open(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = oldStdin
+		stdinSource = nil
+	})
+
+	code, out, errOut = run("match", rule, "--source", "-", "--context", "1", "--no-color")
+	if code != 0 {
+		t.Fatalf("match --source - --context: exit code %d\n%s", code, errOut)
+	}
+	if !strings.Contains(out, stdinName+": func A — 1 finding(s)") || !strings.Contains(out, want) {
+		t.Errorf("expected the stdin source listed:\n%q", out)
+	}
+
+	t.Logf("✓ match --context lists source from memory, without CRs")
+}
+
+func TestWatchFindings(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rule.lift": `lift "no-panic" {
+	from go { match CallExpr { fun: Ident { name: "panic" } } }
+}
+`,
+		"src/a.go": "package a\n\nfunc A() { panic(1); panic(2) }\n",
+	})
+	var out bytes.Buffer
+	oldStdout, oldStderr := stdout, stderr
+	stdout, stderr = &out, &out
+	t.Cleanup(func() { stdout, stderr = oldStdout, oldStderr })
+
+	w := &matchWatcher{liftPath: filepath.Join(dir, "rule.lift"), sourcePath: filepath.Join(dir, "src")}
+	w.run()
+	a := filepath.Join(dir, "src", "a.go")
+	first, second := a+":3:12: warning: no-panic", a+":3:22: warning: no-panic"
+	if len(w.previous) != 2 || !w.previous[first] || !w.previous[second] {
+		t.Fatalf("expected both matches on line 3 as findings, got %v", w.previous)
+	}
+
+	// Dropping one of two matches on a line is reported
+	writeFiles(t, dir, map[string]string{"src/a.go": "package a\n\nfunc A() { panic(1); println(2) }\n"})
+	out.Reset()
+	w.run()
+	if !strings.Contains(out.String(), "1 match(es)\n  - "+second+"\n") {
+		t.Errorf("expected the second match reported gone:\n%s", out.String())
+	}
+
+	out.Reset()
+	w.run()
+	if !strings.Contains(out.String(), "1 match(es), no changes since the last run") {
+		t.Errorf("expected no changes:\n%s", out.String())
+	}
+
+	added, removed := diffFindings(
+		map[string]bool{"a.go:1:1: warning: x": true, "a.go:2:1: warning: x": true},
+		map[string]bool{"a.go:2:1: warning: x": true, "a.go:2:5: warning: x": true, "a.go:1:1: error: y": true},
+	)
+	if want := []string{"a.go:1:1: error: y", "a.go:2:5: warning: x"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added = %v, want %v", added, want)
+	}
+	if want := []string{"a.go:1:1: warning: x"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed = %v, want %v", removed, want)
+	}
+
+	t.Logf("✓ match --watch tells matches sharing a line apart")
+}
+
+func TestMatchDeferClose(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.go": `package a
+
+import "net/http"
+
+func Checked(url string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+func Unchecked(url string) {
+	resp, _ := http.Get(url)
+	defer resp.Body.Close()
+}
+
+func NilChecked(f *File) {
+	if f == nil {
+		return
+	}
+	defer f.Close()
+}
+`,
+	})
+
+	code, out, errOut := run("match", "../../examples/defer-close.lift", "--source", filepath.Join(dir, "a.go"))
+	if code != 0 {
+		t.Fatalf("match: exit code %d\n%s", code, errOut)
+	}
+	if !strings.Contains(out, "1 match(es)") || !strings.Contains(out, "in func Unchecked") {
+		t.Errorf("expected only the close in Unchecked:\n%s", out)
+	}
+
+	t.Logf("✓ examples/defer-close.lift accepts a close after an error check")
+}
+
+func TestLintSkipsExcludedFiles(t *testing.T) {
+	dir := t.TempDir()
+	panics := "package a\n\nfunc A() { panic(1) }\n"
+	writeFiles(t, dir, map[string]string{
+		"rules/panic.lift": `lift "no-panic" {
+	severity: error
+	from go { match CallExpr { fun: Ident { name: "panic" } } }
+}
+`,
+		"src/a.go":                panics,
+		"src/a_test.go":           panics,
+		"src/gen.go":              "// Code generated by hand. DO NOT EDIT.\n\n" + panics,
+		"src/skip_me.go":          panics,
+		"src/vendor/dep/dep.go":   panics,
+		"src/testdata/fixture.go": panics,
+		"src/node_modules/x/x.go": panics,
+	})
+	rules := filepath.Join(dir, "rules")
+	src := filepath.Join(dir, "src")
+
+	code, out, errOut := run("lint", "--rules", rules, "--source", src, "--exclude", "skip_*.go", "--stats")
+	if code != 1 {
+		t.Fatalf("expected exit code 1 for the finding in a.go, got %d\n%s%s", code, out, errOut)
+	}
+	if !strings.Contains(out, "1 violation(s)") || !strings.Contains(out, filepath.Join(src, "a.go")) {
+		t.Errorf("expected only the finding in a.go:\n%s", out)
+	}
+	if !strings.Contains(errOut, "Scanned 1 file(s)") || !strings.Contains(errOut, "5 excluded") {
+		t.Errorf("expected 1 file scanned and 5 excluded in the summary:\n%s", errOut)
+	}
+
+	code, out, _ = run("lint", "--rules", rules, "--source", src, "--exclude", "skip_*.go", "--include-tests", "--include-generated")
+	if code != 1 || !strings.Contains(out, "3 violation(s)") || strings.Contains(out, "vendor") {
+		t.Errorf("expected a.go, a_test.go and gen.go linted with --include-tests --include-generated, got %d:\n%s", code, out)
+	}
+
+	t.Logf("✓ lint leaves out vendored, generated, test and excluded files")
+}
@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+	"unicode/utf8"
+)
+
+// Underlines are red when color is on.
+const (
+	colorUnderline = "\033[31m"
+	colorReset     = "\033[0m"
+)
+
+// matchListing prints match results for stencil match --context: grouped
+// under the declaration that encloses them, each with lines of source
+// around it and the matched range underlined.
+type matchListing struct {
+	context int  // lines shown before and after each match
+	color   bool // color the underline
+	lines   map[string][]string
+}
+
+func newMatchListing(context int, noColor bool) *matchListing {
+	return &matchListing{
+		context: context,
+		color:   !noColor && isTerminal(stdout),
+		lines:   make(map[string][]string),
+	}
+}
+
+// Print lists the matches of one block, which are sorted by file and
+// position, so the matches in one declaration are next to each other.
+func (l *matchListing) Print(results []found) {
+	n := 0
+	for i := 0; i < len(results); i += n {
+		file := results[i].fset.Position(results[i].match.Node.Pos()).Filename
+		decl := declHeader(results[i])
+		n = 1
+		for i+n < len(results) &&
+			results[i+n].fset.Position(results[i+n].match.Node.Pos()).Filename == file &&
+			declHeader(results[i+n]) == decl {
+			n++
+		}
+
+		fmt.Fprintf(stdout, "  %s: %s — %d finding(s)\n", file, decl, n)
+		for j, r := range results[i : i+n] {
+			pos := r.fset.Position(r.match.Node.Pos())
+			fmt.Fprintf(stdout, "    [%d] %s: %s:%d:%d\n", i+j+1, blockSeverity(r.block), pos.Filename, pos.Line, pos.Column)
+			l.printSource(r)
+			printBindings(r.match.Bindings, "      ")
+		}
+	}
+}
+
+// printSource prints the lines around a match with a gutter of line
+// numbers, underlining the match on its first line. A match that runs
+// past that line is underlined to its end.
+func (l *matchListing) printSource(r found) {
+	start := r.fset.Position(r.match.Node.Pos())
+	end := r.fset.Position(r.match.Node.End())
+	lines, ok := l.lines[start.Filename]
+	if !ok {
+		lines = strings.Split(strings.TrimSuffix(string(r.src), "\n"), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSuffix(line, "\r")
+		}
+		l.lines[start.Filename] = lines
+	}
+	if start.Line > len(lines) {
+		return
+	}
+
+	first := max(start.Line-l.context, 1)
+	last := min(start.Line+l.context, len(lines))
+	width := len(fmt.Sprint(last))
+	for n := first; n <= last; n++ {
+		line := lines[n-1]
+		fmt.Fprintf(stdout, "      %*d | %s\n", width, n, line)
+		if n != start.Line {
+			continue
+		}
+
+		// The marker keeps the line's tabs, so it lines up however wide
+		// they are shown
+		col := min(start.Column-1, len(line))
+		var pad strings.Builder
+		for _, c := range line[:col] {
+			if c == '\t' {
+				pad.WriteByte('\t')
+			} else {
+				pad.WriteByte(' ')
+			}
+		}
+		stop := len(strings.TrimRight(line, " \t"))
+		if end.Line == start.Line {
+			stop = min(end.Column-1, len(line))
+		}
+		carets := strings.Repeat("^", max(utf8.RuneCountInString(line[col:max(stop, col)]), 1))
+		if l.color {
+			carets = colorUnderline + carets + colorReset
+		}
+		fmt.Fprintf(stdout, "      %*s | %s%s\n", width, "", pad.String(), carets)
+	}
+}
+
+// declHeader describes the top-level declaration a match is in, or is:
+// func (s *UserService) GetUser, type User, var client.
+func declHeader(r found) string {
+	decl := r.match.Node
+	if len(r.match.Path) > 1 {
+		decl = r.match.Path[1]
+	}
+
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv != nil && len(d.Recv.List) > 0 {
+			recv := d.Recv.List[0]
+			typ := types.ExprString(recv.Type)
+			if len(recv.Names) > 0 {
+				typ = recv.Names[0].Name + " " + typ
+			}
+			return fmt.Sprintf("func (%s) %s", typ, d.Name.Name)
+		}
+		return "func " + d.Name.Name
+	case *ast.GenDecl:
+		var names []string
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				for _, name := range s.Names {
+					names = append(names, name.Name)
+				}
+			case *ast.ImportSpec:
+				names = append(names, s.Path.Value)
+			}
+		}
+		return d.Tok.String() + " " + strings.Join(names, ", ")
+	}
+	return "package level"
+}
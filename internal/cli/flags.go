@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// newFlagSet returns the flag set of a command. Errors and -h print the
+// usage, which is the command's synopsis followed by its flags, to
+// stderr.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage:\n%s\n", strings.TrimRight(usage, "\n"))
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			// Flags are written --flag everywhere else, so list them that way
+			var defaults strings.Builder
+			fs.SetOutput(&defaults)
+			fs.PrintDefaults()
+			fs.SetOutput(stderr)
+			fmt.Fprintln(stderr, "\nFlags:")
+			fmt.Fprint(stderr, strings.ReplaceAll("\n"+defaults.String(), "\n  -", "\n  --")[1:])
+		}
+	}
+	return fs
+}
+
+// parseFlags parses args with fs and returns the positional arguments.
+// Unlike fs.Parse, it reads flags after positional arguments too, so
+// "match rule.lift --source x" and "match --source x rule.lift" are the
+// same. Everything after "--" is positional.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional, nil
+}
+
+// stringsFlag is a flag that may be given more than once, collecting
+// every value.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// sourceFlags are the flags match and apply choose their Go sources with.
+type sourceFlags struct {
+	sources          stringsFlag
+	includeTests     bool
+	exclude          stringsFlag
+	includeGenerated bool
+	sourceName       string
+	changed          bool
+	base             string
+}
+
+func (f *sourceFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.sources, "source", "Go `path` to process: a file, a directory, a glob (** spans directories)\nor - for stdin; repeatable")
+	fs.BoolVar(&f.includeTests, "include-tests", false, "keep _test.go files found in directories and globs")
+	fs.Var(&f.exclude, "exclude", "leave out files found in directories and globs that match the `glob`\n(** spans directories); repeatable")
+	fs.BoolVar(&f.includeGenerated, "include-generated", false, "keep generated files found in directories and globs, which are left\nout like files under vendor, testdata and node_modules")
+	fs.StringVar(&f.sourceName, "source-name", "", "`name` Go source read with --source - is reported and type-checked\nunder (default <stdin>)")
+	fs.BoolVar(&f.changed, "changed", false, "process only .go files changed since --base; with --source, only those\nchanged among the files it names")
+	fs.StringVar(&f.base, "base", "", "`revision` to diff against (default: merge-base with origin/main)")
+}
+
+// runFlags are the flags match, apply and lint share for a run over many
+// files.
+type runFlags struct {
+	optimize bool
+	timings  bool
+	debug    bool
+	skipped  skippedFiles
+}
+
+func (f *runFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.optimize, "optimize-where", true, "check cheap where predicates first; =false keeps the order they're\nwritten in")
+	fs.BoolVar(&f.skipped.verbose, "verbose", false, "list files skipped because they don't parse")
+	fs.BoolVar(&f.skipped.strict, "strict-parse", false, "fail if any file doesn't parse")
+	fs.BoolVar(&f.timings, "stats", false, "break down each block's time in the closing summary into matching\nand where filtering")
+	fs.BoolVar(&f.debug, "debug", false, "note where predicates that are false because a binding they test\nagainst is unbound or empty")
+}
+
+// setDebug sends the matcher's debug notes to stderr, if on, or nowhere.
+func (f *runFlags) setDebug() {
+	matcher.Debug = nil
+	if f.debug {
+		matcher.Debug = stderr
+	}
+}
+
+// isTerminal reports whether w is a terminal, for progress lines and
+// color.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
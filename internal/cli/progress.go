@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// progressInterval limits how often the progress line is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// runStats follows a match, apply or lint run over many files: it keeps a
+// progress line on stderr while the run goes, if stderr is a terminal,
+// and prints a summary at the end.
+type runStats struct {
+	timings  bool // --stats: break each block's time down in the summary
+	excluded int  // source files left out by --exclude and the default skips
+
+	start   time.Time
+	total   int // source files to process
+	done    int
+	tty     bool
+	shown   bool      // the progress line is on screen
+	drawn   time.Time // when it was last drawn
+	blocks  []*grammar.LiftBlock
+	byBlock map[*grammar.LiftBlock]*matcher.Stats
+}
+
+func newRunStats(total int, timings bool) *runStats {
+	return &runStats{
+		timings: timings,
+		start:   time.Now(),
+		total:   total,
+		tty:     isTerminal(stderr),
+		byBlock: make(map[*grammar.LiftBlock]*matcher.Stats),
+	}
+}
+
+// File notes that processing of path is starting. A nil runStats
+// records nothing.
+func (r *runStats) File(path string) {
+	if r == nil {
+		return
+	}
+	r.done++
+	if !r.tty || (time.Since(r.drawn) < progressInterval && r.done < r.total) {
+		return
+	}
+	r.drawn = time.Now()
+	r.shown = true
+	fmt.Fprintf(stderr, "\r\033[K[%d/%d] %s (%s)", r.done, r.total, path, r.elapsed())
+}
+
+// Clear erases the progress line, so other output can be printed; the
+// next file draws it again.
+func (r *runStats) Clear() {
+	if r == nil || !r.shown {
+		return
+	}
+	r.shown = false
+	r.drawn = time.Time{}
+	fmt.Fprint(stderr, "\r\033[K")
+}
+
+// Block records the stats of matching block against one file.
+func (r *runStats) Block(block *grammar.LiftBlock, stats matcher.Stats) {
+	if r == nil {
+		return
+	}
+	total, ok := r.byBlock[block]
+	if !ok {
+		total = &matcher.Stats{}
+		r.byBlock[block] = total
+		r.blocks = append(r.blocks, block)
+	}
+	total.Add(stats)
+}
+
+// Summary clears the progress line and prints the files scanned,
+// skipped and excluded, the matches per block and the wall time, with
+// each block's match and filter time when timings are on. A scope that
+// names a declaration none of the files had is warned about once.
+func (r *runStats) Summary(skipped int) {
+	r.Clear()
+
+	fmt.Fprintf(stderr, "\nScanned %d file(s) in %s", r.done-skipped, r.elapsed())
+	if skipped > 0 {
+		fmt.Fprintf(stderr, ", %d skipped", skipped)
+	}
+	if r.excluded > 0 {
+		fmt.Fprintf(stderr, ", %d excluded", r.excluded)
+	}
+	fmt.Fprintln(stderr)
+
+	width := 0
+	for _, block := range r.blocks {
+		width = max(width, len(block.Name))
+	}
+	for _, block := range r.blocks {
+		stats := r.byBlock[block]
+		fmt.Fprintf(stderr, "  %-*s  %d match(es)", width, block.Name, stats.Kept)
+		if r.timings {
+			fmt.Fprintf(stderr, "  match %s (%d found)  filter %s",
+				round(stats.MatchTime), stats.Matches, round(stats.FilterTime))
+		}
+		fmt.Fprintln(stderr)
+	}
+	for _, scope := range r.missingScopes() {
+		fmt.Fprintf(stderr, "warning: %s: %s %q not found in any source file\n", scope.Pos, scope.Kind, scope.Name)
+	}
+}
+
+// missingScopes returns the scopes no file had the declaration for, in
+// the order they appear in the rules.
+func (r *runStats) missingScopes() []*grammar.MatchScope {
+	var missing []*grammar.MatchScope
+	for _, block := range r.blocks {
+		for scope, found := range r.byBlock[block].Scopes {
+			if !found {
+				missing = append(missing, scope)
+			}
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		a, b := missing[i].Pos, missing[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	return missing
+}
+
+func (r *runStats) elapsed() time.Duration {
+	return round(time.Since(r.start))
+}
+
+// round shortens a duration for display.
+func round(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
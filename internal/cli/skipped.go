@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vinodhalaharvi/stencil/matcher"
+)
+
+// skippedFiles collects source files that couldn't be parsed, so one bad
+// file (cgo, a syntax error, a newer language feature) doesn't stop a run
+// over a directory.
+type skippedFiles struct {
+	verbose bool // list each file and why, not just the count
+	strict  bool // a skipped file fails the run
+
+	Skipped []skippedFile
+}
+
+type skippedFile struct {
+	Path string
+	Err  error
+}
+
+// Skip records path if err is a parse error, and reports whether it did.
+func (s *skippedFiles) Skip(path string, err error) bool {
+	var parseErr *matcher.ParseError
+	if !errors.As(err, &parseErr) {
+		return false
+	}
+	s.Skipped = append(s.Skipped, skippedFile{Path: path, Err: err})
+	return true
+}
+
+// Report prints how many files were skipped, or with verbose each file
+// and its error, to stderr. It reports whether the run should fail.
+func (s *skippedFiles) Report() bool {
+	if len(s.Skipped) == 0 {
+		return false
+	}
+
+	files := "files"
+	if len(s.Skipped) == 1 {
+		files = "file"
+	}
+	if s.verbose {
+		fmt.Fprintf(stderr, "\n%d %s skipped:\n", len(s.Skipped), files)
+		for _, f := range s.Skipped {
+			fmt.Fprintf(stderr, "  %v\n", f.Err) // names the file
+		}
+	} else {
+		fmt.Fprintf(stderr, "\n%d %s skipped, run with --verbose to see why\n", len(s.Skipped), files)
+	}
+	return s.strict
+}
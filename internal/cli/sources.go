@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/internal/filter"
+)
+
+// expandSources resolves the --source flags of match and apply to .go
+// files. Each value is a file, a directory (walked recursively), a glob
+// in which ** stands for any number of directories, as in
+// internal/**/*.go, or - for the source read by readStdinSource. Files
+// found by walking or globbing leave out _test.go files unless
+// includeTests is set, and the files skip leaves out, which are counted
+// in excluded; a file named outright is always kept. A file reached
+// twice is listed once, where it was first found. A value that resolves
+// to no files is an error.
+func expandSources(sources []string, includeTests bool, skip *filter.Filter) (files []string, excluded int, err error) {
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		var root string
+		var found []string
+		if source == stdinArg && stdinSource != nil {
+			found, source = []string{stdinSource.name}, stdinSource.name
+		} else if isGlob(source) {
+			root, found, err = globFiles(source)
+		} else {
+			root = strings.TrimSuffix(source, "/...")
+			found, err = collectFiles(source, ".go")
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		named := len(found) == 1 && found[0] == source
+		n := 0
+		for _, file := range found {
+			if !includeTests && !named && strings.HasSuffix(file, "_test.go") {
+				continue
+			}
+			n++
+			clean := filepath.Clean(file)
+			if seen[clean] {
+				continue
+			}
+			seen[clean] = true
+			if !named {
+				left, err := skip.Skip(root, file)
+				if err != nil {
+					return nil, 0, err
+				}
+				if left {
+					excluded++
+					continue
+				}
+			}
+			files = append(files, file)
+		}
+		if n == 0 {
+			return nil, 0, fmt.Errorf("--source %s matches no .go files", source)
+		}
+	}
+	return files, excluded, nil
+}
+
+// isGlob reports whether a --source value has glob metacharacters.
+func isGlob(source string) bool {
+	return strings.ContainsAny(source, "*?[")
+}
+
+// globFiles returns the .go files matching pattern, walking from root,
+// the directory its leading literal elements name.
+func globFiles(pattern string) (root string, files []string, err error) {
+	pattern = filepath.ToSlash(pattern)
+	elems := strings.Split(pattern, "/")
+	n := 0
+	for n < len(elems)-1 && !isGlob(elems[n]) {
+		n++
+	}
+	root = strings.Join(elems[:n], "/")
+	if root == "" && n > 0 {
+		root = "/"
+	}
+	if root == "" {
+		root = "."
+	}
+	for _, elem := range elems[n:] {
+		if _, err := path.Match(elem, ""); err != nil {
+			return "", nil, fmt.Errorf("--source %s: %w", pattern, err)
+		}
+	}
+	rest := strings.Join(elems[n:], "/")
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(p) != ".go" {
+			return nil
+		}
+		// WalkDir cleans the paths it visits, so ./a/*.go finds a/x.go
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if filter.Match(rest, filepath.ToSlash(rel)) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return root, nil, nil
+	}
+	return root, files, err
+}
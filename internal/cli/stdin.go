@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// stdinArg in place of a .lift path or a --source reads it from stdin.
+const stdinArg = "-"
+
+// stdinName is the file name Go source read from stdin is reported
+// under, unless --source-name gives another.
+const stdinName = "<stdin>"
+
+// stdinFile is Go source read from stdin, and the name it goes by.
+type stdinFile struct {
+	name string
+	data []byte
+}
+
+// stdinSource is the Go source read for --source -, if any. newMatcher
+// and readSource serve it for its name instead of reading the file.
+var stdinSource *stdinFile
+
+// readStdinSource reads Go source from stdin under name, or stdinName if
+// name is empty, and returns the name to process it by.
+func readStdinSource(name string) (string, error) {
+	if name == "" {
+		name = stdinName
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	stdinSource = &stdinFile{name: name, data: data}
+	return name, nil
+}
+
+// readSource returns the contents of a source file, or of stdin for the
+// name it was read under.
+func readSource(path string) ([]byte, error) {
+	if stdinSource != nil && path == stdinSource.name {
+		return stdinSource.data, nil
+	}
+	return os.ReadFile(path)
+}
+
+// checkStdin reports an error if both the .lift file and a --source
+// would be read from stdin.
+func checkStdin(liftPath string, sources []string) error {
+	if liftPath != stdinArg {
+		return nil
+	}
+	for _, source := range sources {
+		if source == stdinArg {
+			return errors.New("the .lift file and --source can't both be read from stdin")
+		}
+	}
+	return nil
+}
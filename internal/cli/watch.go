@@ -0,0 +1,212 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/vinodhalaharvi/stencil/grammar"
+	"github.com/vinodhalaharvi/stencil/internal/rules"
+)
+
+// watchDebounce is how long a burst of file events has to settle before
+// matching runs again; an editor save is often several events.
+const watchDebounce = 200 * time.Millisecond
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\033[H\033[2J"
+
+// matchWatcher re-runs match --watch whenever the .lift file or a Go file
+// under the source path changes, printing what changed since the last run.
+type matchWatcher struct {
+	liftPath   string
+	sourcePath string
+	optimize   bool
+	verbose    bool
+
+	previous map[string]bool // findings of the last successful run
+}
+
+// Watch runs matching once, then again after every change until the
+// process is interrupted.
+func (w *matchWatcher) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Editors often save by renaming a new file over the old one, which a
+	// watch on the file itself doesn't survive, so the .lift file's
+	// directory is watched instead
+	if !strings.HasPrefix(w.liftPath, rules.Prefix) {
+		if err := watcher.Add(filepath.Dir(w.liftPath)); err != nil {
+			return err
+		}
+	}
+	if err := w.addDirs(watcher, w.sourcePath); err != nil {
+		return err
+	}
+
+	w.run()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					w.addDirs(watcher, event.Name)
+				}
+			}
+			if w.relevant(event.Name) {
+				debounce = time.After(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(stderr, "watch error: %v\n", err)
+		case <-debounce:
+			debounce = nil
+			w.run()
+		}
+	}
+}
+
+// addDirs watches path, if it is a directory, and every directory beneath
+// it; fsnotify watches aren't recursive. A file is watched through its
+// directory.
+func (w *matchWatcher) addDirs(watcher *fsnotify.Watcher, path string) error {
+	path = strings.TrimSuffix(path, "/...")
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return watcher.Add(filepath.Dir(path))
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return watcher.Add(p)
+	})
+}
+
+// relevant reports whether a change to name affects the results.
+func (w *matchWatcher) relevant(name string) bool {
+	if filepath.Clean(name) == filepath.Clean(w.liftPath) {
+		return true
+	}
+	return filepath.Ext(name) == ".go"
+}
+
+// run matches once and prints a timestamped summary and the findings
+// added (+) and removed (-) since the previous run. A .lift file that
+// doesn't parse is reported and the previous findings kept.
+func (w *matchWatcher) run() {
+	fmt.Fprint(stdout, clearScreen)
+	fmt.Fprintf(stdout, "[%s] stencil match %s --source %s\n\n", time.Now().Format("15:04:05"), w.liftPath, w.sourcePath)
+
+	current, err := w.findings()
+	var liftErr *liftError
+	if errors.As(err, &liftErr) {
+		printParseError(w.liftPath, liftErr.err)
+	} else if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+	}
+	if err != nil {
+		fmt.Fprintln(stdout, "\nwaiting for changes...")
+		return
+	}
+
+	added, removed := diffFindings(w.previous, current)
+	w.previous = current
+
+	fmt.Fprintf(stdout, "%d match(es)", len(current))
+	if len(added)+len(removed) == 0 {
+		fmt.Fprint(stdout, ", no changes since the last run")
+	}
+	fmt.Fprintln(stdout)
+	for _, f := range added {
+		fmt.Fprintf(stdout, "  + %s\n", f)
+	}
+	for _, f := range removed {
+		fmt.Fprintf(stdout, "  - %s\n", f)
+	}
+	fmt.Fprintln(stdout, "\nwaiting for changes...")
+}
+
+// diffFindings returns the findings in current but not previous, and
+// those in previous but not current, each sorted.
+func diffFindings(previous, current map[string]bool) (added, removed []string) {
+	for f := range current {
+		if !previous[f] {
+			added = append(added, f)
+		}
+	}
+	for f := range previous {
+		if !current[f] {
+			removed = append(removed, f)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// liftError marks a failure to read or parse the .lift file, which is
+// shown with the file's own error formatting.
+type liftError struct{ err error }
+
+func (e *liftError) Error() string { return e.err.Error() }
+
+// findings runs matching and returns each match as file:line:column:
+// severity: block, the form lint reports them in with the column added,
+// so that matches sharing a line are told apart.
+func (w *matchWatcher) findings() (map[string]bool, error) {
+	parser, err := grammar.NewParser()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readLift(w.liftPath)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := parseLift(parser, w.liftPath, data)
+	if err != nil {
+		return nil, &liftError{err}
+	}
+	if w.optimize {
+		optimizeWhere(prog.Blocks)
+	}
+
+	sourcePaths, err := collectFiles(w.sourcePath, ".go")
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := skippedFiles{verbose: w.verbose}
+	results, err := matchSources(prog, sourcePaths, nil, 0, &skipped, nil)
+	if err != nil {
+		return nil, err
+	}
+	skipped.Report()
+
+	current := make(map[string]bool, len(results))
+	for _, r := range results {
+		pos := r.fset.Position(r.match.Node.Pos())
+		current[fmt.Sprintf("%s:%d:%d: %s: %s", pos.Filename, pos.Line, pos.Column, blockSeverity(r.block), r.block.Name)] = true
+	}
+	return current, nil
+}
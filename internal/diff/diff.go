@@ -0,0 +1,175 @@
+// Package diff compares texts line by line and writes the differences as
+// git-style unified diffs, for apply --diff and --patch-file.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+// maxCells bounds the table Edits builds to line up changed lines; past
+// it, the changed region becomes a single edit.
+const maxCells = 4 << 20
+
+// Edit replaces the lines [OldStart, OldEnd) of the old text with the
+// lines [NewStart, NewEnd) of the new one.
+type Edit struct {
+	OldStart, OldEnd int
+	NewStart, NewEnd int
+}
+
+// Lines splits s after each newline, keeping the newlines. A last line
+// without one is kept as it is.
+func Lines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Edits returns the edits that turn the lines a into the lines b, one
+// per run of changed lines, in order.
+func Edits(a, b []string) []Edit {
+	// Lines common to both ends don't need the table
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	if len(a)*len(b) > maxCells {
+		return []Edit{{pre, pre + len(a), pre, pre + len(b)}}
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var edits []Edit
+	var pending *Edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			if pending != nil {
+				edits = append(edits, *pending)
+				pending = nil
+			}
+			i++
+			j++
+			continue
+		}
+		if pending == nil {
+			pending = &Edit{pre + i, pre + i, pre + j, pre + j}
+		}
+		if j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]) {
+			i++
+			pending.OldEnd = pre + i
+		} else {
+			j++
+			pending.NewEnd = pre + j
+		}
+	}
+	if pending != nil {
+		edits = append(edits, *pending)
+	}
+	return edits
+}
+
+// File returns the git-style unified diff that turns old into new for
+// the file at path, which should be relative and slash-separated, or ""
+// if they are the same. A nil old is a file being created.
+func File(path string, old, new []byte) string {
+	if old != nil && string(old) == string(new) {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "diff --git a/%s b/%s\n", path, path)
+	if old == nil {
+		b.WriteString("new file mode 100644\n")
+		b.WriteString("--- /dev/null\n")
+	} else {
+		fmt.Fprintf(&b, "--- a/%s\n", path)
+	}
+	fmt.Fprintf(&b, "+++ b/%s\n", path)
+
+	a, c := Lines(string(old)), Lines(string(new))
+	edits := Edits(a, c)
+	for len(edits) > 0 {
+		// A hunk takes every edit whose context touches the previous one's
+		n := 1
+		for n < len(edits) && edits[n].OldStart-edits[n-1].OldEnd <= 2*context {
+			n++
+		}
+		writeHunk(&b, a, c, edits[:n])
+		edits = edits[n:]
+	}
+	return b.String()
+}
+
+// writeHunk writes one hunk covering edits, with context around them.
+func writeHunk(b *strings.Builder, a, c []string, edits []Edit) {
+	first, last := edits[0], edits[len(edits)-1]
+	oldStart := max(first.OldStart-context, 0)
+	oldEnd := min(last.OldEnd+context, len(a))
+	newStart := first.NewStart - (first.OldStart - oldStart)
+	newEnd := last.NewEnd + (oldEnd - last.OldEnd)
+
+	fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(oldStart, oldEnd), hunkRange(newStart, newEnd))
+	i := oldStart
+	for _, e := range edits {
+		for ; i < e.OldStart; i++ {
+			writeLine(b, ' ', a[i])
+		}
+		for ; i < e.OldEnd; i++ {
+			writeLine(b, '-', a[i])
+		}
+		for j := e.NewStart; j < e.NewEnd; j++ {
+			writeLine(b, '+', c[j])
+		}
+	}
+	for ; i < oldEnd; i++ {
+		writeLine(b, ' ', a[i])
+	}
+}
+
+// hunkRange formats the lines [start, end) as a hunk header range, which
+// counts from 1 and names the line before an empty range.
+func hunkRange(start, end int) string {
+	if end == start {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, end-start)
+}
+
+// writeLine writes a diff line, marking a last line without a newline.
+func writeLine(b *strings.Builder, prefix byte, line string) {
+	b.WriteByte(prefix)
+	b.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		b.WriteString("\n\\ No newline at end of file\n")
+	}
+}
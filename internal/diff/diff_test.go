@@ -0,0 +1,136 @@
+package diff
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	old := "package p\n\nfunc A() {}\n"
+	new := "package p\n\nfunc A() {}\n\nfunc B() {}\n"
+
+	want := "diff --git a/p.go b/p.go\n" +
+		"--- a/p.go\n" +
+		"+++ b/p.go\n" +
+		"@@ -1,3 +1,5 @@\n" +
+		" package p\n" +
+		" \n" +
+		" func A() {}\n" +
+		"+\n" +
+		"+func B() {}\n"
+	if got := File("p.go", []byte(old), []byte(new)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got := File("p.go", []byte(old), []byte(old)); got != "" {
+		t.Errorf("expected no diff for equal files, got:\n%s", got)
+	}
+
+	t.Logf("✓ Unified diff written")
+}
+
+func TestFileHunks(t *testing.T) {
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, strings.Repeat("x", i+1)+"\n")
+	}
+	old := strings.Join(lines, "")
+	lines[1], lines[17] = "changed\n", "changed too\n"
+	got := File("f.txt", []byte(old), []byte(strings.Join(lines, "")))
+
+	if n := strings.Count(got, "\n@@ "); n != 2 {
+		t.Errorf("expected 2 hunks for changes far apart, got %d:\n%s", n, got)
+	}
+	if !strings.Contains(got, "@@ -1,5 +1,5 @@") || !strings.Contains(got, "@@ -15,6 +15,6 @@") {
+		t.Errorf("unexpected hunk ranges:\n%s", got)
+	}
+}
+
+func TestEdits(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []Edit
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", nil},
+		{"a\nc\n", "a\nb\nc\n", []Edit{{1, 1, 1, 2}}},
+		{"a\nb\nc\n", "a\nc\n", []Edit{{1, 2, 1, 1}}},
+		{"a\nb\nc\nd\ne\n", "A\nb\nc\nd\nE\n", []Edit{{0, 1, 0, 1}, {4, 5, 4, 5}}},
+		{"", "a\n", []Edit{{0, 0, 0, 1}}},
+	}
+	for _, tt := range tests {
+		got := Edits(Lines(tt.a), Lines(tt.b))
+		if len(got) != len(tt.want) {
+			t.Errorf("%q -> %q: expected %v, got %v", tt.a, tt.b, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q -> %q: expected %v, got %v", tt.a, tt.b, tt.want, got)
+			}
+		}
+	}
+}
+
+// TestGitApply checks that git accepts the diffs: a change in the middle
+// of a file, a new file in a new directory, and files without a final
+// newline.
+func TestGitApply(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	git("init", "-q")
+
+	files := []struct {
+		path     string
+		old, new string
+		create   bool
+	}{
+		{path: "main.go", old: "package main\n\nfunc main() {\n\trun()\n}\n", new: "package main\n\nfunc main() {\n\tif err := run(); err != nil {\n\t\tpanic(err)\n\t}\n}\n"},
+		{path: "gen/schema.sql", new: "CREATE TABLE users (\n    id BIGINT NOT NULL\n);\n", create: true},
+		{path: "notes.txt", old: "one\ntwo", new: "one\ntwo\nthree"},
+		{path: "tail.txt", old: "one\n", new: "one\ntwo"},
+	}
+
+	var patch strings.Builder
+	for _, f := range files {
+		if !f.create {
+			if err := os.WriteFile(filepath.Join(dir, f.path), []byte(f.old), 0644); err != nil {
+				t.Fatal(err)
+			}
+			patch.WriteString(File(f.path, []byte(f.old), []byte(f.new)))
+		} else {
+			patch.WriteString(File(f.path, nil, []byte(f.new)))
+		}
+	}
+	patchPath := filepath.Join(t.TempDir(), "changes.patch")
+	if err := os.WriteFile(patchPath, []byte(patch.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	git("apply", "--check", patchPath)
+	git("apply", patchPath)
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != f.new {
+			t.Errorf("%s: expected %q after git apply, got %q", f.path, f.new, data)
+		}
+	}
+
+	t.Logf("✓ git apply accepts the patch")
+}
@@ -0,0 +1,115 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"vendor/**", "vendor/github.com/x/x.go", true},
+		{"vendor/**", "internal/vendor/x.go", false},
+		{"**/*_gen.go", "a_gen.go", true},
+		{"**/*_gen.go", "internal/db/models_gen.go", true},
+		{"**/*_gen.go", "internal/db/models.go", false},
+		{"internal/*/x.go", "internal/a/b/x.go", false},
+		{"internal/**/x.go", "internal/a/b/x.go", true},
+		{"internal/**/x.go", "internal/x.go", true},
+		{"**", "a/b/c.go", true},
+		{"*.go", "sub/b.go", false},
+		{"sub/*/*.go", "sub/b.go", false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsGenerated(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"// Code generated by stringer; DO NOT EDIT.\n\npackage p\n", true},
+		{"// Copyright 2024 The Authors.\n\n// Code generated by protoc-gen-go. DO NOT EDIT.\r\n//go:build linux\n\npackage p\n", true},
+		{"// Code generated by hand, edit away.\n\npackage p\n", false},
+		{"// code generated by x. DO NOT EDIT.\n\npackage p\n", false},
+		{"package p\n\n// Code generated by x. DO NOT EDIT.\n", false},
+	}
+	for _, tt := range tests {
+		if got := IsGenerated([]byte(tt.src)); got != tt.want {
+			t.Errorf("IsGenerated(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.go":                  "package a\n",
+		"a_gen.go":              "package a\n",
+		"gen.go":                "// Code generated by x. DO NOT EDIT.\n\npackage a\n",
+		"vendor/x/x.go":         "package x\n",
+		"testdata/t.go":         "package t\n",
+		"web/node_modules/n.go": "package n\n",
+		"internal/b/b.go":       "package b\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skipped := func(f *Filter) string {
+		t.Helper()
+		var names []string
+		for _, name := range []string{"a.go", "a_gen.go", "gen.go", "vendor/x/x.go", "testdata/t.go", "web/node_modules/n.go", "internal/b/b.go"} {
+			skip, err := f.Skip(root, filepath.Join(root, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skip {
+				names = append(names, name)
+			}
+		}
+		return strings.Join(names, " ")
+	}
+
+	f, err := New(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := skipped(f), "gen.go vendor/x/x.go testdata/t.go web/node_modules/n.go"; got != want {
+		t.Errorf("defaults: skipped %q, want %q", got, want)
+	}
+
+	f, err = New([]string{"**/*_gen.go", "internal/**"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := skipped(f), "a_gen.go vendor/x/x.go testdata/t.go web/node_modules/n.go internal/b/b.go"; got != want {
+		t.Errorf("--exclude --include-generated: skipped %q, want %q", got, want)
+	}
+
+	// A root inside a skipped directory is still walked
+	skip, err := f.Skip(filepath.Join(root, "testdata"), filepath.Join(root, "testdata/t.go"))
+	if err != nil || skip {
+		t.Errorf("expected testdata/t.go kept under root testdata, got %v, %v", skip, err)
+	}
+
+	if _, err := New([]string{"vendor/["}, false); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+
+	t.Logf("✓ Exclusions and default skips applied")
+}
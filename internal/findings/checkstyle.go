@@ -0,0 +1,61 @@
+package findings
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// checkstyleReport is the root of a Checkstyle XML report, the format
+// Jenkins' warnings plugins and many CI servers read.
+type checkstyleReport struct {
+	XMLName xml.Name         `xml:"checkstyle"`
+	Version string           `xml:"version,attr"`
+	Files   []checkstyleFile `xml:"file"`
+}
+
+type checkstyleFile struct {
+	Name   string            `xml:"name,attr"`
+	Errors []checkstyleError `xml:"error"`
+}
+
+type checkstyleError struct {
+	Line     int    `xml:"line,attr"`
+	Column   int    `xml:"column,attr"`
+	Severity string `xml:"severity,attr"`
+	Message  string `xml:"message,attr"`
+	Source   string `xml:"source,attr"`
+}
+
+// formatCheckstyle writes findings as Checkstyle XML, one <file> per
+// source file in the order they first appear. The rule is the source,
+// as stencil.<block>.
+func formatCheckstyle(w io.Writer, findings []Finding) error {
+	report := checkstyleReport{Version: "4.3"}
+	index := make(map[string]int)
+	for _, f := range findings {
+		i, ok := index[f.File]
+		if !ok {
+			i = len(report.Files)
+			index[f.File] = i
+			report.Files = append(report.Files, checkstyleFile{Name: f.File})
+		}
+		report.Files[i].Errors = append(report.Files[i].Errors, checkstyleError{
+			Line:     f.Line,
+			Column:   f.Column,
+			Severity: f.Severity,
+			Message:  f.Message,
+			Source:   "stencil." + f.Block,
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,91 @@
+// Package findings is the model behind stencil lint's output: every match
+// becomes a Finding, and each output format is a Formatter that writes a
+// list of them, so adding a format doesn't touch the matching.
+package findings
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Finding is one match of a rule.
+type Finding struct {
+	File     string
+	Line     int
+	Column   int
+	Block    string // the lift block that matched
+	Severity string // "error", "warning" or "info"
+	Message  string
+
+	// Bindings holds the match's bindings rendered as source text, for
+	// --format-template. Other formats leave them out.
+	Bindings map[string]string
+}
+
+// A Formatter writes findings in one output format.
+type Formatter interface {
+	Format(w io.Writer, findings []Finding) error
+}
+
+// FormatterFunc adapts a function to Formatter.
+type FormatterFunc func(w io.Writer, findings []Finding) error
+
+// Format calls f.
+func (f FormatterFunc) Format(w io.Writer, findings []Finding) error {
+	return f(w, findings)
+}
+
+var formats = map[string]Formatter{
+	"text":       FormatterFunc(formatText),
+	"checkstyle": FormatterFunc(formatCheckstyle),
+	"github":     FormatterFunc(formatGitHub),
+}
+
+// Lookup returns the formatter for a format name.
+func Lookup(name string) (Formatter, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q (want %s)", name, strings.Join(Names(), ", "))
+	}
+	return f, nil
+}
+
+// Names returns the supported format names, in order.
+func Names() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sort orders findings by file, then position, then block.
+func Sort(findings []Finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Block < b.Block
+	})
+}
+
+// formatText writes one file:line:col: severity: message line per
+// finding, the form compilers and editors understand.
+func formatText(w io.Writer, findings []Finding) error {
+	for _, f := range findings {
+		if _, err := fmt.Fprintf(w, "%s:%d:%d: %s: %s\n", f.File, f.Line, f.Column, f.Severity, f.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
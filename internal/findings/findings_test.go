@@ -0,0 +1,143 @@
+package findings
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// sample has findings out of order, across files, at every severity, and
+// with characters each format has to escape.
+var sample = []Finding{
+	{File: "pkg/server.go", Line: 40, Column: 2, Block: "response-body-close", Severity: "error", Message: "response body is never closed"},
+	{File: "client.go", Line: 17, Column: 15, Block: "ctx-timeout", Severity: "warning", Message: "http.Get without a context: use NewRequestWithContext"},
+	{File: "client.go", Line: 9, Column: 1, Block: "exported-doc", Severity: "info", Message: "exported func has no doc comment <Client & co>\n100% sure"},
+}
+
+func TestFormatGolden(t *testing.T) {
+	findings := append([]Finding(nil), sample...)
+	Sort(findings)
+
+	for name, golden := range map[string]string{
+		"text":       "findings.txt",
+		"checkstyle": "findings.xml",
+		"github":     "findings.github",
+	} {
+		f, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := f.Format(&buf, findings); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		path := filepath.Join("testdata", golden)
+		if *update {
+			if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v (run with -update to create it)", err)
+		}
+		if buf.String() != string(want) {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", name, buf.String(), want)
+		}
+	}
+
+	t.Logf("✓ Formats match their golden files")
+}
+
+func TestFormatEmpty(t *testing.T) {
+	for _, name := range Names() {
+		f, _ := Lookup(name)
+		var buf bytes.Buffer
+		if err := f.Format(&buf, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if name == "checkstyle" && !strings.Contains(buf.String(), "<checkstyle") {
+			t.Errorf("checkstyle: expected an empty report, got %q", buf.String())
+		}
+	}
+}
+
+func TestLookupUnknown(t *testing.T) {
+	if _, err := Lookup("sarif2"); err == nil || !strings.Contains(err.Error(), "checkstyle, github, text") {
+		t.Errorf("expected an error listing the formats, got %v", err)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	findings := append([]Finding(nil), sample...)
+	Sort(findings)
+	findings[0].Bindings = map[string]string{"Fn": "http.Get"}
+
+	tmpl, err := NewTemplate(
+		"{{.File}}:{{.Line}}: [{{.Block}}] {{.Message}}{{with .Bindings.Fn}} ({{.}}){{end}}",
+		"{{.Total}} finding(s) in {{.Files}} file(s), {{.Errors}} error(s){{range $b, $n := .Blocks}}\n  {{$b}}: {{$n}}{{end}}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Format(&buf, findings[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "client.go:9: [exported-doc] exported func has no doc comment <Client & co>\n100% sure (http.Get)\n" +
+		"client.go:17: [ctx-timeout] http.Get without a context: use NewRequestWithContext\n" +
+		"2 finding(s) in 1 file(s), 0 error(s)\n" +
+		"  ctx-timeout: 1\n" +
+		"  exported-doc: 1\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	t.Logf("✓ Findings written with a template")
+}
+
+func TestTemplateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "finding.tmpl")
+	if err := os.WriteFile(path, []byte("{{.Severity}} {{.File}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := NewTemplate("@"+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Format(&buf, sample[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "error pkg/server.go\n" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	if _, err := NewTemplate("@"+filepath.Join(t.TempDir(), "missing.tmpl"), ""); err == nil {
+		t.Error("expected an error for a missing template file")
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		finding, summary string
+		want             string
+	}{
+		{"{{.File", "", "unclosed action"},
+		{"{{.Path}}", "", "can't evaluate field Path"},
+		{"{{.File}}", "{{.Violations}}", "can't evaluate field Violations"},
+	}
+	for _, tt := range tests {
+		_, err := NewTemplate(tt.finding, tt.summary)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q, %q: expected an error containing %q, got %v", tt.finding, tt.summary, tt.want, err)
+		}
+	}
+}
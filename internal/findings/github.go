@@ -0,0 +1,45 @@
+package findings
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// githubLevels maps severities to GitHub Actions workflow commands.
+var githubLevels = map[string]string{
+	"error":   "error",
+	"warning": "warning",
+	"info":    "notice",
+}
+
+// formatGitHub writes findings as GitHub Actions workflow commands,
+//
+//	::warning file=client.go,line=17,col=2,title=ctx-timeout::message
+//
+// which a workflow step turns into annotations on the pull request.
+func formatGitHub(w io.Writer, findings []Finding) error {
+	for _, f := range findings {
+		level, ok := githubLevels[f.Severity]
+		if !ok {
+			level = "warning"
+		}
+		_, err := fmt.Fprintf(w, "::%s file=%s,line=%d,col=%d,title=%s::%s\n", level,
+			githubProperty(f.File), f.Line, f.Column, githubProperty(f.Block), githubData(f.Message))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// githubData escapes a workflow command's message.
+func githubData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubProperty escapes a workflow command property value, which also
+// can't hold the separators : and ,.
+func githubProperty(s string) string {
+	return strings.NewReplacer(":", "%3A", ",", "%2C").Replace(githubData(s))
+}
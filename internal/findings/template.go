@@ -0,0 +1,113 @@
+package findings
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Summary is what a summary template is executed with, after every
+// finding has been written.
+type Summary struct {
+	Total    int
+	Errors   int
+	Warnings int
+	Info     int
+	Files    int            // files with at least one finding
+	Blocks   map[string]int // findings per block; range visits them by name
+}
+
+// Template is a Formatter that executes a text/template once per
+// finding, with the Finding as its data, and then, if set, a summary
+// template with the Summary. Each output that doesn't end in a newline
+// gets one.
+type Template struct {
+	finding *template.Template
+	summary *template.Template
+}
+
+// NewTemplate parses the per-finding template and, unless it is empty,
+// the summary template. Either may be @path to read the template from a
+// file. Both are tried on sample data, so a template that names a field
+// Finding or Summary doesn't have fails here rather than once per
+// finding. A missing Bindings key renders as an empty string.
+func NewTemplate(finding, summary string) (*Template, error) {
+	t := &Template{}
+	var err error
+	if t.finding, err = parseTemplate("format-template", finding, Finding{Bindings: map[string]string{}}); err != nil {
+		return nil, err
+	}
+	if summary != "" {
+		if t.summary, err = parseTemplate("summary-template", summary, Summary{Blocks: map[string]int{}}); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func parseTemplate(name, text string, sample any) (*template.Template, error) {
+	if path, ok := strings.CutPrefix(text, "@"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		name, text = path, string(data)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Format writes each finding, then the summary.
+func (t *Template) Format(w io.Writer, findings []Finding) error {
+	for _, f := range findings {
+		if err := execLine(w, t.finding, f); err != nil {
+			return err
+		}
+	}
+	if t.summary == nil {
+		return nil
+	}
+	return execLine(w, t.summary, Summarize(findings))
+}
+
+// execLine executes tmpl and writes its output, ending it with a newline.
+func execLine(w io.Writer, tmpl *template.Template, data any) error {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Summarize counts findings by severity, file and block.
+func Summarize(findings []Finding) Summary {
+	s := Summary{Total: len(findings), Blocks: make(map[string]int)}
+	files := make(map[string]bool)
+	for _, f := range findings {
+		switch f.Severity {
+		case "error":
+			s.Errors++
+		case "warning":
+			s.Warnings++
+		case "info":
+			s.Info++
+		}
+		files[f.File] = true
+		s.Blocks[f.Block]++
+	}
+	s.Files = len(files)
+	return s
+}
@@ -0,0 +1,236 @@
+// Package plan records what stencil apply would change, so a run can be
+// reviewed and archived first and then applied verbatim with
+// apply --from-plan.
+//
+// A plan lists, per source file, the actions planned at each match and
+// the byte-range edits that turn the file into its modified form, and
+// the files that emit actions would write:
+//
+//	{
+//	  "version": 1,
+//	  "out_dir": ".",
+//	  "files": [
+//	    {"path": "client.go", "hash": "sha256:...",
+//	     "actions": [{"block": "enforce-ctx-timeout", "kind": "patch", "line": 17, "column": 2}],
+//	     "edits": [{"start": 312, "end": 340, "text": "..."}]}
+//	  ],
+//	  "emitted": [
+//	    {"path": "user.sql", "hash": "sha256:...", "content": "..."}
+//	  ]
+//	}
+//
+// Hashes are of the file as it was when the plan was made, so applying
+// it can refuse files that changed since.
+package plan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vinodhalaharvi/stencil/internal/diff"
+)
+
+// Version is the plan format written by this package.
+const Version = 1
+
+// Plan is the recorded outcome of an apply run.
+type Plan struct {
+	Version int        `json:"version"`
+	OutDir  string     `json:"out_dir"` // emitted paths are relative to it
+	Files   []*File    `json:"files"`
+	Emitted []*Emitted `json:"emitted"`
+
+	index map[string]*File
+}
+
+// File is a source file with planned actions.
+type File struct {
+	Path    string   `json:"path"`
+	Hash    string   `json:"hash"`
+	Actions []Action `json:"actions"`
+	Edits   []Edit   `json:"edits"`
+}
+
+// Action is one action applied at one match.
+type Action struct {
+	Block  string `json:"block"`
+	Kind   string `json:"kind"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// Edit replaces the bytes [Start, End) of the original file with Text.
+type Edit struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+}
+
+// Emitted is a file an emit action writes. Previous is the hash of the
+// file it replaces, or empty if there was none.
+type Emitted struct {
+	Path     string `json:"path"`
+	Hash     string `json:"hash"`
+	Previous string `json:"previous,omitempty"`
+	Content  string `json:"content"`
+}
+
+// New creates an empty plan for emitted files written under outDir.
+func New(outDir string) *Plan {
+	return &Plan{Version: Version, OutDir: outDir}
+}
+
+// Action records an action planned in the source file at path.
+func (p *Plan) Action(path string, a Action) {
+	f := p.file(path)
+	f.Actions = append(f.Actions, a)
+}
+
+// Source records the contents of the source file at path and, if
+// modified is non-nil, the edits that turn it into modified.
+func (p *Plan) Source(path string, original, modified []byte) {
+	f := p.file(path)
+	f.Hash = Hash(original)
+	if modified != nil {
+		f.Edits = Diff(original, modified)
+	}
+}
+
+// Emit records a file written by an emit action.
+func (p *Plan) Emit(e Emitted) {
+	p.Emitted = append(p.Emitted, &e)
+}
+
+func (p *Plan) file(path string) *File {
+	if f, ok := p.index[path]; ok {
+		return f
+	}
+	if p.index == nil {
+		p.index = make(map[string]*File)
+	}
+	f := &File{Path: path, Actions: []Action{}, Edits: []Edit{}}
+	p.index[path] = f
+	p.Files = append(p.Files, f)
+	return f
+}
+
+// Write writes the plan to path as indented JSON.
+func (p *Plan) Write(path string) error {
+	if p.Files == nil {
+		p.Files = []*File{}
+	}
+	if p.Emitted == nil {
+		p.Emitted = []*Emitted{}
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Read reads a plan written by Write.
+func Read(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if p.Version != Version {
+		return nil, fmt.Errorf("%s: unsupported plan version %d", path, p.Version)
+	}
+	if p.OutDir == "" {
+		p.OutDir = "."
+	}
+	return &p, nil
+}
+
+// Check reports every file the plan would change that is no longer as it
+// was when the plan was made, and any emitted content that was altered
+// in the plan itself. Source files without edits are not checked.
+func (p *Plan) Check() error {
+	var errs []error
+	for _, f := range p.Files {
+		if len(f.Edits) == 0 {
+			continue
+		}
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			errs = append(errs, err)
+		} else if Hash(data) != f.Hash {
+			errs = append(errs, fmt.Errorf("%s has changed since the plan was made", f.Path))
+		}
+	}
+	for _, e := range p.Emitted {
+		if Hash([]byte(e.Content)) != e.Hash {
+			errs = append(errs, fmt.Errorf("%s: planned content doesn't match its hash", e.Path))
+		}
+		data, err := os.ReadFile(filepath.Join(p.OutDir, e.Path))
+		switch {
+		case err != nil && !os.IsNotExist(err):
+			errs = append(errs, err)
+		case err != nil && e.Previous != "":
+			errs = append(errs, fmt.Errorf("%s has been removed since the plan was made", e.Path))
+		case err == nil && e.Previous == "":
+			errs = append(errs, fmt.Errorf("%s has been created since the plan was made", e.Path))
+		case err == nil && Hash(data) != e.Previous:
+			errs = append(errs, fmt.Errorf("%s has changed since the plan was made", e.Path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Hash returns the hash plans record for data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Apply returns src with edits applied. The edits must be in order and
+// must not overlap.
+func Apply(src []byte, edits []Edit) ([]byte, error) {
+	var b strings.Builder
+	last := 0
+	for _, e := range edits {
+		if e.Start < last || e.End < e.Start || e.End > len(src) {
+			return nil, fmt.Errorf("edit [%d,%d) is out of order or out of range", e.Start, e.End)
+		}
+		b.Write(src[last:e.Start])
+		b.WriteString(e.Text)
+		last = e.End
+	}
+	b.Write(src[last:])
+	return []byte(b.String()), nil
+}
+
+// Diff returns line-level edits that turn old into new, one per run of
+// changed lines.
+func Diff(old, new []byte) []Edit {
+	a, b := diff.Lines(string(old)), diff.Lines(string(new))
+
+	// offsets[i] is where line i of old starts
+	offsets := make([]int, len(a)+1)
+	for i, line := range a {
+		offsets[i+1] = offsets[i] + len(line)
+	}
+
+	edits := []Edit{}
+	for _, e := range diff.Edits(a, b) {
+		edits = append(edits, Edit{
+			Start: offsets[e.OldStart],
+			End:   offsets[e.OldEnd],
+			Text:  strings.Join(b[e.NewStart:e.NewEnd], ""),
+		})
+	}
+	return edits
+}
@@ -0,0 +1,99 @@
+package plan
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		edits    int
+	}{
+		{"unchanged", "a\nb\nc\n", "a\nb\nc\n", 0},
+		{"insert", "a\nc\n", "a\nb\nc\n", 1},
+		{"delete", "a\nb\nc\n", "a\nc\n", 1},
+		{"replace", "a\nb\nc\n", "a\nB\nc\n", 1},
+		{"separate hunks", "a\nb\nc\nd\ne\n", "A\nb\nc\nd\nE\n", 2},
+		{"no trailing newline", "a\nb", "a\nb\nc", 1},
+		{"from empty", "", "package p\n", 1},
+		{"crlf", "a\r\nb\r\n", "a\r\nx\r\nb\r\n", 1},
+	}
+	for _, tt := range tests {
+		edits := Diff([]byte(tt.old), []byte(tt.new))
+		if len(edits) != tt.edits {
+			t.Errorf("%s: expected %d edit(s), got %+v", tt.name, tt.edits, edits)
+		}
+		got, err := Apply([]byte(tt.old), edits)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(got) != tt.new {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.new, got)
+		}
+	}
+
+	t.Logf("✓ Diff edits reproduce the new source")
+}
+
+func TestApplyRejectsBadEdits(t *testing.T) {
+	src := []byte("hello\n")
+	for _, edits := range [][]Edit{
+		{{Start: 2, End: 1}},
+		{{Start: 0, End: 10}},
+		{{Start: 3, End: 4}, {Start: 1, End: 2}},
+	} {
+		if _, err := Apply(src, edits); err == nil {
+			t.Errorf("expected %+v to be rejected", edits)
+		}
+	}
+
+	t.Logf("✓ Out-of-range and overlapping edits rejected")
+}
+
+func TestWriteReadCheck(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "client.go")
+	original := []byte("package p\n\nfunc F() {}\n")
+	os.WriteFile(source, original, 0644)
+
+	p := New(dir)
+	p.Action(source, Action{Block: "rename", Kind: "patch", Line: 3, Column: 1})
+	p.Source(source, original, []byte("package p\n\nfunc G() {}\n"))
+	p.Emit(Emitted{Path: "gen.sql", Hash: Hash([]byte("CREATE TABLE t;\n")), Content: "CREATE TABLE t;\n"})
+
+	path := filepath.Join(dir, "plan.json")
+	if err := p.Write(path); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if len(got.Files) != 1 || len(got.Files[0].Actions) != 1 || len(got.Files[0].Edits) != 1 || len(got.Emitted) != 1 {
+		t.Fatalf("unexpected plan: %+v", got)
+	}
+	if err := got.Check(); err != nil {
+		t.Errorf("expected a fresh plan to apply, got %v", err)
+	}
+
+	os.WriteFile(source, []byte("package p\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "gen.sql"), []byte("-- mine\n"), 0644)
+	err = got.Check()
+	if err == nil || !strings.Contains(err.Error(), "client.go has changed") || !strings.Contains(err.Error(), "gen.sql has been created") {
+		t.Errorf("expected both files reported, got %v", err)
+	}
+
+	t.Logf("✓ Plan round-trips and detects changed files")
+}
+
+func TestReadVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	os.WriteFile(path, []byte(`{"version": 2}`), 0644)
+	if _, err := Read(path); err == nil || !strings.Contains(err.Error(), "unsupported plan version 2") {
+		t.Errorf("expected a version error, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+// Package report records the transformations applied by stencil apply and
+// writes them as JSON for IDE plugins and CI annotations.
+//
+// A report is an array of entries, one per match acted on:
+//
+//	[
+//	  {"block": "enforce-ctx-timeout", "file": "client.go", "line": 17,
+//	   "actions": ["patch", "insert"]}
+//	]
+package report
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Entry describes the actions applied to a single match.
+type Entry struct {
+	Block   string   `json:"block"`
+	File    string   `json:"file"`
+	Line    int      `json:"line"`
+	Actions []string `json:"actions"`
+}
+
+// Writer accumulates entries and writes them to a file on Close.
+type Writer struct {
+	path    string
+	entries []Entry
+}
+
+// New creates a Writer that will write to path.
+func New(path string) *Writer {
+	return &Writer{path: path}
+}
+
+// Add records an entry.
+func (w *Writer) Add(e Entry) {
+	if e.Actions == nil {
+		e.Actions = []string{}
+	}
+	w.entries = append(w.entries, e)
+}
+
+// Entries returns the recorded entries.
+func (w *Writer) Entries() []Entry {
+	return w.entries
+}
+
+// Close writes all recorded entries to the report file as a JSON array.
+// An empty report is written as [].
+func (w *Writer) Close() error {
+	entries := w.entries
+	if entries == nil {
+		entries = []Entry{}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(w.path, append(data, '\n'), 0644)
+}
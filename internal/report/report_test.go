@@ -0,0 +1,57 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+
+	w := New(path)
+	w.Add(Entry{Block: "enforce-ctx-timeout", File: "client.go", Line: 17, Actions: []string{"patch", "insert"}})
+	w.Add(Entry{Block: "entity-repo", File: "model.go", Line: 3})
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	var got []Entry
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, data)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(got))
+	}
+	if got[0].Block != "enforce-ctx-timeout" || got[0].Line != 17 || len(got[0].Actions) != 2 {
+		t.Errorf("unexpected first entry: %+v", got[0])
+	}
+	if got[1].Actions == nil {
+		t.Error("expected empty actions to be written as [], not null")
+	}
+
+	t.Logf("✓ Report written")
+}
+
+func TestWriterEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+
+	if err := New(path).Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "[]\n" {
+		t.Errorf("expected empty array, got %q", data)
+	}
+
+	t.Logf("✓ Empty report written as []")
+}
@@ -0,0 +1,66 @@
+// Package rules holds the built-in rule library: .lift files compiled
+// into the binary, named by their file name without the extension.
+// Anywhere stencil takes a .lift path, builtin:<name> loads one of them
+// instead, as in
+//
+//	stencil match builtin:ctx-timeout --source ./...
+package rules
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// Prefix marks a .lift path as a built-in rule.
+const Prefix = "builtin:"
+
+//go:embed *.lift
+var files embed.FS
+
+// Rule describes a built-in rule.
+type Rule struct {
+	Name        string
+	Description string // the first line of the file's header comment
+}
+
+// List returns the built-in rules, sorted by name.
+func List() []Rule {
+	entries, _ := fs.ReadDir(files, ".")
+	var list []Rule
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".lift")
+		data, _ := files.ReadFile(entry.Name())
+		list = append(list, Rule{Name: name, Description: description(string(data))})
+	}
+	return list
+}
+
+// Source returns the .lift source of the named rule.
+func Source(name string) ([]byte, error) {
+	data, err := files.ReadFile(name + ".lift")
+	if err != nil {
+		return nil, fmt.Errorf("unknown built-in rule %q (see stencil rules list)", name)
+	}
+	return data, nil
+}
+
+// description returns the first line of the header comment after the
+// file's own name:
+//
+//	// ctx-timeout.lift
+//	//
+//	// HTTP calls made without a context timeout.
+func description(src string) string {
+	for i, line := range strings.Split(src, "\n") {
+		text, ok := strings.CutPrefix(line, "//")
+		if !ok {
+			break
+		}
+		if text = strings.TrimSpace(text); i > 0 && text != "" {
+			return text
+		}
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	list := List()
+	if len(list) == 0 {
+		t.Fatal("expected built-in rules")
+	}
+
+	for _, rule := range list {
+		if rule.Description == "" {
+			t.Errorf("%s: expected a description from the header comment", rule.Name)
+		}
+		src, err := Source(rule.Name)
+		if err != nil {
+			t.Fatalf("%s: %v", rule.Name, err)
+		}
+		if !strings.Contains(string(src), `lift "`+rule.Name+`"`) {
+			t.Errorf("%s: expected a block named after the rule", rule.Name)
+		}
+	}
+}
+
+func TestSourceUnknown(t *testing.T) {
+	for _, name := range []string{"nope", "", "../rules/ctx-timeout"} {
+		if _, err := Source(name); err == nil || !strings.Contains(err.Error(), "unknown built-in rule") {
+			t.Errorf("Source(%q): expected an unknown rule error, got %v", name, err)
+		}
+	}
+}
+
+func TestDescription(t *testing.T) {
+	src := "// name.lift\n//\n// First line.\n// Second line.\n\nlift \"name\" {}\n"
+	if got := description(src); got != "First line." {
+		t.Errorf("expected %q, got %q", "First line.", got)
+	}
+	if got := description("lift \"name\" {}\n"); got != "" {
+		t.Errorf("expected no description, got %q", got)
+	}
+}
@@ -9,20 +9,48 @@
 //   - Deep matching (match CallExpr in $Body { ... })
 //   - Field matching with bindings ($Name), spreads ($Fields...), wildcards (_)
 //   - Nested AST patterns (recursive structural matching)
-//   - Exact string matching for identifiers
+//   - Exact string matching for identifiers and operators (op: "!=")
 package matcher
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path"
 	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/vinodhalaharvi/stencil/grammar"
 )
 
+// Debug, if set, receives notes on where predicates that are false
+// because a binding they test against is unbound or empty. Set it before
+// matching, not during.
+var Debug io.Writer
+
+// debugf writes a note to Debug, if set.
+func debugf(format string, args ...any) {
+	if Debug != nil {
+		fmt.Fprintf(Debug, "debug: "+format+"\n", args...)
+	}
+}
+
 // Bindings holds captured values from pattern matching.
 // Keys are binding names (without $), values are the captured AST nodes.
 type Bindings map[string]any
@@ -36,16 +64,123 @@ func (b Bindings) Copy() Bindings {
 	return c
 }
 
+// Lookup resolves a dotted binding path such as "Name" or "m.Type": the
+// first segment names a binding and each later one a .lift field of the
+// node before it. It reports false if any segment can't be resolved.
+func (b Bindings) Lookup(path string) (any, bool) {
+	name, rest, dotted := strings.Cut(path, ".")
+	val, ok := b[name]
+	for ok && dotted {
+		node, isNode := val.(ast.Node)
+		if !isNode || reflect.ValueOf(node).IsNil() {
+			return nil, false
+		}
+		name, rest, dotted = strings.Cut(rest, ".")
+		val, ok = lookupField(node, name)
+	}
+	return val, ok
+}
+
 // Match represents a successful pattern match with its captured bindings.
 type Match struct {
-	Node     ast.Node // The matched AST node
-	Bindings Bindings // Captured bindings from the match
+	Node     ast.Node   // The matched AST node
+	Bindings Bindings   // Captured bindings from the match
+	Path     []ast.Node // Enclosing nodes, from the file down to Node's parent
+}
+
+// Implicit bindings set on every match returned by MatchBlock.
+const (
+	BindMatch         = "_match"         // the innermost matched node
+	BindEnclosingFunc = "_enclosingFunc" // the FuncDecl containing the match, if any
+	BindPreceding     = "_preceding"     // the statements before the match in its block
+	BindDocs          = "_docs"          // the doc comments of specs in unparenthesized declarations
+	BindAbsentLists   = "_absentLists"   // where the empty lists bound for missing field lists belong
+)
+
+// EnclosingFunc returns the innermost FuncDecl enclosing the match, or the
+// matched node itself if it is a FuncDecl. It returns nil at file level.
+func (m Match) EnclosingFunc() *ast.FuncDecl {
+	if fd, ok := m.Node.(*ast.FuncDecl); ok {
+		return fd
+	}
+	for i := len(m.Path) - 1; i >= 0; i-- {
+		if fd, ok := m.Path[i].(*ast.FuncDecl); ok {
+			return fd
+		}
+	}
+	return nil
+}
+
+// Preceding returns the statements before the match in its enclosing
+// block or case clause: those before the matched statement, or before
+// the statement containing a matched expression. It returns nil when the
+// match is not inside a statement list.
+func (m Match) Preceding() []ast.Stmt {
+	child := m.Node
+	for i := len(m.Path) - 1; i >= 0; i-- {
+		var list []ast.Stmt
+		switch p := m.Path[i].(type) {
+		case *ast.BlockStmt:
+			list = p.List
+		case *ast.CaseClause:
+			list = p.Body
+		case *ast.CommClause:
+			list = p.Body
+		}
+		if stmt, ok := child.(ast.Stmt); ok {
+			if idx := slices.Index(list, stmt); idx >= 0 {
+				return slices.Clip(list[:idx])
+			}
+		}
+		child = m.Path[i]
+	}
+	return nil
 }
 
 // Matcher performs pattern matching against Go AST.
 type Matcher struct {
-	fset *token.FileSet
-	file *ast.File
+	fset  *token.FileSet
+	file  *ast.File
+	src   []byte
+	path  string    // the file src was read from, if any
+	types *typeInfo // set by WithTypeCheck
+
+	granularity Granularity // set by SetGranularity
+
+	scopes map[*grammar.MatchScope]bool // scopes used since MatchFiltered began, and whether each was found
+}
+
+// Granularity limits where matchers without a scope of their own look
+// for matches in a file.
+type Granularity int
+
+const (
+	GranularityFile     Granularity = iota // anywhere in the file
+	GranularityFunction                    // only inside function bodies
+	GranularityPackage                     // only package-level declarations and their specs
+)
+
+var granularities = map[string]Granularity{
+	"file":     GranularityFile,
+	"function": GranularityFunction,
+	"package":  GranularityPackage,
+}
+
+// ParseGranularity returns the granularity named by s: "file",
+// "function" or "package".
+func ParseGranularity(s string) (Granularity, error) {
+	g, ok := granularities[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown scope %q (want package, file or function)", s)
+	}
+	return g, nil
+}
+
+// SetGranularity limits where matchers without an "in" clause or a
+// func/type scope look for matches. Narrower granularities visit fewer
+// nodes, which matters for large files.
+func (m *Matcher) SetGranularity(g Granularity) {
+	m.granularity = g
 }
 
 // New creates a Matcher from Go source code.
@@ -55,17 +190,48 @@ func New(src string) (*Matcher, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parse error: %w", err)
 	}
-	return &Matcher{fset: fset, file: file}, nil
+	return &Matcher{fset: fset, file: file, src: []byte(src)}, nil
 }
 
 // NewFromFile creates a Matcher from a Go source file path.
 func NewFromFile(path string) (*Matcher, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromSource(path, src)
+}
+
+// NewFromSource creates a Matcher from Go source that was read from
+// somewhere other than path, such as stdin or an editor buffer, but is
+// reported and type-checked as the file at path.
+func NewFromSource(path string, src []byte) (*Matcher, error) {
 	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
 	if err != nil {
-		return nil, fmt.Errorf("parse error: %w", err)
+		return nil, &ParseError{Path: path, Err: err}
+	}
+	return &Matcher{fset: fset, file: file, src: src, path: path}, nil
+}
+
+// ParseError is returned by NewFromFile and NewFromSource for a file that isn't valid Go,
+// so callers walking a directory can skip it and carry on.
+type ParseError struct {
+	Path string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	// go/parser errors already start with the file and position
+	var list scanner.ErrorList
+	if errors.As(e.Err, &list) && len(list) > 0 && list[0].Pos.Filename == e.Path {
+		return "parse error: " + e.Err.Error()
 	}
-	return &Matcher{fset: fset, file: file}, nil
+	return fmt.Sprintf("parse error: %s: %v", e.Path, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
 }
 
 // FileSet returns the token.FileSet for position information.
@@ -78,43 +244,253 @@ func (m *Matcher) File() *ast.File {
 	return m.file
 }
 
+// Source returns the Go source the file was parsed from.
+func (m *Matcher) Source() []byte {
+	return m.src
+}
+
 // MatchBlock executes all matchers in a lift block's from clause.
 // Returns all matches with their bindings.
 func (m *Matcher) MatchBlock(block *grammar.LiftBlock) ([]Match, error) {
+	if err := validateWhere(block.Where); err != nil {
+		return nil, err
+	}
+
 	if block.From == nil || len(block.From.Matchers) == 0 {
 		return nil, nil
 	}
 
-	// Start with the first matcher against the whole file
-	firstMatcher := block.From.Matchers[0]
-	matches := m.matchStmt(firstMatcher, m.file, nil)
+	// Paths such as FuncDecl / Body / CallExpr become chains of "in" matchers
+	stmts := block.From.Expand()
+	for _, stmt := range stmts {
+		if err := validateStmt(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	// Start with the first matcher against the whole file (or its scope)
+	var matches []Match
+	var err error
+	if or := stmts[0].Or; or != nil {
+		matches, err = m.matchOr(or, nil, true, block.Scope)
+	} else {
+		matches, err = m.matchScoped(stmts[0], block.Scope)
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	// For subsequent matchers with "in $Binding", match within captured bindings
-	for i := 1; i < len(block.From.Matchers); i++ {
-		stmt := block.From.Matchers[i]
-		if stmt.In == nil {
+	for i := 1; i < len(stmts); i++ {
+		stmt := stmts[i]
+		switch {
+		case stmt.Or != nil:
+			matches, err = m.matchOr(stmt.Or, matches, false, block.Scope)
+			if err != nil {
+				return nil, err
+			}
+		case stmt.In == nil:
 			// No "in" clause — match against whole file, merge bindings
-			newMatches := m.matchStmt(stmt, m.file, nil)
+			newMatches, err := m.matchScoped(stmt, block.Scope)
+			if err != nil {
+				return nil, err
+			}
 			matches = crossJoin(matches, newMatches)
-		} else {
+		default:
 			// "in $Binding" — match within the captured binding
 			var newMatches []Match
 			for _, match := range matches {
-				bindingName := *stmt.In
-				if scope, ok := match.Bindings[bindingName]; ok {
-					if scopeNode, ok := scope.(ast.Node); ok {
-						subMatches := m.matchStmt(stmt, scopeNode, match.Bindings)
-						newMatches = append(newMatches, subMatches...)
-					}
-				}
+				newMatches = append(newMatches, m.matchIn(stmt, match)...)
 			}
 			matches = newMatches
 		}
 	}
 
+	docs := specDocs(m.file)
+	for _, match := range matches {
+		match.Bindings[BindMatch] = match.Node
+		if fd := match.EnclosingFunc(); fd != nil {
+			match.Bindings[BindEnclosingFunc] = fd
+		}
+		if stmts := match.Preceding(); stmts != nil {
+			match.Bindings[BindPreceding] = stmts
+		}
+		if m.types != nil {
+			match.Bindings[BindTypes] = m.types
+		}
+		if len(docs) > 0 {
+			match.Bindings[BindDocs] = docs
+		}
+	}
+
+	return matches, nil
+}
+
+// validateStmt checks a from clause matcher's fields, and those of each
+// alternative of an or_match.
+func validateStmt(stmt *grammar.MatchStmt) error {
+	if stmt.Or == nil {
+		return validateFields(stmt.Fields)
+	}
+	for _, alt := range stmt.Or.Alternatives {
+		switch {
+		case alt.Or != nil:
+			return fmt.Errorf("%s: or_match cannot be nested", alt.Pos)
+		case len(alt.Path) > 0:
+			return fmt.Errorf("%s: or_match alternative match %s cannot be a path", alt.Pos, alt.NodeType)
+		}
+		if err := validateFields(alt.Fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchIn matches stmt within the node match captured as stmt's
+// "in $Binding", inheriting its bindings.
+func (m *Matcher) matchIn(stmt *grammar.MatchStmt, match Match) []Match {
+	if scope, ok := match.Bindings[*stmt.In].(ast.Node); ok {
+		return m.matchFrom(stmt, scope, m.pathFrom(match, scope), match.Bindings)
+	}
+	return nil
+}
+
+// matchOr matches each alternative of an or_match the way a matcher in
+// its place would be, and joins the union with matches, those of the
+// matchers before it; first is set when there are none. An alternative
+// with "in $Binding" matches within each of matches. A node matched by
+// more than one alternative is kept once, with the first one's bindings.
+func (m *Matcher) matchOr(or *grammar.OrMatchStmt, matches []Match, first bool, blockScope *grammar.MatchScope) ([]Match, error) {
+	var free []Match
+	var within []*grammar.MatchStmt
+	for _, alt := range or.Alternatives {
+		if alt.In != nil && !first {
+			within = append(within, alt)
+			continue
+		}
+		altMatches, err := m.matchScoped(alt, blockScope)
+		if err != nil {
+			return nil, err
+		}
+		free = append(free, altMatches...)
+	}
+
+	var result []Match
+	if len(within) < len(or.Alternatives) {
+		result = crossJoin(matches, dedupMatches(free))
+	}
+	for _, match := range matches {
+		var sub []Match
+		for _, alt := range within {
+			sub = append(sub, m.matchIn(alt, match)...)
+		}
+		result = append(result, dedupMatches(sub)...)
+	}
+	return result, nil
+}
+
+// dedupMatches drops every match whose node has the same position as an
+// earlier one's.
+func dedupMatches(matches []Match) []Match {
+	type span struct{ pos, end token.Pos }
+	seen := make(map[span]bool)
+	var result []Match
+	for _, match := range matches {
+		key := span{match.Node.Pos(), match.Node.End()}
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, match)
+		}
+	}
+	return result
+}
+
+// matchScoped matches stmt against the whole file, or against each
+// declaration named by its scope. A matcher's own "in func/type" scope
+// overrides the block's.
+func (m *Matcher) matchScoped(stmt *grammar.MatchStmt, blockScope *grammar.MatchScope) ([]Match, error) {
+	scope := blockScope
+	if stmt.Scope != nil {
+		if stmt.In != nil {
+			return nil, fmt.Errorf("%s: match %s cannot use both in $%s and in %s",
+				stmt.Pos, stmt.NodeType, *stmt.In, stmt.Scope.Kind)
+		}
+		scope = stmt.Scope
+	}
+	if scope == nil {
+		return m.matchGranular(stmt), nil
+	}
+
+	// A file without the declaration has nothing to match; whether any
+	// file has it is for the caller to tell, from Stats.Scopes.
+	roots := m.findScope(scope.Kind, scope.Name)
+	if m.scopes == nil {
+		m.scopes = make(map[*grammar.MatchScope]bool)
+	}
+	m.scopes[scope] = m.scopes[scope] || len(roots) > 0
+
+	var matches []Match
+	for _, root := range roots {
+		matches = append(matches, m.matchStmt(stmt, root, nil)...)
+	}
 	return matches, nil
 }
 
+// matchGranular matches stmt from the roots the matcher's granularity
+// allows: the file, each function body, or the package-level
+// declarations alone.
+func (m *Matcher) matchGranular(stmt *grammar.MatchStmt) []Match {
+	var matches []Match
+	switch m.granularity {
+	case GranularityFunction:
+		for _, decl := range m.file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Body != nil {
+				matches = append(matches, m.matchFrom(stmt, fd.Body, []ast.Node{m.file, fd}, nil)...)
+			}
+		}
+	case GranularityPackage:
+		for _, decl := range m.file.Decls {
+			if match, ok := matchNode(stmt, decl, []ast.Node{m.file}, nil); ok {
+				matches = append(matches, match)
+			}
+			if gd, ok := decl.(*ast.GenDecl); ok {
+				for _, spec := range gd.Specs {
+					if match, ok := matchNode(stmt, spec, []ast.Node{m.file, gd}, nil); ok {
+						matches = append(matches, match)
+					}
+				}
+			}
+		}
+	default:
+		matches = m.matchStmt(stmt, m.file, nil)
+	}
+	return matches
+}
+
+// findScope returns the top-level declarations of the given kind ("func"
+// or "type") with the given name. Methods sharing a name are all returned.
+func (m *Matcher) findScope(kind, name string) []ast.Node {
+	var roots []ast.Node
+	for _, decl := range m.file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if kind == "func" && d.Name.Name == name {
+				roots = append(roots, d)
+			}
+		case *ast.GenDecl:
+			if kind != "type" || d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				if ts, ok := spec.(*ast.TypeSpec); ok && ts.Name.Name == name {
+					roots = append(roots, ts)
+				}
+			}
+		}
+	}
+	return roots
+}
+
 // crossJoin combines matches from two matchers, merging their bindings.
 func crossJoin(a, b []Match) []Match {
 	if len(a) == 0 {
@@ -130,9 +506,13 @@ func crossJoin(a, b []Match) []Match {
 			for k, v := range mb.Bindings {
 				merged[k] = v
 			}
+			if homes := mergeHomes(ma.Bindings, mb.Bindings); homes != nil {
+				merged[BindAbsentLists] = homes
+			}
 			result = append(result, Match{
 				Node:     ma.Node,
 				Bindings: merged,
+				Path:     ma.Path,
 			})
 		}
 	}
@@ -141,41 +521,120 @@ func crossJoin(a, b []Match) []Match {
 
 // matchStmt finds all nodes matching a MatchStmt, optionally within a scope.
 func (m *Matcher) matchStmt(stmt *grammar.MatchStmt, scope ast.Node, inherited Bindings) []Match {
+	return m.matchFrom(stmt, scope, m.pathTo(scope), inherited)
+}
+
+// matchFrom is matchStmt for a scope whose enclosing nodes, from the file
+// root down, are already known.
+func (m *Matcher) matchFrom(stmt *grammar.MatchStmt, scope ast.Node, path []ast.Node, inherited Bindings) []Match {
 	var matches []Match
 
+	// stack holds the nodes enclosing the one being visited
+	stack := path
+
 	ast.Inspect(scope, func(n ast.Node) bool {
 		if n == nil {
+			stack = stack[:len(stack)-1]
 			return false
 		}
 
-		// Check if node type matches
-		if !nodeTypeMatches(n, stmt.NodeType) {
-			return true // continue traversing
-		}
-
-		// Try to match fields
-		bindings := make(Bindings)
-		if inherited != nil {
-			for k, v := range inherited {
-				bindings[k] = v
-			}
-		}
-
-		if matchFields(n, stmt.Fields, bindings) {
-			matches = append(matches, Match{
-				Node:     n,
-				Bindings: bindings,
-			})
+		if match, ok := matchNode(stmt, n, stack, inherited); ok {
+			matches = append(matches, match)
 		}
 
+		stack = append(stack, n)
 		return true // continue to find more matches
 	})
 
 	return matches
 }
 
+// matchNode matches stmt against n alone, given the nodes enclosing it.
+func matchNode(stmt *grammar.MatchStmt, n ast.Node, path []ast.Node, inherited Bindings) (Match, bool) {
+	// Check if node type matches
+	if !nodeTypeMatches(n, stmt.NodeType) {
+		return Match{}, false
+	}
+
+	// Try to match fields
+	bindings := make(Bindings)
+	for k, v := range inherited {
+		bindings[k] = v
+	}
+	if homes := mergeHomes(inherited, nil); homes != nil {
+		bindings[BindAbsentLists] = homes
+	}
+	if !matchFields(patternNode(n, stmt.NodeType, declDoc(n, path)), stmt.Fields, bindings) {
+		return Match{}, false
+	}
+	return Match{
+		Node:     n,
+		Bindings: bindings,
+		Path:     append([]ast.Node(nil), path...),
+	}, true
+}
+
+// pathTo returns the nodes enclosing target, from the file root down to
+// target's parent. It returns nil if target is the file or not found.
+func (m *Matcher) pathTo(target ast.Node) []ast.Node {
+	if target == ast.Node(m.file) {
+		return nil
+	}
+	path, _ := pathIn(m.file, nil, target)
+	return path
+}
+
+// pathFrom is pathTo for a node bound by match, which usually encloses
+// its node or lies within it, so that only the match's node is searched
+// rather than the whole file.
+func (m *Matcher) pathFrom(match Match, target ast.Node) []ast.Node {
+	for i, n := range match.Path {
+		if n == target {
+			return match.Path[:i:i]
+		}
+	}
+	if target == match.Node {
+		return match.Path
+	}
+	if path, ok := pathIn(match.Node, match.Path, target); ok {
+		return path
+	}
+	return m.pathTo(target)
+}
+
+// pathIn searches root, whose enclosing nodes are outer, for target and
+// returns the nodes enclosing it, from the file root down.
+func pathIn(root ast.Node, outer []ast.Node, target ast.Node) ([]ast.Node, bool) {
+	stack := append([]ast.Node(nil), outer...)
+	var path []ast.Node
+	found := false
+	ast.Inspect(root, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return false
+		}
+		if n == target {
+			path = append([]ast.Node(nil), stack...)
+			found = true
+			return false
+		}
+		stack = append(stack, n)
+		return true
+	})
+	return path, found
+}
+
 // nodeTypeMatches checks if a node's type matches the expected type name.
+// Import is an ImportSpec; see importNode.
 func nodeTypeMatches(n ast.Node, typeName string) bool {
+	if typeName == "Import" {
+		_, ok := n.(*ast.ImportSpec)
+		return ok
+	}
+
 	// Get the actual type name without package prefix
 	t := reflect.TypeOf(n)
 	if t.Kind() == reflect.Ptr {
@@ -184,6 +643,91 @@ func nodeTypeMatches(n ast.Node, typeName string) bool {
 	return t.Name() == typeName
 }
 
+// importNode is the node an Import pattern matches the fields of: an
+// ImportSpec with its path unquoted, and its name, if it has one, as the
+// string alias. doc is the spec's, or its declaration's, as for specNode,
+// and comment the spec's.
+type importNode struct {
+	*ast.ImportSpec
+	Path  string
+	Alias any // string, or nil for an import without a name
+	Doc   *ast.CommentGroup
+}
+
+// The spec nodes are how a pattern sees a spec declared without
+// parentheses, as in "// T is ...\ntype T int": with the declaration's doc
+// comment, which the parser gives the GenDecl instead. Every other field
+// is the spec's own.
+type (
+	typeSpecNode struct {
+		*ast.TypeSpec
+		Doc *ast.CommentGroup
+	}
+	valueSpecNode struct {
+		*ast.ValueSpec
+		Doc *ast.CommentGroup
+	}
+	importSpecNode struct {
+		*ast.ImportSpec
+		Doc *ast.CommentGroup
+	}
+)
+
+// interfaceNode is the node an InterfaceType pattern matches the fields
+// of: methods are the interface's methods alone, and embeds the types
+// it embeds, so $Methods... binds one field per method.
+type interfaceNode struct {
+	*ast.InterfaceType
+	Methods []*ast.Field
+	Embeds  []*ast.Field
+}
+
+// patternNode returns the node whose fields a pattern of the given type
+// matches: n itself, the importNode of an ImportSpec for Import, the
+// interfaceNode of an InterfaceType, or the spec node of a spec given
+// doc, its declaration's doc comment, by declDoc.
+func patternNode(n ast.Node, typeName string, doc *ast.CommentGroup) ast.Node {
+	switch n := n.(type) {
+	case *ast.ImportSpec:
+		if typeName != "Import" {
+			if doc != nil {
+				return &importSpecNode{ImportSpec: n, Doc: doc}
+			}
+			return n
+		}
+		imp := &importNode{ImportSpec: n, Doc: n.Doc}
+		if doc != nil {
+			imp.Doc = doc
+		}
+		imp.Path, _ = strconv.Unquote(n.Path.Value)
+		if n.Name != nil {
+			imp.Alias = n.Name.Name
+		}
+		return imp
+	case *ast.InterfaceType:
+		iface := &interfaceNode{InterfaceType: n}
+		if n.Methods != nil {
+			for _, f := range n.Methods.List {
+				if len(f.Names) > 0 {
+					iface.Methods = append(iface.Methods, f)
+				} else {
+					iface.Embeds = append(iface.Embeds, f)
+				}
+			}
+		}
+		return iface
+	case *ast.TypeSpec:
+		if doc != nil {
+			return &typeSpecNode{TypeSpec: n, Doc: doc}
+		}
+	case *ast.ValueSpec:
+		if doc != nil {
+			return &valueSpecNode{ValueSpec: n, Doc: doc}
+		}
+	}
+	return n
+}
+
 // matchFields attempts to match all field constraints against a node.
 // Returns true if all fields match, populating bindings along the way.
 func matchFields(n ast.Node, fields []*grammar.FieldMatch, bindings Bindings) bool {
@@ -199,7 +743,11 @@ func matchFields(n ast.Node, fields []*grammar.FieldMatch, bindings Bindings) bo
 func matchField(n ast.Node, field *grammar.FieldMatch, bindings Bindings) bool {
 	// Get the field value from the node using reflection
 	fieldValue := getField(n, field.Name)
-	if fieldValue == nil && !field.Value.Wild {
+	if fieldValue == nil && (field.Value.Empty || field.Value.Nil) {
+		// An absent list, e.g. the nil List of a default case, is empty
+		return true
+	}
+	if fieldValue == nil && !field.Value.Wild && field.Value.Tag == nil {
 		// Field doesn't exist and we're not using wildcard
 		// Check if it's an optional field that can be nil
 		if field.Value.Binding != nil || field.Value.Spread != nil {
@@ -207,6 +755,22 @@ func matchField(n ast.Node, field *grammar.FieldMatch, bindings Bindings) bool {
 			if field.Value.Binding != nil {
 				bindings[field.Value.Binding.Name] = nil
 			}
+			// An absent field list (e.g. a func with no results) is
+			// bound empty, and put in place if a patch adds to it
+			if spread := field.Value.Spread; spread != nil {
+				if !inBounds(0, spread.Bounds) {
+					return false
+				}
+				if fl := absentFieldList(n, field.Name); fl != nil {
+					bindings[spread.Name] = filterSpread(fl, spread)
+					homes, _ := bindings[BindAbsentLists].(map[*ast.FieldList]fieldListHome)
+					if homes == nil {
+						homes = make(map[*ast.FieldList]fieldListHome)
+						bindings[BindAbsentLists] = homes
+					}
+					homes[fl] = fieldListHome{node: n, field: field.Name}
+				}
+			}
 			return true
 		}
 		return false
@@ -228,15 +792,24 @@ func matchValue(value any, pattern *grammar.MatchValue, bindings Bindings) bool
 		return true
 	}
 
-	// Spread binding — capture as slice
+	// Spread binding — capture as slice, if it has as many elements as
+	// the spread's bounds allow
 	if pattern.Spread != nil {
-		bindings[pattern.Spread.Name] = value
+		captured := filterSpread(value, pattern.Spread)
+		if !inBounds(getLength(captured), pattern.Spread.Bounds) {
+			return false
+		}
+		bindings[pattern.Spread.Name] = captured
 		return true
 	}
 
-	// Exact string match
+	// Exact string match; dotted strings against expressions are
+	// selector paths such as "http.Get" or "$Recv.client.Get"
 	if pattern.Exact != nil {
-		expected := strings.Trim(*pattern.Exact, `"`)
+		expected := *pattern.Exact
+		if expr, ok := value.(ast.Expr); ok && strings.Contains(expected, ".") {
+			return matchSelectorPath(expr, expected, bindings)
+		}
 		return matchExact(value, expected)
 	}
 
@@ -245,73 +818,287 @@ func matchValue(value any, pattern *grammar.MatchValue, bindings Bindings) bool
 		return matchASTPattern(value, pattern.Pattern, bindings)
 	}
 
+	// nil, e.g. the Comm of a select's default case
+	if pattern.Nil {
+		return isNil(value)
+	}
+
+	// Empty list pattern
+	if pattern.Empty {
+		return isEmpty(value)
+	}
+
 	// List pattern
 	if pattern.List != nil {
 		return matchList(value, pattern.List, bindings)
 	}
 
+	// Struct tag keys
+	if pattern.Tag != nil {
+		return matchTag(value, pattern.Tag, bindings)
+	}
+
 	return false
 }
 
-// matchExact checks if a value matches an exact string.
-func matchExact(value any, expected string) bool {
-	switch v := value.(type) {
-	case *ast.Ident:
-		return v != nil && v.Name == expected
-	case string:
-		return v == expected
-	default:
-		return false
+// matchTag matches the keys of a struct tag against a tag pattern. A
+// missing or malformed tag has no keys, and a key the tag doesn't have
+// only matches nil.
+func matchTag(value any, pattern *grammar.TagPattern, bindings Bindings) bool {
+	tag := structTag(value)
+	for _, key := range pattern.Keys {
+		v, ok := tag.Lookup(key.Key)
+		if !ok {
+			if !key.Value.Nil {
+				return false
+			}
+			continue
+		}
+		if key.Value.Nil || !matchValue(v, key.Value, bindings) {
+			return false
+		}
 	}
+	return true
 }
 
-// matchASTPattern matches a value against a nested AST pattern.
-func matchASTPattern(value any, pattern *grammar.ASTPattern, bindings Bindings) bool {
-	// Handle the value being a node or needing unwrapping
-	node := toNode(value)
-	if node == nil {
-		return false
+// structTag returns the struct tag of a field or of its Tag literal.
+func structTag(v any) reflect.StructTag {
+	switch val := v.(type) {
+	case *ast.Field:
+		if val != nil {
+			return structTag(val.Tag)
+		}
+	case *ast.BasicLit:
+		if val == nil || val.Kind != token.STRING {
+			return ""
+		}
+		if s, err := strconv.Unquote(val.Value); err == nil {
+			return reflect.StructTag(s)
+		}
 	}
+	return ""
+}
 
-	// Check type matches
-	if !nodeTypeMatches(node, pattern.NodeType) {
+// inBounds reports whether a spread of n elements satisfies its bounds.
+func inBounds(n int, bounds *grammar.SpreadBounds) bool {
+	if bounds == nil {
+		return true
+	}
+	if bounds.Min != nil && n < *bounds.Min {
 		return false
 	}
-
-	// Match all fields
-	return matchFields(node, pattern.Fields, bindings)
+	return bounds.Max == nil || n <= *bounds.Max
 }
 
-// matchList matches a list value against a list pattern.
-func matchList(value any, patterns []*grammar.MatchValue, bindings Bindings) bool {
-	// Convert value to a slice of items
-	items := toSlice(value)
-	if items == nil {
-		return false
+// filterSpread applies a spread's property filter, returning the kept
+// elements of a FieldList as []*ast.Field and of a slice as a slice of
+// the same type. Unfiltered spreads capture the value unchanged.
+func filterSpread(value any, spread *grammar.SpreadBinding) any {
+	if spread.Filter == nil {
+		return value
 	}
-
-	// For now, simple positional matching
-	// TODO: Handle spreads in list patterns more sophisticatedly
-	if len(patterns) != len(items) {
-		return false
+	keep := properties[*spread.Filter]
+
+	if fl, ok := value.(*ast.FieldList); ok {
+		var fields []*ast.Field
+		if fl != nil {
+			for _, f := range fl.List {
+				if keep(f) {
+					fields = append(fields, f)
+				}
+			}
+		}
+		return fields
 	}
 
-	for i, p := range patterns {
-		if !matchValue(items[i], p, bindings) {
-			return false
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+	kept := reflect.MakeSlice(rv.Type(), 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		if keep(rv.Index(i).Interface()) {
+			kept = reflect.Append(kept, rv.Index(i))
 		}
 	}
-	return true
+	return kept.Interface()
 }
 
-// getField retrieves a field from an AST node by name.
+// matchExact checks if a value matches an exact string. Names and
+// strings may also match a glob; operators and channel directions only
+// match exactly, so op: "*" is multiplication.
+func matchExact(value any, expected string) bool {
+	switch v := value.(type) {
+	case *ast.Ident:
+		return v != nil && matchGlob(expected, v.Name)
+	case string:
+		return matchGlob(expected, v)
+	case token.Token:
+		return v.String() == expected
+	case ast.ChanDir:
+		return chanDirs[v] == expected
+	default:
+		return false
+	}
+}
+
+// matchGlob reports whether s is expected or, if expected has an
+// unescaped *, ? or [, matches it as a path.Match glob: "Test*" or
+// "*Context". A backslash escapes a metacharacter, so "\\*" is a literal
+// star. A malformed glob only matches itself.
+func matchGlob(expected, s string) bool {
+	if s == expected {
+		return true
+	}
+	if !isGlob(expected) {
+		return strings.Contains(expected, `\`) && s == unescapeGlob(expected)
+	}
+	ok, err := path.Match(expected, s)
+	return ok && err == nil
+}
+
+// isGlob reports whether s has an unescaped glob metacharacter.
+func isGlob(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeGlob drops the backslashes escaping glob metacharacters.
+func unescapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`*?[]\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// chanDirs names channel directions for patterns: chan T is "BOTH",
+// chan<- T "SEND" and <-chan T "RECV".
+var chanDirs = map[ast.ChanDir]string{
+	ast.SEND:            "SEND",
+	ast.RECV:            "RECV",
+	ast.SEND | ast.RECV: "BOTH",
+}
+
+// matchSelectorPath matches a selector chain like s.client.Get against a
+// dotted path, walking segments right to left. A segment may be a name,
+// "*" to accept any name, or "$Name" to bind it. The leftmost segment
+// covers whatever remains of the chain: "*" accepts any receiver
+// expression and "$Name" binds it.
+func matchSelectorPath(expr ast.Expr, path string, bindings Bindings) bool {
+	segments := strings.Split(path, ".")
+
+	for i := len(segments) - 1; i > 0; i-- {
+		sel, ok := expr.(*ast.SelectorExpr)
+		if !ok || !matchPathSegment(sel.Sel, segments[i], bindings) {
+			return false
+		}
+		expr = sel.X
+	}
+
+	switch head := segments[0]; {
+	case head == "*":
+		return true
+	case strings.HasPrefix(head, "$"):
+		bindings[head[1:]] = expr
+		return true
+	default:
+		ident, ok := expr.(*ast.Ident)
+		return ok && ident.Name == head
+	}
+}
+
+// matchPathSegment matches one selector name against a path segment.
+func matchPathSegment(ident *ast.Ident, segment string, bindings Bindings) bool {
+	switch {
+	case segment == "*":
+		return true
+	case strings.HasPrefix(segment, "$"):
+		bindings[segment[1:]] = ident
+		return true
+	default:
+		return ident.Name == segment
+	}
+}
+
+// matchASTPattern matches a value against a nested AST pattern.
+func matchASTPattern(value any, pattern *grammar.ASTPattern, bindings Bindings) bool {
+	pattern = expandPattern(pattern)
+	if pattern == nil {
+		return false
+	}
+
+	// Handle the value being a node or needing unwrapping
+	node := toNode(value)
+	if node == nil {
+		return false
+	}
+
+	// Check type matches
+	if !nodeTypeMatches(node, pattern.NodeType) {
+		return false
+	}
+
+	// Match all fields
+	return matchFields(patternNode(node, pattern.NodeType, nil), pattern.Fields, bindings)
+}
+
+// expandPattern follows a named pattern reference to its definition.
+// It returns nil for a reference that was never resolved.
+func expandPattern(pattern *grammar.ASTPattern) *grammar.ASTPattern {
+	for pattern != nil && pattern.Ref != "" {
+		pattern = pattern.Def
+	}
+	return pattern
+}
+
+// matchList matches a list value against a list pattern.
+func matchList(value any, patterns []*grammar.MatchValue, bindings Bindings) bool {
+	// Convert value to a slice of items
+	items := toSlice(value)
+	if items == nil {
+		return false
+	}
+
+	// For now, simple positional matching
+	// TODO: Handle spreads in list patterns more sophisticatedly
+	if len(patterns) != len(items) {
+		return false
+	}
+
+	for i, p := range patterns {
+		if !matchValue(items[i], p, bindings) {
+			return false
+		}
+	}
+	return true
+}
+
+// getField retrieves a field from an AST node by name.
 func getField(n ast.Node, name string) any {
+	val, _ := lookupField(n, name)
+	return val
+}
+
+// lookupField retrieves a field from an AST node by name, reporting
+// whether the node has such a field. A nil field is found but nil.
+func lookupField(n ast.Node, name string) (any, bool) {
 	v := reflect.ValueOf(n)
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
 	if v.Kind() != reflect.Struct {
-		return nil
+		return nil, false
 	}
 
 	// Map common .lift field names to actual Go AST field names
@@ -319,14 +1106,86 @@ func getField(n ast.Node, name string) any {
 
 	f := v.FieldByName(goFieldName)
 	if !f.IsValid() {
-		return nil
+		// Operands: lhs/rhs name X/Y on BinaryExpr
+		if alias, ok := operandAliases[name]; ok {
+			f = v.FieldByName(alias)
+		}
+	}
+	if !f.IsValid() {
+		return nil, false
 	}
 
 	if f.Kind() == reflect.Ptr && f.IsNil() {
+		return nil, true
+	}
+
+	return f.Interface(), true
+}
+
+// absentFieldList returns an empty list standing in for the field name
+// of n if that is a nil *ast.FieldList, and nil otherwise. n is left as
+// it is; PlaceFieldList puts the list there. An empty list prints
+// identically to a nil one.
+func absentFieldList(n ast.Node, name string) *ast.FieldList {
+	v := reflect.ValueOf(n)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	f := v.Elem().FieldByName(mapFieldName(name))
+	if !f.IsValid() || !f.CanSet() || f.Type() != reflect.TypeOf((*ast.FieldList)(nil)) || !f.IsNil() {
 		return nil
 	}
+	return &ast.FieldList{}
+}
+
+// mergeHomes combines the absent field lists bound by two matches, so
+// each keeps its home when their bindings are joined.
+func mergeHomes(a, b Bindings) map[*ast.FieldList]fieldListHome {
+	ha, _ := a[BindAbsentLists].(map[*ast.FieldList]fieldListHome)
+	hb, _ := b[BindAbsentLists].(map[*ast.FieldList]fieldListHome)
+	if len(ha) == 0 && len(hb) == 0 {
+		return nil
+	}
+	merged := make(map[*ast.FieldList]fieldListHome, len(ha)+len(hb))
+	for fl, home := range ha {
+		merged[fl] = home
+	}
+	for fl, home := range hb {
+		merged[fl] = home
+	}
+	return merged
+}
+
+// fieldListHome is the node and field an absent field list stands in for.
+type fieldListHome struct {
+	node  ast.Node
+	field string
+}
+
+// PlaceFieldList returns the list to add fields to for fl, a field list
+// bound in bindings: fl itself, or if the matcher bound fl for a missing
+// list, such as the results of a func without any, the list now in its
+// place, which is fl once it has been put there.
+func PlaceFieldList(bindings Bindings, fl *ast.FieldList) *ast.FieldList {
+	homes, _ := bindings[BindAbsentLists].(map[*ast.FieldList]fieldListHome)
+	home, ok := homes[fl]
+	if !ok {
+		return fl
+	}
+	f := reflect.ValueOf(home.node).Elem().FieldByName(mapFieldName(home.field))
+	if f.IsNil() {
+		f.Set(reflect.ValueOf(fl))
+		return fl
+	}
+	return f.Interface().(*ast.FieldList)
+}
 
-	return f.Interface()
+// operandAliases maps lhs/rhs to the X/Y operand fields of expressions
+// such as BinaryExpr, which have no Lhs/Rhs fields of their own.
+var operandAliases = map[string]string{
+	"lhs": "X",
+	"rhs": "Y",
 }
 
 // mapFieldName maps .lift field names to Go AST struct field names.
@@ -356,6 +1215,7 @@ func mapFieldName(name string) string {
 		"elts":    "Elts",
 		"elt":     "Elt",
 		"key":     "Key",
+		"dir":     "Dir",
 		"len":     "Len",
 		"lhs":     "Lhs",
 		"rhs":     "Rhs",
@@ -363,6 +1223,10 @@ func mapFieldName(name string) string {
 		"init":    "Init",
 		"post":    "Post",
 		"op":      "Op",
+		"assign":  "Assign",
+		"chan":    "Chan",
+		"comm":    "Comm",
+		"call":    "Call",
 	}
 
 	if mapped, ok := fieldMap[name]; ok {
@@ -437,18 +1301,54 @@ func EvalPredicate(pred *grammar.Predicate, bindings Bindings) bool {
 		return !EvalPredicate(pred.Not, bindings)
 	}
 
+	if pred.Group != nil {
+		return evalGroup(pred.Group, bindings)
+	}
+
 	if pred.Contains != nil {
 		return evalContains(pred.Contains, bindings)
 	}
 
+	if pred.NotContainsAny != nil {
+		return evalNotContainsAny(pred.NotContainsAny, bindings)
+	}
+
+	if pred.NotPrecededBy != nil {
+		return !evalPrecededBy(pred.NotPrecededBy, bindings)
+	}
+
 	if pred.LenCheck != nil {
 		return evalLenCheck(pred.LenCheck, bindings)
 	}
 
+	if pred.CountCheck != nil {
+		return evalCount(pred.CountCheck, bindings)
+	}
+
+	if pred.DepsCheck != nil {
+		return evalDeps(pred.DepsCheck, bindings)
+	}
+
+	if pred.EqualCheck != nil {
+		return evalEqualCheck(pred.EqualCheck, bindings)
+	}
+
 	if pred.MemberCheck != nil {
 		return evalMemberCheck(pred.MemberCheck, bindings)
 	}
 
+	if pred.FieldsNamed != nil {
+		return evalFieldsNamedPred(pred.FieldsNamed, bindings)
+	}
+
+	if pred.TagCheck != nil {
+		return evalTagCheck(pred.TagCheck, bindings)
+	}
+
+	if pred.StringCheck != nil {
+		return evalStringCheck(pred.StringCheck, bindings)
+	}
+
 	if pred.PropCheck != nil {
 		return evalPropCheck(pred.PropCheck, bindings)
 	}
@@ -456,6 +1356,18 @@ func EvalPredicate(pred *grammar.Predicate, bindings Bindings) bool {
 	return false
 }
 
+// evalGroup evaluates an and/or group, short-circuiting. An empty "and"
+// is true and an empty "or" is false.
+func evalGroup(group *grammar.PredGroup, bindings Bindings) bool {
+	isOr := group.Op == "or"
+	for _, pred := range group.Predicates {
+		if EvalPredicate(pred, bindings) == isOr {
+			return isOr
+		}
+	}
+	return !isOr
+}
+
 // evalContains checks if a binding contains a pattern.
 func evalContains(pred *grammar.ContainsPred, bindings Bindings) bool {
 	scope, ok := bindings[pred.Binding]
@@ -463,28 +1375,132 @@ func evalContains(pred *grammar.ContainsPred, bindings Bindings) bool {
 		return false
 	}
 
-	scopeNode, ok := scope.(ast.Node)
-	if !ok {
+	return countMatches(scope, pred.Pattern, 1) > 0
+}
+
+// evalNotContainsAny passes only if none of the patterns occur in a binding.
+func evalNotContainsAny(pred *grammar.NotContainsAnyPred, bindings Bindings) bool {
+	for _, pattern := range pred.Patterns {
+		contains := &grammar.ContainsPred{Binding: pred.Binding, Pattern: pattern}
+		if evalContains(contains, bindings) {
+			return false
+		}
+	}
+	return true
+}
+
+// evalPrecededBy reports whether the pattern occurs in the statements
+// before the match, with any binding it shares with the match bound to
+// the same expression.
+func evalPrecededBy(pred *grammar.PrecededByPred, bindings Bindings) bool {
+	pattern := expandPattern(pred.Pattern)
+	stmts, _ := bindings[BindPreceding].([]ast.Stmt)
+	if pattern == nil || len(stmts) == 0 {
 		return false
 	}
 
 	found := false
-	ast.Inspect(scopeNode, func(n ast.Node) bool {
-		if n == nil || found {
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			if found || n == nil {
+				return false
+			}
+			if nodeTypeMatches(n, pattern.NodeType) {
+				subBindings := make(Bindings)
+				found = matchFields(patternNode(n, pattern.NodeType, nil), pattern.Fields, subBindings) && sameBindings(bindings, subBindings)
+			}
+			return !found
+		})
+		if found {
+			break
+		}
+	}
+	return found
+}
+
+// sameBindings reports whether every name bound in both a and b refers
+// to the same node, or to expressions spelled the same way, as two uses
+// of one variable are.
+func sameBindings(a, b Bindings) bool {
+	for name, bv := range b {
+		av, ok := a[name]
+		if !ok || name == BindAbsentLists {
+			continue
+		}
+		ae, aok := av.(ast.Expr)
+		be, bok := bv.(ast.Expr)
+		switch {
+		case aok && bok:
+			if types.ExprString(ae) != types.ExprString(be) {
+				return false
+			}
+		case !reflect.DeepEqual(av, bv):
 			return false
 		}
+	}
+	return true
+}
+
+// evalCount compares the number of pattern occurrences in a binding.
+func evalCount(pred *grammar.CountPred, bindings Bindings) bool {
+	scope, ok := bindings[pred.Binding]
+	if !ok {
+		return false
+	}
+
+	// Every comparison is decided once the count exceeds the operand,
+	// and >= is decided as soon as it reaches it.
+	limit := pred.Value + 1
+	if pred.Op == ">=" && pred.Value > 0 {
+		limit = pred.Value
+	}
 
-		if nodeTypeMatches(n, pred.Pattern.NodeType) {
-			subBindings := make(Bindings)
-			if matchFields(n, pred.Pattern.Fields, subBindings) {
-				found = true
+	return compareInt(countMatches(scope, pred.Pattern, limit), pred.Op, pred.Value)
+}
+
+// countMatches counts nodes within scope matching pattern, stopping early
+// once limit is reached (limit <= 0 means no limit). Scope may be a node
+// or a slice of nodes such as a spread binding.
+func countMatches(scope any, pattern *grammar.ASTPattern, limit int) int {
+	pattern = expandPattern(pattern)
+	if pattern == nil {
+		return 0
+	}
+
+	var roots []ast.Node
+	if n, ok := scope.(ast.Node); ok {
+		roots = append(roots, n)
+	} else {
+		for _, item := range toSlice(scope) {
+			if n, ok := item.(ast.Node); ok {
+				roots = append(roots, n)
+			}
+		}
+	}
+
+	count := 0
+	done := func() bool { return limit > 0 && count >= limit }
+
+	for _, root := range roots {
+		ast.Inspect(root, func(n ast.Node) bool {
+			if n == nil || done() {
 				return false
 			}
+
+			if nodeTypeMatches(n, pattern.NodeType) {
+				subBindings := make(Bindings)
+				if matchFields(patternNode(n, pattern.NodeType, nil), pattern.Fields, subBindings) {
+					count++
+				}
+			}
+			return !done()
+		})
+		if done() {
+			break
 		}
-		return true
-	})
+	}
 
-	return found
+	return count
 }
 
 // evalLenCheck evaluates a length predicate.
@@ -494,21 +1510,24 @@ func evalLenCheck(pred *grammar.LenPred, bindings Bindings) bool {
 		return false
 	}
 
-	length := getLength(val)
+	return compareInt(getLength(val), pred.Op, pred.Value)
+}
 
-	switch pred.Op {
+// compareInt applies a comparison operator from the .lift grammar.
+func compareInt(n int, op string, value int) bool {
+	switch op {
 	case ">":
-		return length > pred.Value
+		return n > value
 	case ">=":
-		return length >= pred.Value
+		return n >= value
 	case "<":
-		return length < pred.Value
+		return n < value
 	case "<=":
-		return length <= pred.Value
+		return n <= value
 	case "==":
-		return length == pred.Value
+		return n == value
 	case "!=":
-		return length != pred.Value
+		return n != value
 	}
 	return false
 }
@@ -555,9 +1574,363 @@ func evalMemberCheck(pred *grammar.MemberPred, bindings Bindings) bool {
 	}
 
 	// Check membership
-	for _, member := range pred.Values {
-		if strings.Trim(member, `"`) == strVal {
-			return true
+	if pred.Set != nil {
+		return slices.Contains(memberSet(pred, bindings), strVal)
+	}
+	return slices.ContainsFunc(pred.Values, func(v string) bool {
+		return matchGlob(v, strVal)
+	})
+}
+
+// memberSet returns the names in the binding on the right of an in
+// predicate. An unbound or empty set is noted to Debug; nothing is in it.
+func memberSet(pred *grammar.MemberPred, bindings Bindings) []string {
+	path := pred.Set.Name
+	if pred.Set.Field != nil {
+		path += "." + *pred.Set.Field
+	}
+	val, ok := bindings.Lookup(path)
+	if !ok {
+		debugf("%s: $%s in $%s: $%s is not bound, so the predicate is false", pred.Pos, pred.Binding, path, path)
+		return nil
+	}
+	set := setNames(val)
+	if len(set) == 0 {
+		debugf("%s: $%s in $%s: $%s holds no names, so the predicate is false", pred.Pos, pred.Binding, path, path)
+	}
+	return set
+}
+
+// setNames returns the names in a bound value: an identifier's name, a
+// string or string literal, the names declared by a field, spec or
+// declaration, and those of each element of a list, a field list or a
+// composite literal. Unnamed fields give their type. Any other node gives
+// its source.
+func setNames(v any) []string {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		return nil
+	}
+
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case *ast.Ident:
+		return []string{val.Name}
+	case *ast.BasicLit:
+		if s, err := strconv.Unquote(val.Value); err == nil && val.Kind == token.STRING {
+			return []string{s}
+		}
+		return []string{val.Value}
+	case *ast.Field:
+		if len(val.Names) == 0 {
+			return setNames(val.Type)
+		}
+		return setNames(val.Names)
+	case *ast.FieldList:
+		return setNames(val.List)
+	case *ast.StructType:
+		return setNames(val.Fields)
+	case *ast.TypeSpec:
+		return setNames(val.Name)
+	case *ast.ValueSpec:
+		return setNames(val.Names)
+	case *ast.GenDecl:
+		return setNames(val.Specs)
+	case *ast.FuncDecl:
+		return setNames(val.Name)
+	case *ast.CompositeLit:
+		return setNames(val.Elts)
+	case ast.Node:
+		if s, ok := stringValue(val); ok {
+			return []string{s}
+		}
+		return nil
+	}
+
+	var names []string
+	if rv.Kind() == reflect.Slice {
+		for i := 0; i < rv.Len(); i++ {
+			names = append(names, setNames(rv.Index(i).Interface())...)
+		}
+	}
+	return names
+}
+
+// evalEqualCheck compares a binding's string form to a string, or tests
+// whether it is nil. A missing node equals no string.
+func evalEqualCheck(pred *grammar.EqualPred, bindings Bindings) bool {
+	val, ok := bindings[pred.Binding]
+	if !ok {
+		return false
+	}
+
+	var equal bool
+	if pred.Nil {
+		equal = isNil(val)
+	} else if !isNil(val) {
+		str, ok := stringValue(val)
+		equal = ok && str == *pred.Value
+	}
+	return equal == (pred.Op == "==")
+}
+
+// evalTagCheck evaluates hasTag, or compares the value of a tag key. A
+// key the tag doesn't have equals no value.
+func evalTagCheck(pred *grammar.TagPred, bindings Bindings) bool {
+	val, ok := bindings[pred.Binding]
+	if !ok {
+		return false
+	}
+
+	v, ok := structTag(val).Lookup(pred.Key)
+	if pred.Func == "hasTag" {
+		return ok
+	}
+	equal := ok && v == *pred.Value
+	return equal == (*pred.Op == "==")
+}
+
+// evalStringCheck evaluates hasPrefix/hasSuffix/matches against the string
+// form of a binding.
+func evalStringCheck(pred *grammar.StringPred, bindings Bindings) bool {
+	val, ok := bindings[pred.Binding]
+	if !ok {
+		return false
+	}
+
+	str, ok := stringValue(val)
+	if pred.Text {
+		str, ok = textValue(specDoc(val, bindings))
+	}
+	if !ok {
+		return false
+	}
+
+	arg := pred.Argument
+	switch pred.Func {
+	case "hasPrefix":
+		return strings.HasPrefix(str, arg)
+	case "hasSuffix":
+		return strings.HasSuffix(str, arg)
+	case "matches":
+		re, err := compileRegexp(arg)
+		return err == nil && re.MatchString(str)
+	}
+	return false
+}
+
+// stringValue returns the string form of a binding: an identifier's name,
+// a string as-is, or the rendered Go source of any other node.
+func stringValue(v any) (string, bool) {
+	switch val := v.(type) {
+	case *ast.Ident:
+		if val == nil {
+			return "", false
+		}
+		return val.Name, true
+	case string:
+		return val, true
+	case ast.Node:
+		var buf bytes.Buffer
+		if err := format.Node(&buf, token.NewFileSet(), val); err != nil {
+			return "", false
+		}
+		return buf.String(), true
+	}
+	return "", false
+}
+
+// textValue returns the text of a comment group, or of the doc comment
+// of a declaration, spec or field; a missing comment has no text. Other
+// values give their string form.
+func textValue(v any) (string, bool) {
+	if v == nil {
+		return "", true
+	}
+	if cg, ok := commentGroup(v); ok {
+		return commentText(cg), true
+	}
+	return stringValue(v)
+}
+
+// commentGroup returns v if it is a comment group, or else the doc
+// comment of a node that can have one. ok is false for other values.
+func commentGroup(v any) (cg *ast.CommentGroup, ok bool) {
+	if cg, ok := v.(*ast.CommentGroup); ok {
+		return cg, true
+	}
+	n, ok := v.(ast.Node)
+	if !ok || isNil(n) {
+		return nil, false
+	}
+	doc, ok := lookupField(n, "Doc")
+	if !ok {
+		return nil, false
+	}
+	cg, ok = doc.(*ast.CommentGroup)
+	return cg, ok || doc == nil
+}
+
+// commentText returns the lines of a comment group with their // or
+// /* */ markers, and the space after //, stripped, joined by newlines.
+// Unlike CommentGroup.Text it keeps directives and blank lines.
+func commentText(cg *ast.CommentGroup) string {
+	if cg == nil {
+		return ""
+	}
+	var lines []string
+	for _, c := range cg.List {
+		if line, ok := strings.CutPrefix(c.Text, "//"); ok {
+			lines = append(lines, strings.TrimPrefix(line, " "))
+			continue
+		}
+		text := strings.TrimSuffix(strings.TrimPrefix(c.Text, "/*"), "*/")
+		lines = append(lines, strings.Split(text, "\n")...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// specDocs returns the doc comment of each spec in a declaration without
+// parentheses, such as "// T is ...\ntype T int", which the parser gives
+// the GenDecl rather than the spec.
+func specDocs(file *ast.File) map[ast.Spec]*ast.CommentGroup {
+	docs := make(map[ast.Spec]*ast.CommentGroup)
+	for _, decl := range file.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && !gd.Lparen.IsValid() && gd.Doc != nil {
+			for _, spec := range gd.Specs {
+				docs[spec] = gd.Doc
+			}
+		}
+	}
+	return docs
+}
+
+// declDoc returns the doc comment of the declaration n is in, the last
+// node of path, if n is a spec without one of its own in a declaration
+// without parentheses, and nil otherwise.
+func declDoc(n ast.Node, path []ast.Node) *ast.CommentGroup {
+	if len(path) == 0 {
+		return nil
+	}
+	gd, ok := path[len(path)-1].(*ast.GenDecl)
+	if !ok || gd.Lparen.IsValid() {
+		return nil
+	}
+	if _, ok := n.(ast.Spec); !ok {
+		return nil
+	}
+	if cg, _ := commentGroup(n); cg != nil {
+		return nil
+	}
+	return gd.Doc
+}
+
+// specDoc returns the doc comment specDocs recorded in bindings for v, a
+// spec without one of its own, or else v.
+func specDoc(v any, bindings Bindings) any {
+	spec, ok := v.(ast.Spec)
+	if !ok {
+		return v
+	}
+	if cg, _ := commentGroup(spec); cg != nil {
+		return v
+	}
+	docs, _ := bindings[BindDocs].(map[ast.Spec]*ast.CommentGroup)
+	if doc, ok := docs[spec]; ok {
+		return doc
+	}
+	return v
+}
+
+// hasDoc reports whether v is a comment group, or has a doc comment, with
+// some text in it.
+func hasDoc(v any) bool {
+	cg, _ := commentGroup(v)
+	return strings.TrimSpace(commentText(cg)) != ""
+}
+
+var (
+	regexpMu    sync.Mutex
+	regexpCache = make(map[string]*regexp.Regexp)
+)
+
+// compileRegexp compiles a matches() pattern once and caches it.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpMu.Lock()
+	defer regexpMu.Unlock()
+
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// properties maps each property predicate name ($X.name) to its test.
+// Type properties look through an *ast.Field to its declared type.
+var properties = map[string]func(v any) bool{
+	"exported":           isExported,
+	"unexported":         isUnexported,
+	"pointer":            isTypeExpr[*ast.StarExpr],
+	"pointer_to_pointer": isPointerToPointer,
+	"slice":              isTypeExpr[*ast.ArrayType],
+	"map":                isTypeExpr[*ast.MapType],
+	"variadic":           isTypeExpr[*ast.Ellipsis],
+	"channel":            isTypeExpr[*ast.ChanType],
+	"interface":          isTypeExpr[*ast.InterfaceType],
+	"func":               isTypeExpr[*ast.FuncType],
+	"generic":            isGeneric,
+	"builtin":            isBuiltin,
+	"named":              isNamed,
+	"error":              isErrorType,
+	"empty":              isEmpty,
+	"has_doc":            hasDoc,
+}
+
+// evalFieldsNamedPred reports whether any field bound to pred.Binding —
+// a struct type, a field list, a spread of fields or a single field —
+// has a name matching pred.Pattern. Embedded fields are named by their
+// type.
+func evalFieldsNamedPred(pred *grammar.FieldsNamedPred, bindings Bindings) bool {
+	re, err := compileRegexp(pred.Pattern)
+	if err != nil {
+		return false
+	}
+
+	var fields []*ast.Field
+	switch val := bindings[pred.Binding].(type) {
+	case *ast.StructType:
+		if val != nil && val.Fields != nil {
+			fields = val.Fields.List
+		}
+	case *ast.FieldList:
+		if val != nil {
+			fields = val.List
+		}
+	case []*ast.Field:
+		fields = val
+	case *ast.Field:
+		fields = []*ast.Field{val}
+	}
+
+	for _, field := range fields {
+		if field == nil {
+			continue
+		}
+		for _, name := range field.Names {
+			if re.MatchString(name.Name) {
+				return true
+			}
+		}
+		if len(field.Names) == 0 {
+			if id := embeddedName(field.Type); id != nil && re.MatchString(id.Name) {
+				return true
+			}
 		}
 	}
 	return false
@@ -570,38 +1943,345 @@ func evalPropCheck(pred *grammar.PropertyPred, bindings Bindings) bool {
 		return false
 	}
 
-	switch pred.Property {
-	case "exported":
-		return isExported(val)
-	case "pointer":
-		_, ok := val.(*ast.StarExpr)
-		return ok
-	case "slice":
-		_, ok := val.(*ast.ArrayType)
-		return ok
-	case "map":
-		_, ok := val.(*ast.MapType)
-		return ok
-	case "error":
-		if ident, ok := val.(*ast.Ident); ok {
-			return ident.Name == "error"
+	if pred.Property == "implements" {
+		return evalImplements(pred, bindings)
+	}
+
+	check, ok := properties[pred.Property]
+	if !ok {
+		return false
+	}
+	if pred.Property == "has_doc" {
+		val = specDoc(val, bindings)
+	}
+	return check(val)
+}
+
+// typeExpr returns the type expression of a field, or v itself otherwise.
+func typeExpr(v any) any {
+	if f, ok := v.(*ast.Field); ok && f != nil {
+		return f.Type
+	}
+	return v
+}
+
+// isTypeExpr reports whether v (or v's field type) is an AST node of type T.
+func isTypeExpr[T ast.Expr](v any) bool {
+	_, ok := typeExpr(v).(T)
+	return ok
+}
+
+// isGeneric reports whether a function or type declaration has type parameters.
+func isGeneric(v any) bool {
+	switch val := v.(type) {
+	case *ast.FuncDecl:
+		return val != nil && val.Type.TypeParams != nil && len(val.Type.TypeParams.List) > 0
+	case *ast.FuncType:
+		return val != nil && val.TypeParams != nil && len(val.TypeParams.List) > 0
+	case *ast.TypeSpec:
+		return val != nil && val.TypeParams != nil && len(val.TypeParams.List) > 0
+	}
+	return false
+}
+
+// isErrorType reports whether v (or v's field type) is the error type.
+func isErrorType(v any) bool {
+	ident, ok := typeExpr(v).(*ast.Ident)
+	return ok && ident != nil && ident.Name == "error"
+}
+
+// isEmpty reports whether v is absent: a nil node, such as the missing
+// init of "for ; i < n; i++", or an empty list.
+func isEmpty(v any) bool {
+	if fl, ok := v.(*ast.FieldList); ok {
+		return fl == nil || len(fl.List) == 0
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	case reflect.Slice:
+		return rv.Len() == 0
+	}
+	return false
+}
+
+// isNil reports whether v is nil: a missing node, or a nil list.
+func isNil(v any) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// isBuiltin reports whether v names a predeclared Go identifier
+// (int, string, error, len, make, nil, true, ...).
+func isBuiltin(v any) bool {
+	var name string
+	switch val := typeExpr(v).(type) {
+	case *ast.Ident:
+		if val == nil {
+			return false
 		}
+		name = val.Name
+	case string:
+		name = val
+	default:
 		return false
 	}
+	return types.Universe.Lookup(name) != nil
+}
+
+// isNamed reports whether v (or v's field type) is a named type that
+// isn't predeclared: T, pkg.T, or an instantiation such as List[T].
+func isNamed(v any) bool {
+	switch val := typeExpr(v).(type) {
+	case *ast.Ident:
+		return val != nil && !isBuiltin(val)
+	case *ast.SelectorExpr:
+		_, ok := val.X.(*ast.Ident)
+		return ok
+	case *ast.IndexExpr:
+		return isNamed(val.X)
+	case *ast.IndexListExpr:
+		return isNamed(val.X)
+	}
 	return false
 }
 
-// isExported checks if a value represents an exported identifier.
+// isPointerToPointer reports whether v (or v's field type) is **T.
+func isPointerToPointer(v any) bool {
+	star, ok := typeExpr(v).(*ast.StarExpr)
+	if !ok || star == nil {
+		return false
+	}
+	_, ok = star.X.(*ast.StarExpr)
+	return ok
+}
+
+// isUnexported is the inverse of isExported for names: identifiers,
+// strings and fields. Anything else is neither.
+func isUnexported(v any) bool {
+	switch val := v.(type) {
+	case *ast.Ident:
+		return val != nil && !isExported(val)
+	case string:
+		return !isExported(val)
+	case *ast.Field:
+		return val != nil && !isExported(val)
+	}
+	return false
+}
+
+// isExported checks if a value represents an exported identifier,
+// i.e. its first rune is an upper-case Unicode letter.
 func isExported(v any) bool {
 	switch val := v.(type) {
 	case *ast.Ident:
-		return val != nil && len(val.Name) > 0 && val.Name[0] >= 'A' && val.Name[0] <= 'Z'
+		return val != nil && startsUpper(val.Name)
 	case string:
-		return len(val) > 0 && val[0] >= 'A' && val[0] <= 'Z'
+		return startsUpper(val)
+	case *ast.Field:
+		// A field is exported if any of its names is; an embedded
+		// field is exported if its type name is.
+		if val == nil {
+			return false
+		}
+		for _, name := range val.Names {
+			if startsUpper(name.Name) {
+				return true
+			}
+		}
+		if len(val.Names) == 0 {
+			return isExported(embeddedName(val.Type))
+		}
 	}
 	return false
 }
 
+// embeddedName returns the type name of an embedded field: T, *T, pkg.T.
+func embeddedName(expr ast.Expr) *ast.Ident {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t
+	case *ast.StarExpr:
+		return embeddedName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel
+	case *ast.IndexExpr:
+		return embeddedName(t.X)
+	case *ast.IndexListExpr:
+		return embeddedName(t.X)
+	}
+	return nil
+}
+
+// startsUpper reports whether the first rune of s is upper case.
+func startsUpper(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsUpper(r)
+}
+
+// validateWhere reports property predicates that name an unknown property
+// and matches() predicates with an invalid regex.
+func validateWhere(whereClauses []*grammar.WhereClause) error {
+	for _, where := range whereClauses {
+		for _, pred := range where.Predicates {
+			if err := validatePredicate(pred); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validatePredicate(pred *grammar.Predicate) error {
+	if pred.Not != nil {
+		return validatePredicate(pred.Not)
+	}
+	if pred.Group != nil {
+		for _, p := range pred.Group.Predicates {
+			if err := validatePredicate(p); err != nil {
+				return err
+			}
+		}
+	}
+	if pred.StringCheck != nil && pred.StringCheck.Func == "matches" {
+		if _, err := compileRegexp(pred.StringCheck.Argument); err != nil {
+			return fmt.Errorf("%s: invalid regex in $%s.matches: %v",
+				pred.StringCheck.Pos, pred.StringCheck.Binding, err)
+		}
+	}
+	if pred.FieldsNamed != nil {
+		if _, err := compileRegexp(pred.FieldsNamed.Pattern); err != nil {
+			return fmt.Errorf("%s: invalid regex in $%s.fields_named: %v",
+				pred.FieldsNamed.Pos, pred.FieldsNamed.Binding, err)
+		}
+	}
+	if tag := pred.TagCheck; tag != nil {
+		if tag.Func == "tag" && tag.Op == nil {
+			return fmt.Errorf("%s: $%s.tag(%q) needs a comparison, e.g. $%s.tag(%q) == \"-\"",
+				tag.Pos, tag.Binding, tag.Key, tag.Binding, tag.Key)
+		}
+		if tag.Func == "hasTag" && tag.Op != nil {
+			return fmt.Errorf("%s: $%s.hasTag(%q) can't be compared; use $%s.tag(%q) %s %q",
+				tag.Pos, tag.Binding, tag.Key, tag.Binding, tag.Key, *tag.Op, *tag.Value)
+		}
+	}
+	if member := pred.MemberCheck; member != nil && member.Set != nil && len(member.Set.Transforms) > 0 {
+		return fmt.Errorf("%s: $%s in $%s: transforms don't apply in a where clause",
+			member.Pos, member.Binding, member.Set.Name)
+	}
+	if prop := pred.PropCheck; prop != nil {
+		if prop.Property == "implements" {
+			if prop.Arg == nil {
+				return fmt.Errorf("%s: $%s.implements needs an interface, e.g. $%s.implements \"io.Reader\"",
+					prop.Pos, prop.Binding, prop.Binding)
+			}
+		} else if _, ok := properties[prop.Property]; !ok {
+			return fmt.Errorf("%s: unknown property $%s.%s", prop.Pos, prop.Binding, prop.Property)
+		} else if prop.Arg != nil {
+			return fmt.Errorf("%s: $%s.%s takes no argument", prop.Pos, prop.Binding, prop.Property)
+		}
+	}
+	return nil
+}
+
+// validateFields reports spread filters that name an unknown property.
+func validateFields(fields []*grammar.FieldMatch) error {
+	for _, field := range fields {
+		if err := validateValue(field.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateValue(v *grammar.MatchValue) error {
+	if spread := v.Spread; spread != nil && spread.Filter != nil {
+		if _, ok := properties[*spread.Filter]; !ok {
+			return fmt.Errorf("%s: unknown property in $%s...(%s)",
+				spread.Pos, spread.Name, *spread.Filter)
+		}
+	}
+	if spread := v.Spread; spread != nil && spread.Bounds != nil {
+		if b := spread.Bounds; b.Min != nil && b.Max != nil && *b.Min > *b.Max {
+			return fmt.Errorf("%s: $%s...(min=%d,max=%d) can never match",
+				b.Pos, spread.Name, *b.Min, *b.Max)
+		}
+	}
+	if pattern := expandPattern(v.Pattern); pattern != nil {
+		if err := validateFields(pattern.Fields); err != nil {
+			return err
+		}
+	}
+	for _, item := range v.List {
+		if err := validateValue(item); err != nil {
+			return err
+		}
+	}
+	if v.Tag != nil {
+		for _, key := range v.Tag.Keys {
+			if k := key.Value; k.Binding == nil && !k.Wild && !k.Nil && k.Exact == nil {
+				return fmt.Errorf("%s: tag key %s takes a string, a binding, _ or nil", key.Pos, key.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// OptimizeWhere merges where clauses into one whose predicates are ordered
+// cheapest first, so FilterMatches rejects a match before reaching the
+// expensive ones. Predicates have no side effects and all of them must
+// hold, so the order doesn't change which matches pass.
+func OptimizeWhere(whereClauses []*grammar.WhereClause) []*grammar.WhereClause {
+	if len(whereClauses) == 0 {
+		return whereClauses
+	}
+
+	var preds []*grammar.Predicate
+	for _, where := range whereClauses {
+		preds = append(preds, where.Predicates...)
+	}
+	sort.SliceStable(preds, func(i, j int) bool {
+		return predicateCost(preds[i]) < predicateCost(preds[j])
+	})
+	return []*grammar.WhereClause{{Pos: whereClauses[0].Pos, Predicates: preds}}
+}
+
+// predicateCost estimates how expensive a predicate is to evaluate.
+// Property, membership and length checks look at a single binding;
+// contains, count and deps walk the AST below it.
+func predicateCost(pred *grammar.Predicate) int {
+	switch {
+	case pred.Not != nil:
+		return predicateCost(pred.Not)
+	case pred.Group != nil:
+		cost := 0
+		for _, p := range pred.Group.Predicates {
+			cost += predicateCost(p)
+		}
+		return cost
+	case pred.PropCheck != nil, pred.EqualCheck != nil:
+		return 1
+	case pred.MemberCheck != nil, pred.LenCheck != nil, pred.TagCheck != nil:
+		return 2
+	case pred.StringCheck != nil, pred.FieldsNamed != nil:
+		return 3
+	case pred.Contains != nil, pred.CountCheck != nil, pred.DepsCheck != nil, pred.NotPrecededBy != nil:
+		return 10
+	case pred.NotContainsAny != nil:
+		return 10 * len(pred.NotContainsAny.Patterns)
+	}
+	return 0
+}
+
 // FilterMatches filters matches using where clause predicates.
 func FilterMatches(matches []Match, whereClauses []*grammar.WhereClause) []Match {
 	if len(whereClauses) == 0 {
@@ -628,3 +2308,53 @@ func FilterMatches(matches []Match, whereClauses []*grammar.WhereClause) []Match
 	}
 	return filtered
 }
+
+// Stats records the work done matching one block against one file, for
+// finding the rules that make a run slow.
+type Stats struct {
+	Matches    int           // matches of the from clause
+	Kept       int           // matches the where clause kept
+	MatchTime  time.Duration // spent in MatchBlock
+	FilterTime time.Duration // spent in FilterMatches
+
+	// Scopes holds the "in func/type" scopes the block used, and whether
+	// the file had the declaration each names.
+	Scopes map[*grammar.MatchScope]bool
+}
+
+// Add accumulates o into s.
+func (s *Stats) Add(o Stats) {
+	s.Matches += o.Matches
+	s.Kept += o.Kept
+	s.MatchTime += o.MatchTime
+	s.FilterTime += o.FilterTime
+	for scope, found := range o.Scopes {
+		if s.Scopes == nil {
+			s.Scopes = make(map[*grammar.MatchScope]bool)
+		}
+		s.Scopes[scope] = s.Scopes[scope] || found
+	}
+}
+
+// MatchFiltered runs MatchBlock and then FilterMatches with the block's
+// where clause, timing each.
+func (m *Matcher) MatchFiltered(block *grammar.LiftBlock) ([]Match, Stats, error) {
+	var stats Stats
+
+	m.scopes = nil
+	start := time.Now()
+	matches, err := m.MatchBlock(block)
+	stats.MatchTime = time.Since(start)
+	stats.Scopes = m.scopes
+	if err != nil {
+		return nil, stats, err
+	}
+	stats.Matches = len(matches)
+
+	start = time.Now()
+	matches = FilterMatches(matches, block.Where)
+	stats.FilterTime = time.Since(start)
+	stats.Kept = len(matches)
+
+	return matches, stats, nil
+}
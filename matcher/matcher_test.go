@@ -1,11 +1,24 @@
 package matcher
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/vinodhalaharvi/stencil/grammar"
 )
 
+var update = flag.Bool("update", false, "rewrite golden files under testdata")
+
 func TestMatchFuncDecl(t *testing.T) {
 	src := `
 package main
@@ -505,3 +518,3034 @@ lift "test" {
 
 	t.Logf("✓ Wildcard matching works")
 }
+
+func TestPropertyPredicates(t *testing.T) {
+	src := `
+package main
+
+type Sample struct {
+	Ch    chan int
+	Any   interface{}
+	Fn    func() error
+	Ptr   *int
+	Items []string
+	Index map[string]int
+	Count int
+	Err   error
+	Local Sample
+	PP    **int
+}
+
+func Variadic(prefix string, args ...any) {}
+func Generic[T any](v T) T { return v }
+func Plain(x int) {}
+func helper() {}
+`
+	tests := []struct {
+		property string
+		match    string
+		want     int
+	}{
+		{"channel", "Field { type: $T }", 1},
+		{"interface", "Field { type: $T }", 1},
+		{"func", "Field { type: $T }", 1},
+		// Ptr and PP
+		{"pointer", "Field { type: $T }", 2},
+		{"pointer_to_pointer", "Field { type: $T }", 1},
+		{"slice", "Field { type: $T }", 1},
+		{"map", "Field { type: $T }", 1},
+		// Err and the result of Fn
+		{"error", "Field { type: $T }", 2},
+		{"variadic", "Field { type: $T }", 1},
+		// Count, Err, Fn's result, prefix, x, and the [T any] constraint
+		{"builtin", "Field { type: $T }", 6},
+		// Local, and Generic's v and result
+		{"named", "Field { type: $T }", 3},
+		{"generic", "FuncDecl { type: $T }", 1},
+		{"exported", "FuncDecl { name: $T }", 3},
+		{"unexported", "FuncDecl { name: $T }", 1},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.property, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match `+tt.match+`
+	}
+
+	where {
+		$T.`+tt.property+`
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match error: %v", err)
+			}
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+			if len(matches) != tt.want {
+				t.Errorf("$T.%s: expected %d match(es), got %d", tt.property, tt.want, len(matches))
+			}
+		})
+	}
+
+	t.Logf("✓ Property predicates work")
+}
+
+func TestUnknownProperty(t *testing.T) {
+	m, err := New("package main\n\nfunc F() {}\n")
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl { name: $Name }
+	}
+
+	where {
+		not $Name.shiny
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("unknown property should still parse: %v", err)
+	}
+
+	if _, err := m.MatchBlock(prog.Blocks[0]); err == nil || !strings.Contains(err.Error(), "unknown property $Name.shiny") {
+		t.Errorf("expected unknown property error, got %v", err)
+	}
+
+	t.Logf("✓ Unknown property rejected")
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	src := `
+package main
+
+type Überweisung struct {
+	Betrag int
+}
+
+type ärger struct{}
+
+func Ändern() {}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "exported-types" {
+	from go {
+		match TypeSpec {
+			name: $Näme
+		}
+	}
+
+	where {
+		$Näme.exported
+	}
+}
+
+lift "exact" {
+	from go {
+		match FuncDecl {
+			name: Ident { name: "Ändern" }
+		}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 exported type (Überweisung), got %d", len(matches))
+	}
+	if name := matches[0].Bindings["Näme"]; name == nil || name.(*ast.Ident).Name != "Überweisung" {
+		t.Errorf("expected $Näme = Überweisung, got %v", name)
+	}
+
+	matches, _ = m.MatchBlock(prog.Blocks[1])
+	if len(matches) != 1 {
+		t.Fatalf("expected exact match on Ändern, got %d", len(matches))
+	}
+
+	t.Logf("✓ Unicode identifiers match")
+}
+
+func TestMatchIfStmtCondition(t *testing.T) {
+	src := `
+package main
+
+func Load() error {
+	data, err := read()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if x := data[0]; x != nil {
+		use(x)
+	}
+	return nil
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "nil-checks" {
+	from go {
+		match IfStmt {
+			cond: BinaryExpr {
+				op: "!="
+				rhs: Ident { name: "nil" }
+			}
+			body: $Body
+		}
+	}
+}
+
+lift "nil-checks-with-init" {
+	from go {
+		match IfStmt {
+			init: AssignStmt { lhs: [$Var] }
+			cond: BinaryExpr { lhs: $X op: "!=" }
+		}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 nil-check ifs, got %d", len(matches))
+	}
+	if _, ok := matches[0].Bindings["Body"].(*ast.BlockStmt); !ok {
+		t.Errorf("expected $Body to be a BlockStmt, got %T", matches[0].Bindings["Body"])
+	}
+
+	matches, _ = m.MatchBlock(prog.Blocks[1])
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 if with init, got %d", len(matches))
+	}
+	if v, ok := matches[0].Bindings["Var"].(*ast.Ident); !ok || v.Name != "x" {
+		t.Errorf("expected $Var = x, got %v", matches[0].Bindings["Var"])
+	}
+
+	t.Logf("✓ IfStmt condition matching works")
+}
+
+func TestStringPredicates(t *testing.T) {
+	src := `
+package main
+
+func TestLogin() {}
+func TestLogout() {}
+func LoginHandler() {}
+func NewServer() {}
+func Newline() {}
+func newClient() {}
+`
+	tests := []struct {
+		where string
+		want  int
+	}{
+		{`$Name.hasPrefix("Test")`, 2},
+		{`$Name.hasSuffix("Handler")`, 1},
+		{`$Name.matches("^New[A-Z]")`, 1},
+		{`not $Name.matches("^(?i)new")`, 3},
+		{`$Type.matches("^func[(][)]$")`, 6},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl { name: $Name type: $Type }
+	}
+
+	where {
+		`+tt.where+`
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match error: %v", err)
+			}
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+			if len(matches) != tt.want {
+				t.Errorf("expected %d match(es), got %d", tt.want, len(matches))
+			}
+		})
+	}
+
+	t.Logf("✓ String predicates work")
+}
+
+func TestFieldsNamedPredicate(t *testing.T) {
+	src := `
+package main
+
+type User struct {
+	ID   int
+	Name string
+}
+
+type Order struct {
+	UUID  string
+	Total float64
+}
+
+type Tag struct {
+	Name string
+}
+
+type Audited struct {
+	Entity
+	CreatedBy string
+}
+`
+	tests := []struct {
+		where string
+		want  int
+	}{
+		{`$Fields.fields_named "^(ID|UUID)$"`, 2},
+		{`$Fields.fields_named "^ID$"
+		$Fields.fields_named "^Name$"`, 1},
+		{`not $Fields.fields_named "^Name$"`, 2},
+		// Embedded fields are named by their type
+		{`$Fields.fields_named "^Entity$"`, 1},
+		{`$Fields.fields_named "By$"`, 1},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		for _, match := range []string{
+			"TypeSpec { type: StructType { fields: $Fields } }",
+			"TypeSpec { type: StructType { fields: FieldList { list: $Fields... } } }",
+			"TypeSpec { type: $Fields }",
+		} {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match `+match+`
+	}
+
+	where {
+		`+tt.where+`
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match error: %v", err)
+			}
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+			if len(matches) != tt.want {
+				t.Errorf("%s where %s: expected %d match(es), got %d", match, tt.where, tt.want, len(matches))
+			}
+		}
+	}
+
+	m, _ := New(src)
+	prog, _ := parser.ParseString("test.lift", `lift "bad" { from go { match StructType { fields: $Fields } } where { $Fields.fields_named "(" } }`)
+	if _, err := m.MatchBlock(prog.Blocks[0]); err == nil || !strings.Contains(err.Error(), "invalid regex in $Fields.fields_named") {
+		t.Errorf("expected an invalid regex error, got %v", err)
+	}
+
+	t.Logf("✓ fields_named predicate works")
+}
+
+func TestInvalidRegexRejected(t *testing.T) {
+	m, err := New("package main\n\nfunc F() {}\n")
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("bad.lift", `
+lift "test" {
+	from go {
+		match FuncDecl { name: $Name }
+	}
+
+	where {
+		$Name.matches("([a-z")
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	_, err = m.MatchBlock(prog.Blocks[0])
+	if err == nil || !strings.Contains(err.Error(), "bad.lift:8:3") || !strings.Contains(err.Error(), "invalid regex") {
+		t.Errorf("expected positioned invalid regex error, got %v", err)
+	}
+
+	t.Logf("✓ Invalid regex rejected with position")
+}
+
+func TestMatchRangeStmt(t *testing.T) {
+	src := `
+package main
+
+func Sum(items []int) int {
+	total := 0
+	for _, v := range items {
+		total += v
+	}
+	for i := range items {
+		_ = i
+	}
+	return total
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "range-with-value" {
+	from go {
+		match RangeStmt {
+			key: Ident { name: "_" }
+			value: $Value
+			x: $Slice
+			body: $Body
+		}
+	}
+}
+
+lift "range-define" {
+	from go {
+		match RangeStmt {
+			tok: ":="
+			x: Ident { name: "items" }
+		}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 key/value range loop, got %d", len(matches))
+	}
+	if v, ok := matches[0].Bindings["Value"].(*ast.Ident); !ok || v.Name != "v" {
+		t.Errorf("expected $Value = v, got %v", matches[0].Bindings["Value"])
+	}
+	if s, ok := matches[0].Bindings["Slice"].(*ast.Ident); !ok || s.Name != "items" {
+		t.Errorf("expected $Slice = items, got %v", matches[0].Bindings["Slice"])
+	}
+
+	matches, _ = m.MatchBlock(prog.Blocks[1])
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 range loops over items, got %d", len(matches))
+	}
+
+	t.Logf("✓ RangeStmt matching works")
+}
+
+func TestMatchForStmt(t *testing.T) {
+	src := `
+package main
+
+func Loops(n int) {
+	for i := 0; i < n; i++ {
+	}
+	i := 0
+	for ; i < n; i++ {
+	}
+	for i < n {
+		i++
+	}
+	for {
+		break
+	}
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		where string
+		want  int
+	}{
+		{"any loop", "", 4},
+		{"empty init", "where { $Init.empty }", 3},
+		{"empty init with post", "where { $Init.empty  not $Post.empty }", 1},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `
+lift "for-loops" {
+	from go {
+		match ForStmt {
+			init: $Init
+			cond: $Cond
+			post: $Post
+			body: $Body
+		}
+	}
+	`+tt.where+`
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+			if len(matches) != tt.want {
+				t.Fatalf("expected %d loops, got %d", tt.want, len(matches))
+			}
+			for _, match := range matches {
+				if cond := match.Bindings["Cond"]; cond != nil {
+					if _, ok := cond.(*ast.BinaryExpr); !ok {
+						t.Errorf("expected $Cond to be a comparison, got %T", cond)
+					}
+				}
+				if _, ok := match.Bindings["Body"].(*ast.BlockStmt); !ok {
+					t.Errorf("expected $Body to be a block, got %T", match.Bindings["Body"])
+				}
+			}
+		})
+	}
+
+	t.Logf("✓ ForStmt matching works")
+}
+
+func TestMatchSwitchStmt(t *testing.T) {
+	src := `
+package main
+
+func Describe(v any, n int) string {
+	switch n {
+	case 0:
+		return "zero"
+	default:
+		return "many"
+	}
+	switch x := v.(type) {
+	case int:
+		return "int"
+	case string:
+		_ = x
+	}
+	switch v.(type) {
+	case nil:
+	default:
+	}
+	return ""
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		lift string
+		want int
+	}{
+		{"switch on tag", `match SwitchStmt { tag: Ident { name: "n" } body: $Body }`, 1},
+		{"type switch", `match TypeSwitchStmt { assign: $Assign body: $Body }`, 2},
+		{"type switch binding", `match TypeSwitchStmt { assign: AssignStmt { lhs: [Ident { name: "x" }] } }`, 1},
+		{"default case", `match CaseClause { list: [] }`, 2},
+		{"case with values", `match CaseClause { list: [$V] }`, 4},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "t" { from go { `+tt.lift+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			if len(matches) != tt.want {
+				t.Errorf("expected %d matches, got %d", tt.want, len(matches))
+			}
+		})
+	}
+
+	t.Logf("✓ SwitchStmt and TypeSwitchStmt matching works")
+}
+
+func TestMatchSendStmt(t *testing.T) {
+	src := `
+package main
+
+func Publish(events chan<- string, done chan struct{}) {
+	events <- "start"
+	select {
+	case events <- "tick":
+	default:
+	}
+	select {
+	case done <- struct{}{}:
+	case <-done:
+	}
+}
+
+func Drain(events chan string) {
+	for e := range events {
+		_ = e
+	}
+}
+
+func Notify(out chan int) {
+	out <- 1
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		lift string
+		want int
+	}{
+		{"all sends", `match SendStmt { chan: $Ch value: $Val }`, 4},
+		{"sends on a channel", `match SendStmt { chan: Ident { name: "events" } value: $Val }`, 2},
+		{"send cases", `match CommClause { comm: SendStmt { chan: $Ch } }`, 2},
+		{"non-blocking send", `match SelectStmt { body: $Body }
+			} where {
+				contains($Body, CommClause { comm: SendStmt { chan: $Ch } })
+				contains($Body, CommClause { comm: [] })`, 1},
+		{"default cases", `match CommClause { comm: nil }`, 1},
+		{"selects without default", `match SelectStmt { body: $Body }
+			} where {
+				not contains($Body, CommClause { comm: nil })`, 1},
+		{"sends without select", `match FuncDecl { body: $Body }
+			} where {
+				contains($Body, SendStmt { chan: $Ch })
+				not contains($Body, SelectStmt { body: $Cases })`, 1},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "t" { from go { `+tt.lift+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+			if len(matches) != tt.want {
+				t.Errorf("expected %d matches, got %d", tt.want, len(matches))
+			}
+		})
+	}
+
+	// A send is non-blocking only as the case of a select with a default
+	prog, _ := parser.ParseString("test.lift", `lift "t" { from go { match SendStmt { chan: $Ch value: $Val } } }`)
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	var blocking []string
+	for _, match := range matches {
+		if !inNonBlockingSelect(match) {
+			blocking = append(blocking, match.Bindings["Ch"].(*ast.Ident).Name)
+		}
+	}
+	if want := []string{"events", "done", "out"}; !slices.Equal(blocking, want) {
+		t.Errorf("blocking sends on %v, want %v", blocking, want)
+	}
+
+	t.Logf("✓ SendStmt matching works")
+}
+
+// inNonBlockingSelect reports whether a matched send is the case of a
+// select statement that has a default case.
+func inNonBlockingSelect(match Match) bool {
+	n := len(match.Path)
+	if n < 3 {
+		return false
+	}
+	clause, ok := match.Path[n-1].(*ast.CommClause)
+	if !ok || clause.Comm != match.Node {
+		return false
+	}
+	sel, ok := match.Path[n-3].(*ast.SelectStmt)
+	if !ok {
+		return false
+	}
+	for _, stmt := range sel.Body.List {
+		if stmt.(*ast.CommClause).Comm == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMatchPath(t *testing.T) {
+	src := `
+package main
+
+var client = newClient()
+
+func Fetch(url string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func Report() {
+	if verbose {
+		log.Println("report")
+	}
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		lift string
+		want []string // callee of each match
+	}{
+		{"calls in function bodies", `match FuncDecl / Body / CallExpr { fun: $Fn }`,
+			[]string{"http.Get", "log.Println", "resp.Body.Close", "log.Println"}},
+		{"same as in chain", `match FuncDecl { body: $Body } match CallExpr in $Body { fun: $Fn }`,
+			[]string{"http.Get", "log.Println", "resp.Body.Close", "log.Println"}},
+		{"calls in if bodies", `match FuncDecl / Body / IfStmt / Body / CallExpr { fun: $Fn }`,
+			[]string{"log.Println", "log.Println"}},
+		{"path in scope", `match FuncDecl / Body / CallExpr in func "Report" { fun: $Fn }`,
+			[]string{"log.Println"}},
+		{"fields on the last node", `match FuncDecl / Body / CallExpr { fun: "http.Get" args: [$URL] }`,
+			[]string{"http.Get"}},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "t" { from go { `+tt.lift+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			var got []string
+			for _, match := range matches {
+				got = append(got, types.ExprString(match.Node.(*ast.CallExpr).Fun))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got calls %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Logf("✓ Match paths work")
+}
+
+func TestPredicateCount(t *testing.T) {
+	src := `
+package main
+
+type Pair struct {
+	A, B  Point
+	C     Point
+	Label string
+}
+
+type Single struct {
+	P Point
+}
+
+func Many() error {
+	if err := a(); err != nil {
+		return err
+	}
+	if err := b(); err != nil {
+		return err
+	}
+	if err := c(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func Few() error {
+	if err := a(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func Noisy() {
+	log.Error("a")
+	log.Error("b")
+	log.Info("c")
+	log.Error("d")
+	if x {
+		log.Error("e")
+	}
+}
+`
+	tests := []struct {
+		name  string
+		match string
+		where string
+		want  int
+	}{
+		{
+			name:  "err checks >= 3",
+			match: `FuncDecl { body: $Body }`,
+			where: `count($Body, IfStmt { cond: BinaryExpr { op: "!=" rhs: Ident { name: "nil" } } }) >= 3`,
+			want:  1,
+		},
+		{
+			name:  "err checks == 1",
+			match: `FuncDecl { body: $Body }`,
+			where: `count($Body, IfStmt { cond: BinaryExpr { op: "!=" } }) == 1`,
+			want:  1,
+		},
+		{
+			name:  "err checks < 10",
+			match: `FuncDecl { body: $Body }`,
+			where: `count($Body, ReturnStmt { }) < 10`,
+			want:  3,
+		},
+		{
+			name:  "fields of type Point >= 2",
+			match: `TypeSpec { type: StructType { fields: $Fields... } }`,
+			where: `count($Fields, Field { type: Ident { name: "Point" } }) >= 2`,
+			want:  1,
+		},
+		{
+			name:  "error logging > 3 as an attribute",
+			match: `FuncDecl { body: $Body }`,
+			where: `$Body.count(CallExpr { fun: SelectorExpr { sel: Ident { name: "Error" } } }) > 3`,
+			want:  1,
+		},
+		{
+			name:  "negated attribute",
+			match: `FuncDecl { body: $Body }`,
+			where: `not $Body.count(CallExpr { fun: SelectorExpr { sel: "Error" } }) > 3`,
+			want:  2,
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match `+tt.match+`
+	}
+
+	where {
+		`+tt.where+`
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+			if len(matches) != tt.want {
+				t.Errorf("expected %d match(es), got %d", tt.want, len(matches))
+			}
+		})
+	}
+
+	t.Logf("✓ Count predicate works")
+}
+
+func TestCountMatchesLimit(t *testing.T) {
+	m, err := New("package main\n\nfunc F() { a(); b(); c(); d() }\n")
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	pattern := &grammar.ASTPattern{NodeType: "CallExpr"}
+	if got := countMatches(m.File(), pattern, 0); got != 4 {
+		t.Errorf("unlimited count: got %d, want 4", got)
+	}
+	if got := countMatches(m.File(), pattern, 2); got != 2 {
+		t.Errorf("limited count: got %d, want 2", got)
+	}
+
+	t.Logf("✓ Count stops at limit")
+}
+
+func TestPredicateGroups(t *testing.T) {
+	src := `
+package main
+
+func GetUser() {}
+func PostUser() {}
+func DeleteUser() {}
+func getCache() {}
+func dialBackend() { net.Dial("tcp", "x") }
+`
+	tests := []struct {
+		name  string
+		where string
+		want  int
+	}{
+		{"or", `or { $Name.hasPrefix("Get") $Name.hasPrefix("Post") }`, 2},
+		{"flat and unchanged", `$Name.exported $Name.hasSuffix("User")`, 3},
+		{"and group", `and { $Name.exported $Name.hasSuffix("User") }`, 3},
+		{"not or", `not or { $Name.hasPrefix("Get") $Name.hasPrefix("get") }`, 3},
+		{"nested", `or {
+			and { $Name.exported $Name.hasPrefix("Delete") }
+			and { not $Name.exported contains($Body, SelectorExpr { sel: Ident { name: "Dial" } }) }
+		}`, 2},
+		{"empty or", `or { }`, 0},
+		{"empty and", `and { }`, 5},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+	}
+
+	where {
+		`+tt.where+`
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+			if len(matches) != tt.want {
+				t.Errorf("expected %d match(es), got %d", tt.want, len(matches))
+			}
+		})
+	}
+
+	t.Logf("✓ Predicate groups work")
+}
+
+func TestEnclosingContext(t *testing.T) {
+	src := `
+package main
+
+var client = http.DefaultClient
+
+func CreateUser() {
+	if ok {
+		client.Post("url", "", nil)
+	}
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "deep" {
+	from go {
+		match FuncDecl { body: $Body }
+		match CallExpr in $Body {
+			fun: SelectorExpr { sel: $CallName }
+		}
+	}
+}
+
+lift "top-level" {
+	from go {
+		match ValueSpec { names: [$Name] }
+	}
+}
+
+lift "outer-binding" {
+	from go {
+		match GenDecl { }
+		match FuncDecl { body: $Body }
+		match IfStmt in $Body { body: $Then }
+		match CallExpr in $Body { }
+		match Ident in $Then { }
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
+	match := matches[0]
+
+	call, ok := match.Node.(*ast.CallExpr)
+	if !ok {
+		t.Fatalf("expected innermost node to be the CallExpr, got %T", match.Node)
+	}
+	if match.Bindings[BindMatch] != call {
+		t.Error("expected $_match to be the CallExpr")
+	}
+
+	fd, ok := match.Bindings[BindEnclosingFunc].(*ast.FuncDecl)
+	if !ok || fd.Name.Name != "CreateUser" {
+		t.Errorf("expected $_enclosingFunc = CreateUser, got %v", match.Bindings[BindEnclosingFunc])
+	}
+
+	// file → FuncDecl → BlockStmt → IfStmt → BlockStmt → ExprStmt
+	if len(match.Path) != 6 {
+		t.Fatalf("expected path of 6 nodes, got %d", len(match.Path))
+	}
+	if _, ok := match.Path[0].(*ast.File); !ok {
+		t.Errorf("expected path to start at the file, got %T", match.Path[0])
+	}
+	if _, ok := match.Path[3].(*ast.IfStmt); !ok {
+		t.Errorf("expected IfStmt in path, got %T", match.Path[3])
+	}
+
+	pos := m.FileSet().Position(match.Node.Pos())
+	if pos.Line != 8 {
+		t.Errorf("expected match on call line 8, got %d", pos.Line)
+	}
+
+	matches, _ = m.MatchBlock(prog.Blocks[1])
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 top-level match, got %d", len(matches))
+	}
+	if _, ok := matches[0].Bindings[BindEnclosingFunc]; ok {
+		t.Error("expected no $_enclosingFunc at file level")
+	}
+
+	// Scopes bound by an enclosing match, within the match's node or by
+	// another matcher altogether have the same paths as a search of the file
+	matches, _ = m.MatchBlock(prog.Blocks[2])
+	if len(matches) == 0 {
+		t.Fatal("expected matches within bindings")
+	}
+	for _, match := range matches {
+		if want := m.pathTo(match.Node); !reflect.DeepEqual(match.Path, want) {
+			t.Errorf("%T at line %d: path %v, want %v", match.Node,
+				m.FileSet().Position(match.Node.Pos()).Line, match.Path, want)
+		}
+	}
+
+	t.Logf("✓ Enclosing context recorded")
+}
+
+func TestPredicateNotContainsAny(t *testing.T) {
+	src := `
+package main
+
+func Clean() {
+	fmt.Println("ok")
+}
+
+func Panics() {
+	panic("boom")
+}
+
+func Fatals() {
+	log.Fatal("boom")
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "no-abort" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+	}
+
+	where {
+		not_contains_any($Body, [
+			CallExpr { fun: Ident { name: "panic" } },
+			CallExpr { fun: SelectorExpr { x: Ident { name: "log" } sel: Ident { name: "Fatal" } } }
+		])
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
+	if name := matches[0].Bindings["Name"].(*ast.Ident).Name; name != "Clean" {
+		t.Errorf("expected Clean, got %s", name)
+	}
+
+	t.Logf("✓ not_contains_any rejects bodies containing any pattern")
+}
+
+func TestMatchScope(t *testing.T) {
+	src := `
+package main
+
+type Config struct {
+	Addr string
+	Port int
+}
+
+type Other struct {
+	Name string
+}
+
+func main() {
+	run()
+	serve()
+}
+
+func helper() {
+	run()
+}
+`
+	tests := []struct {
+		name    string
+		lift    string
+		want    int
+		missing bool // the scope isn't found in Stats.Scopes
+	}{
+		{
+			name: "in func",
+			lift: `from go { match CallExpr in func "main" { } }`,
+			want: 2,
+		},
+		{
+			name: "in type",
+			lift: `from go { match Field in type "Config" { } }`,
+			want: 2,
+		},
+		{
+			name: "block scope",
+			lift: `scope func "helper" from go { match CallExpr { } }`,
+			want: 1,
+		},
+		{
+			name: "matcher scope overrides block scope",
+			lift: `scope func "helper" from go { match CallExpr in func "main" { } }`,
+			want: 2,
+		},
+		{
+			name:    "missing func",
+			lift:    `from go { match CallExpr in func "nope" { } }`,
+			want:    0,
+			missing: true,
+		},
+		{
+			name:    "missing block scope",
+			lift:    `scope type "Nope" from go { match Field { } }`,
+			want:    0,
+			missing: true,
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `lift "test" { `+tt.lift+` }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, stats, err := m.MatchFiltered(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(matches) != tt.want {
+				t.Errorf("expected %d match(es), got %d", tt.want, len(matches))
+			}
+			if len(stats.Scopes) != 1 {
+				t.Fatalf("expected 1 scope in stats, got %v", stats.Scopes)
+			}
+			for scope, found := range stats.Scopes {
+				if found == tt.missing {
+					t.Errorf("scope %s %q: found = %v, want %v", scope.Kind, scope.Name, found, !tt.missing)
+				}
+			}
+		})
+	}
+
+	t.Logf("✓ Match scopes restrict matching to named declarations")
+}
+
+func TestSelectorPathSugar(t *testing.T) {
+	src := `
+package main
+
+func handler() {
+	http.Get("url")
+	s.client.Get("url")
+	a.b.c.Do(req)
+	Get("url")
+}
+`
+	tests := []struct {
+		path  string
+		want  []int // lines of matching calls
+		bind  string
+		bound string
+	}{
+		{path: "http.Get", want: []int{5}},
+		{path: "*.client.Get", want: []int{6}},
+		{path: "a.b.c.Do", want: []int{7}},
+		{path: "*.*.c.Do", want: []int{7}},
+		{path: "*.Get", want: []int{5, 6}},
+		{path: "b.c.Do", want: nil},
+		{path: "$Pkg.Get", want: []int{5, 6}, bind: "Pkg", bound: "http"},
+		{path: "a.$Field.c.Do", want: []int{7}, bind: "Field", bound: "b"},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match CallExpr { fun: "`+tt.path+`" }
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			if len(matches) != len(tt.want) {
+				t.Fatalf("expected %d match(es), got %d", len(tt.want), len(matches))
+			}
+			for i, match := range matches {
+				if line := m.FileSet().Position(match.Node.Pos()).Line; line != tt.want[i] {
+					t.Errorf("match %d: expected line %d, got %d", i, tt.want[i], line)
+				}
+			}
+
+			if tt.bind != "" {
+				ident, ok := matches[0].Bindings[tt.bind].(*ast.Ident)
+				if !ok || ident.Name != tt.bound {
+					t.Errorf("expected $%s = %s, got %v", tt.bind, tt.bound, matches[0].Bindings[tt.bind])
+				}
+			}
+		})
+	}
+
+	t.Logf("✓ Selector path sugar matches qualified calls")
+}
+
+func TestPatternAliases(t *testing.T) {
+	src := `
+package main
+
+func WithCtx(ctx context.Context, id string) error {
+	if err := load(ctx, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+func WithoutCtx(id string) error {
+	return nil
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+pattern CtxType = SelectorExpr { x: Ident { name: "context" } sel: Ident { name: "Context" } }
+pattern CtxParam = Field { type: CtxType }
+pattern ErrCheck = IfStmt { cond: BinaryExpr { op: "!=" rhs: Ident { name: "nil" } } }
+
+lift "ctx-first" {
+	from go {
+		match FuncDecl { name: $Name type: FuncType { params: FieldList { list: [CtxParam, _] } } }
+	}
+}
+
+lift "checks-errors" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+	}
+
+	where {
+		contains($Body, ErrCheck)
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+	if err := prog.ResolvePatterns(); err != nil {
+		t.Fatalf("failed to resolve patterns: %v", err)
+	}
+
+	for _, block := range prog.Blocks {
+		matches, _ := m.MatchBlock(block)
+		matches = FilterMatches(matches, block.Where)
+
+		if len(matches) != 1 {
+			t.Fatalf("%s: expected 1 match, got %d", block.Name, len(matches))
+		}
+		if name := matches[0].Bindings["Name"].(*ast.Ident).Name; name != "WithCtx" {
+			t.Errorf("%s: expected WithCtx, got %s", block.Name, name)
+		}
+	}
+
+	t.Logf("✓ Named patterns expand in matchers and predicates")
+}
+
+func TestMatchReturnStmt(t *testing.T) {
+	src := `
+package main
+
+func load(id string) (*User, error) {
+	u, err := fetch(id)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("user %s: %w", id, ErrNotFound)
+	}
+	return u, nil
+}
+
+func save(u *User) error {
+	if err := store(u); err != nil {
+		return err
+	}
+	return nil
+}
+
+func noop() {
+	return
+}
+`
+	tests := []struct {
+		name  string
+		match string
+		want  []int // lines of matching returns
+	}{
+		{
+			name:  "return nil, err",
+			match: `ReturnStmt { results: [Ident { name: "nil" }, $Err] }`,
+			want:  []int{7, 10},
+		},
+		{
+			name:  "unwrapped error",
+			match: `ReturnStmt { results: [Ident { name: "nil" }, Ident { name: "err" }] }`,
+			want:  []int{7},
+		},
+		{
+			name:  "single value",
+			match: `ReturnStmt { results: [$Err] }`,
+			want:  []int{17, 19},
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match `+tt.match+`
+	}
+}
+`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, _ := m.MatchBlock(prog.Blocks[0])
+			if len(matches) != len(tt.want) {
+				t.Fatalf("expected %d match(es), got %d", len(tt.want), len(matches))
+			}
+			for i, match := range matches {
+				if line := m.FileSet().Position(match.Node.Pos()).Line; line != tt.want[i] {
+					t.Errorf("match %d: expected line %d, got %d", i, tt.want[i], line)
+				}
+			}
+		})
+	}
+
+	t.Logf("✓ ReturnStmt results matching works")
+}
+
+func TestFilteredSpread(t *testing.T) {
+	src := `
+package main
+
+type User struct {
+	ID        int
+	Name      string
+	password  string
+	createdAt time.Time
+	io.Reader
+	*sync.Mutex
+	cache
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "public" {
+	from go {
+		match TypeSpec {
+			name: $Name
+			type: StructType { fields: $PublicFields...(exported) }
+		}
+	}
+}
+
+lift "all" {
+	from go {
+		match TypeSpec {
+			type: StructType { fields: $Fields... }
+		}
+	}
+}
+
+lift "unknown" {
+	from go {
+		match TypeSpec {
+			type: StructType { fields: $Fields...(shiny) }
+		}
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
+
+	fields, ok := matches[0].Bindings["PublicFields"].([]*ast.Field)
+	if !ok {
+		t.Fatalf("expected []*ast.Field, got %T", matches[0].Bindings["PublicFields"])
+	}
+
+	var got []string
+	for _, f := range fields {
+		if len(f.Names) > 0 {
+			got = append(got, f.Names[0].Name)
+		} else {
+			got = append(got, "embedded")
+		}
+	}
+	if want := "ID Name embedded embedded"; strings.Join(got, " ") != want {
+		t.Errorf("expected %s, got %v", want, got)
+	}
+
+	matches, _ = m.MatchBlock(prog.Blocks[1])
+	if fl, ok := matches[0].Bindings["Fields"].(*ast.FieldList); !ok || len(fl.List) != 7 {
+		t.Errorf("expected unfiltered spread to capture the whole FieldList")
+	}
+
+	if _, err := m.MatchBlock(prog.Blocks[2]); err == nil || !strings.Contains(err.Error(), "unknown property") {
+		t.Errorf("expected unknown property error, got %v", err)
+	}
+
+	t.Logf("✓ Filtered spread captures only matching fields")
+}
+
+func TestSpreadBounds(t *testing.T) {
+	src := `
+package main
+
+func none() {}
+
+func two(a, b int) (int, error) {
+	return fmt.Sprint(a, b), nil
+}
+
+func main() {
+	none()
+	two(1, 2)
+	fmt.Println(1, 2, 3, 4, 5, 6)
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	count := func(pattern string) int {
+		t.Helper()
+		matches, err := matchPattern(t, m, pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		return len(matches)
+	}
+
+	tests := []struct {
+		pattern string
+		want    int
+	}{
+		{`CallExpr { args: $Args... }`, 4},
+		{`CallExpr { args: $Args...(min=6) }`, 1},
+		{`CallExpr { args: $Args...(min=1,max=3) }`, 2},
+		{`CallExpr { args: $Args...(max=0) }`, 1},
+		{`FuncType { params: FieldList { list: $Params...(min=1) } }`, 1},
+		{`FuncType { results: $Results...(min=1) }`, 1},
+		{`FuncType { results: $Results...(max=0) }`, 2},
+	}
+	for _, tt := range tests {
+		if got := count(tt.pattern); got != tt.want {
+			t.Errorf("%s: expected %d match(es), got %d", tt.pattern, tt.want, got)
+		}
+	}
+
+	if _, err := matchPattern(t, m, `CallExpr { args: $Args...(min=3,max=1) }`); err == nil || !strings.Contains(err.Error(), "can never match") {
+		t.Errorf("expected min > max to be rejected, got %v", err)
+	}
+
+	t.Logf("✓ Spread bounds constrain the captured length")
+}
+
+// matchPattern runs a single match pattern against m.
+func TestMatchGranularity(t *testing.T) {
+	src := `
+package main
+
+var client = newClient()
+
+type Config struct {
+	Name string
+}
+
+func main() {
+	type local struct{}
+	run(newClient())
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		scope   string
+		pattern string
+		want    int
+	}{
+		{"file", "CallExpr {}", 3},
+		{"function", "CallExpr {}", 2},
+		{"package", "CallExpr {}", 0},
+		{"file", "TypeSpec {}", 2},
+		{"function", "TypeSpec {}", 1},
+		{"package", "TypeSpec {}", 1},
+		{"package", "FuncDecl {}", 1},
+		{"function", "FuncDecl {}", 0},
+		{"package", `ValueSpec { names: [$Name] }`, 1},
+	}
+	for _, tt := range tests {
+		g, err := ParseGranularity(tt.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetGranularity(g)
+		matches, err := matchPattern(t, m, tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		if len(matches) != tt.want {
+			t.Errorf("--scope %s, %s: expected %d matches, got %d", tt.scope, tt.pattern, tt.want, len(matches))
+		}
+	}
+
+	// A function-scoped match still knows its enclosing function
+	m.SetGranularity(GranularityFunction)
+	matches, _ := matchPattern(t, m, "CallExpr {}")
+	if fd := matches[0].EnclosingFunc(); fd == nil || fd.Name.Name != "main" {
+		t.Errorf("expected enclosing func main, got %v", fd)
+	}
+
+	if _, err := ParseGranularity("module"); err == nil {
+		t.Error("expected an error for an unknown scope")
+	}
+
+	t.Logf("✓ --scope limits where matching starts")
+}
+
+func matchPattern(t *testing.T, m *Matcher, pattern string) ([]Match, error) {
+	t.Helper()
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", "lift \"t\" {\n\tfrom go {\n\t\tmatch "+pattern+"\n\t}\n}\n")
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", pattern, err)
+	}
+	return m.MatchBlock(prog.Blocks[0])
+}
+
+func TestMatchEscapedStringLiteral(t *testing.T) {
+	src := `
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("say \"hi\"")
+	fmt.Println("say hi")
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "quoted-literal" {
+	from go {
+		match BasicLit { value: "\"say \\\"hi\\\"\"" }
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, err := m.MatchBlock(prog.Blocks[0])
+	if err != nil {
+		t.Fatalf("match failed: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 literal with escaped quotes, got %d", len(matches))
+	}
+
+	t.Logf("✓ Escaped string literal matched")
+}
+
+func TestOptimizeWhere(t *testing.T) {
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+	}
+	where {
+		not contains($Body, CallExpr { fun: "log.Println" })
+		$Name.matches("^Handle")
+	}
+	where {
+		$Name in ["HandleA", "HandleB"]
+		$Name.exported
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	where := OptimizeWhere(prog.Blocks[0].Where)
+	if len(where) != 1 {
+		t.Fatalf("expected where clauses merged into 1, got %d", len(where))
+	}
+
+	preds := where[0].Predicates
+	if len(preds) != 4 {
+		t.Fatalf("expected 4 predicates, got %d", len(preds))
+	}
+	if preds[0].PropCheck == nil || preds[1].MemberCheck == nil ||
+		preds[2].StringCheck == nil || preds[3].Not == nil {
+		t.Errorf("expected property, member, string, contains order, got %+v %+v %+v %+v",
+			preds[0], preds[1], preds[2], preds[3])
+	}
+
+	src := `
+package main
+
+func HandleA() { log.Println("a") }
+func HandleB() {}
+func handleC() {}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	inOrder := FilterMatches(matches, prog.Blocks[0].Where)
+	optimized := FilterMatches(matches, where)
+	if len(inOrder) != 1 || len(optimized) != 1 || optimized[0].Node != inOrder[0].Node {
+		t.Errorf("expected the same single match either way, got %d and %d", len(inOrder), len(optimized))
+	}
+
+	t.Logf("✓ Where predicates ordered cheapest first")
+}
+
+func TestTypeCheckImplements(t *testing.T) {
+	dir := t.TempDir()
+	src := `package tc
+
+import "io"
+
+type Store interface {
+	Get(key string) string
+}
+
+type File struct{}
+
+func (f *File) Read(p []byte) (int, error) { return 0, nil }
+
+type Cache struct{}
+
+func (c Cache) Get(key string) string { return key }
+func (c Cache) Error() string         { return "cache" }
+func (c Cache) String() string        { return "cache" }
+
+type Plain struct{}
+
+var _ io.Reader = (*File)(nil)
+`
+	path := filepath.Join(dir, "tc.go")
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/tc\n\ngo 1.22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+	if err := m.WithTypeCheck(nil); err != nil {
+		t.Fatalf("type check failed: %v", err)
+	}
+
+	tests := []struct {
+		iface string
+		want  []string
+	}{
+		{"io.Reader", []string{"File"}},
+		{"Store", []string{"Store", "Cache"}},
+		{"error", []string{"Cache"}},
+		{"io.Writer", nil},
+		{"fmt.Stringer", []string{"Cache"}}, // fmt isn't imported
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.iface, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", fmt.Sprintf(`
+lift "test" {
+	from go {
+		match TypeSpec { name: $Name }
+	}
+	where {
+		$Name.implements %q
+	}
+}
+`, tt.iface))
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			if !UsesTypes(prog.Blocks[0].Where) {
+				t.Errorf("expected where clause to need types")
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			var got []string
+			for _, match := range FilterMatches(matches, prog.Blocks[0].Where) {
+				got = append(got, match.Bindings["Name"].(*ast.Ident).Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v to implement %s, got %v", tt.want, tt.iface, got)
+			}
+		})
+	}
+
+	prog, err := parser.ParseString("test.lift", `
+lift "test" {
+	from go {
+		match TypeSpec { name: $Name }
+	}
+	where {
+		$Name.implements
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+	if _, err := m.MatchBlock(prog.Blocks[0]); err == nil || !strings.Contains(err.Error(), "needs an interface") {
+		t.Errorf("expected missing interface error, got %v", err)
+	}
+
+	plain, _ := New(src)
+	if err := plain.WithTypeCheck(nil); err == nil {
+		t.Errorf("expected type check without a file to fail")
+	}
+
+	t.Logf("✓ $X.implements checks interface satisfaction with go/types")
+}
+
+func TestPredicateDeps(t *testing.T) {
+	dir := t.TempDir()
+	src := `package tc
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+func Mixed(w http.ResponseWriter, db *sql.DB) {
+	rows, _ := db.Query("SELECT 1")
+	defer rows.Close()
+	w.WriteHeader(http.StatusOK)
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func Store(db *sql.DB) {
+	db.Close()
+}
+
+func Local() {
+	Store(nil)
+}
+`
+	path := filepath.Join(dir, "tc.go")
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/tc\n\ngo 1.22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+	if err := m.WithTypeCheck(nil); err != nil {
+		t.Fatalf("type check failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		where string
+		want  []string
+	}{
+		{"sql", `deps($Body) contains "database/sql"`, []string{"Mixed", "Store"}},
+		{"http", `deps($Body) contains "net/http"`, []string{"Mixed", "Handler"}},
+		{"mixed", `deps($Body) contains "database/sql"
+		deps($Body) contains "net/http"`, []string{"Mixed"}},
+		{"own package", `deps($Body) contains "example.com/tc"`, nil},
+		{"neither", `not deps($Body) contains "database/sql"
+		not deps($Body) contains "net/http"`, []string{"Local"}},
+	}
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", fmt.Sprintf(`
+lift "test" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+	}
+	where {
+		%s
+	}
+}
+`, tt.where))
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			if !UsesTypes(prog.Blocks[0].Where) {
+				t.Errorf("expected deps to need types")
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			var got []string
+			for _, match := range FilterMatches(matches, prog.Blocks[0].Where) {
+				got = append(got, match.Bindings["Name"].(*ast.Ident).Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Logf("✓ deps() finds the packages a node uses")
+}
+
+func TestNewFromFileParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.go")
+	if err := os.WriteFile(path, []byte("package p\n\nfunc Broken( {\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewFromFile(path)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected a *ParseError, got %T: %v", err, err)
+	}
+	if parseErr.Path != path {
+		t.Errorf("expected path %s, got %s", path, parseErr.Path)
+	}
+	if want := "parse error: " + path + ":3:14: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("expected error starting %q, got %q", want, err.Error())
+	}
+
+	// A file that can't be read isn't a parse error
+	if _, err := NewFromFile(filepath.Join(t.TempDir(), "missing.go")); errors.As(err, &parseErr) {
+		t.Errorf("expected a missing file not to be a parse error")
+	}
+
+	t.Logf("✓ Parse errors name the file")
+}
+
+func TestMatchMapAndChanTypes(t *testing.T) {
+	src := `
+package main
+
+type Event struct {
+	Meta    map[string]interface{}
+	Counts  map[string]int
+	Extra   map[int]interface{}
+	In      <-chan error
+	Out     chan<- string
+	Both    chan int
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		pattern string
+		want    int
+	}{
+		{`Field { type: MapType { key: "string" value: InterfaceType {} } }`, 1},
+		{`Field { type: MapType { key: "string" value: $V } }`, 2},
+		{`StructType { fields: FieldList { list: [_, _, _, _, _, _] } }`, 1},
+		{`MapType { key: $K value: InterfaceType {} }`, 2},
+		{`ChanType { dir: "RECV" }`, 1},
+		{`ChanType { dir: "SEND" value: "string" }`, 1},
+		{`ChanType { dir: "BOTH" }`, 1},
+		{`ChanType { dir: "SEND" value: "int" }`, 0},
+	}
+	for _, tt := range tests {
+		matches, err := matchPattern(t, m, tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		if len(matches) != tt.want {
+			t.Errorf("%s: expected %d match(es), got %d", tt.pattern, tt.want, len(matches))
+		}
+	}
+
+	// Printed patterns name the direction the same way
+	matches, _ := matchPattern(t, m, `ChanType { dir: "RECV" }`)
+	for _, match := range matches {
+		if got := FormatPattern(match.Node, 0); !strings.Contains(got, `dir: "RECV"`) {
+			t.Errorf("expected dir: \"RECV\" in %s", got)
+		}
+	}
+
+	t.Logf("✓ MapType and ChanType patterns match")
+}
+
+func TestMatchOr(t *testing.T) {
+	src := `
+package main
+
+import "net/http"
+
+func Fetch(client *http.Client) {
+	http.Get("a")
+	client.Get("b")
+	http.Post("c", "", nil)
+}
+
+func Other() {
+	http.Get("d")
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		from string
+		want int
+	}{
+		// Either form of Get
+		{`or_match {
+			match CallExpr { fun: SelectorExpr { x: Ident { name: "http" } sel: Ident { name: "Get" } } }
+			match CallExpr { fun: SelectorExpr { x: Ident { name: "client" } sel: Ident { name: "Get" } } }
+		}`, 3},
+		// A call both alternatives match is reported once
+		{`or_match {
+			match CallExpr { fun: SelectorExpr { sel: Ident { name: "Get" } } }
+			match CallExpr { fun: SelectorExpr { x: Ident { name: "http" } } }
+		}`, 4},
+		// Alternatives within a binding, per enclosing function
+		{`match FuncDecl { name: "Fetch" body: $Body }
+		or_match {
+			match CallExpr in $Body { fun: SelectorExpr { x: Ident { name: "http" } sel: Ident { name: "Get" } } }
+			match CallExpr in $Body { fun: SelectorExpr { x: Ident { name: "client" } } }
+		}`, 2},
+	}
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		prog, err := parser.ParseString("test.lift", "lift \"t\" {\n\tfrom go {\n"+tt.from+"\n\t}\n}\n")
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.from, err)
+		}
+		matches, err := m.MatchBlock(prog.Blocks[0])
+		if err != nil {
+			t.Fatalf("%s: %v", tt.from, err)
+		}
+		if len(matches) != tt.want {
+			t.Errorf("%s: expected %d match(es), got %d", tt.from, tt.want, len(matches))
+		}
+	}
+
+	prog, err := parser.ParseString("test.lift", `lift "t" {
+	from go {
+		or_match { match FuncDecl / Body / CallExpr {} }
+	}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.MatchBlock(prog.Blocks[0]); err == nil || !strings.Contains(err.Error(), "cannot be a path") {
+		t.Errorf("expected an error for a path alternative, got %v", err)
+	}
+
+	t.Logf("✓ or_match matches any alternative")
+}
+
+func TestPredicateMemberOfBinding(t *testing.T) {
+	src := `
+package main
+
+type (
+	User  struct{}
+	Order struct{}
+)
+
+type Store struct {
+	U    User
+	O    *Order
+	Name string
+}
+
+func lookup(id, name string) {}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	tests := []struct {
+		lift string
+		want int
+	}{
+		// Names of the specs of a type declaration
+		{`match GenDecl { tok: "type" specs: $Types... }
+		match Field { type: $FieldType }
+	} where { $FieldType in $Types }`, 1},
+		// Field names of a field list, reached through a field
+		{`match FuncDecl { name: $Name type: $Type }
+	} where { $Name in $Type.params }`, 0},
+		{`match FuncDecl { type: FuncType { params: $Params } }
+		match Ident { name: $Id }
+	} where { $Id in $Params }`, 2},
+		// An unbound set holds nothing
+		{`match Field { type: $FieldType }
+	} where { $FieldType in $Missing }`, 0},
+	}
+	var debug bytes.Buffer
+	Debug = &debug
+	defer func() { Debug = nil }()
+
+	parser, _ := grammar.NewParser()
+	for _, tt := range tests {
+		prog, err := parser.ParseString("test.lift", "lift \"t\" {\n\tfrom go {\n"+tt.lift+"\n}\n")
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.lift, err)
+		}
+		matches, err := m.MatchBlock(prog.Blocks[0])
+		if err != nil {
+			t.Fatalf("%s: %v", tt.lift, err)
+		}
+		if matches = FilterMatches(matches, prog.Blocks[0].Where); len(matches) != tt.want {
+			t.Errorf("%s: expected %d match(es), got %d", tt.lift, tt.want, len(matches))
+		}
+	}
+
+	if !strings.Contains(debug.String(), "$Missing is not bound") {
+		t.Errorf("expected a debug note for the unbound set, got:\n%s", debug.String())
+	}
+
+	t.Logf("✓ in predicates test against bound names")
+}
+
+func TestNewFromSource(t *testing.T) {
+	// The name needn't exist; positions and errors use it
+	m, err := NewFromSource("buffer/client.go", []byte("package p\n\nfunc F() {\n\tg()\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := matchPattern(t, m, "CallExpr {}")
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d (%v)", len(matches), err)
+	}
+	if pos := m.FileSet().Position(matches[0].Node.Pos()); pos.String() != "buffer/client.go:4:2" {
+		t.Errorf("expected buffer/client.go:4:2, got %s", pos)
+	}
+
+	var parseErr *ParseError
+	if _, err := NewFromSource("buffer/broken.go", []byte("package p\nfunc (")); !errors.As(err, &parseErr) || parseErr.Path != "buffer/broken.go" {
+		t.Errorf("expected a *ParseError for buffer/broken.go, got %v", err)
+	}
+}
+
+func TestPredicateNotPrecededBy(t *testing.T) {
+	src := `
+package main
+
+func checked(r io.ReadCloser) {
+	if r == nil {
+		return
+	}
+	defer r.Close()
+}
+
+func otherChecked(f, g *os.File) {
+	if g == nil {
+		return
+	}
+	defer f.Close()
+}
+
+func unchecked(resp *http.Response) {
+	defer resp.Body.Close()
+	if resp.Body != nil {
+	}
+}
+
+func checkedField(resp *http.Response) {
+	if resp.Body != nil {
+		log.Println("body")
+	}
+	defer resp.Body.Close()
+}
+
+func nested(r io.ReadCloser) {
+	if r != nil {
+		defer r.Close()
+	}
+}
+
+func unlock(mu *sync.Mutex) {
+	defer mu.Unlock()
+}
+`
+	closes := `match DeferStmt { call: CallExpr { fun: SelectorExpr { x: $Res sel: Ident { name: "Close" } } } }`
+
+	tests := []struct {
+		name  string
+		where string
+		want  []string
+	}{
+		{"all closes", "", []string{"checked", "otherChecked", "unchecked", "checkedField", "nested"}},
+		{
+			name:  "no nil check first",
+			where: `where { not_preceded_by(IfStmt { cond: BinaryExpr { x: $Res y: Ident { name: "nil" } } }) }`,
+			want:  []string{"otherChecked", "unchecked", "nested"},
+		},
+		{
+			name:  "nested pattern",
+			where: `where { not_preceded_by(BinaryExpr { x: $Res op: "!=" }) }`,
+			want:  []string{"checked", "otherChecked", "unchecked", "nested"},
+		},
+		{
+			name:  "negated",
+			where: `where { not not_preceded_by(IfStmt { cond: BinaryExpr { x: $Res } }) }`,
+			want:  []string{"checked", "checkedField"},
+		},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(src)
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			prog, err := parser.ParseString("test.lift", `lift "test" { from go { `+closes+` } `+tt.where+` }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			matches = FilterMatches(matches, prog.Blocks[0].Where)
+
+			var got []string
+			for _, match := range matches {
+				got = append(got, match.EnclosingFunc().Name.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Logf("✓ not_preceded_by looks only at earlier statements in the block")
+}
+
+func TestFormatPatternReparses(t *testing.T) {
+	src := `
+package main
+
+type Store struct {
+	db   *sql.DB ` + "`json:\"-\"`" + `
+	name string
+}
+
+func (s *Store) GetUser(ctx context.Context, id string) (*User, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT name FROM users WHERE id = $1", id)
+	var u User
+	if err := row.Scan(&u.Name); err != nil {
+		return nil, fmt.Errorf("get user %q:\n%w", id, err)
+	}
+	for i := 0; i < 3; i++ {
+		u.Tags = append(u.Tags, []string{"a", "b"}...)
+	}
+	return &u, nil
+}
+
+func noop() {}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+	parser, _ := grammar.NewParser()
+
+	for _, depth := range []int{0, 1, 3} {
+		for _, decl := range m.File().Decls {
+			pattern := FormatPattern(decl, depth)
+			prog, err := parser.ParseString("inspect.lift", "lift \"inspect\" {\n\tfrom go {\n\t\tmatch "+pattern+"\n\t}\n}\n")
+			if err != nil {
+				t.Fatalf("depth %d: output does not reparse: %v\n%s", depth, err, pattern)
+			}
+
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("depth %d: match failed: %v", depth, err)
+			}
+			if len(matches) != 1 || matches[0].Node != decl {
+				t.Errorf("depth %d: expected the pattern to match only its own declaration, got %d match(es)\n%s", depth, len(matches), pattern)
+			}
+		}
+	}
+
+	full := FormatPattern(m.File().Decls[1], 0)
+	for _, want := range []string{
+		`name: Ident { name: "GetUser" }`,
+		`recv: FieldList {`,
+		`tok: ":="`,
+		`value: "\"get user %q:\\n%w\""`,
+		`op: "<"`,
+	} {
+		if !strings.Contains(full, want) {
+			t.Errorf("expected output to contain %s\n%s", want, full)
+		}
+	}
+	for _, unwanted := range []string{"obj:", "pos:", "lbrace:", "doc:"} {
+		if strings.Contains(full, unwanted) {
+			t.Errorf("expected output to omit %s\n%s", unwanted, full)
+		}
+	}
+
+	if got, want := FormatPattern(m.File().Decls[2], 1), `type: FuncType { params: _ }`; !strings.Contains(got, want) {
+		t.Errorf("expected %s at depth 1, got %s", want, got)
+	}
+
+	t.Logf("✓ Printed patterns reparse and match their source")
+}
+
+func TestScaffoldGolden(t *testing.T) {
+	tests := []struct {
+		snippet  string
+		nodeType string
+		golden   string
+	}{
+		{"http_get.go", "CallExpr", "http_get.lift"},
+		{"handler.go", "FuncDecl", "handler.lift"},
+		{"config.go", "TypeSpec", "config.lift"},
+		{"loop.go", "RangeStmt", "loop.lift"},
+	}
+
+	parser, _ := grammar.NewParser()
+
+	for _, tt := range tests {
+		t.Run(tt.snippet, func(t *testing.T) {
+			m, err := NewFromFile(filepath.Join("..", "testdata", "scaffold", tt.snippet))
+			if err != nil {
+				t.Fatalf("failed to create matcher: %v", err)
+			}
+
+			got, err := m.Scaffold(tt.nodeType)
+			if err != nil {
+				t.Fatalf("scaffold failed: %v", err)
+			}
+
+			golden := filepath.Join("..", "testdata", "scaffold", tt.golden)
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("read golden (run go test -update to create it): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("scaffold differs from %s:\n%s", golden, got)
+			}
+
+			// The rule parses and matches the node it was made from
+			prog, err := parser.ParseString(tt.golden, got)
+			if err != nil {
+				t.Fatalf("scaffold does not parse: %v", err)
+			}
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			if len(matches) == 0 {
+				t.Errorf("expected the scaffold to match its own %s", tt.nodeType)
+			}
+		})
+	}
+
+	m, _ := New("package p\n")
+	if _, err := m.Scaffold("CallExpr"); err == nil || err.Error() != "no CallExpr in source" {
+		t.Errorf("expected no CallExpr in source, got %v", err)
+	}
+
+	t.Logf("✓ Scaffolded rules match their golden files")
+}
+
+func TestMatchFilteredStats(t *testing.T) {
+	m, err := New(benchmarkSource(20))
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("stats.lift", `
+lift "exported" {
+	from go {
+		match FuncDecl { name: $Name }
+	}
+	where {
+		$Name.exported
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+
+	matches, stats, err := m.MatchFiltered(prog.Blocks[0])
+	if err != nil {
+		t.Fatalf("match failed: %v", err)
+	}
+	if len(matches) != 2 || stats.Matches != 20 || stats.Kept != 2 {
+		t.Errorf("expected 2 of 20 matches kept, got %d (stats %+v)", len(matches), stats)
+	}
+	if stats.MatchTime <= 0 {
+		t.Errorf("expected matching to be timed, got %+v", stats)
+	}
+
+	var total Stats
+	total.Add(stats)
+	total.Add(stats)
+	if total.Matches != 40 || total.Kept != 4 || total.MatchTime != 2*stats.MatchTime {
+		t.Errorf("expected Add to sum, got %+v", total)
+	}
+
+	t.Logf("✓ MatchFiltered reports counts and timings")
+}
+
+// benchmarkSource returns a file of n functions; only every tenth one is
+// exported, and each makes a few calls for contains to walk.
+func benchmarkSource(n int) string {
+	var b strings.Builder
+	b.WriteString("package main\n")
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("handle%d", i)
+		if i%10 == 0 {
+			name = fmt.Sprintf("Handle%d", i)
+		}
+		fmt.Fprintf(&b, "\nfunc %s(items []int) {\n", name)
+		b.WriteString("\tfor _, v := range items {\n\t\tif v > 0 {\n\t\t\tprocess(v)\n\t\t}\n\t}\n")
+		b.WriteString("\tlog.Println(len(items))\n}\n")
+	}
+	return b.String()
+}
+
+// benchmarkSizes are the numbers of functions in the generated sources
+// the matcher benchmarks run against.
+var benchmarkSizes = []int{10, 100, 1000}
+
+// benchmarkMatch runs the first block of lift against benchmarkSource(n)
+// for each of benchmarkSizes, failing unless it finds want(n) matches.
+func benchmarkMatch(b *testing.B, lift string, want func(n int) int) {
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("bench.lift", lift)
+	if err != nil {
+		b.Fatalf("failed to parse lift: %v", err)
+	}
+	block := prog.Blocks[0]
+
+	for _, n := range benchmarkSizes {
+		m, err := New(benchmarkSource(n))
+		if err != nil {
+			b.Fatalf("failed to create matcher: %v", err)
+		}
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matches, err := m.MatchBlock(block)
+				if err != nil {
+					b.Fatalf("match failed: %v", err)
+				}
+				if len(matches) != want(n) {
+					b.Fatalf("expected %d matches, got %d", want(n), len(matches))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatchFuncDecl(b *testing.B) {
+	benchmarkMatch(b, `
+lift "bench" {
+	from go {
+		match FuncDecl {
+			name: $Name
+			type: FuncType { params: $Params... }
+			body: $Body
+		}
+	}
+}
+`, func(n int) int { return n })
+}
+
+// BenchmarkMatchDeepCallExpr finds the call nested three statements deep
+// in each function's body.
+func BenchmarkMatchDeepCallExpr(b *testing.B) {
+	benchmarkMatch(b, `
+lift "bench" {
+	from go {
+		match FuncDecl { body: $Body }
+		match CallExpr in $Body {
+			fun: Ident { name: "process" }
+			args: [$Arg]
+		}
+	}
+}
+`, func(n int) int { return n })
+}
+
+// BenchmarkCrossJoin matches every function against every exported one,
+// N×N/10 combinations, since the matchers share no binding.
+func BenchmarkCrossJoin(b *testing.B) {
+	benchmarkMatch(b, `
+lift "bench" {
+	from go {
+		match FuncDecl { name: $Caller }
+		match FuncDecl { name: "Handle*" type: FuncType { params: [Field { type: ArrayType { elt: "int" } }] } }
+	}
+}
+`, func(n int) int { return n * n / 10 })
+}
+
+func BenchmarkFilterMatches(b *testing.B) {
+	parser, _ := grammar.NewParser()
+	prog, err := parser.ParseString("bench.lift", `
+lift "bench" {
+	from go {
+		match FuncDecl { name: $Name body: $Body }
+	}
+	where {
+		not contains($Body, CallExpr { fun: "http.Get" })
+		$Name.exported
+	}
+}
+`)
+	if err != nil {
+		b.Fatalf("failed to parse lift: %v", err)
+	}
+
+	for _, n := range benchmarkSizes {
+		m, err := New(benchmarkSource(n))
+		if err != nil {
+			b.Fatalf("failed to create matcher: %v", err)
+		}
+		matches, err := m.MatchBlock(prog.Blocks[0])
+		if err != nil {
+			b.Fatalf("match failed: %v", err)
+		}
+
+		for _, bc := range []struct {
+			name  string
+			where []*grammar.WhereClause
+		}{
+			{"in-order", prog.Blocks[0].Where},
+			{"optimized", OptimizeWhere(prog.Blocks[0].Where)},
+		} {
+			b.Run(fmt.Sprintf("n=%d/%s", n, bc.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if got := FilterMatches(matches, bc.where); len(got) != n/10 {
+						b.Fatalf("expected %d matches, got %d", n/10, len(got))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	src := `
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/acme/api"
+	"github.com/acme/api/v2/client"
+)
+
+func TestGet(t *testing.T)    {}
+func TestPost(t *testing.T)   {}
+func BenchmarkGet(b *testing.B) {}
+
+func handle(ctx context.Context, c *client.Client) {
+	api.Get(ctx)
+	api.Post(ctx)
+	api.Delete(ctx)
+	fmt.Println("user:created", "order:created", "*", "a*b")
+	_ = 2 * 3
+}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	tests := []struct {
+		name    string
+		pattern string
+		want    int
+	}{
+		{"ident prefix", `match FuncDecl { name: "Test*" }`, 2},
+		{"ident suffix", `match SelectorExpr { sel: "*Context" }`, 1},
+		{"single character", `match FuncDecl { name: "Test????" }`, 1},
+		{"character class", `match FuncDecl { name: "[BT]*Get" }`, 2},
+		{"string literal contents", `match BasicLit { value: "\"*:created\"" }`, 2},
+		{"escaped star", `match BasicLit { value: "\"\\*\"" }`, 1},
+		{"escaped star inside", `match BasicLit { value: "\"a\\*b\"" }`, 1},
+		{"import path", `match ImportSpec { path: BasicLit { value: "\"github.com/acme/*\"" } }`, 1},
+		{"import path subtree", `match ImportSpec { path: BasicLit { value: "\"github.com/acme/*/*/*\"" } }`, 1},
+		{"operator is exact", `match BinaryExpr { op: "*" }`, 1},
+		{"operator glob", `match BinaryExpr { op: "?" }`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "glob" { from go { `+tt.pattern+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			matches, err := m.MatchBlock(prog.Blocks[0])
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			if len(matches) != tt.want {
+				t.Errorf("%s: got %d matches, want %d", tt.pattern, len(matches), tt.want)
+			}
+		})
+	}
+
+	prog, err := parser.ParseString("test.lift", `
+lift "glob-member" {
+	from go {
+		match CallExpr { fun: SelectorExpr { x: Ident { name: "api" } sel: $CallName } }
+	}
+	where {
+		$CallName in ["Get*", "Po?t"]
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("failed to parse lift: %v", err)
+	}
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	matches = FilterMatches(matches, prog.Blocks[0].Where)
+	if len(matches) != 2 {
+		t.Fatalf("expected Get and Post to be in the globs, got %d matches", len(matches))
+	}
+
+	t.Logf("✓ Globs match names, string literals and import paths")
+}
+
+func TestMatchStructTags(t *testing.T) {
+	src := "package main\n\ntype User struct {\n" +
+		"\tID       int    `json:\"id\" db:\"id\"`\n" +
+		"\tPassword string `json:\"-\" db:\"password\"`\n" +
+		"\tToken    string `json:\"-\"`\n" +
+		"\tNotes    string\n" +
+		"\tBroken   string `json:\"broken`\n" +
+		"}\n"
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	tests := []struct {
+		name  string
+		lift  string
+		names []string
+	}{
+		{"exact value", `match Field { names: [$Name] tag: { json: "-" } }`, []string{"Password", "Token"}},
+		{"missing key", `match Field { names: [$Name] tag: { db: nil } }`, []string{"Token", "Notes", "Broken"}},
+		{"any value", `match Field { names: [$Name] tag: { db: _ } }`, []string{"ID", "Password"}},
+		{"glob value", `match Field { names: [$Name] tag: { db: "pass*" } }`, []string{"Password"}},
+		{"two keys", `match Field { names: [$Name] tag: { json: "-" db: nil } }`, []string{"Token"}},
+		{"empty pattern", `match Field { names: [$Name] tag: {} }`, []string{"ID", "Password", "Token", "Notes", "Broken"}},
+		{"has tag", `match Field { names: [$Name] } } where { $_match.hasTag("db") `, []string{"ID", "Password"}},
+		{"lacks tag", `match Field { names: [$Name] } } where { not $_match.hasTag("json") `, []string{"Notes", "Broken"}},
+		{"tag equals", `match Field { names: [$Name] tag: $Tag } } where { $Tag.tag("json") == "-" `, []string{"Password", "Token"}},
+		{"tag differs", `match Field { names: [$Name] } } where { $_match.tag("json") != "-" `, []string{"ID", "Notes", "Broken"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "tags" { from go { `+tt.lift+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			block := prog.Blocks[0]
+			matches, err := m.MatchBlock(block)
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			var names []string
+			for _, match := range FilterMatches(matches, block.Where) {
+				names = append(names, match.Bindings["Name"].(*ast.Ident).Name)
+			}
+			if !slices.Equal(names, tt.names) {
+				t.Errorf("got %v, want %v", names, tt.names)
+			}
+		})
+	}
+
+	// Tag values bind to the key's value
+	prog, _ := parser.ParseString("test.lift", `lift "t" { from go { match Field { tag: { db: $Column json: "-" } } } }`)
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 1 || matches[0].Bindings["Column"] != "password" {
+		t.Errorf("expected $Column = password, got %v", matches)
+	}
+
+	for _, lift := range []string{
+		`match Field { tag: { db: Ident { name: "x" } } }`,
+		`match Field { tag: $T } } where { $T.tag("db") `,
+		`match Field { tag: $T } } where { $T.hasTag("db") == "x" `,
+	} {
+		prog, err := parser.ParseString("test.lift", `lift "bad" { from go { `+lift+` } }`)
+		if err != nil {
+			t.Fatalf("failed to parse lift: %v", err)
+		}
+		if _, err := m.MatchBlock(prog.Blocks[0]); err == nil {
+			t.Errorf("expected %s to be rejected", lift)
+		}
+	}
+
+	t.Logf("✓ Struct tags match by key")
+}
+
+func TestMatchComments(t *testing.T) {
+	src := `package main
+
+// Get fetches a user.
+//
+// Deprecated: use Fetch.
+func Get() {}
+
+// Fetch fetches a user.
+func Fetch() {}
+
+func Undocumented() {}
+
+/* Legacy is
+   DEPRECATED too. */
+func Legacy() {}
+
+type Config struct {
+	// Addr is where to listen.
+	Addr string
+	Port int // TODO: validate
+	Host string
+}
+
+// Mode is how the server runs.
+type Mode int
+
+type (
+	// Level is a log level.
+	Level int
+	Plain int
+)
+
+// Timeout is the deadline.
+// Deprecated: set it per request.
+var Timeout = 5
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	tests := []struct {
+		name  string
+		lift  string
+		names []string
+	}{
+		{"doc text", `match FuncDecl { name: $Name doc: $Doc } } where { $Doc.text.matches("(?i)deprecated") `, []string{"Get", "Legacy"}},
+		{"declaration text", `match FuncDecl { name: $Name } } where { $_match.text.hasPrefix("Fetch fetches") `, []string{"Fetch"}},
+		{"text lines", `match FuncDecl { name: $Name } } where { $_match.text.matches("(?m)^Deprecated: use Fetch\\.$") `, []string{"Get"}},
+		{"has_doc", `match FuncDecl { name: $Name } } where { not $_match.has_doc `, []string{"Undocumented"}},
+		{"doc is nil", `match FuncDecl { name: $Name doc: $Doc } } where { $Doc == nil `, []string{"Undocumented"}},
+		{"doc is not nil", `match Field { names: [$Name] doc: $Doc } } where { $Doc != nil `, []string{"Addr"}},
+		{"doc pattern nil", `match Field { names: [$Name] doc: nil } `, []string{"Port", "Host"}},
+		{"trailing comment", `match Field { names: [$Name] comment: $C } } where { $C.text.hasPrefix("TODO") `, []string{"Port"}},
+		{"spec has_doc", `match TypeSpec { name: $Name } } where { $_match.has_doc `, []string{"Mode", "Level"}},
+		{"spec without doc", `match TypeSpec { name: $Name } } where { not $_match.has_doc `, []string{"Config", "Plain"}},
+		{"spec doc binding", `match TypeSpec { name: $Name doc: $Doc } } where { $Doc != nil `, []string{"Mode", "Level"}},
+		{"spec text", `match ValueSpec { names: [$Name] } } where { $_match.text.matches("(?m)^Deprecated:") `, []string{"Timeout"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "comments" { from go { `+tt.lift+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			block := prog.Blocks[0]
+			matches, err := m.MatchBlock(block)
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			var names []string
+			for _, match := range FilterMatches(matches, block.Where) {
+				names = append(names, match.Bindings["Name"].(*ast.Ident).Name)
+			}
+			if !slices.Equal(names, tt.names) {
+				t.Errorf("got %v, want %v", names, tt.names)
+			}
+		})
+	}
+
+	t.Logf("✓ Doc and trailing comments match")
+}
+
+func TestMatchImport(t *testing.T) {
+	src := `package main
+
+import (
+	"fmt"
+	. "strings"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/internal/auth"
+	_ "github.com/lib/pq"
+)
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	tests := []struct {
+		name  string
+		lift  string
+		paths []string
+	}{
+		{"exact path", `match Import { path: "github.com/pkg/errors" }`, []string{"github.com/pkg/errors"}},
+		{"glob path", `match Import { path: "github.com/*/*" }`, []string{"github.com/pkg/errors", "github.com/internal/auth", "github.com/lib/pq"}},
+		{"no alias", `match Import { alias: nil }`, []string{"fmt", "github.com/internal/auth"}},
+		{"alias binding", `match Import { alias: $Alias } } where { $Alias == "." `, []string{"strings"}},
+		{"not dot", `match Import { alias: $Alias } } where { $Alias != "." `, []string{"fmt", "github.com/pkg/errors", "github.com/internal/auth", "github.com/lib/pq"}},
+		{"alias nil check", `match Import { alias: $Alias } } where { $Alias == nil `, []string{"fmt", "github.com/internal/auth"}},
+		{"path prefix", `match Import { path: $Path } } where { $Path.hasPrefix("github.com/internal") `, []string{"github.com/internal/auth"}},
+		{"blank import", `match Import { alias: "_" }`, []string{"github.com/lib/pq"}},
+		{"ImportSpec is unchanged", `match ImportSpec { path: BasicLit { value: "\"fmt\"" } }`, []string{"fmt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "imports" { from go { `+tt.lift+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			block := prog.Blocks[0]
+			matches, err := m.MatchBlock(block)
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			var paths []string
+			for _, match := range FilterMatches(matches, block.Where) {
+				if spec, ok := match.Node.(*ast.ImportSpec); ok {
+					paths = append(paths, strings.Trim(spec.Path.Value, `"`))
+				}
+			}
+			if !slices.Equal(paths, tt.paths) {
+				t.Errorf("got %v, want %v", paths, tt.paths)
+			}
+		})
+	}
+
+	// Import works as a nested pattern too
+	prog, _ := parser.ParseString("test.lift", `lift "t" { from go { match GenDecl { specs: [_, Import { alias: "." }, _, _, _] } } }`)
+	if matches, _ := m.MatchBlock(prog.Blocks[0]); len(matches) != 1 {
+		t.Errorf("expected the import block to match, got %d matches", len(matches))
+	}
+
+	// The bound path is unquoted and the alias a string
+	prog, _ = parser.ParseString("test.lift", `lift "t" { from go { match Import { path: $Path alias: $Alias } } }`)
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 5 || matches[2].Bindings["Path"] != "github.com/pkg/errors" || matches[2].Bindings["Alias"] != "pkgerrors" {
+		t.Errorf("expected $Path and $Alias as strings, got %v", matches)
+	}
+
+	t.Logf("✓ Import patterns match unquoted paths and aliases")
+}
+
+func TestMatchInterfaceMethods(t *testing.T) {
+	src := `package main
+
+import "io"
+
+type Store interface {
+	io.Closer
+	Get(id int64) (string, error)
+	Put(id int64, v string) error
+	Delete(id int64) error
+	List() []string
+}
+
+type Small interface {
+	Get(id int64) string
+}
+
+type Empty interface{}
+`
+	m, err := New(src)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+
+	parser, _ := grammar.NewParser()
+	tests := []struct {
+		name  string
+		lift  string
+		names []string
+	}{
+		{"more than 3 methods", `match TypeSpec { name: $Name type: InterfaceType { methods: $Methods... } } } where { len($Methods) > 3`, []string{"Store"}},
+		{"embeds", `match TypeSpec { name: $Name type: InterfaceType { embeds: $Embeds... } } } where { len($Embeds) > 0`, []string{"Store"}},
+		{"no methods", `match TypeSpec { name: $Name type: InterfaceType { methods: [] } }`, []string{"Empty"}},
+		{"method list", `match TypeSpec { name: $Name type: InterfaceType { methods: [Field { names: ["Get"] }] } }`, []string{"Small"}},
+		{"bounded spread", `match TypeSpec { name: $Name type: InterfaceType { methods: $Methods...(min=1,max=2) } }`, []string{"Small"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.ParseString("test.lift", `lift "ifaces" { from go { `+tt.lift+` } }`)
+			if err != nil {
+				t.Fatalf("failed to parse lift: %v", err)
+			}
+			block := prog.Blocks[0]
+			matches, err := m.MatchBlock(block)
+			if err != nil {
+				t.Fatalf("match failed: %v", err)
+			}
+			var names []string
+			for _, match := range FilterMatches(matches, block.Where) {
+				names = append(names, match.Node.(*ast.TypeSpec).Name.Name)
+			}
+			if !slices.Equal(names, tt.names) {
+				t.Errorf("got %v, want %v", names, tt.names)
+			}
+		})
+	}
+
+	// The spread holds one field per method, the embedded type apart
+	prog, _ := parser.ParseString("test.lift", `lift "t" { from go { match TypeSpec { name: "Store" type: InterfaceType { methods: $Methods... embeds: $Embeds... } } } }`)
+	matches, _ := m.MatchBlock(prog.Blocks[0])
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
+	methods, _ := matches[0].Bindings["Methods"].([]*ast.Field)
+	embeds, _ := matches[0].Bindings["Embeds"].([]*ast.Field)
+	if len(methods) != 4 || methods[0].Names[0].Name != "Get" || len(embeds) != 1 {
+		t.Errorf("expected 4 methods and 1 embed, got %d and %d", len(methods), len(embeds))
+	}
+
+	t.Logf("✓ InterfaceType patterns split methods from embedded types")
+}
@@ -0,0 +1,185 @@
+package matcher
+
+import (
+	"go/ast"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// inlineWidth is the longest pattern FormatPattern keeps on one line.
+const inlineWidth = 72
+
+var (
+	nodeType         = reflect.TypeOf((*ast.Node)(nil)).Elem()
+	commentGroupType = reflect.TypeOf((*ast.CommentGroup)(nil))
+	tokenType        = reflect.TypeOf(token.ILLEGAL)
+	chanDirType      = reflect.TypeOf(ast.SEND)
+)
+
+// FormatPattern prints n in the pattern syntax of .lift files, so that
+// the output, used as a match, matches n:
+//
+//	FuncDecl { name: Ident { name: "GetUser" } type: FuncType { ... } }
+//
+// Fields are named as the matcher reads them, strings and tokens are
+// quoted, and positions, comments and resolver objects are left out.
+// Nodes nested more than depth levels below n print as _; depth 0 means
+// no limit.
+func FormatPattern(n ast.Node, depth int) string {
+	p := patternPrinter{depth: depth}
+	out, _ := p.value(reflect.ValueOf(n), 0, "")
+	return out
+}
+
+type patternPrinter struct {
+	depth int
+
+	// scaffold prints a starting point for a rule rather than an exact
+	// pattern; see Scaffold for what changes.
+	scaffold bool
+	bound    map[string]int // times each field has been bound
+	bindings []string       // the bindings made, in order
+}
+
+// value formats v at the given nesting level, for a line starting with
+// indent. It reports false for values patterns cannot express.
+func (p *patternPrinter) value(v reflect.Value, level int, indent string) (string, bool) {
+	switch {
+	case v.Kind() == reflect.Interface:
+		if v.IsNil() {
+			return "", false
+		}
+		return p.value(v.Elem(), level, indent)
+	case p.scaffold && v.Type() == reflect.TypeOf((*ast.Ident)(nil)) && !v.IsNil():
+		return strconv.Quote(v.Interface().(*ast.Ident).Name), true
+	case p.scaffold && v.Type() == reflect.TypeOf((*ast.SelectorExpr)(nil)) && !v.IsNil():
+		if path, ok := selectorPath(v.Interface().(*ast.SelectorExpr)); ok {
+			return strconv.Quote(path), true
+		}
+		return p.node(v.Elem(), level, indent), true
+	case v.Type() == tokenType:
+		return strconv.Quote(v.Interface().(token.Token).String()), true
+	case v.Type() == chanDirType:
+		return strconv.Quote(chanDirs[v.Interface().(ast.ChanDir)]), true
+	case v.Kind() == reflect.String:
+		return strconv.Quote(v.String()), true
+	case v.Kind() == reflect.Slice && v.Type().Elem().Implements(nodeType):
+		return p.list(v, level, indent), true
+	case v.Kind() == reflect.Ptr && v.Type().Implements(nodeType) && v.Type() != commentGroupType:
+		if v.IsNil() {
+			return "", false
+		}
+		if p.depth > 0 && level > p.depth {
+			return "_", true
+		}
+		return p.node(v.Elem(), level, indent), true
+	}
+	return "", false
+}
+
+// node formats the struct behind an AST node pointer.
+func (p *patternPrinter) node(v reflect.Value, level int, indent string) string {
+	var fields []string
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if b, ok := p.binding(f.Name, v.Field(i)); ok {
+			fields = append(fields, liftFieldName(f.Name)+": "+b)
+			continue
+		}
+		if s, ok := p.value(v.Field(i), level+1, indent+"\t"); ok {
+			fields = append(fields, liftFieldName(f.Name)+": "+s)
+		}
+	}
+
+	name := v.Type().Name()
+	if len(fields) == 0 {
+		return name + " { }"
+	}
+	if line := name + " { " + strings.Join(fields, " ") + " }"; fits(line, indent) {
+		return line
+	}
+	return name + " {\n" + indent + "\t" + strings.Join(fields, "\n"+indent+"\t") + "\n" + indent + "}"
+}
+
+// scaffoldBindings are the fields Scaffold turns into bindings: the
+// parts of a declaration or call a rule usually goes on to inspect or
+// rewrite.
+var scaffoldBindings = map[string]bool{
+	"Name":    true,
+	"Recv":    true,
+	"Params":  true,
+	"Results": true,
+	"Body":    true,
+	"Args":    true,
+}
+
+// binding returns $Field for a field that is a capture point when
+// scaffolding, numbering repeats ($Body2) so each binding stays distinct.
+// Only nodes and lists of nodes are bound; the string Name of an Ident
+// is left as it is.
+func (p *patternPrinter) binding(field string, v reflect.Value) (string, bool) {
+	if !p.scaffold || !scaffoldBindings[field] {
+		return "", false
+	}
+	switch {
+	case v.Kind() == reflect.Slice && v.Type().Elem().Implements(nodeType):
+	case (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() && v.Type().Implements(nodeType):
+	default:
+		return "", false
+	}
+
+	p.bound[field]++
+	name := "$" + field
+	if n := p.bound[field]; n > 1 {
+		name += strconv.Itoa(n)
+	}
+	p.bindings = append(p.bindings, name)
+	return name, true
+}
+
+// selectorPath returns a selector chain of plain identifiers, such as
+// http.Get or s.client.Do, as a dotted path.
+func selectorPath(sel *ast.SelectorExpr) (string, bool) {
+	switch x := sel.X.(type) {
+	case *ast.Ident:
+		return x.Name + "." + sel.Sel.Name, true
+	case *ast.SelectorExpr:
+		path, ok := selectorPath(x)
+		return path + "." + sel.Sel.Name, ok
+	}
+	return "", false
+}
+
+// list formats a slice of nodes.
+func (p *patternPrinter) list(v reflect.Value, level int, indent string) string {
+	var elems []string
+	for i := 0; i < v.Len(); i++ {
+		if s, ok := p.value(v.Index(i), level, indent+"\t"); ok {
+			elems = append(elems, s)
+		}
+	}
+
+	if line := "[" + strings.Join(elems, ", ") + "]"; fits(line, indent) {
+		return line
+	}
+	return "[\n" + indent + "\t" + strings.Join(elems, ",\n"+indent+"\t") + "\n" + indent + "]"
+}
+
+// fits reports whether s can stay on a line starting with indent.
+func fits(s, indent string) bool {
+	return !strings.Contains(s, "\n") && len(indent)*4+len(s) <= inlineWidth
+}
+
+// liftFieldName is the .lift spelling of a Go AST field name; see
+// mapFieldName, which maps it back.
+func liftFieldName(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[size:]
+}
@@ -0,0 +1,60 @@
+package matcher
+
+import (
+	"fmt"
+	"go/ast"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Scaffold returns a .lift file to start a rule from: one block, named
+// after the source file, matching the first node of type nodeType in it.
+// The pattern is the node as FormatPattern prints it, loosened so it
+// matches more than the example it came from:
+//
+//   - an identifier becomes its name as an exact string, and a selector
+//     chain of identifiers a dotted path, as in fun: "http.Get"
+//   - name, recv, params, results, body and args fields become bindings
+//     ($Name, $Body, ...) instead of being spelled out, so their contents
+//     are free to differ; a repeated name is numbered ($Body2)
+//
+// The where clause, which lists the bindings, and the actions are left
+// as stubs to fill in.
+func (m *Matcher) Scaffold(nodeType string) (string, error) {
+	var found ast.Node
+	ast.Inspect(m.file, func(n ast.Node) bool {
+		if found == nil && n != nil && nodeTypeMatches(n, nodeType) {
+			found = n
+		}
+		return found == nil
+	})
+
+	source := "source"
+	name := "rule"
+	if m.path != "" {
+		source = filepath.Base(m.path)
+		name = strings.TrimSuffix(source, filepath.Ext(source))
+	}
+	if found == nil {
+		return "", fmt.Errorf("no %s in %s", nodeType, source)
+	}
+
+	p := patternPrinter{scaffold: true, bound: make(map[string]int)}
+	pattern := p.node(reflect.ValueOf(found).Elem(), 0, "\t\t")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %s.lift\n", name)
+	fmt.Fprintf(&b, "//\n// Scaffolded from the first %s in %s. Narrow the pattern, then\n", nodeType, source)
+	b.WriteString("// add where predicates and an action.\n\n")
+	fmt.Fprintf(&b, "lift %q {\n", name)
+	fmt.Fprintf(&b, "\tfrom go {\n\t\tmatch %s\n\t}\n\n", pattern)
+	if len(p.bindings) > 0 {
+		fmt.Fprintf(&b, "\twhere {\n\t\t// predicates on %s\n\t}\n\n", strings.Join(p.bindings, ", "))
+	} else {
+		b.WriteString("\twhere {\n\t\t// predicates on $_match, the matched node\n\t}\n\n")
+	}
+	b.WriteString("\t// patch { ... }, insert code { ... } or emit go { ... }\n")
+	b.WriteString("}\n")
+	return b.String(), nil
+}
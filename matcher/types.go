@@ -0,0 +1,283 @@
+package matcher
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/vinodhalaharvi/stencil/grammar"
+)
+
+// BindTypes is the implicit binding holding the type information of a
+// matcher set up with WithTypeCheck, which $X.implements consults.
+const BindTypes = "_types"
+
+// typeInfo is the type-checked package of the matcher's file.
+type typeInfo struct {
+	pkg  *types.Package
+	info *types.Info
+
+	// Packages named by implements that the file's package doesn't
+	// depend on, loaded on first use
+	conf   packages.Config
+	extern map[string]*types.Package
+}
+
+// WithTypeCheck loads the package containing the matcher's file with
+// go/packages and type-checks it, so predicates such as
+// $Name.implements "io.Reader" can use go/types. conf may be nil; its
+// Mode, Fset and ParseFile are overridden so that the type information
+// refers to the matcher's own AST. The matcher must come from NewFromFile
+// or NewFromSource.
+func (m *Matcher) WithTypeCheck(conf *packages.Config) error {
+	if m.path == "" {
+		return fmt.Errorf("type checking needs a source file: use NewFromFile or NewFromSource")
+	}
+	abs, err := filepath.Abs(m.path)
+	if err != nil {
+		return err
+	}
+
+	var cfg packages.Config
+	if conf != nil {
+		cfg = *conf
+	}
+	cfg.Mode |= packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+		packages.NeedTypes | packages.NeedTypesInfo | packages.NeedImports | packages.NeedDeps
+	cfg.Fset = m.fset
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Dir(abs)
+	}
+
+	// Hand the loader our AST for our file, so types.Info is keyed by the
+	// nodes bindings hold
+	parse := cfg.ParseFile
+	cfg.ParseFile = func(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
+		if filepath.Clean(filename) == abs {
+			return m.file, nil
+		}
+		if parse != nil {
+			return parse(fset, filename, src)
+		}
+		return parser.ParseFile(fset, filename, src, parser.ParseComments)
+	}
+
+	pkgs, err := packages.Load(&cfg, "file="+abs)
+	if err != nil {
+		return fmt.Errorf("type check %s: %w", m.path, err)
+	}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Syntax {
+			if f != m.file {
+				continue
+			}
+			if len(pkg.Errors) > 0 {
+				return fmt.Errorf("type check %s: %v", m.path, pkg.Errors[0])
+			}
+			m.types = &typeInfo{
+				pkg:    pkg.Types,
+				info:   pkg.TypesInfo,
+				conf:   packages.Config{Dir: cfg.Dir, Env: cfg.Env, Context: cfg.Context},
+				extern: make(map[string]*types.Package),
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("type check %s: no package contains the file", m.path)
+}
+
+// UsesTypes reports whether any where clause needs type information,
+// i.e. the matcher should be set up with WithTypeCheck.
+func UsesTypes(whereClauses []*grammar.WhereClause) bool {
+	for _, where := range whereClauses {
+		for _, pred := range where.Predicates {
+			if predUsesTypes(pred) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func predUsesTypes(pred *grammar.Predicate) bool {
+	switch {
+	case pred.Not != nil:
+		return predUsesTypes(pred.Not)
+	case pred.Group != nil:
+		for _, p := range pred.Group.Predicates {
+			if predUsesTypes(p) {
+				return true
+			}
+		}
+	case pred.DepsCheck != nil:
+		return true
+	case pred.PropCheck != nil:
+		return pred.PropCheck.Property == "implements"
+	}
+	return false
+}
+
+// evalImplements reports whether the type bound to pred.Binding, or a
+// pointer to it, satisfies the interface named by pred.Arg: "io.Reader"
+// for an interface in a package the file's package depends on, or
+// "Store" for one in the package itself. Without type information, or
+// if the interface can't be found, it is false.
+func evalImplements(pred *grammar.PropertyPred, bindings Bindings) bool {
+	t, _ := bindings[BindTypes].(*typeInfo)
+	if t == nil || pred.Arg == nil {
+		return false
+	}
+	typ := t.typeOf(bindings[pred.Binding])
+	iface := t.lookupInterface(*pred.Arg)
+	if typ == nil || iface == nil {
+		return false
+	}
+	if types.Implements(typ, iface) {
+		return true
+	}
+	_, isPtr := typ.(*types.Pointer)
+	return !isPtr && !types.IsInterface(typ) && types.Implements(types.NewPointer(typ), iface)
+}
+
+// evalDeps reports whether the node bound to pred.Binding depends on the
+// package pred.Path. Without type information it is false.
+func evalDeps(pred *grammar.DepsPred, bindings Bindings) bool {
+	t, _ := bindings[BindTypes].(*typeInfo)
+	if t == nil {
+		return false
+	}
+	return t.deps(bindings[pred.Binding])[pred.Path]
+}
+
+// deps returns the import paths of the packages whose names, functions,
+// types, methods or fields are used within v, a node or a list of them.
+// A call to sql.Open, but also
+// db.Query on a *sql.DB, depends on database/sql. The file's own package
+// isn't included.
+func (t *typeInfo) deps(v any) map[string]bool {
+	items := []any{v}
+	if _, ok := v.(ast.Node); !ok {
+		items = toSlice(v)
+	}
+
+	paths := make(map[string]bool)
+	for _, item := range items {
+		root, ok := item.(ast.Node)
+		if !ok || reflect.ValueOf(root).IsNil() {
+			continue
+		}
+		ast.Inspect(root, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			switch obj := t.info.Uses[ident].(type) {
+			case nil:
+			case *types.PkgName:
+				paths[obj.Imported().Path()] = true
+			default:
+				if pkg := obj.Pkg(); pkg != nil && pkg != t.pkg {
+					paths[pkg.Path()] = true
+				}
+			}
+			return true
+		})
+	}
+	return paths
+}
+
+// typeOf returns the type a bound node denotes or has.
+func (t *typeInfo) typeOf(v any) types.Type {
+	switch n := v.(type) {
+	case *ast.Ident:
+		if obj := t.info.ObjectOf(n); obj != nil {
+			return obj.Type()
+		}
+	case *ast.TypeSpec:
+		if obj := t.info.Defs[n.Name]; obj != nil {
+			return obj.Type()
+		}
+	case *ast.Field:
+		return t.info.TypeOf(n.Type)
+	case ast.Expr:
+		return t.info.TypeOf(n)
+	}
+	return nil
+}
+
+// lookupInterface finds a named interface type, searching the package's
+// scope and the universe (for error), or for a qualified name, everything
+// the package imports and then the named package itself.
+func (t *typeInfo) lookupInterface(name string) *types.Interface {
+	var obj types.Object
+	if path, typeName, ok := cutLast(name, "."); ok {
+		pkg := findImport(t.pkg, path, make(map[*types.Package]bool))
+		if pkg == nil {
+			pkg = t.load(path)
+		}
+		if pkg != nil {
+			obj = pkg.Scope().Lookup(typeName)
+		}
+	} else if obj = t.pkg.Scope().Lookup(name); obj == nil {
+		obj = types.Universe.Lookup(name)
+	}
+
+	if tn, ok := obj.(*types.TypeName); ok {
+		iface, _ := tn.Type().Underlying().(*types.Interface)
+		return iface
+	}
+	return nil
+}
+
+// findImport searches pkg's imports, transitively, for the package with
+// the given path.
+func findImport(pkg *types.Package, path string, seen map[*types.Package]bool) *types.Package {
+	if seen[pkg] {
+		return nil
+	}
+	seen[pkg] = true
+	for _, imp := range pkg.Imports() {
+		if imp.Path() == path {
+			return imp
+		}
+		if found := findImport(imp, path, seen); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// load type-checks a package outside the file's dependencies, so that
+// "io.Reader" works in a file that never imports io. It caches failures
+// as nil.
+func (t *typeInfo) load(path string) *types.Package {
+	if pkg, ok := t.extern[path]; ok {
+		return pkg
+	}
+	t.extern[path] = nil
+	conf := t.conf
+	// Like WithTypeCheck, check dependencies from source rather than trust
+	// export data written by whichever toolchain is installed
+	conf.Mode = packages.NeedName | packages.NeedTypes | packages.NeedSyntax |
+		packages.NeedImports | packages.NeedDeps
+	pkgs, err := packages.Load(&conf, path)
+	if err == nil && len(pkgs) == 1 && len(pkgs[0].Errors) == 0 {
+		t.extern[path] = pkgs[0].Types
+	}
+	return t.extern[path]
+}
+
+// cutLast slices s around the last sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,5 @@
+﻿// +build linux
+
+package client
+
+func Fetch() {}
@@ -0,0 +1,10 @@
+// Copyright 2024 The Stencil Authors.
+// Use of this source code is governed by the MIT license.
+
+//go:build linux && amd64
+// +build linux,amd64
+
+// Package client talks to the service.
+package client
+
+func Fetch() {}
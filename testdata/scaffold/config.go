@@ -0,0 +1,8 @@
+package scaffold
+
+import "time"
+
+type Config struct {
+	Addr    string        `json:"addr"`
+	Timeout time.Duration `json:"timeout"`
+}
@@ -0,0 +1,13 @@
+package scaffold
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type Server struct{ users map[string]string }
+
+func (s *Server) GetUser(w http.ResponseWriter, r *http.Request) {
+	name := s.users[r.URL.Query().Get("id")]
+	json.NewEncoder(w).Encode(name)
+}
@@ -0,0 +1,9 @@
+package scaffold
+
+func total(items []int) int {
+	sum := 0
+	for _, v := range items {
+		sum += v
+	}
+	return sum
+}
@@ -0,0 +1,18 @@
+//go:build ignore
+
+package client
+
+import "time"
+
+// User is the record UserService fetches.
+type User struct {
+	ID        int64      `json:"id"`
+	Email     string     `json:"email" db:"email_address"`
+	Name      string     `json:"name"`
+	Nickname  *string    `json:"nickname,omitempty"`
+	Admin     bool       `json:"admin"`
+	Avatar    []byte     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Session   string     `json:"-" db:"-"`
+}